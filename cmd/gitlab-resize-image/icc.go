@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// colorProfile is an ICC matrix/TRC RGB display profile, the kind of profile
+// embedded by cameras, phones and most image editors.
+type colorProfile struct {
+	// toXYZ maps linear RGB to the D50 profile connection space
+	toXYZ [3][3]float64
+	// trc maps an encoded 8-bit channel value to linear light
+	trc [3][256]float64
+}
+
+// The sRGB colorants adapted to D50, as found in the reference sRGB ICC profile
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+var (
+	xyzToSRGB   = invertMatrix(srgbToXYZ)
+	srgbEncoder = newSRGBEncoder()
+)
+
+var errUnsupportedProfile = errors.New("unsupported ICC profile")
+
+const srgbEncoderSize = 4096
+
+func parseColorProfile(data []byte) (*colorProfile, error) {
+	if len(data) < 132 {
+		return nil, errors.New("ICC profile too short")
+	}
+
+	if string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, errUnsupportedProfile
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, errors.New("ICC tag table truncated")
+		}
+
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errors.New("ICC tag out of bounds")
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p := &colorProfile{}
+	for i, c := range []string{"r", "g", "b"} {
+		xyz, ok := tags[c+"XYZ"]
+		if !ok {
+			return nil, errUnsupportedProfile
+		}
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("invalid %sXYZ tag", c)
+		}
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row][i] = s15Fixed16(xyz[8+row*4:])
+		}
+
+		trc, ok := tags[c+"TRC"]
+		if !ok {
+			return nil, errUnsupportedProfile
+		}
+		curve, err := parseToneCurve(trc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sTRC tag: %v", c, err)
+		}
+		for v := 0; v < 256; v++ {
+			p.trc[i][v] = curve(float64(v) / 255)
+		}
+	}
+
+	return p, nil
+}
+
+// parseToneCurve understands both the sampled 'curv' and the parametric
+// 'para' tone reproduction curve types.
+func parseToneCurve(data []byte) (func(float64) float64, error) {
+	if len(data) < 12 {
+		return nil, errors.New("too short")
+	}
+
+	switch string(data[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(data[8:]))
+		if len(data) < 12+2*n {
+			return nil, errors.New("truncated curve")
+		}
+
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			frac := pos - float64(i)
+			return table[i]*(1-frac) + table[i+1]*frac
+		}, nil
+	case "para":
+		funcType := int(binary.BigEndian.Uint16(data[8:]))
+		numParams := []int{1, 3, 4, 5, 7}
+		if funcType >= len(numParams) || len(data) < 12+4*numParams[funcType] {
+			return nil, errors.New("invalid parametric curve")
+		}
+
+		// g, a, b, c, d, e, f as named by the ICC specification
+		var p [7]float64
+		for i := 0; i < numParams[funcType]; i++ {
+			p[i] = s15Fixed16(data[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+		return func(x float64) float64 {
+			switch funcType {
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			case 4:
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			default:
+				return math.Pow(x, g)
+			}
+		}, nil
+	}
+
+	return nil, errors.New("unknown curve type")
+}
+
+// isSRGB tells whether converting with this profile would be a no-op, in
+// which case we can skip the conversion altogether.
+func (p *colorProfile) isSRGB() bool {
+	const tolerance = 0.002
+
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			if math.Abs(p.toXYZ[row][col]-srgbToXYZ[row][col]) > tolerance {
+				return false
+			}
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, v := range []int{32, 64, 128, 192, 224} {
+			if math.Abs(p.trc[i][v]-srgbDecode(float64(v)/255)) > tolerance {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// convertToSRGB converts the pixels of img from the color space described by
+// the profile into sRGB in place.
+func (p *colorProfile) convertToSRGB(img *image.NRGBA) {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToSRGB[i][k] * p.toXYZ[k][j]
+			}
+		}
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):img.PixOffset(bounds.Max.X, y)]
+		for x := 0; x+3 < len(row); x += 4 {
+			r, g, b := p.trc[0][row[x]], p.trc[1][row[x+1]], p.trc[2][row[x+2]]
+			row[x] = srgbEncode(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+			row[x+1] = srgbEncode(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+			row[x+2] = srgbEncode(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+		}
+	}
+}
+
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func newSRGBEncoder() []uint8 {
+	table := make([]uint8, srgbEncoderSize+1)
+	for i := range table {
+		v := float64(i) / srgbEncoderSize
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		table[i] = uint8(math.Round(v * 255))
+	}
+	return table
+}
+
+func srgbEncode(linear float64) uint8 {
+	if linear <= 0 {
+		return srgbEncoder[0]
+	}
+	if linear >= 1 {
+		return srgbEncoder[srgbEncoderSize]
+	}
+	return srgbEncoder[int(linear*srgbEncoderSize+0.5)]
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func invertMatrix(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+
+	return [3][3]float64{
+		{
+			(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det,
+			(m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det,
+			(m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det,
+		},
+		{
+			(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det,
+			(m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det,
+			(m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det,
+		},
+		{
+			(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det,
+			(m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det,
+			(m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det,
+		},
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"io/ioutil"
 	"mime"
 	"os"
 	"strconv"
@@ -28,7 +30,14 @@ func _main() error {
 		return fmt.Errorf("GL_RESIZE_IMAGE_CONTENT_TYPE is empty")
 	}
 
-	src, extension, err := image.Decode(os.Stdin)
+	// Workhorse only hands us images below the configured maximum file size, so it is
+	// safe to buffer the input; we need to look at it twice to extract the metadata.
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	src, extension, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("decode: %w", err)
 	}
@@ -40,6 +49,54 @@ func _main() error {
 		return fmt.Errorf("find imaging format: %w", err)
 	}
 
-	image := imaging.Resize(src, requestedWidth, 0, imaging.Lanczos)
+	meta := readMetadata(extension, data)
+
+	// Orientation has to be fixed before scaling, since the requested width refers
+	// to the image as it is displayed, not as it is stored.
+	image := imaging.Resize(applyOrientation(src, meta.orientation), requestedWidth, 0, imaging.Lanczos)
+
+	if meta.iccProfile != nil {
+		// Converting after scaling means we only touch the pixels we actually serve
+		if err := convertColorProfile(image, meta.iccProfile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: warning: skipping color conversion: %v\n", os.Args[0], err)
+		}
+	}
+
+	// The encoders do not write any of the original metadata, so the output is
+	// stripped of EXIF data (including GPS coordinates) and color profiles.
 	return imaging.Encode(os.Stdout, image, format)
 }
+
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case orientationFlipH:
+		return imaging.FlipH(img)
+	case orientationRotate180:
+		return imaging.Rotate180(img)
+	case orientationFlipV:
+		return imaging.FlipV(img)
+	case orientationTranspose:
+		return imaging.Transpose(img)
+	case orientationRotate270:
+		return imaging.Rotate270(img)
+	case orientationTransverse:
+		return imaging.Transverse(img)
+	case orientationRotate90:
+		return imaging.Rotate90(img)
+	}
+
+	return img
+}
+
+func convertColorProfile(img *image.NRGBA, iccProfile []byte) error {
+	profile, err := parseColorProfile(iccProfile)
+	if err != nil {
+		return err
+	}
+
+	if !profile.isSRGB() {
+		profile.convertToSRGB(img)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMetadata(t *testing.T) {
+	tests := []struct {
+		desc        string
+		fixture     string
+		orientation int
+		hasProfile  bool
+	}{
+		{desc: "little endian EXIF", fixture: "image-exif-orientation-6.jpg", orientation: orientationRotate270},
+		{desc: "big endian EXIF", fixture: "image-exif-orientation-8.jpg", orientation: orientationRotate90},
+		{desc: "PNG with ICC profile", fixture: "image-icc-linear.png", orientation: orientationNormal, hasProfile: true},
+		{desc: "PNG without metadata", fixture: "image.png", orientation: orientationNormal},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			data := readFixture(t, tc.fixture)
+			_, format, err := image.Decode(bytes.NewReader(data))
+			require.NoError(t, err)
+
+			meta := readMetadata(format, data)
+
+			require.Equal(t, tc.orientation, meta.orientation)
+			require.Equal(t, tc.hasProfile, meta.iccProfile != nil)
+		})
+	}
+}
+
+func TestReadMetadataJPEGWithChunkedICCProfile(t *testing.T) {
+	profile := readProfile(t)
+	jpg := readFixture(t, "image-exif-orientation-6.jpg")
+
+	// Profiles are split over several APP2 segments, which may be in any order
+	half := len(profile) / 2
+	jpg = insertJPEGSegment(jpg, 0xe2, append([]byte("ICC_PROFILE\x00\x02\x02"), profile[half:]...))
+	jpg = insertJPEGSegment(jpg, 0xe2, append([]byte("ICC_PROFILE\x00\x01\x02"), profile[:half]...))
+
+	meta := readMetadata("jpeg", jpg)
+
+	require.Equal(t, orientationRotate270, meta.orientation)
+	require.Equal(t, profile, meta.iccProfile)
+}
+
+func TestReadMetadataIgnoresGarbage(t *testing.T) {
+	for _, format := range []string{"jpeg", "png", "gif"} {
+		meta := readMetadata(format, []byte("\xff\xd8\xff\xe1\xff\xffExif\x00\x00II*\x00"))
+		require.Equal(t, orientationNormal, meta.orientation)
+		require.Nil(t, meta.iccProfile)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	data := readFixture(t, "image-exif-orientation-6.jpg")
+	src, format, err := image.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 40, 20), src.Bounds())
+
+	img := applyOrientation(src, readMetadata(format, data).orientation)
+
+	// The stored image has red on the left and blue on the right; once rotated
+	// clockwise, red ends up at the top.
+	require.Equal(t, image.Rect(0, 0, 20, 40), img.Bounds())
+	requireColor(t, color.NRGBA{255, 0, 0, 255}, img.At(10, 5))
+	requireColor(t, color.NRGBA{0, 0, 255, 255}, img.At(10, 35))
+}
+
+func TestConvertColorProfile(t *testing.T) {
+	img := imaging.New(4, 4, color.NRGBA{128, 128, 128, 255})
+
+	require.NoError(t, convertColorProfile(img, readProfile(t)))
+
+	// The fixture profile has sRGB primaries but a linear tone curve, so only
+	// the gamma encoding should change.
+	require.Equal(t, color.NRGBA{188, 188, 188, 255}, img.NRGBAAt(1, 1))
+}
+
+func TestConvertColorProfileRejectsUnsupportedProfile(t *testing.T) {
+	profile := readProfile(t)
+	copy(profile[16:], "CMYK")
+	img := imaging.New(4, 4, color.NRGBA{128, 128, 128, 255})
+
+	require.Equal(t, errUnsupportedProfile, convertColorProfile(img, profile))
+	require.Equal(t, color.NRGBA{128, 128, 128, 255}, img.NRGBAAt(1, 1))
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("../../testdata/" + name)
+	require.NoError(t, err)
+	return data
+}
+
+func readProfile(t *testing.T) []byte {
+	meta := readMetadata("png", readFixture(t, "image-icc-linear.png"))
+	require.NotNil(t, meta.iccProfile)
+	return meta.iccProfile
+}
+
+func insertJPEGSegment(jpg []byte, marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	out = append(out, payload...)
+	return append(out, jpg[2:]...)
+}
+
+// JPEG is lossy, so we only check that the dominant channel is right
+func requireColor(t *testing.T, expected color.NRGBA, actual color.Color) {
+	c := color.NRGBAModel.Convert(actual).(color.NRGBA)
+	require.InDelta(t, expected.R, c.R, 16)
+	require.InDelta(t, expected.G, c.G, 16)
+	require.InDelta(t, expected.B, c.B, 16)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+)
+
+// EXIF orientation values as defined by the TIFF 6.0 specification.
+const (
+	orientationNormal     = 1
+	orientationFlipH      = 2
+	orientationRotate180  = 3
+	orientationFlipV      = 4
+	orientationTranspose  = 5
+	orientationRotate270  = 6
+	orientationTransverse = 7
+	orientationRotate90   = 8
+)
+
+const (
+	exifOrientationTag = 0x0112
+	exifTypeShort      = 3
+)
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// imageMetadata holds the bits of embedded image metadata that affect how the
+// image is rendered. Everything else is discarded when the image is re-encoded.
+type imageMetadata struct {
+	orientation int
+	iccProfile  []byte
+}
+
+// readMetadata extracts orientation and color profile information from the
+// raw image data. Malformed or missing metadata is not an error; we simply
+// fall back to rendering the pixels as they are.
+func readMetadata(format string, data []byte) imageMetadata {
+	meta := imageMetadata{orientation: orientationNormal}
+
+	switch format {
+	case "jpeg":
+		readJPEGMetadata(data, &meta)
+	case "png":
+		readPNGMetadata(data, &meta)
+	}
+
+	return meta
+}
+
+func readJPEGMetadata(data []byte, meta *imageMetadata) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return
+	}
+
+	iccChunks := map[int][]byte{}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte
+			pos++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// Standalone markers without a length field
+			pos += 2
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image; all metadata segments precede these
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(segment, jpegExifHeader):
+			if o, ok := exifOrientation(segment[len(jpegExifHeader):]); ok {
+				meta.orientation = o
+			}
+		case marker == 0xe2 && bytes.HasPrefix(segment, jpegICCHeader) && len(segment) > len(jpegICCHeader)+2:
+			// ICC profiles larger than a single segment are split into numbered chunks
+			seq := int(segment[len(jpegICCHeader)])
+			iccChunks[seq] = segment[len(jpegICCHeader)+2:]
+		}
+
+		pos += 2 + length
+	}
+
+	if len(iccChunks) == 0 {
+		return
+	}
+
+	seqs := make([]int, 0, len(iccChunks))
+	for seq := range iccChunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	var profile []byte
+	for _, seq := range seqs {
+		profile = append(profile, iccChunks[seq]...)
+	}
+	meta.iccProfile = profile
+}
+
+func readPNGMetadata(data []byte, meta *imageMetadata) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return
+	}
+
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) {
+			return
+		}
+		chunk := data[pos+8 : pos+8+length]
+
+		switch chunkType {
+		case "eXIf":
+			if o, ok := exifOrientation(chunk); ok {
+				meta.orientation = o
+			}
+		case "iCCP":
+			if profile, ok := pngICCProfile(chunk); ok {
+				meta.iccProfile = profile
+			}
+		case "IEND":
+			return
+		}
+
+		pos += 12 + length
+	}
+}
+
+// pngICCProfile decompresses the profile stored in an iCCP chunk, which is
+// laid out as a null-terminated name, a compression method and zlib data.
+func pngICCProfile(chunk []byte) ([]byte, bool) {
+	sep := bytes.IndexByte(chunk, 0)
+	if sep < 0 || sep+2 > len(chunk) || chunk[sep+1] != 0 {
+		return nil, false
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(chunk[sep+2:]))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+
+	profile, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, false
+	}
+
+	return profile, true
+}
+
+// exifOrientation looks up the Orientation tag in IFD0 of the given TIFF
+// structured EXIF data.
+func exifOrientation(tiff []byte) (int, bool) {
+	if len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		if order.Uint16(tiff[entry+2:]) != exifTypeShort {
+			return 0, false
+		}
+
+		o := int(order.Uint16(tiff[entry+8:]))
+		if o < orientationNormal || o > orientationRotate90 {
+			return 0, false
+		}
+		return o, true
+	}
+
+	return 0, false
+}
@@ -79,6 +79,7 @@ type ObjectStorageParams struct {
 	Provider      string
 	S3Config      config.S3Config
 	GoCloudConfig config.GoCloudConfig
+	GoogleConfig  config.GoogleConfig
 }
 
 type RemoteObject struct {
@@ -144,12 +145,26 @@ type Response struct {
 	Repository gitalypb.Repository
 	// For git-http, does the requestor have the right to view all refs?
 	ShowAllRefs bool
+	// For git-http, may the requestor fetch with the read-only 'dumb' protocol?
+	DumbHTTP bool
+	// For git-http push, blobs larger than this many bytes are rejected. 0
+	// means no limit.
+	MaxPushBlobSize int64
+	// For git-http, overrides the per-user bandwidth limit in bytes per
+	// second if positive
+	BandwidthLimit int64
+	// For git-http, how many seconds we may reuse this response for the
+	// other requests of the same fetch or push. 0 means never.
+	PreAuthorizeCacheTTL int64
 	// Detects whether an artifact is used for code intelligence
 	ProcessLsif bool
 	// Detects whether LSIF artifact will be parsed with references
 	ProcessLsifReferences bool
 	// The maximum accepted size in bytes of the upload
 	MaximumSize int64
+	// The hashes of the upload that GitLab Rails needs, of md5, sha1, sha256
+	// and sha512. Empty means all of them.
+	UploadHashes []string
 }
 
 // singleJoiningSlash is taken from reverseproxy.go:NewSingleHostReverseProxy
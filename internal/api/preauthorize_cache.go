@@ -0,0 +1,199 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const (
+	defaultPreAuthorizeCacheEntries = 10000
+	defaultPreAuthorizeCacheMaxTTL  = 5 * time.Second
+)
+
+var preAuthorizeCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_preauthorize_cache_requests_total",
+		Help: "How many pre-authorizations of Git requests were served from the cache, by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(preAuthorizeCacheRequests)
+}
+
+// PreAuthorizeCache keeps the pre-authorization responses that GitLab Rails
+// marks as cacheable with PreAuthorizeCacheTTL, so that the requests of one
+// 'git fetch' don't all go to Rails. A nil PreAuthorizeCache caches nothing.
+type PreAuthorizeCache struct {
+	maxEntries int
+	maxTTL     time.Duration
+
+	sync.Mutex
+	entries map[string]*preAuthorizeCacheEntry
+}
+
+type preAuthorizeCacheEntry struct {
+	// We keep the encoded response so that each request gets its own copy
+	response []byte
+	expires  time.Time
+}
+
+// NewPreAuthorizeCache returns nil unless the cache is enabled
+func NewPreAuthorizeCache(cfg config.PreAuthorizeCacheConfig) *PreAuthorizeCache {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultPreAuthorizeCacheEntries
+	}
+
+	maxTTL := defaultPreAuthorizeCacheMaxTTL
+	if cfg.MaxTTL != nil {
+		maxTTL = cfg.MaxTTL.Duration
+	}
+
+	return &PreAuthorizeCache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		entries:    make(map[string]*preAuthorizeCacheEntry),
+	}
+}
+
+// CachedPreAuthorizeHandler is PreAuthorizeHandler for requests that may
+// reuse the response of an earlier request. scope returns what the response
+// applies to, e.g. the repository and whether it is a fetch or a push; an
+// empty scope is never cached. The cache key also holds the Authorization
+// header and the client IP.
+func (api *API) CachedPreAuthorizeHandler(cache *PreAuthorizeCache, scope func(*http.Request) string, next HandleFunc, suffix string) http.Handler {
+	if cache == nil {
+		return api.PreAuthorizeHandler(next, suffix)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := preAuthorizeCacheKey(r, scope(r))
+		if key == "" {
+			api.PreAuthorizeHandler(next, suffix).ServeHTTP(w, r)
+			return
+		}
+
+		if a := cache.get(key); a != nil {
+			preAuthorizeCacheRequests.WithLabelValues("hit").Inc()
+			log.WithContextFields(r.Context(), log.Fields{
+				"gl_id":         a.GL_ID,
+				"gl_repository": a.GL_REPOSITORY,
+			}).Info("pre-authorization cache hit")
+
+			next(w, r, a)
+			return
+		}
+
+		preAuthorizeCacheRequests.WithLabelValues("miss").Inc()
+		api.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *Response) {
+			// Negotiate authentication answers each request differently
+			if w.Header().Get("WWW-Authenticate") == "" {
+				if err := cache.put(key, a); err != nil {
+					helper.LogError(r, err)
+				}
+			}
+
+			next(w, r, a)
+		}, suffix).ServeHTTP(w, r)
+	})
+}
+
+func preAuthorizeCacheKey(r *http.Request, scope string) string {
+	if scope == "" {
+		return ""
+	}
+
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	authorization := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+
+	return scope + "\x00" + hex.EncodeToString(authorization[:]) + "\x00" + clientIP
+}
+
+func (c *PreAuthorizeCache) get(key string) *Response {
+	c.Lock()
+	entry := c.entries[key]
+	if entry != nil && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		entry = nil
+	}
+	c.Unlock()
+
+	if entry == nil {
+		return nil
+	}
+
+	a := &Response{}
+	if err := json.Unmarshal(entry.response, a); err != nil {
+		return nil
+	}
+
+	return a
+}
+
+func (c *PreAuthorizeCache) put(key string, a *Response) error {
+	if a.PreAuthorizeCacheTTL <= 0 {
+		return nil
+	}
+
+	// A misbehaving Rails must not keep revoked access alive for long
+	ttl := time.Duration(a.PreAuthorizeCacheTTL) * time.Second
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	response, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.entries) >= c.maxEntries {
+		c.removeExpired(now)
+	}
+
+	// Rather than evicting live entries we don't cache until some expire
+	if len(c.entries) >= c.maxEntries {
+		return nil
+	}
+
+	c.entries[key] = &preAuthorizeCacheEntry{
+		response: response,
+		expires:  now.Add(ttl),
+	}
+
+	return nil
+}
+
+func (c *PreAuthorizeCache) removeExpired(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
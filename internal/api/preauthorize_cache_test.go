@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func startPreAuthorizeServer(t *testing.T, response *Response, calls *int) (*API, func()) {
+	testhelper.ConfigureSecret()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", ResponseContentType)
+		require.NoError(t, json.NewEncoder(w).Encode(response))
+	}))
+
+	return NewAPI(helper.URLMustParse(ts.URL), "123", http.DefaultTransport), ts.Close
+}
+
+func repositoryScope(r *http.Request) string {
+	return strings.SplitAfter(r.URL.Path, ".git")[0]
+}
+
+func doPreAuthorize(t *testing.T, h http.Handler, path, authorization, remoteAddr string) {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", authorization)
+	r.RemoteAddr = remoteAddr
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+}
+
+func TestCachedPreAuthorizeHandler(t *testing.T) {
+	calls := 0
+	a, cleanUp := startPreAuthorizeServer(t, &Response{GL_ID: "user-1", PreAuthorizeCacheTTL: 60}, &calls)
+	defer cleanUp()
+
+	var responses []*Response
+	h := a.CachedPreAuthorizeHandler(NewPreAuthorizeCache(config.PreAuthorizeCacheConfig{Enabled: true}), repositoryScope, func(w http.ResponseWriter, r *http.Request, ar *Response) {
+		responses = append(responses, ar)
+	}, "")
+
+	doPreAuthorize(t, h, "/foo.git/info/refs", "Basic Zm9vOmJhcg==", "1.2.3.4:1000")
+	doPreAuthorize(t, h, "/foo.git/git-upload-pack", "Basic Zm9vOmJhcg==", "1.2.3.4:2000")
+	require.Equal(t, 1, calls, "the second request is a cache hit")
+
+	doPreAuthorize(t, h, "/foo.git/info/refs", "Basic b3RoZXI6dXNlcg==", "1.2.3.4:1000")
+	doPreAuthorize(t, h, "/foo.git/info/refs", "Basic Zm9vOmJhcg==", "5.6.7.8:1000")
+	doPreAuthorize(t, h, "/bar.git/info/refs", "Basic Zm9vOmJhcg==", "1.2.3.4:1000")
+	require.Equal(t, 4, calls, "other credentials, clients and repositories miss")
+
+	require.Len(t, responses, 5)
+	for _, ar := range responses {
+		require.Equal(t, "user-1", ar.GL_ID)
+	}
+	require.False(t, responses[0] == responses[1], "each request gets its own response")
+}
+
+func TestCachedPreAuthorizeHandlerDoesNotCache(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		cache    *PreAuthorizeCache
+		response *Response
+		scope    func(*http.Request) string
+	}{
+		{
+			desc:     "disabled",
+			cache:    NewPreAuthorizeCache(config.PreAuthorizeCacheConfig{}),
+			response: &Response{PreAuthorizeCacheTTL: 60},
+			scope:    repositoryScope,
+		},
+		{
+			desc:     "no TTL",
+			cache:    NewPreAuthorizeCache(config.PreAuthorizeCacheConfig{Enabled: true}),
+			response: &Response{},
+			scope:    repositoryScope,
+		},
+		{
+			desc:     "no scope",
+			cache:    NewPreAuthorizeCache(config.PreAuthorizeCacheConfig{Enabled: true}),
+			response: &Response{PreAuthorizeCacheTTL: 60},
+			scope:    func(*http.Request) string { return "" },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			calls := 0
+			a, cleanUp := startPreAuthorizeServer(t, tc.response, &calls)
+			defer cleanUp()
+
+			h := a.CachedPreAuthorizeHandler(tc.cache, tc.scope, func(http.ResponseWriter, *http.Request, *Response) {}, "")
+			doPreAuthorize(t, h, "/foo.git/info/refs", "Basic Zm9vOmJhcg==", "1.2.3.4:1000")
+			doPreAuthorize(t, h, "/foo.git/info/refs", "Basic Zm9vOmJhcg==", "1.2.3.4:1000")
+			require.Equal(t, 2, calls)
+		})
+	}
+}
+
+func TestPreAuthorizeCacheExpiresAndLimitsEntries(t *testing.T) {
+	c := NewPreAuthorizeCache(config.PreAuthorizeCacheConfig{Enabled: true, MaxEntries: 1})
+
+	require.NoError(t, c.put("first", &Response{GL_ID: "user-1", PreAuthorizeCacheTTL: 60}))
+	require.NoError(t, c.put("second", &Response{GL_ID: "user-2", PreAuthorizeCacheTTL: 60}))
+	require.NotNil(t, c.get("first"))
+	require.Nil(t, c.get("second"), "live entries are not evicted")
+
+	c.entries["first"].expires = time.Now().Add(-time.Second)
+	require.Nil(t, c.get("first"))
+
+	require.NoError(t, c.put("second", &Response{GL_ID: "user-2", PreAuthorizeCacheTTL: 60}))
+	require.Equal(t, "user-2", c.get("second").GL_ID)
+}
+
+func TestPreAuthorizeCacheClampsTTL(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		maxTTL *config.TomlDuration
+		ttl    time.Duration
+	}{
+		{desc: "default maximum", ttl: defaultPreAuthorizeCacheMaxTTL},
+		{desc: "configured maximum", maxTTL: &config.TomlDuration{Duration: 30 * time.Second}, ttl: 30 * time.Second},
+		{desc: "below the maximum", maxTTL: &config.TomlDuration{Duration: 2 * time.Hour}, ttl: time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := NewPreAuthorizeCache(config.PreAuthorizeCacheConfig{Enabled: true, MaxTTL: tc.maxTTL})
+
+			start := time.Now()
+			require.NoError(t, c.put("key", &Response{PreAuthorizeCacheTTL: 3600}))
+			expires := c.entries["key"].expires
+
+			require.False(t, expires.Before(start.Add(tc.ttl)))
+			require.False(t, expires.After(time.Now().Add(tc.ttl)))
+		})
+	}
+}
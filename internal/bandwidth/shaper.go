@@ -0,0 +1,250 @@
+/*
+Package bandwidth limits how fast we send Git and download responses, for
+the whole node and for each user or client IP, with token buckets.
+*/
+package bandwidth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// We write at most this much at once so that slow writes don't hog the
+// node bucket
+const chunkSize = 32 * 1024
+
+var throttledSeconds = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_bandwidth_throttled_seconds_total",
+		Help: "How long responses waited for the bandwidth limits, by the limit that held them back",
+	},
+	[]string{"limit"},
+)
+
+func init() {
+	prometheus.MustRegister(throttledSeconds)
+}
+
+// Shaper holds the token buckets. A nil Shaper doesn't limit anything.
+type Shaper struct {
+	global      *bucket
+	perIdentity int64
+	burst       int64
+
+	sync.Mutex
+	identities map[string]*identityBucket
+}
+
+type identityBucket struct {
+	*bucket
+	// users counts the responses that use the bucket
+	users int
+}
+
+func NewShaper(cfg config.BandwidthConfig) *Shaper {
+	s := &Shaper{
+		perIdentity: cfg.PerIdentityRate,
+		burst:       cfg.Burst,
+		identities:  make(map[string]*identityBucket),
+	}
+
+	if cfg.GlobalRate > 0 {
+		s.global = newBucket(cfg.GlobalRate, s.burstFor(cfg.GlobalRate))
+	}
+
+	return s
+}
+
+// burstFor defaults to one second of traffic
+func (s *Shaper) burstFor(rate int64) int64 {
+	if s.burst > 0 {
+		return s.burst
+	}
+	return rate
+}
+
+// Wrap returns a ResponseWriter that waits for the node bucket and for
+// the bucket of glID, or of the client IP if glID is empty. A positive
+// rate overrides the configured per-identity rate. done must be called
+// once the response is complete.
+func (s *Shaper) Wrap(w http.ResponseWriter, r *http.Request, glID string, rate int64) (shaped http.ResponseWriter, done func()) {
+	noop := func() {}
+	if s == nil {
+		return w, noop
+	}
+
+	if rate <= 0 {
+		rate = s.perIdentity
+	}
+
+	if s.global == nil && rate <= 0 {
+		// Keep io.ReaderFrom and friends of w
+		return w, noop
+	}
+
+	sw := &shapedWriter{ResponseWriter: w, ctx: r.Context(), global: s.global}
+	if rate <= 0 {
+		return sw, noop
+	}
+
+	identity := glID
+	if identity == "" {
+		identity = clientIP(r)
+	}
+
+	sw.identity = s.join(identity, rate)
+	return sw, func() { s.leave(identity) }
+}
+
+func (s *Shaper) join(identity string, rate int64) *bucket {
+	s.Lock()
+	defer s.Unlock()
+
+	b := s.identities[identity]
+	if b == nil {
+		b = &identityBucket{bucket: newBucket(rate, s.burstFor(rate))}
+		s.identities[identity] = b
+	} else {
+		// The last response of an identity decides its rate
+		b.setRate(rate, s.burstFor(rate))
+	}
+
+	b.users++
+	return b.bucket
+}
+
+func (s *Shaper) leave(identity string) {
+	s.Lock()
+	defer s.Unlock()
+
+	b := s.identities[identity]
+	b.users--
+	if b.users == 0 {
+		delete(s.identities, identity)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+type shapedWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	global   *bucket
+	identity *bucket
+}
+
+func (w *shapedWriter) Write(data []byte) (int, error) {
+	written := 0
+
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		if err := w.wait(len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		data = data[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (w *shapedWriter) wait(n int) error {
+	limit := "global"
+	delay := w.global.reserve(n)
+	if identityDelay := w.identity.reserve(n); identityDelay > delay {
+		limit = "identity"
+		delay = identityDelay
+	}
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		throttledSeconds.WithLabelValues(limit).Add(delay.Seconds())
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+}
+
+func (w *shapedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// bucket is a token bucket that may go into debt: reserve always takes
+// the tokens, and says how long to wait until they would have been there.
+type bucket struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst int64) *bucket {
+	return &bucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *bucket) setRate(rate, burst int64) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	b.rate = float64(rate)
+	b.burst = float64(burst)
+}
+
+func (b *bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *bucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
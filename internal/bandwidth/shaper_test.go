@@ -0,0 +1,104 @@
+package bandwidth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestBucketReserve(t *testing.T) {
+	b := newBucket(1000, 1000)
+
+	require.Equal(t, time.Duration(0), b.reserve(1000), "the burst is free")
+
+	delay := b.reserve(500)
+	require.True(t, delay > 400*time.Millisecond && delay <= 500*time.Millisecond, "delay %v", delay)
+
+	var nilBucket *bucket
+	require.Equal(t, time.Duration(0), nilBucket.reserve(1000))
+}
+
+func TestShaperWithoutLimits(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	var nilShaper *Shaper
+	shaped, done := nilShaper.Wrap(w, r, "user-1", 1000)
+	require.Equal(t, w, shaped)
+	done()
+
+	shaped, done = NewShaper(config.BandwidthConfig{}).Wrap(w, r, "user-1", 0)
+	require.Equal(t, w, shaped)
+	done()
+}
+
+func TestShaperLimitsPerIdentity(t *testing.T) {
+	testCases := []struct {
+		desc string
+		cfg  config.BandwidthConfig
+		rate int64
+	}{
+		{desc: "configured rate", cfg: config.BandwidthConfig{PerIdentityRate: 100000, Burst: 10000}},
+		{desc: "override", cfg: config.BandwidthConfig{PerIdentityRate: 1000, Burst: 10000}, rate: 100000},
+		{desc: "global rate", cfg: config.BandwidthConfig{GlobalRate: 100000, Burst: 10000}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			shaped, done := NewShaper(tc.cfg).Wrap(w, httptest.NewRequest("GET", "/", nil), "user-1", tc.rate)
+			defer done()
+
+			start := time.Now()
+			n, err := shaped.Write(make([]byte, 60000))
+			elapsed := time.Since(start)
+
+			require.NoError(t, err)
+			require.Equal(t, 60000, n)
+			require.Equal(t, 60000, w.Body.Len())
+			// 10000 bytes of burst, and 50000 bytes at 100000 bytes per second
+			require.True(t, elapsed > 400*time.Millisecond && elapsed < 2*time.Second, "elapsed %v", elapsed)
+		})
+	}
+}
+
+func TestShaperSharesBucketsPerIdentity(t *testing.T) {
+	s := NewShaper(config.BandwidthConfig{PerIdentityRate: 1000})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+
+	first, doneFirst := s.Wrap(httptest.NewRecorder(), r, "user-1", 0)
+	second, doneSecond := s.Wrap(httptest.NewRecorder(), r, "user-1", 0)
+	byIP, doneByIP := s.Wrap(httptest.NewRecorder(), r, "", 0)
+
+	require.Equal(t, first.(*shapedWriter).identity, second.(*shapedWriter).identity)
+	require.NotEqual(t, first.(*shapedWriter).identity, byIP.(*shapedWriter).identity)
+	require.Contains(t, s.identities, "1.2.3.4")
+
+	doneFirst()
+	doneSecond()
+	doneByIP()
+	require.Empty(t, s.identities, "unused buckets are removed")
+}
+
+func TestShapedWriteStopsWhenRequestIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+	shaped, done := NewShaper(config.BandwidthConfig{PerIdentityRate: 1000}).Wrap(httptest.NewRecorder(), r, "user-1", 0)
+	defer done()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := shaped.Write(make([]byte, 100000))
+	require.Equal(t, context.Canceled, err)
+}
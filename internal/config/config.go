@@ -1,8 +1,12 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"net/url"
+	"path"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
@@ -28,7 +32,7 @@ type TomlDuration struct {
 	time.Duration
 }
 
-func (d *TomlDuration) UnmarshalTest(text []byte) error {
+func (d *TomlDuration) UnmarshalText(text []byte) error {
 	temp, err := time.ParseDuration(string(text))
 	d.Duration = temp
 	return err
@@ -37,8 +41,9 @@ func (d *TomlDuration) UnmarshalTest(text []byte) error {
 type ObjectStorageCredentials struct {
 	Provider string
 
-	S3Credentials    S3Credentials    `toml:"s3"`
-	AzureCredentials AzureCredentials `toml:"azurerm"`
+	S3Credentials     S3Credentials     `toml:"s3"`
+	AzureCredentials  AzureCredentials  `toml:"azurerm"`
+	GoogleCredentials GoogleCredentials `toml:"google"`
 }
 
 type ObjectStorageConfig struct {
@@ -69,6 +74,17 @@ type AzureCredentials struct {
 	AccountKey  string `toml:"azure_storage_access_key"`
 }
 
+type GoogleCredentials struct {
+	JSONKeyLocation    string `toml:"google_json_key_location"`
+	JSONKeyString      string `toml:"google_json_key_string"`
+	ApplicationDefault bool   `toml:"google_application_default"` // Use Application Default Credentials, e.g. GKE Workload Identity
+}
+
+type GoogleConfig struct {
+	Bucket   string `toml:"-"`
+	Endpoint string `toml:"-"`
+}
+
 type RedisConfig struct {
 	URL             TomlURL
 	Sentinel        []TomlURL
@@ -87,6 +103,220 @@ type ImageResizerConfig struct {
 	MaxFilesize    uint64 `toml:"max_filesize"`
 }
 
+type PackCacheConfig struct {
+	Enabled bool          `toml:"enabled"`
+	Dir     string        `toml:"dir"`
+	MaxSize int64         `toml:"max_size"`
+	TTL     *TomlDuration `toml:"ttl"`
+}
+
+type FileCacheConfig struct {
+	Enabled bool          `toml:"enabled"`
+	Dir     string        `toml:"dir"`
+	MaxSize int64         `toml:"max_size"`
+	MaxAge  *TomlDuration `toml:"max_age"`
+}
+
+// UploadPackRule selects git-upload-pack requests by repository and by what
+// they ask for, and decides what to do with them.
+type UploadPackRule struct {
+	// Name labels the queue metrics of rules with the "queue" action
+	Name string `toml:"name"`
+	// Repositories are glob patterns matched against both the gl_repository
+	// (e.g. "project-42") and the relative path of the repository
+	Repositories []string `toml:"repositories"`
+	// Command is "fetch" or "ls-refs"; empty matches any command
+	Command string `toml:"command"`
+	// FullClone only matches fetches without haves, shallows or deepen
+	FullClone bool `toml:"full_clone"`
+	// Unfiltered only matches requests without an object filter
+	Unfiltered bool `toml:"unfiltered"`
+	// Action is "reject" or "queue"
+	Action       string        `toml:"action"`
+	Message      string        `toml:"message"`
+	Limit        uint          `toml:"limit"`
+	QueueLimit   uint          `toml:"queue_limit"`
+	QueueTimeout *TomlDuration `toml:"queue_timeout"`
+}
+
+func (r *UploadPackRule) Validate() error {
+	for _, pattern := range r.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+	}
+
+	switch r.Command {
+	case "", "fetch", "ls-refs":
+	default:
+		return fmt.Errorf("unknown command %q", r.Command)
+	}
+
+	switch r.Action {
+	case "reject":
+	case "queue":
+		if r.Name == "" {
+			return errors.New("queue rules need a name")
+		}
+		if r.Limit == 0 {
+			return errors.New("queue rules need a positive limit")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	return nil
+}
+
+// CloneLimitsConfig limits the concurrent git-upload-pack requests of each
+// user and of each repository. A zero limit means no limit.
+type CloneLimitsConfig struct {
+	PerUser       uint `toml:"per_user"`
+	PerRepository uint `toml:"per_repository"`
+	// QueueLimit is how many requests over the limit may wait for a slot,
+	// per user or repository
+	QueueLimit   uint          `toml:"queue_limit"`
+	QueueTimeout *TomlDuration `toml:"queue_timeout"`
+}
+
+// BandwidthConfig limits how fast we send Git responses, archives,
+// snapshots and X-Sendfile downloads, in bytes per second. A zero rate means
+// no limit.
+type BandwidthConfig struct {
+	// GlobalRate is shared by all responses of this node
+	GlobalRate int64 `toml:"global_rate"`
+	// PerIdentityRate is shared by the responses of each user, or of each
+	// client IP if we don't know the user
+	PerIdentityRate int64 `toml:"per_identity_rate"`
+	// Burst defaults to one second of traffic
+	Burst int64 `toml:"burst"`
+}
+
+// PreAuthorizeCacheConfig enables reusing the pre-authorization responses
+// of Git requests that GitLab Rails marks as cacheable
+type PreAuthorizeCacheConfig struct {
+	Enabled bool `toml:"enabled"`
+	// MaxEntries defaults to 10000
+	MaxEntries int `toml:"max_entries"`
+	// MaxTTL caps the PreAuthorizeCacheTTL that GitLab Rails asks for.
+	// Default: 5s
+	MaxTTL *TomlDuration `toml:"max_ttl"`
+}
+
+// TusConfig enables tus resumable uploads of package files
+type TusConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Store is where we keep partial uploads: "local" (the default) or "s3"
+	Store string `toml:"store"`
+	// Dir holds the partial uploads of the local store
+	Dir string `toml:"dir"`
+	// MaxSize is the largest upload we accept, in bytes. 0 means no limit.
+	MaxSize int64 `toml:"max_size"`
+	// Expiration is how long clients have to complete an upload. Default: 24h
+	Expiration *TomlDuration `toml:"expiration"`
+	// S3 configures the s3 store. It uses the credentials of
+	// [object_storage.s3].
+	S3 TusS3Config `toml:"s3"`
+}
+
+// TusS3Config holds partial tus uploads as S3 multipart uploads
+type TusS3Config struct {
+	Bucket    string `toml:"bucket"`
+	Region    string `toml:"region"`
+	Endpoint  string `toml:"endpoint"`
+	PathStyle bool   `toml:"path_style"`
+	// PartSize defaults to 10MB. S3 needs at least 5MB.
+	PartSize int64 `toml:"part_size"`
+}
+
+// MultipartUploadConfig configures how we upload S3 multipart uploads to
+// presigned URLs
+type MultipartUploadConfig struct {
+	// Concurrency is how many parts of an upload we upload at the same
+	// time. Default: 1
+	Concurrency int `toml:"concurrency"`
+	// Buffer is where we keep parts while we upload them: "disk" (the
+	// default) or "memory"
+	Buffer string `toml:"buffer"`
+}
+
+func (c *MultipartUploadConfig) Validate() error {
+	if c.Concurrency < 0 {
+		return errors.New("concurrency must not be negative")
+	}
+
+	switch c.Buffer {
+	case "", "disk", "memory":
+	default:
+		return fmt.Errorf("unknown buffer %q", c.Buffer)
+	}
+
+	return nil
+}
+
+func (c *GoogleCredentials) Validate() error {
+	if c.JSONKeyLocation != "" && c.JSONKeyString != "" {
+		return errors.New("google_json_key_location and google_json_key_string are mutually exclusive")
+	}
+
+	return nil
+}
+
+func (c *TusConfig) Validate() error {
+	switch c.Store {
+	case "", "local":
+		if c.Dir == "" {
+			return errors.New("the local store needs a dir")
+		}
+	case "s3":
+		if c.S3.Bucket == "" {
+			return errors.New("the s3 store needs a bucket")
+		}
+		if c.S3.PartSize != 0 && c.S3.PartSize < 5*1024*1024 {
+			return errors.New("the s3 store needs a part_size of at least 5MB")
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store)
+	}
+
+	return nil
+}
+
+// GitalyConfig configures the connections to Gitaly
+type GitalyConfig struct {
+	// CAFile holds PEM encoded certificates that we trust for tls://
+	// addresses, in addition to the system certificates
+	CAFile string `toml:"ca_file"`
+	// HealthCheckInterval is how often we check the health of the cached
+	// connections
+	HealthCheckInterval *TomlDuration `toml:"health_check_interval"`
+	// ConnectionTTL is how long we keep connections that no request uses
+	ConnectionTTL *TomlDuration `toml:"connection_ttl"`
+	// HedgeDelay is how long we wait for a replica to answer GetBlob and
+	// GetArchive before we ask the next one too. Hedging is off if unset.
+	HedgeDelay *TomlDuration `toml:"hedge_delay"`
+}
+
+// PushSecretPattern is a regular expression that must not match any line
+// of the blobs in a 'git push'.
+type PushSecretPattern struct {
+	// Name is shown to the user when a blob matches
+	Name    string `toml:"name"`
+	Pattern string `toml:"pattern"`
+}
+
+func (p *PushSecretPattern) Validate() error {
+	if p.Name == "" {
+		return errors.New("secret patterns need a name")
+	}
+
+	if _, err := regexp.Compile(p.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", p.Pattern, err)
+	}
+
+	return nil
+}
+
 type Config struct {
 	Redis                    *RedisConfig             `toml:"redis"`
 	Backend                  *url.URL                 `toml:"-"`
@@ -105,6 +335,18 @@ type Config struct {
 	ObjectStorageCredentials ObjectStorageCredentials `toml:"object_storage"`
 	PropagateCorrelationID   bool                     `toml:"-"`
 	ImageResizerConfig       ImageResizerConfig       `toml:"image_resizer"`
+	PackCacheConfig          PackCacheConfig          `toml:"pack_cache"`
+	UploadPackRules          []UploadPackRule         `toml:"upload_pack_rule"`
+	ArchiveCacheConfig       FileCacheConfig          `toml:"archive_cache"`
+	BundleCacheConfig        FileCacheConfig          `toml:"bundle_cache"`
+	DumbHTTPCacheConfig      FileCacheConfig          `toml:"dumb_http_cache"`
+	PushSecretPatterns       []PushSecretPattern      `toml:"push_secret_pattern"`
+	GitalyConfig             GitalyConfig             `toml:"gitaly"`
+	CloneLimitsConfig        CloneLimitsConfig        `toml:"clone_limits"`
+	BandwidthConfig          BandwidthConfig          `toml:"bandwidth"`
+	PreAuthorizeCacheConfig  PreAuthorizeCacheConfig  `toml:"preauthorize_cache"`
+	TusConfig                TusConfig                `toml:"tus"`
+	MultipartUploadConfig    MultipartUploadConfig    `toml:"multipart_upload"`
 }
 
 var DefaultImageResizerConfig = ImageResizerConfig{
@@ -119,6 +361,42 @@ func LoadConfig(data string) (*Config, error) {
 		return nil, err
 	}
 
+	queueNames := make(map[string]bool)
+	for i := range cfg.UploadPackRules {
+		rule := &cfg.UploadPackRules[i]
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("upload_pack_rule %d: %v", i, err)
+		}
+
+		// Queue metrics are registered by name
+		if rule.Action == "queue" {
+			if queueNames[rule.Name] {
+				return nil, fmt.Errorf("upload_pack_rule %d: duplicate queue name %q", i, rule.Name)
+			}
+			queueNames[rule.Name] = true
+		}
+	}
+
+	for i := range cfg.PushSecretPatterns {
+		if err := cfg.PushSecretPatterns[i].Validate(); err != nil {
+			return nil, fmt.Errorf("push_secret_pattern %d: %v", i, err)
+		}
+	}
+
+	if cfg.TusConfig.Enabled {
+		if err := cfg.TusConfig.Validate(); err != nil {
+			return nil, fmt.Errorf("tus: %v", err)
+		}
+	}
+
+	if err := cfg.MultipartUploadConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("multipart_upload: %v", err)
+	}
+
+	if err := cfg.ObjectStorageCredentials.GoogleCredentials.Validate(); err != nil {
+		return nil, fmt.Errorf("object_storage.google: %v", err)
+	}
+
 	return cfg, nil
 }
 
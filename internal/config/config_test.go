@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -28,6 +29,22 @@ func TestLoadEmptyConfig(t *testing.T) {
 	require.NoError(t, cfg.RegisterGoCloudURLOpeners())
 }
 
+func TestLoadRedisDurations(t *testing.T) {
+	config := `
+[redis]
+ReadTimeout = "5s"
+WriteTimeout = "1m"
+KeepAlivePeriod = "300ms"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	require.Equal(t, &TomlDuration{Duration: 5 * time.Second}, cfg.Redis.ReadTimeout)
+	require.Equal(t, &TomlDuration{Duration: time.Minute}, cfg.Redis.WriteTimeout)
+	require.Equal(t, &TomlDuration{Duration: 300 * time.Millisecond}, cfg.Redis.KeepAlivePeriod)
+}
+
 func TestLoadObjectStorageConfig(t *testing.T) {
 	config := `
 [object_storage]
@@ -54,6 +71,40 @@ aws_secret_access_key = "gdk-minio"
 	require.Equal(t, expected, cfg.ObjectStorageCredentials)
 }
 
+func TestLoadGoogleObjectStorageConfig(t *testing.T) {
+	config := `
+[object_storage]
+provider = "Google"
+
+[object_storage.google]
+google_json_key_location = "/etc/gitlab/gcs.json"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := ObjectStorageCredentials{
+		Provider: "Google",
+		GoogleCredentials: GoogleCredentials{
+			JSONKeyLocation: "/etc/gitlab/gcs.json",
+		},
+	}
+
+	require.Equal(t, expected, cfg.ObjectStorageCredentials)
+}
+
+func TestLoadInvalidGoogleObjectStorageConfig(t *testing.T) {
+	config := `
+[object_storage.google]
+google_json_key_location = "/etc/gitlab/gcs.json"
+google_json_key_string = "{}"
+`
+
+	_, err := LoadConfig(config)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "object_storage.google")
+}
+
 func TestRegisterGoCloudURLOpeners(t *testing.T) {
 	cfg, err := LoadConfig(azureConfig)
 	require.NoError(t, err)
@@ -97,3 +148,276 @@ max_filesize = 350000
 
 	require.Equal(t, expected, cfg.ImageResizerConfig)
 }
+
+func TestLoadPackCacheConfig(t *testing.T) {
+	config := `
+[pack_cache]
+enabled = true
+dir = "/tmp/cache"
+max_size = 1024
+ttl = "10m"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := PackCacheConfig{
+		Enabled: true,
+		Dir:     "/tmp/cache",
+		MaxSize: 1024,
+		TTL:     &TomlDuration{Duration: 10 * time.Minute},
+	}
+
+	require.Equal(t, expected, cfg.PackCacheConfig)
+}
+
+func TestLoadArchiveCacheConfig(t *testing.T) {
+	config := `
+[archive_cache]
+enabled = true
+dir = "/home/git/gitlab/shared/cache/archive"
+max_size = 1024
+max_age = "1h"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := FileCacheConfig{
+		Enabled: true,
+		Dir:     "/home/git/gitlab/shared/cache/archive",
+		MaxSize: 1024,
+		MaxAge:  &TomlDuration{Duration: time.Hour},
+	}
+
+	require.Equal(t, expected, cfg.ArchiveCacheConfig)
+}
+
+func TestLoadUploadPackRules(t *testing.T) {
+	config := `
+[[upload_pack_rule]]
+repositories = ["project-42"]
+full_clone = true
+unfiltered = true
+action = "reject"
+message = "please use a partial clone"
+
+[[upload_pack_rule]]
+name = "full_clones"
+full_clone = true
+action = "queue"
+limit = 2
+queue_limit = 10
+queue_timeout = "30s"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := []UploadPackRule{
+		{
+			Repositories: []string{"project-42"},
+			FullClone:    true,
+			Unfiltered:   true,
+			Action:       "reject",
+			Message:      "please use a partial clone",
+		},
+		{
+			Name:         "full_clones",
+			FullClone:    true,
+			Action:       "queue",
+			Limit:        2,
+			QueueLimit:   10,
+			QueueTimeout: &TomlDuration{Duration: 30 * time.Second},
+		},
+	}
+
+	require.Equal(t, expected, cfg.UploadPackRules)
+}
+
+func TestLoadUploadPackRulesRejectsDuplicateQueueNames(t *testing.T) {
+	config := `
+[[upload_pack_rule]]
+name = "full_clones"
+full_clone = true
+action = "queue"
+limit = 10
+
+[[upload_pack_rule]]
+name = "full_clones"
+action = "queue"
+limit = 5
+`
+
+	_, err := LoadConfig(config)
+	require.EqualError(t, err, `upload_pack_rule 1: duplicate queue name "full_clones"`)
+}
+
+func TestLoadPushSecretPatterns(t *testing.T) {
+	config := `
+[[push_secret_pattern]]
+name = "AWS access key"
+pattern = "AKIA[0-9A-Z]{16}"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := []PushSecretPattern{{Name: "AWS access key", Pattern: "AKIA[0-9A-Z]{16}"}}
+	require.Equal(t, expected, cfg.PushSecretPatterns)
+
+	_, err = LoadConfig("[[push_secret_pattern]]\nname = \"broken\"\npattern = \"a(b\"\n")
+	require.Error(t, err)
+
+	_, err = LoadConfig("[[push_secret_pattern]]\npattern = \"secret\"\n")
+	require.Error(t, err)
+}
+
+func TestLoadGitalyConfig(t *testing.T) {
+	config := `
+[gitaly]
+ca_file = "/etc/gitlab/ssl/gitaly-ca.pem"
+health_check_interval = "1m"
+connection_ttl = "1h"
+hedge_delay = "250ms"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := GitalyConfig{
+		CAFile:              "/etc/gitlab/ssl/gitaly-ca.pem",
+		HealthCheckInterval: &TomlDuration{Duration: time.Minute},
+		ConnectionTTL:       &TomlDuration{Duration: time.Hour},
+		HedgeDelay:          &TomlDuration{Duration: 250 * time.Millisecond},
+	}
+	require.Equal(t, expected, cfg.GitalyConfig)
+}
+
+func TestLoadCloneLimitsConfig(t *testing.T) {
+	config := `
+[clone_limits]
+per_user = 10
+per_repository = 50
+queue_limit = 20
+queue_timeout = "10s"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := CloneLimitsConfig{
+		PerUser:       10,
+		PerRepository: 50,
+		QueueLimit:    20,
+		QueueTimeout:  &TomlDuration{Duration: 10 * time.Second},
+	}
+	require.Equal(t, expected, cfg.CloneLimitsConfig)
+}
+
+func TestLoadBandwidthConfig(t *testing.T) {
+	config := `
+[bandwidth]
+global_rate = 1000000
+per_identity_rate = 100000
+burst = 10000
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := BandwidthConfig{GlobalRate: 1000000, PerIdentityRate: 100000, Burst: 10000}
+	require.Equal(t, expected, cfg.BandwidthConfig)
+}
+
+func TestLoadPreAuthorizeCacheConfig(t *testing.T) {
+	config := `
+[preauthorize_cache]
+enabled = true
+max_entries = 500
+max_ttl = "10s"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := PreAuthorizeCacheConfig{Enabled: true, MaxEntries: 500, MaxTTL: &TomlDuration{Duration: 10 * time.Second}}
+	require.Equal(t, expected, cfg.PreAuthorizeCacheConfig)
+}
+
+func TestLoadTusConfig(t *testing.T) {
+	config := `
+[tus]
+enabled = true
+store = "s3"
+max_size = 10000000
+expiration = "2h"
+
+[tus.s3]
+bucket = "tus-uploads"
+region = "us-east-1"
+part_size = 5242880
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := TusConfig{
+		Enabled:    true,
+		Store:      "s3",
+		MaxSize:    10000000,
+		Expiration: &TomlDuration{2 * time.Hour},
+		S3:         TusS3Config{Bucket: "tus-uploads", Region: "us-east-1", PartSize: 5242880},
+	}
+	require.Equal(t, expected, cfg.TusConfig)
+}
+
+func TestLoadInvalidTusConfig(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		config string
+	}{
+		{desc: "local store without dir", config: "[tus]\nenabled = true\n"},
+		{desc: "s3 store without bucket", config: "[tus]\nenabled = true\nstore = \"s3\"\n"},
+		{desc: "s3 parts that are too small", config: "[tus]\nenabled = true\nstore = \"s3\"\n[tus.s3]\nbucket = \"tus\"\npart_size = 1048576\n"},
+		{desc: "unknown store", config: "[tus]\nenabled = true\nstore = \"gcs\"\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := LoadConfig(tc.config)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadMultipartUploadConfig(t *testing.T) {
+	config := `
+[multipart_upload]
+concurrency = 4
+buffer = "memory"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := MultipartUploadConfig{Concurrency: 4, Buffer: "memory"}
+	require.Equal(t, expected, cfg.MultipartUploadConfig)
+}
+
+func TestLoadInvalidMultipartUploadConfig(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		config string
+	}{
+		{desc: "negative concurrency", config: "[multipart_upload]\nconcurrency = -1\n"},
+		{desc: "unknown buffer", config: "[multipart_upload]\nbuffer = \"redis\"\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := LoadConfig(tc.config)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package filestore
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// ChecksumError means that the client sent a malformed checksum for an
+// upload, or one that the upload doesn't match
+type ChecksumError struct {
+	msg string
+}
+
+func (e *ChecksumError) Error() string {
+	return e.msg
+}
+
+func checksumErrorf(format string, a ...interface{}) error {
+	return &ChecksumError{msg: fmt.Sprintf(format, a...)}
+}
+
+// Hash names in Digest (RFC 3230) and Repr-Digest (RFC 9530) headers
+var digestAlgorithms = map[string]string{
+	"md5":     "md5",
+	"sha":     "sha1",
+	"sha-256": "sha256",
+	"sha-512": "sha512",
+}
+
+// Maven clients send hex checksums in these headers
+var checksumHeaders = map[string]string{
+	"X-Checksum-Md5":    "md5",
+	"X-Checksum-Sha1":   "sha1",
+	"X-Checksum-Sha256": "sha256",
+	"X-Checksum-Sha512": "sha512",
+}
+
+// ChecksumsFromHeader returns the checksums of an upload that the client
+// sent in Content-MD5, Digest, Repr-Digest or X-Checksum-* headers, as hex
+// strings by hash name. We ignore algorithms that we don't compute.
+func ChecksumsFromHeader(h http.Header) (map[string]string, error) {
+	checksums := make(map[string]string)
+
+	add := func(header, hashName string, sum []byte) error {
+		if sum == nil {
+			return checksumErrorf("invalid %s checksum in %s header", hashName, header)
+		}
+
+		if factory := hashFactories[hashName]; factory != nil && len(sum) != factory().Size() {
+			return checksumErrorf("invalid %s checksum in %s header", hashName, header)
+		}
+
+		checksum := hex.EncodeToString(sum)
+		if previous, ok := checksums[hashName]; ok && previous != checksum {
+			return checksumErrorf("conflicting %s checksums", hashName)
+		}
+
+		checksums[hashName] = checksum
+		return nil
+	}
+
+	if value := h.Get("Content-MD5"); value != "" {
+		if err := add("Content-MD5", "md5", decodeBase64(value)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, header := range []string{"Digest", "Repr-Digest"} {
+		// http.Header.Values needs Go 1.14
+		for _, value := range h[textproto.CanonicalMIMEHeaderKey(header)] {
+			for _, member := range strings.Split(value, ",") {
+				algorithm, encoded, err := parseDigest(header, member)
+				if err != nil {
+					return nil, err
+				}
+
+				hashName, ok := digestAlgorithms[algorithm]
+				if !ok {
+					continue
+				}
+
+				if err := add(header, hashName, decodeBase64(encoded)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for header, hashName := range checksumHeaders {
+		if value := h.Get(header); value != "" {
+			sum, err := hex.DecodeString(strings.TrimSpace(value))
+			if err != nil {
+				sum = nil
+			}
+
+			if err := add(header, hashName, sum); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return checksums, nil
+}
+
+// parseDigest splits members like "SHA-256=base64" of Digest headers and
+// "sha-256=:base64:" of Repr-Digest headers
+func parseDigest(header, member string) (algorithm string, encoded string, err error) {
+	member = strings.TrimSpace(member)
+
+	split := strings.SplitN(member, "=", 2)
+	if len(split) != 2 {
+		return "", "", checksumErrorf("invalid %s header", header)
+	}
+
+	algorithm = strings.ToLower(strings.TrimSpace(split[0]))
+	encoded = strings.TrimSpace(split[1])
+
+	if header == "Repr-Digest" {
+		// Drop structured field parameters
+		encoded = strings.SplitN(encoded, ";", 2)[0]
+
+		if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			return "", "", checksumErrorf("invalid %s header", header)
+		}
+		encoded = encoded[1 : len(encoded)-1]
+	}
+
+	return algorithm, encoded, nil
+}
+
+func decodeBase64(encoded string) []byte {
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil
+	}
+
+	return sum
+}
+
+// VerifyChecksums returns a *ChecksumError if the file doesn't match one
+// of checksums, as returned by ChecksumsFromHeader
+func (fh *FileHandler) VerifyChecksums(checksums map[string]string) error {
+	for hashName, expected := range checksums {
+		if actual := fh.hashes[hashName]; actual != expected {
+			return checksumErrorf("%s checksum mismatch: expected %s, got %s", hashName, expected, actual)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package filestore_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+)
+
+// Checksums of "test"
+const (
+	testMD5    = "098f6bcd4621d373cade4e832627b4f6"
+	testSHA1   = "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
+	testSHA256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+)
+
+func TestChecksumsFromHeader(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		headers  map[string]string
+		expected map[string]string
+	}{
+		{
+			desc:     "no checksums",
+			headers:  map[string]string{"Content-Type": "application/octet-stream"},
+			expected: map[string]string{},
+		},
+		{
+			desc:     "Content-MD5",
+			headers:  map[string]string{"Content-MD5": "CY9rzUYh03PK3k6DJie09g=="},
+			expected: map[string]string{"md5": testMD5},
+		},
+		{
+			desc:     "Digest",
+			headers:  map[string]string{"Digest": "SHA-256=n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=, sha=qUqP5cyxm6YcTAhz05Hph5gvu9M=, UNIXsum=30637"},
+			expected: map[string]string{"sha256": testSHA256, "sha1": testSHA1},
+		},
+		{
+			desc:     "Repr-Digest",
+			headers:  map[string]string{"Repr-Digest": "sha-256=:n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=:, md5=:CY9rzUYh03PK3k6DJie09g==:"},
+			expected: map[string]string{"sha256": testSHA256, "md5": testMD5},
+		},
+		{
+			desc:     "X-Checksum headers",
+			headers:  map[string]string{"X-Checksum-Sha1": testSHA1, "X-Checksum-Sha256": strings.ToUpper(testSHA256), "X-Checksum-Deploy": "true"},
+			expected: map[string]string{"sha1": testSHA1, "sha256": testSHA256},
+		},
+		{
+			desc:     "matching checksums in several headers",
+			headers:  map[string]string{"Content-MD5": "CY9rzUYh03PK3k6DJie09g==", "X-Checksum-Md5": testMD5},
+			expected: map[string]string{"md5": testMD5},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+
+			checksums, err := filestore.ChecksumsFromHeader(h)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, checksums)
+		})
+	}
+}
+
+func TestChecksumsFromHeaderErrors(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		headers map[string]string
+	}{
+		{desc: "Content-MD5 is not base64", headers: map[string]string{"Content-MD5": "not base64"}},
+		{desc: "Content-MD5 is too short", headers: map[string]string{"Content-MD5": "CY9rzUYh03PK3k6D"}},
+		{desc: "Digest without a value", headers: map[string]string{"Digest": "SHA-256"}},
+		{desc: "Repr-Digest without colons", headers: map[string]string{"Repr-Digest": "sha-256=n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="}},
+		{desc: "X-Checksum is not hex", headers: map[string]string{"X-Checksum-Sha1": "not hex"}},
+		{desc: "X-Checksum is the wrong hash", headers: map[string]string{"X-Checksum-Sha256": testSHA1}},
+		{desc: "conflicting checksums", headers: map[string]string{"Content-MD5": "CY9rzUYh03PK3k6DJie09g==", "X-Checksum-Md5": strings.Repeat("0", 32)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+
+			_, err := filestore.ChecksumsFromHeader(h)
+			var checksumErr *filestore.ChecksumError
+			require.True(t, errors.As(err, &checksumErr), "expected a ChecksumError, got %v", err)
+		})
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader("test"), 4, &filestore.SaveFileOpts{LocalTempPath: tmpFolder})
+	require.NoError(t, err)
+
+	require.NoError(t, fh.VerifyChecksums(nil))
+	require.NoError(t, fh.VerifyChecksums(map[string]string{"md5": testMD5, "sha256": testSHA256}))
+
+	err = fh.VerifyChecksums(map[string]string{"md5": testMD5, "sha1": strings.Repeat("0", 40)})
+	var checksumErr *filestore.ChecksumError
+	require.True(t, errors.As(err, &checksumErr))
+	require.Contains(t, err.Error(), "sha1 checksum mismatch")
+}
@@ -112,9 +112,6 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 		RemoteID:  opts.RemoteID,
 		RemoteURL: opts.RemoteURL,
 	}
-	hashes := newMultiHash()
-	reader = io.TeeReader(reader, hashes.Writer)
-
 	var clientMode string
 
 	switch {
@@ -137,9 +134,17 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 			opts.ObjectStorageConfig.S3Credentials,
 			opts.ObjectStorageConfig.S3Config,
 		)
+	case opts.UseWorkhorseClientEnabled() && opts.ObjectStorageConfig.IsGoogle():
+		clientMode = "gcs"
+		uploadDestination, err = objectstore.NewGCSObject(
+			opts.RemoteTempObjectID,
+			opts.ObjectStorageConfig.GoogleCredentials,
+			opts.ObjectStorageConfig.GoogleConfig,
+		)
 	case opts.IsMultipart():
 		clientMode = "multipart"
-		uploadDestination, err = objectstore.NewMultipart(
+		var m *objectstore.Multipart
+		m, err = objectstore.NewMultipart(
 			opts.PresignedParts,
 			opts.PresignedCompleteMultipart,
 			opts.PresignedAbortMultipart,
@@ -147,6 +152,11 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 			opts.PutHeaders,
 			opts.PartSize,
 		)
+		if err == nil {
+			m.Concurrency = opts.PartConcurrency
+			m.MemoryBuffer = opts.PartMemoryBuffer
+		}
+		uploadDestination = m
 	default:
 		clientMode = "http"
 		uploadDestination, err = objectstore.NewObject(
@@ -161,6 +171,11 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 		return nil, err
 	}
 
+	// Uploaders that compare the ETag with an MD5 compute it themselves, so
+	// we only compute what GitLab Rails asked for
+	hashes := newMultiHash(opts.Hashes)
+	reader = io.TeeReader(reader, hashes.Writer)
+
 	if opts.MaximumSize > 0 {
 		if size > opts.MaximumSize {
 			return nil, SizeError(fmt.Errorf("the upload size %d is over maximum of %d bytes", size, opts.MaximumSize))
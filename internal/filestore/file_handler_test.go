@@ -318,6 +318,35 @@ func TestSaveFileWithS3WorkhorseClient(t *testing.T) {
 	test.S3ObjectExists(t, sess, s3Config, remoteObject, test.ObjectContent)
 }
 
+func TestSaveFileWithGoogleWorkhorseClient(t *testing.T) {
+	googleCreds, googleConfig, stub, ts := test.SetupGCS(t, "uploads")
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	remoteObject := "tmp/test-file/1"
+	opts := filestore.SaveFileOpts{
+		RemoteID:           "test-file",
+		Deadline:           testDeadline(),
+		UseWorkhorseClient: true,
+		RemoteTempObjectID: remoteObject,
+		ObjectStorageConfig: filestore.ObjectStorageConfig{
+			Provider:          "Google",
+			GoogleCredentials: googleCreds,
+			GoogleConfig:      googleConfig,
+		},
+	}
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, &opts)
+	require.NoError(t, err)
+	require.Equal(t, test.ObjectMD5, fh.MD5())
+
+	data, ok := stub.GetObject(remoteObject)
+	require.True(t, ok)
+	require.Equal(t, test.ObjectContent, string(data))
+}
+
 func TestSaveFileWithAzureWorkhorseClient(t *testing.T) {
 	mux, bucketDir, cleanup := test.SetupGoCloudFileBucket(t, "azblob")
 	defer cleanup()
@@ -395,6 +424,47 @@ func TestSaveMultipartInBodyFailure(t *testing.T) {
 	require.EqualError(t, err, test.MultipartUploadInternalError().Error())
 }
 
+func TestSaveFileWithHashes(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	tests := []struct {
+		name     string
+		opts     filestore.SaveFileOpts
+		expected map[string]string
+	}{
+		{
+			name:     "Local only",
+			opts:     filestore.SaveFileOpts{LocalTempPath: tmpFolder, Hashes: []string{"sha256"}},
+			expected: map[string]string{"sha256": test.ObjectSHA256},
+		},
+	}
+
+	for _, spec := range tests {
+		t.Run(spec.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, &spec.opts)
+			require.NoError(t, err)
+
+			fields, err := fh.GitLabFinalizeFields("file")
+			require.NoError(t, err)
+
+			for _, hashName := range []string{"md5", "sha1", "sha256", "sha512"} {
+				expected, ok := spec.expected[hashName]
+				if !ok {
+					require.NotContains(t, fields, "file."+hashName)
+					continue
+				}
+
+				require.Equal(t, expected, fields["file."+hashName])
+			}
+		})
+	}
+}
+
 func checkFileHandlerWithFields(t *testing.T, fh *filestore.FileHandler, fields map[string]string, prefix string) {
 	key := func(field string) string {
 		if prefix == "" {
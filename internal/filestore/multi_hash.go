@@ -22,12 +22,24 @@ type multiHash struct {
 	hashes map[string]hash.Hash
 }
 
-func newMultiHash() (m *multiHash) {
+// newMultiHash computes hashNames, or all hashes if hashNames is empty
+func newMultiHash(hashNames []string) (m *multiHash) {
 	m = &multiHash{}
 	m.hashes = make(map[string]hash.Hash)
 
+	if len(hashNames) == 0 {
+		for hash := range hashFactories {
+			hashNames = append(hashNames, hash)
+		}
+	}
+
 	var writers []io.Writer
-	for hash, hashFactory := range hashFactories {
+	for _, hash := range hashNames {
+		hashFactory := hashFactories[hash]
+		if hashFactory == nil || m.hashes[hash] != nil {
+			continue
+		}
+
 		writer := hashFactory()
 
 		m.hashes[hash] = writer
@@ -0,0 +1,35 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func BenchmarkMultiHash(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	benchmarks := []struct {
+		name      string
+		hashNames []string
+	}{
+		{name: "all"},
+		{name: "md5", hashNames: []string{"md5"}},
+		{name: "sha256", hashNames: []string{"sha256"}},
+		{name: "md5+sha256", hashNames: []string{"md5", "sha256"}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+
+			for i := 0; i < b.N; i++ {
+				m := newMultiHash(bm.hashNames)
+				if _, err := io.Copy(m.Writer, bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+				m.finish()
+			}
+		})
+	}
+}
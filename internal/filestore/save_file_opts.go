@@ -2,6 +2,7 @@ package filestore
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -20,6 +21,9 @@ type ObjectStorageConfig struct {
 	S3Credentials config.S3Credentials
 	S3Config      config.S3Config
 
+	GoogleCredentials config.GoogleCredentials
+	GoogleConfig      config.GoogleConfig
+
 	// GoCloud mux that maps azureblob:// and future URLs (e.g. s3://, gcs://, etc.) to a handler
 	URLMux *blob.URLMux
 
@@ -53,6 +57,9 @@ type SaveFileOpts struct {
 	Deadline time.Time
 	// The maximum accepted size in bytes of the upload
 	MaximumSize int64
+	// Hashes are the hashes to compute, of md5, sha1, sha256 and sha512.
+	// Empty means all of them.
+	Hashes []string
 
 	//MultipartUpload parameters
 	// PartSize is the exact size of each uploaded part. Only the last one can be smaller
@@ -63,6 +70,34 @@ type SaveFileOpts struct {
 	PresignedCompleteMultipart string
 	// PresignedAbortMultipart is a presigned URL for AbortMultipartUpload
 	PresignedAbortMultipart string
+	// PartConcurrency is how many parts we upload at the same time
+	PartConcurrency int
+	// PartMemoryBuffer buffers parts in memory instead of temporary files
+	PartMemoryBuffer bool
+}
+
+// AddHashes makes sure that we compute hashNames. It does nothing if we
+// compute all hashes anyway.
+func (s *SaveFileOpts) AddHashes(hashNames ...string) {
+	if len(s.Hashes) == 0 {
+		return
+	}
+
+	for _, hashName := range hashNames {
+		if !s.hasHash(hashName) {
+			s.Hashes = append(s.Hashes, hashName)
+		}
+	}
+}
+
+func (s *SaveFileOpts) hasHash(hashName string) bool {
+	for _, h := range s.Hashes {
+		if h == hashName {
+			return true
+		}
+	}
+
+	return false
 }
 
 // UseWorkhorseClientEnabled checks if the options require direct access to object storage
@@ -98,6 +133,13 @@ func GetOpts(apiResponse *api.Response) (*SaveFileOpts, error) {
 		RemoteTempObjectID: apiResponse.RemoteObject.RemoteTempObjectID,
 		Deadline:           time.Now().Add(timeout),
 		MaximumSize:        apiResponse.MaximumSize,
+		Hashes:             append([]string(nil), apiResponse.UploadHashes...),
+	}
+
+	for _, hashName := range opts.Hashes {
+		if hashFactories[hashName] == nil {
+			return nil, fmt.Errorf("API response has unknown hash %q", hashName)
+		}
 	}
 
 	if opts.LocalTempPath != "" && opts.RemoteID != "" {
@@ -113,6 +155,7 @@ func GetOpts(apiResponse *api.Response) (*SaveFileOpts, error) {
 		opts.ObjectStorageConfig.Provider = objectStorageParams.Provider
 		opts.ObjectStorageConfig.S3Config = objectStorageParams.S3Config
 		opts.ObjectStorageConfig.GoCloudConfig = objectStorageParams.GoCloudConfig
+		opts.ObjectStorageConfig.GoogleConfig = objectStorageParams.GoogleConfig
 	}
 
 	// Backwards compatibility to ensure API servers that do not include the
@@ -140,6 +183,10 @@ func (c *ObjectStorageConfig) IsAzure() bool {
 	return strings.EqualFold(c.Provider, "AzureRM")
 }
 
+func (c *ObjectStorageConfig) IsGoogle() bool {
+	return strings.EqualFold(c.Provider, "Google") || strings.EqualFold(c.Provider, "GCS")
+}
+
 func (c *ObjectStorageConfig) IsGoCloud() bool {
 	return c.GoCloudConfig.URL != ""
 }
@@ -147,6 +194,8 @@ func (c *ObjectStorageConfig) IsGoCloud() bool {
 func (c *ObjectStorageConfig) IsValid() bool {
 	if c.IsAWS() {
 		return c.S3Config.Bucket != "" && c.S3Config.Region != "" && c.s3CredentialsValid()
+	} else if c.IsGoogle() && c.GoogleConfig.Bucket != "" {
+		return c.googleCredentialsValid()
 	} else if c.IsGoCloud() {
 		// We could parse and validate the URL, but GoCloud providers
 		// such as AzureRM don't have a fallback to normal HTTP, so we
@@ -169,3 +218,9 @@ func (c *ObjectStorageConfig) s3CredentialsValid() bool {
 
 	return false
 }
+
+func (c *ObjectStorageConfig) googleCredentialsValid() bool {
+	creds := c.GoogleCredentials
+
+	return creds.JSONKeyLocation != "" || creds.JSONKeyString != "" || creds.ApplicationDefault
+}
@@ -150,6 +150,10 @@ func TestGetOptsFail(t *testing.T) {
 			desc: "both local and remote",
 			in:   api.Response{TempPath: "/foobar", RemoteObject: api.RemoteObject{ID: "id"}},
 		},
+		{
+			desc: "unknown hash",
+			in:   api.Response{TempPath: "/foobar", UploadHashes: []string{"sha256", "crc32"}},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -160,6 +164,22 @@ func TestGetOptsFail(t *testing.T) {
 	}
 }
 
+func TestGetOptsHashes(t *testing.T) {
+	opts, err := filestore.GetOpts(&api.Response{TempPath: "/foo/bar"})
+	require.NoError(t, err)
+	require.Empty(t, opts.Hashes)
+
+	opts.AddHashes("sha1")
+	require.Empty(t, opts.Hashes, "we compute all hashes anyway")
+
+	opts, err = filestore.GetOpts(&api.Response{TempPath: "/foo/bar", UploadHashes: []string{"sha256"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"sha256"}, opts.Hashes)
+
+	opts.AddHashes("sha1", "sha256")
+	require.Equal(t, []string{"sha256", "sha1"}, opts.Hashes)
+}
+
 func TestGetOptsDefaultTimeout(t *testing.T) {
 	deadline := time.Now().Add(filestore.DefaultObjectStoreTimeout)
 	opts, err := filestore.GetOpts(&api.Response{TempPath: "/foo/bar"})
@@ -271,6 +291,75 @@ func TestUseWorkhorseClientEnabled(t *testing.T) {
 	}
 }
 
+func TestGoogleConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		provider    string
+		bucket      string
+		credentials config.GoogleCredentials
+		valid       bool
+	}{
+		{
+			name:        "JSON key file",
+			provider:    "Google",
+			bucket:      "uploads",
+			credentials: config.GoogleCredentials{JSONKeyLocation: "/etc/gitlab/gcs.json"},
+			valid:       true,
+		},
+		{
+			name:        "JSON key",
+			provider:    "GCS",
+			bucket:      "uploads",
+			credentials: config.GoogleCredentials{JSONKeyString: "{}"},
+			valid:       true,
+		},
+		{
+			name:        "application default credentials",
+			provider:    "Google",
+			bucket:      "uploads",
+			credentials: config.GoogleCredentials{ApplicationDefault: true},
+			valid:       true,
+		},
+		{
+			name:     "no credentials",
+			provider: "Google",
+			bucket:   "uploads",
+			valid:    false,
+		},
+		{
+			name:        "no bucket",
+			provider:    "Google",
+			credentials: config.GoogleCredentials{ApplicationDefault: true},
+			valid:       false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apiResponse := &api.Response{
+				RemoteObject: api.RemoteObject{
+					Timeout:            10,
+					ID:                 "id",
+					UseWorkhorseClient: true,
+					RemoteTempObjectID: "test-object",
+					ObjectStorage: &api.ObjectStorageParams{
+						Provider:     test.provider,
+						GoogleConfig: config.GoogleConfig{Bucket: test.bucket},
+					},
+				},
+			}
+			opts, err := filestore.GetOpts(apiResponse)
+			require.NoError(t, err)
+			opts.ObjectStorageConfig.GoogleCredentials = test.credentials
+
+			require.True(t, opts.ObjectStorageConfig.IsGoogle())
+			require.Equal(t, apiResponse.RemoteObject.ObjectStorage.GoogleConfig, opts.ObjectStorageConfig.GoogleConfig)
+			require.Equal(t, test.valid, opts.ObjectStorageConfig.IsValid())
+			require.Equal(t, test.valid, opts.UseWorkhorseClientEnabled())
+		})
+	}
+}
+
 func TestGoCloudConfig(t *testing.T) {
 	mux, _, cleanup := test.SetupGoCloudFileBucket(t, "azblob")
 	defer cleanup()
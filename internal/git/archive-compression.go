@@ -0,0 +1,71 @@
+package git
+
+import (
+	"io"
+	"regexp"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archiveCompression is a TAR compression that Gitaly does not offer. We
+// request a plain TAR from Gitaly and compress it on the fly instead.
+type archiveCompression struct {
+	name        string
+	pattern     *regexp.Regexp
+	contentType string
+	newWriter   func(io.Writer) (io.WriteCloser, error)
+}
+
+var archiveCompressions = []*archiveCompression{
+	{
+		name:        "xz",
+		pattern:     regexp.MustCompile(`\.(tar\.xz|txz|xz)$`),
+		contentType: "application/x-xz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+	},
+	{
+		name:        "zstd",
+		pattern:     regexp.MustCompile(`\.(tar\.zst|tzst|zst)$`),
+		contentType: "application/zstd",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	},
+}
+
+func parseCompressedBasename(basename string) (*archiveCompression, bool) {
+	for _, c := range archiveCompressions {
+		if c.pattern.MatchString(basename) {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// compress returns the compressed contents of r. The caller must close the
+// returned reader, which stops the compression if it has not finished yet.
+func (c *archiveCompression) compress(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		cw, err := c.newWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(cw, r); err != nil {
+			cw.Close()
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(cw.Close())
+	}()
+
+	return pr
+}
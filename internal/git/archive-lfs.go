@@ -0,0 +1,166 @@
+package git
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+)
+
+// Archives that include LFS objects are cached separately from those that
+// contain the pointer files.
+const lfsArchiveCacheSubdir = "with-lfs"
+
+// gzipCompression is used for .tar.gz archives with LFS objects, because
+// Gitaly can only compress the TAR before we replace the pointers.
+var gzipCompression = &archiveCompression{
+	name: "gzip",
+	// The same as for the .tar.gz archives compressed by Gitaly
+	contentType: "application/octet-stream",
+	newWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+}
+
+// lfsArchiveFormat returns the formats to request from Gitaly and to
+// compress the rewritten TAR with. Only TAR based formats we can compress
+// ourselves support LFS objects.
+func lfsArchiveFormat(format gitalypb.GetArchiveRequest_Format, compression *archiveCompression) (gitalypb.GetArchiveRequest_Format, *archiveCompression, bool) {
+	switch {
+	case compression != nil:
+		return gitalypb.GetArchiveRequest_TAR, compression, true
+	case format == gitalypb.GetArchiveRequest_TAR:
+		return gitalypb.GetArchiveRequest_TAR, nil, true
+	case format == gitalypb.GetArchiveRequest_TAR_GZ:
+		return gitalypb.GetArchiveRequest_TAR, gzipCompression, true
+	}
+
+	return format, compression, false
+}
+
+func lfsArchivePath(archivePath string) string {
+	return filepath.Join(filepath.Dir(archivePath), lfsArchiveCacheSubdir, filepath.Base(archivePath))
+}
+
+// includeLfsObjects returns the TAR archive from r with LFS pointer files
+// replaced by the content of the objects they point to. Pointers to
+// objects that are unknown or unavailable are left alone. The caller must
+// close the returned reader.
+func includeLfsObjects(ctx context.Context, r io.Reader, objects []lfs.Object) io.ReadCloser {
+	index := lfsObjectIndex(objects)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copyTarWithLfsObjects(ctx, pw, r, index))
+	}()
+
+	return pr
+}
+
+func copyTarWithLfsObjects(ctx context.Context, w io.Writer, r io.Reader, objects map[string]*lfs.Object) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("read archive: %v", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > lfs.MaxPointerSize {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("read archive: %v", err)
+		}
+
+		if content := openLfsObject(ctx, hdr.Name, data, objects); content != nil {
+			err := copyLfsObject(tw, hdr, content)
+			content.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func lfsObjectIndex(objects []lfs.Object) map[string]*lfs.Object {
+	index := make(map[string]*lfs.Object, len(objects))
+	for i := range objects {
+		index[objects[i].Oid] = &objects[i]
+	}
+	return index
+}
+
+// openLfsObject returns nil if data is not a pointer to an object we can
+// serve in place of the pointer.
+func openLfsObject(ctx context.Context, name string, data []byte, objects map[string]*lfs.Object) *sizedReadCloser {
+	pointer, ok := lfs.ParsePointer(data)
+	if !ok {
+		return nil
+	}
+
+	object, ok := objects[pointer.Oid]
+	if !ok || object.Size != pointer.Size {
+		return nil
+	}
+
+	content, err := object.Open(ctx)
+	if err != nil {
+		log.WithContextFields(ctx, log.Fields{"path": name, "oid": object.Oid}).WithError(err).Error("keeping LFS pointer")
+		return nil
+	}
+
+	return &sizedReadCloser{ReadCloser: content, size: object.Size}
+}
+
+type sizedReadCloser struct {
+	io.ReadCloser
+	size int64
+}
+
+func copyLfsObject(tw *tar.Writer, hdr *tar.Header, content *sizedReadCloser) error {
+	hdr.Size = content.size
+	// Let the writer pick a format that can hold the new size
+	hdr.Format = tar.FormatUnknown
+	delete(hdr.PAXRecords, "size")
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	// The header promised exactly this many bytes, so a short object
+	// corrupts the archive and must abort it.
+	if _, err := io.CopyN(tw, content, content.size); err != nil {
+		return fmt.Errorf("copy LFS object %s: %v", hdr.Name, err)
+	}
+
+	return nil
+}
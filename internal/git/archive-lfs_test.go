@@ -0,0 +1,204 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+)
+
+const (
+	testLfsOid        = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	testUnknownLfsOid = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+type tarEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func TestIncludeLfsObjects(t *testing.T) {
+	objectContent := bytes.Repeat([]byte("large file "), 1000)
+	objectPath := writeTempFile(t, objectContent)
+	defer os.Remove(objectPath)
+	objects := []lfs.Object{{Oid: testLfsOid, Size: int64(len(objectContent)), Path: objectPath}}
+
+	archive := buildTar(t, testArchiveWithLfsPointers(objectContent))
+
+	r := includeLfsObjects(context.Background(), bytes.NewReader(archive), objects)
+	defer r.Close()
+
+	entries := readTar(t, r)
+	require.Len(t, entries, 5)
+
+	require.Equal(t, byte(tar.TypeXGlobalHeader), entries[0].hdr.Typeflag)
+	require.Equal(t, "1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541", entries[0].hdr.PAXRecords["comment"])
+	require.Equal(t, "repo/", entries[1].hdr.Name)
+	require.Equal(t, "repo/README.md", entries[2].hdr.Name)
+	require.Equal(t, "hello\n", entries[2].content)
+
+	require.Equal(t, "repo/large.bin", entries[3].hdr.Name)
+	require.Equal(t, int64(0644), entries[3].hdr.Mode)
+	require.Equal(t, int64(len(objectContent)), entries[3].hdr.Size)
+	require.Equal(t, string(objectContent), entries[3].content)
+
+	require.Equal(t, "repo/unknown.bin", entries[4].hdr.Name)
+	require.Equal(t, lfsPointer(testUnknownLfsOid, 5), entries[4].content, "pointers to unknown objects are kept")
+}
+
+func TestIncludeLfsObjectsKeepsPointersToUnavailableObjects(t *testing.T) {
+	objectContent := []byte("large file")
+	objects := []lfs.Object{{Oid: testLfsOid, Size: int64(len(objectContent)), Path: "/does/not/exist"}}
+
+	archive := buildTar(t, testArchiveWithLfsPointers(objectContent))
+
+	r := includeLfsObjects(context.Background(), bytes.NewReader(archive), objects)
+	defer r.Close()
+
+	entries := readTar(t, r)
+	require.Equal(t, lfsPointer(testLfsOid, len(objectContent)), entries[3].content)
+}
+
+func TestSendArchiveIncludesLfsObjects(t *testing.T) {
+	objectContent := bytes.Repeat([]byte("large file "), 1000)
+	archive := buildTar(t, testArchiveWithLfsPointers(objectContent))
+
+	var requestedFormat gitalypb.GetArchiveRequest_Format
+	addr, cleanUp := startRepositoryServer(t, &repositoryServiceServer{
+		GetArchiveFunc: func(req *gitalypb.GetArchiveRequest, stream gitalypb.RepositoryService_GetArchiveServer) error {
+			requestedFormat = req.GetFormat()
+			return stream.Send(&gitalypb.GetArchiveResponse{Data: archive})
+		},
+	})
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	objectPath := writeTempFile(t, objectContent)
+	defer os.Remove(objectPath)
+
+	archivePath := filepath.Join(dir, "project-1", "abc", "archive.tar.gz")
+	sendData := archiveSendData(t, archiveParams{
+		ArchivePath:     archivePath,
+		GitalyServer:    gitaly.Server{Address: addr},
+		CommitId:        "1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541",
+		IncludeLfsBlobs: true,
+		LfsObjects:      []lfs.Object{{Oid: testLfsOid, Size: int64(len(objectContent)), Path: objectPath}},
+	})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		SendArchive.Inject(w, httptest.NewRequest("GET", "/archive.tar.gz", nil), sendData)
+		require.Equal(t, 200, w.Code)
+		require.Equal(t, `attachment; filename="archive.tar.gz"`, w.Header().Get("Content-Disposition"))
+		require.Equal(t, gitalypb.GetArchiveRequest_TAR, requestedFormat)
+
+		zr, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		entries := readTar(t, zr)
+		require.Equal(t, string(objectContent), entries[3].content)
+	}
+
+	require.NoFileExists(t, archivePath, "archives with LFS objects are cached separately")
+	require.FileExists(t, filepath.Join(dir, "project-1", "abc", lfsArchiveCacheSubdir, "archive.tar.gz"))
+}
+
+func TestLfsArchiveFormat(t *testing.T) {
+	xz, _ := parseCompressedBasename("archive.tar.xz")
+
+	for _, tc := range []struct {
+		format      gitalypb.GetArchiveRequest_Format
+		compression *archiveCompression
+		expected    *archiveCompression
+		ok          bool
+	}{
+		{gitalypb.GetArchiveRequest_TAR, nil, nil, true},
+		{gitalypb.GetArchiveRequest_TAR_GZ, nil, gzipCompression, true},
+		{gitalypb.GetArchiveRequest_TAR, xz, xz, true},
+		{gitalypb.GetArchiveRequest_TAR_BZ2, nil, nil, false},
+		{gitalypb.GetArchiveRequest_ZIP, nil, nil, false},
+	} {
+		format, compression, ok := lfsArchiveFormat(tc.format, tc.compression)
+		require.Equal(t, tc.ok, ok, "format %v", tc.format)
+		if ok {
+			require.Equal(t, gitalypb.GetArchiveRequest_TAR, format)
+			require.Equal(t, tc.expected, compression)
+		} else {
+			require.Equal(t, tc.format, format)
+		}
+	}
+}
+
+func testArchiveWithLfsPointers(objectContent []byte) []tarEntry {
+	return []tarEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541"}}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "repo/", Mode: 0755}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "repo/README.md", Mode: 0644}, content: "hello\n"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "repo/large.bin", Mode: 0644}, content: lfsPointer(testLfsOid, len(objectContent))},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "repo/unknown.bin", Mode: 0644}, content: lfsPointer(testUnknownLfsOid, 5)},
+	}
+}
+
+func lfsPointer(oid string, size int) string {
+	return fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, size)
+}
+
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := io.WriteString(tw, e.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func readTar(t *testing.T, r io.Reader) []tarEntry {
+	var entries []tarEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		entries = append(entries, tarEntry{hdr: *hdr, content: string(content)})
+	}
+}
+
+// writeTempFile returns the path of a new file with data. The caller must
+// remove it.
+func writeTempFile(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "lfs-object")
+	require.NoError(t, err)
+
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	return f.Name()
+}
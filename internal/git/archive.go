@@ -5,6 +5,7 @@ In this file we handle 'git archive' downloads
 package git
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,20 +14,29 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto" //lint:ignore SA1019 https://gitlab.com/gitlab-org/gitlab-workhorse/-/issues/274
 
 	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/bandwidth"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 )
 
-type archive struct{ senddata.Prefix }
+type archive struct {
+	senddata.Prefix
+	cache  *FileCache
+	shaper *bandwidth.Shaper
+}
 type archiveParams struct {
 	ArchivePath       string
 	ArchivePrefix     string
@@ -35,10 +45,17 @@ type archiveParams struct {
 	GitalyRepository  gitalypb.Repository
 	DisableCache      bool
 	GetArchiveRequest []byte
+	// IncludeLfsBlobs replaces LFS pointer files in TAR based archives by
+	// the content of the LfsObjects they point to
+	IncludeLfsBlobs bool
+	LfsObjects      []lfs.Object
+	// BandwidthLimit overrides the per-identity bandwidth limit in bytes
+	// per second if positive
+	BandwidthLimit int64
 }
 
 var (
-	SendArchive     = &archive{"git-archive:"}
+	SendArchive     = &archive{Prefix: "git-archive:"}
 	gitArchiveCache = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gitlab_workhorse_git_archive_cache",
@@ -46,10 +63,38 @@ var (
 		},
 		[]string{"result"},
 	)
+	gitArchiveCacheHitRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_archive_cache_hit_ratio",
+			Help: "Ratio of 'git archive' cache hits to cache lookups since startup",
+		},
+	)
+
+	archiveCacheHits, archiveCacheLookups int64
 )
 
 func init() {
 	prometheus.MustRegister(gitArchiveCache)
+	prometheus.MustRegister(gitArchiveCacheHitRatio)
+}
+
+// NewSendArchive returns the 'git archive' injecter that registers cache
+// hits with the given cache manager, which may be nil, and sends archives
+// at the pace of shaper.
+func NewSendArchive(cache *FileCache, shaper *bandwidth.Shaper) senddata.Injecter {
+	return &archive{Prefix: SendArchive.Prefix, cache: cache, shaper: shaper}
+}
+
+func countArchiveCacheLookup(result string) {
+	gitArchiveCache.WithLabelValues(result).Inc()
+
+	hits := atomic.LoadInt64(&archiveCacheHits)
+	if result == "hit" {
+		hits = atomic.AddInt64(&archiveCacheHits, 1)
+	}
+	lookups := atomic.AddInt64(&archiveCacheLookups, 1)
+
+	gitArchiveCacheHitRatio.Set(float64(hits) / float64(lookups))
 }
 
 func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
@@ -59,9 +104,16 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 		return
 	}
 
+	w, done := a.shaper.Wrap(w, r, "", params.BandwidthLimit)
+	defer done()
+
 	urlPath := r.URL.Path
 	format, ok := parseBasename(filepath.Base(urlPath))
-	if !ok {
+	compression, compressed := parseCompressedBasename(filepath.Base(urlPath))
+	if compressed {
+		format = gitalypb.GetArchiveRequest_TAR
+	}
+	if !ok && !compressed {
 		helper.Fail500(w, r, fmt.Errorf("SendArchive: invalid format: %s", urlPath))
 		return
 	}
@@ -69,12 +121,20 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 	cacheEnabled := !params.DisableCache
 	archiveFilename := path.Base(params.ArchivePath)
 
+	if params.IncludeLfsBlobs {
+		format, compression, params.IncludeLfsBlobs = lfsArchiveFormat(format, compression)
+	}
+	if params.IncludeLfsBlobs {
+		params.ArchivePath = lfsArchivePath(params.ArchivePath)
+	}
+
 	if cacheEnabled {
 		cachedArchive, err := os.Open(params.ArchivePath)
 		if err == nil {
 			defer cachedArchive.Close()
-			gitArchiveCache.WithLabelValues("hit").Inc()
-			setArchiveHeaders(w, format, archiveFilename)
+			countArchiveCacheLookup("hit")
+			a.cache.touch(params.ArchivePath)
+			setArchiveHeaders(w, format, compression, archiveFilename)
 			// Even if somebody deleted the cachedArchive from disk since we opened
 			// the file, Unix file semantics guarantee we can still read from the
 			// open file in this process.
@@ -83,58 +143,213 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 		}
 	}
 
-	gitArchiveCache.WithLabelValues("miss").Inc()
+	if !cacheEnabled {
+		countArchiveCacheLookup("miss")
+		streamArchive(w, r, params, format, compression, archiveFilename)
+		return
+	}
 
-	var tempFile *os.File
-	var err error
+	gen, reader, created, err := joinArchiveGeneration(r.Context(), params, format, compression, archiveFilename)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendArchive: %v", err))
+		return
+	}
+	defer gen.release()
+	defer reader.Close()
 
-	if cacheEnabled {
-		// We assume the tempFile has a unique name so that concurrent requests are
-		// safe. We create the tempfile in the same directory as the final cached
-		// archive we want to create so that we can use an atomic link(2) operation
-		// to finalize the cached archive.
-		tempFile, err = prepareArchiveTempfile(path.Dir(params.ArchivePath), archiveFilename)
-		if err != nil {
-			helper.Fail500(w, r, fmt.Errorf("SendArchive: create tempfile: %v", err))
-			return
-		}
-		defer tempFile.Close()
-		defer os.Remove(tempFile.Name())
+	if created {
+		countArchiveCacheLookup("miss")
+	} else {
+		countArchiveCacheLookup("coalesced")
 	}
 
-	var archiveReader io.Reader
+	if err := gen.waitStarted(r.Context()); err != nil {
+		return
+	}
+	if written, done, err, _ := gen.state(); written == 0 && done && err != nil {
+		helper.Fail500(w, r, err)
+		return
+	}
 
-	archiveReader, err = handleArchiveWithGitaly(r, params, format)
-	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("operations.GetArchive: %v", err))
+	// Start writing the response
+	setArchiveHeaders(w, format, compression, archiveFilename)
+	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+	if _, err := gen.writeTo(r.Context(), reader, w); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy 'git archive' output: %v", err)})
 		return
 	}
+}
 
-	reader := archiveReader
-	if cacheEnabled {
-		reader = io.TeeReader(archiveReader, tempFile)
+func streamArchive(w http.ResponseWriter, r *http.Request, params archiveParams, format gitalypb.GetArchiveRequest_Format, compression *archiveCompression, archiveFilename string) {
+	archiveReader, err := openArchive(r.Context(), params, format, compression)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("operations.GetArchive: %v", err))
+		return
 	}
+	defer archiveReader.Close()
 
 	// Start writing the response
-	setArchiveHeaders(w, format, archiveFilename)
+	setArchiveHeaders(w, format, compression, archiveFilename)
 	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
-	if _, err := io.Copy(w, reader); err != nil {
+	if _, err := io.Copy(w, archiveReader); err != nil {
 		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy 'git archive' output: %v", err)})
 		return
 	}
+}
 
-	if cacheEnabled {
-		err := finalizeCachedArchive(tempFile, params.ArchivePath)
-		if err != nil {
-			helper.LogError(r, fmt.Errorf("SendArchive: finalize cached archive: %v", err))
-			return
+// archiveGeneration is a single Gitaly GetArchive call whose output is
+// written to a tempfile next to the cached archive. All concurrent requests
+// for the same ArchivePath follow that tempfile instead of asking Gitaly
+// again.
+type archiveGeneration struct {
+	*growingFile
+	archivePath string
+	tempPath    string
+	cancel      context.CancelFunc
+	// readers is protected by archiveGenerations
+	readers int
+}
+
+var archiveGenerations = struct {
+	sync.Mutex
+	m map[string]*archiveGeneration
+}{m: make(map[string]*archiveGeneration)}
+
+// joinArchiveGeneration returns the running generation of the archive,
+// starting one if needed, along with an open reader for its tempfile. The
+// caller must call release on the generation when it is done.
+func joinArchiveGeneration(ctx context.Context, params archiveParams, format gitalypb.GetArchiveRequest_Format, compression *archiveCompression, archiveFilename string) (gen *archiveGeneration, reader *os.File, created bool, err error) {
+	archiveGenerations.Lock()
+	defer archiveGenerations.Unlock()
+
+	if gen, ok := archiveGenerations.m[params.ArchivePath]; ok {
+		// The tempfile is only removed after the generation has been removed
+		// from the map, so this should not fail
+		if reader, err := os.Open(gen.tempPath); err == nil {
+			gen.readers++
+			return gen, reader, false, nil
+		}
+	}
+
+	// We assume the tempFile has a unique name so that concurrent requests are
+	// safe. We create the tempfile in the same directory as the final cached
+	// archive we want to create so that we can use an atomic link(2) operation
+	// to finalize the cached archive.
+	tempFile, err := prepareArchiveTempfile(path.Dir(params.ArchivePath), archiveFilename)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("create tempfile: %v", err)
+	}
+
+	reader, err = os.Open(tempFile.Name())
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, nil, false, fmt.Errorf("open tempfile: %v", err)
+	}
+
+	// The generation must not depend on the request that happened to start
+	// it, because that client may go away while others are still reading.
+	genCtx, cancel := context.WithCancel(detachedContext(ctx))
+	gen = &archiveGeneration{
+		growingFile: newGrowingFile(),
+		archivePath: params.ArchivePath,
+		tempPath:    tempFile.Name(),
+		cancel:      cancel,
+		readers:     1,
+	}
+	archiveGenerations.m[params.ArchivePath] = gen
+
+	go gen.generate(genCtx, tempFile, params, format, compression)
+
+	return gen, reader, true, nil
+}
+
+func (gen *archiveGeneration) generate(ctx context.Context, tempFile *os.File, params archiveParams, format gitalypb.GetArchiveRequest_Format, compression *archiveCompression) {
+	defer gen.cancel()
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	err := gen.copyArchive(ctx, tempFile, params, format, compression)
+	if err == nil {
+		if err := finalizeCachedArchive(tempFile, gen.archivePath); err != nil {
+			// The archive is complete, we just could not cache it
+			log.WithContextFields(ctx, log.Fields{"path": gen.archivePath}).WithError(err).Error("SendArchive: finalize cached archive")
 		}
 	}
+
+	archiveGenerations.Lock()
+	if archiveGenerations.m[gen.archivePath] == gen {
+		delete(archiveGenerations.m, gen.archivePath)
+	}
+	archiveGenerations.Unlock()
+
+	gen.finish(err)
+}
+
+func (gen *archiveGeneration) copyArchive(ctx context.Context, tempFile *os.File, params archiveParams, format gitalypb.GetArchiveRequest_Format, compression *archiveCompression) error {
+	archiveReader, err := openArchive(ctx, params, format, compression)
+	if err != nil {
+		return fmt.Errorf("operations.GetArchive: %v", err)
+	}
+	defer archiveReader.Close()
+
+	if _, err := io.Copy(&growingFileWriter{file: tempFile, growingFile: gen.growingFile}, archiveReader); err != nil {
+		return fmt.Errorf("operations.GetArchive: %v", err)
+	}
+
+	return nil
 }
 
-func handleArchiveWithGitaly(r *http.Request, params archiveParams, format gitalypb.GetArchiveRequest_Format) (io.Reader, error) {
+// release gives up interest in the generation. If nobody is left to read
+// an unfinished archive we stop generating it.
+func (gen *archiveGeneration) release() {
+	archiveGenerations.Lock()
+	defer archiveGenerations.Unlock()
+
+	gen.readers--
+	if gen.readers > 0 || gen.isDone() {
+		return
+	}
+
+	if archiveGenerations.m[gen.archivePath] == gen {
+		delete(archiveGenerations.m, gen.archivePath)
+	}
+	gen.cancel()
+}
+
+// openArchive streams the archive from Gitaly, including LFS objects and
+// compressing it on the fly if Gitaly can't do that.
+func openArchive(ctx context.Context, params archiveParams, format gitalypb.GetArchiveRequest_Format, compression *archiveCompression) (io.ReadCloser, error) {
+	gitalyReader, err := handleArchiveWithGitaly(ctx, params, format, compression != nil || params.IncludeLfsBlobs)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveReader := ioutil.NopCloser(gitalyReader)
+	if params.IncludeLfsBlobs {
+		archiveReader = includeLfsObjects(ctx, gitalyReader, params.LfsObjects)
+	}
+
+	if compression == nil {
+		return archiveReader, nil
+	}
+
+	return &compressedArchive{ReadCloser: compression.compress(archiveReader), source: archiveReader}, nil
+}
+
+type compressedArchive struct {
+	io.ReadCloser
+	source io.Closer
+}
+
+func (a *compressedArchive) Close() error {
+	a.source.Close()
+	return a.ReadCloser.Close()
+}
+
+func handleArchiveWithGitaly(ctx context.Context, params archiveParams, format gitalypb.GetArchiveRequest_Format, overrideFormat bool) (io.Reader, error) {
 	var request *gitalypb.GetArchiveRequest
-	ctx, c, err := gitaly.NewRepositoryClient(r.Context(), params.GitalyServer)
+	ctx, c, err := gitaly.NewRepositoryClient(ctx, params.GitalyServer)
 	if err != nil {
 		return nil, err
 	}
@@ -145,6 +360,10 @@ func handleArchiveWithGitaly(r *http.Request, params archiveParams, format gital
 		if err := proto.Unmarshal(params.GetArchiveRequest, request); err != nil {
 			return nil, fmt.Errorf("unmarshal GetArchiveRequest: %v", err)
 		}
+
+		if overrideFormat {
+			request.Format = format
+		}
 	} else {
 		request = &gitalypb.GetArchiveRequest{
 			Repository: &params.GitalyRepository,
@@ -157,14 +376,16 @@ func handleArchiveWithGitaly(r *http.Request, params archiveParams, format gital
 	return c.ArchiveReader(ctx, request)
 }
 
-func setArchiveHeaders(w http.ResponseWriter, format gitalypb.GetArchiveRequest_Format, archiveFilename string) {
+func setArchiveHeaders(w http.ResponseWriter, format gitalypb.GetArchiveRequest_Format, compression *archiveCompression, archiveFilename string) {
 	w.Header().Del("Content-Length")
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveFilename))
+	setAttachmentFilename(w, archiveFilename)
 	// Caching proxies usually don't cache responses with Set-Cookie header
 	// present because it implies user-specific data, which is not the case
 	// for repository archives.
 	w.Header().Del("Set-Cookie")
-	if format == gitalypb.GetArchiveRequest_ZIP {
+	if compression != nil {
+		w.Header().Set("Content-Type", compression.contentType)
+	} else if format == gitalypb.GetArchiveRequest_ZIP {
 		w.Header().Set("Content-Type", "application/zip")
 	} else {
 		w.Header().Set("Content-Type", "application/octet-stream")
@@ -176,7 +397,17 @@ func prepareArchiveTempfile(dir string, prefix string) (*os.File, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	return ioutil.TempFile(dir, prefix)
+
+	f, err := ioutil.TempFile(dir, prefix)
+	if os.IsNotExist(err) {
+		// The FileCache janitor removed the empty directory in between
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return ioutil.TempFile(dir, prefix)
+	}
+
+	return f, err
 }
 
 func finalizeCachedArchive(tempFile *os.File, archivePath string) error {
@@ -1,12 +1,30 @@
 package git
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto" //lint:ignore SA1019 https://gitlab.com/gitlab-org/gitlab-workhorse/-/issues/274
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"google.golang.org/grpc"
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 
 	"github.com/stretchr/testify/require"
@@ -39,6 +57,107 @@ func TestParseBasename(t *testing.T) {
 	}
 }
 
+func TestParseCompressedBasename(t *testing.T) {
+	for _, testCase := range []struct {
+		in  string
+		out string
+	}{
+		{"foo.tar.xz", "xz"},
+		{"foo-master.txz", "xz"},
+		{"foo-v1.2.1.xz", "xz"},
+		{"foo.tar.zst", "zstd"},
+		{"foo-master.tzst", "zstd"},
+		{"foo-v1.2.1.zst", "zstd"},
+	} {
+		compression, ok := parseCompressedBasename(testCase.in)
+		require.True(t, ok, "parseCompressedBasename did not recognize %q", testCase.in)
+		require.Equal(t, testCase.out, compression.name)
+
+		_, ok = parseBasename(testCase.in)
+		require.False(t, ok, "Gitaly formats must not shadow %q", testCase.in)
+	}
+
+	for _, basename := range []string{"archive", "foo.tar.gz", "foo.zip", "foo.tar"} {
+		_, ok := parseCompressedBasename(basename)
+		require.False(t, ok, "%q is produced by Gitaly", basename)
+	}
+}
+
+func TestSendArchiveCompressesTar(t *testing.T) {
+	tarData := testTar(t)
+
+	var requestedFormat gitalypb.GetArchiveRequest_Format
+	addr, cleanUp := startRepositoryServer(t, &repositoryServiceServer{
+		GetArchiveFunc: func(req *gitalypb.GetArchiveRequest, stream gitalypb.RepositoryService_GetArchiveServer) error {
+			requestedFormat = req.GetFormat()
+			return stream.Send(&gitalypb.GetArchiveResponse{Data: tarData})
+		},
+	})
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	decompressors := map[string]func(io.Reader) (io.Reader, error){
+		"xz": func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+		"zst": func(r io.Reader) (io.Reader, error) {
+			d, err := zstd.NewReader(r)
+			return d, err
+		},
+	}
+
+	for ext, decompress := range decompressors {
+		for _, disableCache := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s disableCache=%v", ext, disableCache), func(t *testing.T) {
+				archivePath := filepath.Join(dir, fmt.Sprintf("%v", disableCache), "archive.tar."+ext)
+				getArchiveRequest, err := proto.Marshal(&gitalypb.GetArchiveRequest{Format: gitalypb.GetArchiveRequest_TAR_GZ})
+				require.NoError(t, err)
+
+				sendData := archiveSendData(t, archiveParams{
+					ArchivePath:       archivePath,
+					GitalyServer:      gitaly.Server{Address: addr},
+					DisableCache:      disableCache,
+					GetArchiveRequest: getArchiveRequest,
+				})
+
+				for i := 0; i < 2; i++ {
+					w := httptest.NewRecorder()
+					SendArchive.Inject(w, httptest.NewRequest("GET", "/archive.tar."+ext, nil), sendData)
+					require.Equal(t, 200, w.Code)
+					require.Equal(t, gitalypb.GetArchiveRequest_TAR, requestedFormat)
+
+					r, err := decompress(w.Body)
+					require.NoError(t, err)
+					data, err := ioutil.ReadAll(r)
+					require.NoError(t, err)
+					require.Equal(t, tarData, data)
+				}
+
+				if disableCache {
+					require.NoFileExists(t, archivePath)
+				} else {
+					require.FileExists(t, archivePath)
+				}
+			})
+		}
+	}
+}
+
+func testTar(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for i := 0; i < 10; i++ {
+		content := bytes.Repeat([]byte(fmt.Sprintf("file %d\n", i)), 1000)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("repo/file-%d.txt", i), Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
 func TestFinalizeArchive(t *testing.T) {
 	tempFile, err := ioutil.TempFile("", "gitlab-workhorse-test")
 	if err != nil {
@@ -54,14 +173,20 @@ func TestFinalizeArchive(t *testing.T) {
 }
 
 func TestSetArchiveHeaders(t *testing.T) {
+	xz, _ := parseCompressedBasename("archive.tar.xz")
+	zst, _ := parseCompressedBasename("archive.tar.zst")
+
 	for _, testCase := range []struct {
-		in  gitalypb.GetArchiveRequest_Format
-		out string
+		in          gitalypb.GetArchiveRequest_Format
+		compression *archiveCompression
+		out         string
 	}{
-		{gitalypb.GetArchiveRequest_ZIP, "application/zip"},
-		{gitalypb.GetArchiveRequest_TAR, "application/octet-stream"},
-		{gitalypb.GetArchiveRequest_TAR_GZ, "application/octet-stream"},
-		{gitalypb.GetArchiveRequest_TAR_BZ2, "application/octet-stream"},
+		{gitalypb.GetArchiveRequest_ZIP, nil, "application/zip"},
+		{gitalypb.GetArchiveRequest_TAR, nil, "application/octet-stream"},
+		{gitalypb.GetArchiveRequest_TAR_GZ, nil, "application/octet-stream"},
+		{gitalypb.GetArchiveRequest_TAR_BZ2, nil, "application/octet-stream"},
+		{gitalypb.GetArchiveRequest_TAR, xz, "application/x-xz"},
+		{gitalypb.GetArchiveRequest_TAR, zst, "application/zstd"},
 	} {
 		w := httptest.NewRecorder()
 
@@ -76,7 +201,7 @@ func TestSetArchiveHeaders(t *testing.T) {
 		// This should be preserved
 		w.Header().Set("Cache-Control", "public, max-age=3600")
 
-		setArchiveHeaders(w, testCase.in, "filename")
+		setArchiveHeaders(w, testCase.in, testCase.compression, "filename")
 
 		testhelper.RequireResponseHeader(t, w, "Content-Type", testCase.out)
 		testhelper.RequireResponseHeader(t, w, "Content-Length")
@@ -85,3 +210,128 @@ func TestSetArchiveHeaders(t *testing.T) {
 		require.Empty(t, w.Header().Get("Set-Cookie"), "remove Set-Cookie")
 	}
 }
+
+type repositoryServiceServer struct {
+	gitalypb.UnimplementedRepositoryServiceServer
+	GetArchiveFunc   func(*gitalypb.GetArchiveRequest, gitalypb.RepositoryService_GetArchiveServer) error
+	CreateBundleFunc func(*gitalypb.CreateBundleRequest, gitalypb.RepositoryService_CreateBundleServer) error
+}
+
+func (srv *repositoryServiceServer) GetArchive(req *gitalypb.GetArchiveRequest, s gitalypb.RepositoryService_GetArchiveServer) error {
+	return srv.GetArchiveFunc(req, s)
+}
+
+func (srv *repositoryServiceServer) CreateBundle(req *gitalypb.CreateBundleRequest, s gitalypb.RepositoryService_CreateBundleServer) error {
+	return srv.CreateBundleFunc(req, s)
+}
+
+func TestSendArchiveCoalescesConcurrentRequests(t *testing.T) {
+	archiveData := bytes.Repeat([]byte("archive data "), 10000)
+
+	var calls int32
+	release := make(chan struct{})
+	addr, cleanUp := startRepositoryServer(t, &repositoryServiceServer{
+		GetArchiveFunc: func(req *gitalypb.GetArchiveRequest, stream gitalypb.RepositoryService_GetArchiveServer) error {
+			atomic.AddInt32(&calls, 1)
+			if err := stream.Send(&gitalypb.GetArchiveResponse{Data: archiveData[:100]}); err != nil {
+				return err
+			}
+			<-release
+			return stream.Send(&gitalypb.GetArchiveResponse{Data: archiveData[100:]})
+		},
+	})
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archivePath := filepath.Join(dir, "project-1", "abc", "archive.tar.gz")
+	sendData := archiveSendData(t, archiveParams{ArchivePath: archivePath, GitalyServer: gitaly.Server{Address: addr}})
+
+	const clients = 5
+	responses := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			SendArchive.Inject(w, httptest.NewRequest("GET", "/archive.tar.gz", nil), sendData)
+		}(responses[i])
+	}
+
+	// Wait for all clients to be following the same generation
+	require.Eventually(t, func() bool {
+		archiveGenerations.Lock()
+		defer archiveGenerations.Unlock()
+		gen, ok := archiveGenerations.m[archivePath]
+		return ok && gen.readers == clients
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, w := range responses {
+		require.Equal(t, 200, w.Code)
+		require.Equal(t, archiveData, w.Body.Bytes())
+	}
+
+	cached, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+	require.Equal(t, archiveData, cached)
+
+	files, err := ioutil.ReadDir(filepath.Dir(archivePath))
+	require.NoError(t, err)
+	require.Len(t, files, 1, "tempfile has been removed")
+}
+
+func TestSendArchiveFailsBeforeFirstByte(t *testing.T) {
+	addr, cleanUp := startRepositoryServer(t, &repositoryServiceServer{
+		GetArchiveFunc: func(req *gitalypb.GetArchiveRequest, stream gitalypb.RepositoryService_GetArchiveServer) error {
+			return fmt.Errorf("broken")
+		},
+	})
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	archivePath := filepath.Join(dir, "archive.zip")
+	sendData := archiveSendData(t, archiveParams{ArchivePath: archivePath, GitalyServer: gitaly.Server{Address: addr}})
+
+	w := httptest.NewRecorder()
+	SendArchive.Inject(w, httptest.NewRequest("GET", "/archive.zip", nil), sendData)
+
+	require.Equal(t, 500, w.Code)
+	require.NoFileExists(t, archivePath)
+
+	archiveGenerations.Lock()
+	defer archiveGenerations.Unlock()
+	require.Empty(t, archiveGenerations.m)
+}
+
+func archiveSendData(t *testing.T, params archiveParams) string {
+	jsonParams, err := json.Marshal(params)
+	require.NoError(t, err)
+	return "git-archive:" + base64.URLEncoding.EncodeToString(jsonParams)
+}
+
+func startRepositoryServer(t testing.TB, s gitalypb.RepositoryServiceServer) (string, func()) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+
+	socket := filepath.Join(tmp, "gitaly.sock")
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	srv := grpc.NewServer()
+	gitalypb.RegisterRepositoryServiceServer(srv, s)
+	go srv.Serve(ln)
+
+	return fmt.Sprintf("%s://%s", ln.Addr().Network(), ln.Addr().String()), func() {
+		srv.GracefulStop()
+		os.RemoveAll(tmp)
+	}
+}
@@ -1,13 +1,19 @@
 package git
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 )
 
@@ -15,6 +21,10 @@ type blob struct{ senddata.Prefix }
 type blobParams struct {
 	GitalyServer   gitaly.Server
 	GetBlobRequest gitalypb.GetBlobRequest
+	// If ResolveLfsPointers is set, blobs that are pointers to one of
+	// LfsObjects are replaced by the content of the object.
+	ResolveLfsPointers bool
+	LfsObjects         []lfs.Object
 }
 
 var SendBlob = &blob{"git-blob:"}
@@ -26,17 +36,66 @@ func (b *blob) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 		return
 	}
 
+	request := &params.GetBlobRequest
+	limit := request.Limit
+	etag := blobETag(&params)
+
+	setBlobHeaders(w)
+	if helper.IsNotModified(r, etag) {
+		helper.WriteNotModified(w, etag)
+		return
+	}
+
+	// Don't make Gitaly send more of the blob than the requested range
+	// needs. We must see the whole blob to recognize LFS pointers though.
+	rng := parseByteRange(r, etag)
+	if end := rng.end(); end >= 0 {
+		if params.ResolveLfsPointers && end < lfs.MaxPointerSize {
+			end = lfs.MaxPointerSize
+		}
+		if limit < 0 || end < limit {
+			request.Limit = end
+		}
+	}
+
 	ctx, blobClient, err := gitaly.NewBlobClient(r.Context(), params.GitalyServer)
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("blob.GetBlob: %v", err))
 		return
 	}
 
-	setBlobHeaders(w)
-	if err := blobClient.SendBlob(ctx, w, &params.GetBlobRequest); err != nil {
+	size, content, err := blobClient.BlobReader(ctx, request)
+	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("blob.GetBlob: %v", err))
 		return
 	}
+
+	truncated := limit >= 0 && limit < size
+	if truncated {
+		size = limit
+	}
+
+	if params.ResolveLfsPointers && !truncated && size <= lfs.MaxPointerSize {
+		data, err := ioutil.ReadAll(io.LimitReader(content, size))
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("blob.GetBlob: read blob: %v", err))
+			return
+		}
+
+		if object := openLfsObject(ctx, request.Oid, data, lfsObjectIndex(params.LfsObjects)); object != nil {
+			defer object.Close()
+			size, content = object.size, object.ReadCloser
+		} else {
+			// The ETag stands for the LFS object, which may become
+			// available later on.
+			etag = ""
+			content = bytes.NewReader(data)
+		}
+	}
+
+	if err := serveBlob(w, rng, etag, size, content); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("blob.GetBlob: %v", err)})
+	}
 }
 
 func setBlobHeaders(w http.ResponseWriter) {
@@ -44,4 +103,150 @@ func setBlobHeaders(w http.ResponseWriter) {
 	// present because it implies user-specific data, which is not the case
 	// for blobs.
 	w.Header().Del("Set-Cookie")
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+// blobETag identifies the blob content by its object ID. Blobs never change
+// but the same blob can be served truncated or as an LFS object.
+func blobETag(params *blobParams) string {
+	etag := params.GetBlobRequest.Oid
+	if etag == "" {
+		return ""
+	}
+
+	if limit := params.GetBlobRequest.Limit; limit >= 0 {
+		etag += "-" + strconv.FormatInt(limit, 10)
+	}
+	if params.ResolveLfsPointers {
+		etag += "-lfs"
+	}
+
+	return `"` + etag + `"`
+}
+
+func serveBlob(w http.ResponseWriter, rng *byteRange, etag string, size int64, content io.Reader) error {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	start, length := int64(0), size
+	status := http.StatusOK
+	if rng != nil {
+		var ok bool
+		if start, length, ok = rng.resolve(size); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if err := skip(content, start); err != nil {
+		return fmt.Errorf("skip to range start: %v", err)
+	}
+
+	if _, err := io.CopyN(w, content, length); err != nil {
+		return fmt.Errorf("copy blob data: %v", err)
+	}
+
+	return nil
+}
+
+func skip(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekStart)
+		return err
+	}
+
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	return err
+}
+
+// byteRange is a single range of a Range request header. A negative first
+// means the last 'last' bytes, a negative last means up to the end.
+type byteRange struct {
+	first, last int64
+}
+
+// parseByteRange returns nil unless the request asks for exactly one range
+// of the representation identified by etag. We serve the whole blob in
+// that case.
+func parseByteRange(r *http.Request, etag string) *byteRange {
+	header := r.Header.Get("Range")
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return nil
+	}
+
+	// If-Range may also hold a date, which we can't validate
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		return nil
+	}
+
+	spec := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-", 2)
+	if len(spec) != 2 {
+		return nil
+	}
+
+	rng := &byteRange{first: -1, last: -1}
+	var err error
+	if spec[0] != "" {
+		if rng.first, err = strconv.ParseInt(spec[0], 10, 64); err != nil || rng.first < 0 {
+			return nil
+		}
+	}
+	if spec[1] != "" {
+		if rng.last, err = strconv.ParseInt(spec[1], 10, 64); err != nil || rng.last < 0 {
+			return nil
+		}
+	}
+
+	switch {
+	case spec[0] == "" && spec[1] == "":
+		return nil
+	case rng.first >= 0 && rng.last >= 0 && rng.last < rng.first:
+		return nil
+	}
+
+	return rng
+}
+
+// end returns the number of leading bytes of the blob the range needs, or
+// -1 if that depends on the size of the blob.
+func (rng *byteRange) end() int64 {
+	if rng == nil || rng.first < 0 || rng.last < 0 {
+		return -1
+	}
+	return rng.last + 1
+}
+
+func (rng *byteRange) resolve(size int64) (start, length int64, ok bool) {
+	if rng.first < 0 {
+		if rng.last == 0 || size == 0 {
+			return 0, 0, false
+		}
+		if rng.last > size {
+			return 0, size, true
+		}
+		return size - rng.last, rng.last, true
+	}
+
+	if rng.first >= size {
+		return 0, 0, false
+	}
+
+	last := rng.last
+	if last < 0 || last >= size {
+		last = size - 1
+	}
+
+	return rng.first, last - rng.first + 1, true
 }
@@ -1,12 +1,26 @@
 package git
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http/httptest"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
 )
 
+const testBlobOid = "54fcc214b94e78d7a41a9a8fe6d87a5e59500e51"
+
 func TestSetBlobHeaders(t *testing.T) {
 	w := httptest.NewRecorder()
 	w.Header().Set("Set-Cookie", "gitlab_cookie=123456")
@@ -15,3 +29,210 @@ func TestSetBlobHeaders(t *testing.T) {
 
 	require.Empty(t, w.Header().Get("Set-Cookie"), "remove Set-Cookie")
 }
+
+func TestSendBlobETag(t *testing.T) {
+	srv := &blobServiceServer{data: []byte("hello world")}
+	sendData, cleanUp := blobSendData(t, srv, blobParams{GetBlobRequest: gitalypb.GetBlobRequest{Oid: testBlobOid, Limit: -1}})
+	defer cleanUp()
+
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, httptest.NewRequest("GET", "/blob", nil), sendData)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "hello world", w.Body.String())
+	require.Equal(t, "11", w.Header().Get("Content-Length"))
+	require.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	etag := w.Header().Get("ETag")
+	require.Equal(t, `"`+testBlobOid+`"`, etag)
+
+	r := httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+	require.Equal(t, 304, w.Code)
+	require.Empty(t, w.Body.String())
+	require.Equal(t, 1, srv.calls, "no Gitaly call for revalidation")
+}
+
+func TestSendBlobRange(t *testing.T) {
+	data := []byte("0123456789")
+
+	testCases := []struct {
+		desc         string
+		rangeHeader  string
+		ifRange      string
+		code         int
+		body         string
+		contentRange string
+		limit        int64
+	}{
+		{desc: "no range", code: 200, body: "0123456789", limit: -1},
+		{desc: "closed", rangeHeader: "bytes=2-4", code: 206, body: "234", contentRange: "bytes 2-4/10", limit: 5},
+		{desc: "beyond the end", rangeHeader: "bytes=8-20", code: 206, body: "89", contentRange: "bytes 8-9/10", limit: 21},
+		{desc: "open ended", rangeHeader: "bytes=7-", code: 206, body: "789", contentRange: "bytes 7-9/10", limit: -1},
+		{desc: "suffix", rangeHeader: "bytes=-3", code: 206, body: "789", contentRange: "bytes 7-9/10", limit: -1},
+		{desc: "unsatisfiable", rangeHeader: "bytes=10-", code: 416, contentRange: "bytes */10", limit: -1},
+		{desc: "multiple ranges", rangeHeader: "bytes=0-1,3-4", code: 200, body: "0123456789", limit: -1},
+		{desc: "invalid", rangeHeader: "bytes=4-2", code: 200, body: "0123456789", limit: -1},
+		{desc: "matching If-Range", rangeHeader: "bytes=2-4", ifRange: `"` + testBlobOid + `"`, code: 206, body: "234", contentRange: "bytes 2-4/10", limit: 5},
+		{desc: "stale If-Range", rangeHeader: "bytes=2-4", ifRange: `"other"`, code: 200, body: "0123456789", limit: -1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv := &blobServiceServer{data: data}
+			sendData, cleanUp := blobSendData(t, srv, blobParams{GetBlobRequest: gitalypb.GetBlobRequest{Oid: testBlobOid, Limit: -1}})
+			defer cleanUp()
+
+			r := httptest.NewRequest("GET", "/blob", nil)
+			if tc.rangeHeader != "" {
+				r.Header.Set("Range", tc.rangeHeader)
+			}
+			if tc.ifRange != "" {
+				r.Header.Set("If-Range", tc.ifRange)
+			}
+
+			w := httptest.NewRecorder()
+			SendBlob.Inject(w, r, sendData)
+
+			require.Equal(t, tc.code, w.Code)
+			require.Equal(t, tc.body, w.Body.String())
+			require.Equal(t, tc.contentRange, w.Header().Get("Content-Range"))
+			require.Equal(t, tc.limit, srv.limit, "limit sent to Gitaly")
+		})
+	}
+}
+
+func TestSendBlobRangeWithLimit(t *testing.T) {
+	srv := &blobServiceServer{data: []byte("0123456789")}
+	sendData, cleanUp := blobSendData(t, srv, blobParams{GetBlobRequest: gitalypb.GetBlobRequest{Oid: testBlobOid, Limit: 6}})
+	defer cleanUp()
+
+	r := httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("Range", "bytes=4-8")
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, r, sendData)
+
+	require.Equal(t, 206, w.Code)
+	require.Equal(t, "45", w.Body.String())
+	require.Equal(t, "bytes 4-5/6", w.Header().Get("Content-Range"))
+	require.Equal(t, `"`+testBlobOid+`-6"`, w.Header().Get("ETag"))
+	require.Equal(t, int64(6), srv.limit)
+}
+
+func TestSendBlobResolvesLfsPointers(t *testing.T) {
+	objectContent := bytes.Repeat([]byte("large file "), 1000)
+	objectPath := writeTempFile(t, objectContent)
+	defer os.Remove(objectPath)
+	objects := []lfs.Object{{Oid: testLfsOid, Size: int64(len(objectContent)), Path: objectPath}}
+
+	testCases := []struct {
+		desc        string
+		pointer     string
+		rangeHeader string
+		code        int
+		body        string
+		etag        string
+	}{
+		{desc: "object", pointer: lfsPointer(testLfsOid, len(objectContent)), code: 200, body: string(objectContent), etag: `"` + testBlobOid + `-lfs"`},
+		{desc: "object range", pointer: lfsPointer(testLfsOid, len(objectContent)), rangeHeader: "bytes=11-21", code: 206, body: string(objectContent[11:22]), etag: `"` + testBlobOid + `-lfs"`},
+		{desc: "unknown object", pointer: lfsPointer(testUnknownLfsOid, 5), code: 200, body: lfsPointer(testUnknownLfsOid, 5)},
+		{desc: "size mismatch", pointer: lfsPointer(testLfsOid, 5), code: 200, body: lfsPointer(testLfsOid, 5)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv := &blobServiceServer{data: []byte(tc.pointer)}
+			sendData, cleanUp := blobSendData(t, srv, blobParams{
+				GetBlobRequest:     gitalypb.GetBlobRequest{Oid: testBlobOid, Limit: -1},
+				ResolveLfsPointers: true,
+				LfsObjects:         objects,
+			})
+			defer cleanUp()
+
+			r := httptest.NewRequest("GET", "/blob", nil)
+			if tc.rangeHeader != "" {
+				r.Header.Set("Range", tc.rangeHeader)
+			}
+
+			w := httptest.NewRecorder()
+			SendBlob.Inject(w, r, sendData)
+
+			require.Equal(t, tc.code, w.Code)
+			require.Equal(t, tc.body, w.Body.String())
+			require.Equal(t, tc.etag, w.Header().Get("ETag"))
+		})
+	}
+}
+
+func TestSendBlobKeepsLfsPointersByDefault(t *testing.T) {
+	pointer := lfsPointer(testLfsOid, 11000)
+	objects := []lfs.Object{{Oid: testLfsOid, Size: 11000, Path: "/does/not/matter"}}
+	srv := &blobServiceServer{data: []byte(pointer)}
+	sendData, cleanUp := blobSendData(t, srv, blobParams{
+		GetBlobRequest: gitalypb.GetBlobRequest{Oid: testBlobOid, Limit: -1},
+		LfsObjects:     objects,
+	})
+	defer cleanUp()
+
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, httptest.NewRequest("GET", "/blob", nil), sendData)
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, pointer, w.Body.String())
+}
+
+type blobServiceServer struct {
+	gitalypb.UnimplementedBlobServiceServer
+	data  []byte
+	calls int
+	limit int64
+}
+
+func (srv *blobServiceServer) GetBlob(req *gitalypb.GetBlobRequest, stream gitalypb.BlobService_GetBlobServer) error {
+	srv.calls++
+	srv.limit = req.Limit
+
+	data := srv.data
+	if req.Limit >= 0 && req.Limit < int64(len(data)) {
+		data = data[:req.Limit]
+	}
+
+	// Send small chunks to exercise skipping across messages
+	resp := &gitalypb.GetBlobResponse{Oid: req.Oid, Size: int64(len(srv.data))}
+	for {
+		n := 3
+		if n > len(data) {
+			n = len(data)
+		}
+		resp.Data = data[:n]
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		resp = &gitalypb.GetBlobResponse{}
+
+		data = data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+func blobSendData(t *testing.T, srv *blobServiceServer, params blobParams) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	gitalypb.RegisterBlobServiceServer(grpcServer, srv)
+	go grpcServer.Serve(ln)
+
+	params.GitalyServer = gitaly.Server{Address: fmt.Sprintf("tcp://%s", ln.Addr().String())}
+	jsonParams, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	return "git-blob:" + base64.URLEncoding.EncodeToString(jsonParams), func() {
+		grpcServer.Stop()
+		// A later test may get the same port, and must not get our cached
+		// connection to the server we just stopped
+		gitaly.CloseConnections()
+	}
+}
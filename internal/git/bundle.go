@@ -0,0 +1,148 @@
+/*
+In this file we handle 'git bundle' downloads, which clients use to
+bootstrap clones of big repositories
+*/
+
+package git
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+const defaultBundleFilename = "repository.bundle"
+
+type bundle struct {
+	senddata.Prefix
+	cache *FileCache
+}
+type bundleParams struct {
+	GitalyServer        gitaly.Server
+	CreateBundleRequest string
+	// BundlePath is where the bundle is cached. Bundles are not cached if
+	// it is empty.
+	BundlePath     string
+	BundleFilename string
+}
+
+var (
+	SendBundle     = &bundle{Prefix: "git-bundle:"}
+	gitBundleCache = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_bundle_cache",
+			Help: "Cache hits and misses for 'git bundle' streaming",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gitBundleCache)
+}
+
+// NewSendBundle returns the 'git bundle' injecter that registers cache hits
+// with the given cache manager, which may be nil.
+func NewSendBundle(cache *FileCache) senddata.Injecter {
+	return &bundle{Prefix: SendBundle.Prefix, cache: cache}
+}
+
+func (b *bundle) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params bundleParams
+	if err := b.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: unpack sendData: %v", err))
+		return
+	}
+
+	request := &gitalypb.CreateBundleRequest{}
+	if err := gitaly.UnmarshalJSON(params.CreateBundleRequest, request); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: unmarshal CreateBundleRequest: %v", err))
+		return
+	}
+
+	filename := params.BundleFilename
+	if filename == "" && params.BundlePath != "" {
+		filename = path.Base(params.BundlePath)
+	}
+	if filename == "" {
+		filename = defaultBundleFilename
+	}
+
+	if params.BundlePath != "" {
+		cachedBundle, err := os.Open(params.BundlePath)
+		if err == nil {
+			defer cachedBundle.Close()
+			gitBundleCache.WithLabelValues("hit").Inc()
+			b.cache.touch(params.BundlePath)
+			setBundleHeaders(w, filename)
+			// Only cached bundles have a known size and can be resumed
+			http.ServeContent(w, r, "", time.Unix(0, 0), cachedBundle)
+			return
+		}
+	}
+
+	gitBundleCache.WithLabelValues("miss").Inc()
+
+	ctx, c, err := gitaly.NewRepositoryClient(r.Context(), params.GitalyServer)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: gitaly.NewRepositoryClient: %v", err))
+		return
+	}
+
+	reader, err := c.BundleReader(ctx, request)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: client.BundleReader: %v", err))
+		return
+	}
+
+	var tempFile *os.File
+	if params.BundlePath != "" {
+		// The tempfile lives next to the cached bundle so that we can
+		// finalize it with an atomic link(2)
+		tempFile, err = prepareArchiveTempfile(path.Dir(params.BundlePath), filename)
+		if err != nil {
+			log.WithContextFields(r.Context(), log.Fields{"path": params.BundlePath}).WithError(err).Error("SendBundle: not caching bundle")
+		} else {
+			defer os.Remove(tempFile.Name())
+			defer tempFile.Close()
+			reader = io.TeeReader(reader, tempFile)
+		}
+	}
+
+	w.Header().Del("Content-Length")
+	setBundleHeaders(w, filename)
+	w.WriteHeader(http.StatusOK) // Errors aren't detectable beyond this point
+
+	if _, err := io.Copy(w, reader); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendBundle: copy 'git bundle' output: %v", err)})
+		return
+	}
+
+	if tempFile != nil {
+		if err := finalizeCachedArchive(tempFile, params.BundlePath); err != nil {
+			log.WithContextFields(r.Context(), log.Fields{"path": params.BundlePath}).WithError(err).Error("SendBundle: finalize cached bundle")
+		}
+	}
+}
+
+func setBundleHeaders(w http.ResponseWriter, filename string) {
+	setAttachmentFilename(w, filename)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	// Caching proxies usually don't cache responses with Set-Cookie header
+	// present because it implies user-specific data, which is not the case
+	// for bundles.
+	w.Header().Del("Set-Cookie")
+}
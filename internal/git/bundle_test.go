@@ -0,0 +1,123 @@
+package git
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+)
+
+func TestSendBundle(t *testing.T) {
+	bundleData := bytes.Repeat([]byte("bundle data "), 1000)
+	addr, calls, cleanUp := startBundleServer(t, bundleData, nil)
+	defer cleanUp()
+
+	sendData := bundleSendData(t, bundleParams{GitalyServer: gitaly.Server{Address: addr}})
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Set-Cookie", "gitlab_cookie=123456")
+	SendBundle.Inject(w, httptest.NewRequest("GET", "/bundle", nil), sendData)
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, bundleData, w.Body.Bytes())
+	require.Equal(t, `attachment; filename="repository.bundle"`, w.Header().Get("Content-Disposition"))
+	require.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	require.Empty(t, w.Header().Get("Set-Cookie"))
+	require.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestSendBundleCachesAndResumes(t *testing.T) {
+	bundleData := bytes.Repeat([]byte("bundle data "), 1000)
+	addr, calls, cleanUp := startBundleServer(t, bundleData, nil)
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "bundle-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bundlePath := filepath.Join(dir, "project-1", "abc", "project.bundle")
+	sendData := bundleSendData(t, bundleParams{GitalyServer: gitaly.Server{Address: addr}, BundlePath: bundlePath})
+
+	w := httptest.NewRecorder()
+	SendBundle.Inject(w, httptest.NewRequest("GET", "/bundle", nil), sendData)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, bundleData, w.Body.Bytes())
+	require.Equal(t, `attachment; filename="project.bundle"`, w.Header().Get("Content-Disposition"))
+
+	cached, err := ioutil.ReadFile(bundlePath)
+	require.NoError(t, err)
+	require.Equal(t, bundleData, cached)
+
+	r := httptest.NewRequest("GET", "/bundle", nil)
+	r.Header.Set("Range", "bytes=100-")
+	w = httptest.NewRecorder()
+	SendBundle.Inject(w, r, sendData)
+
+	require.Equal(t, 206, w.Code)
+	require.Equal(t, bundleData[100:], w.Body.Bytes())
+	require.Equal(t, int32(1), atomic.LoadInt32(calls), "cache hits don't call Gitaly")
+}
+
+func TestSendBundleDoesNotCacheFailures(t *testing.T) {
+	bundleData := bytes.Repeat([]byte("bundle data "), 1000)
+	addr, _, cleanUp := startBundleServer(t, bundleData, errors.New("broken repository"))
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "bundle-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bundlePath := filepath.Join(dir, "project.bundle")
+	sendData := bundleSendData(t, bundleParams{GitalyServer: gitaly.Server{Address: addr}, BundlePath: bundlePath})
+
+	w := httptest.NewRecorder()
+	SendBundle.Inject(w, httptest.NewRequest("GET", "/bundle", nil), sendData)
+
+	require.NoFileExists(t, bundlePath)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files, "tempfiles are removed")
+}
+
+func TestSetBundleHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	setBundleHeaders(w, `my "monorepo" ä.bundle`)
+
+	require.Equal(t, `attachment; filename="my \"monorepo\" ä.bundle"`, w.Header().Get("Content-Disposition"))
+}
+
+func startBundleServer(t *testing.T, bundleData []byte, finalErr error) (string, *int32, func()) {
+	var calls int32
+	addr, cleanUp := startRepositoryServer(t, &repositoryServiceServer{
+		CreateBundleFunc: func(req *gitalypb.CreateBundleRequest, stream gitalypb.RepositoryService_CreateBundleServer) error {
+			atomic.AddInt32(&calls, 1)
+			for i := 0; i < len(bundleData); i += 1000 {
+				if err := stream.Send(&gitalypb.CreateBundleResponse{Data: bundleData[i : i+1000]}); err != nil {
+					return err
+				}
+			}
+			return finalErr
+		},
+	})
+
+	return addr, &calls, cleanUp
+}
+
+func bundleSendData(t *testing.T, params bundleParams) string {
+	params.CreateBundleRequest = `{"repository":{"storageName":"default","relativePath":"foo/bar.git"}}`
+	jsonParams, err := json.Marshal(params)
+	require.NoError(t, err)
+	return "git-bundle:" + base64.URLEncoding.EncodeToString(jsonParams)
+}
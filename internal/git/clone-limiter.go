@@ -0,0 +1,235 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const defaultCloneQueueTimeout = 10 * time.Second
+
+var (
+	errCloneLimitQueueFull = errors.New("too many concurrent requests")
+	errCloneLimitTimedOut  = errors.New("timed out waiting for a free slot")
+
+	cloneLimiterRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_clone_limiter_requests_total",
+			Help: "How many git-upload-pack requests the per-user and per-repository limits have seen, by limit and result",
+		},
+		[]string{"limit", "result"},
+	)
+
+	cloneLimiterBusy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_clone_limiter_busy",
+			Help: "How many git-upload-pack requests hold a slot of the per-user and per-repository limits",
+		},
+		[]string{"limit"},
+	)
+
+	cloneLimiterWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_clone_limiter_waiting",
+			Help: "How many git-upload-pack requests wait for a slot of the per-user and per-repository limits",
+		},
+		[]string{"limit"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cloneLimiterRequests)
+	prometheus.MustRegister(cloneLimiterBusy)
+	prometheus.MustRegister(cloneLimiterWaiting)
+}
+
+// CloneLimiter limits the concurrent git-upload-pack requests, for both
+// info/refs and the POST, of each user and of each repository.
+type CloneLimiter struct {
+	users        *keyedLimit
+	repositories *keyedLimit
+}
+
+func NewCloneLimiter(cfg config.CloneLimitsConfig) *CloneLimiter {
+	timeout := defaultCloneQueueTimeout
+	if cfg.QueueTimeout != nil {
+		timeout = cfg.QueueTimeout.Duration
+	}
+
+	return &CloneLimiter{
+		users:        newKeyedLimit("user", cfg.PerUser, cfg.QueueLimit, timeout),
+		repositories: newKeyedLimit("repository", cfg.PerRepository, cfg.QueueLimit, timeout),
+	}
+}
+
+// acquire waits for a slot of both the user and the repository of the
+// request. If it returns a nil error, release must be called once the
+// request is done.
+func (l *CloneLimiter) acquire(ctx context.Context, a *api.Response) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	releaseUser, err := l.users.acquire(ctx, a.GL_ID)
+	if err != nil {
+		return nil, err
+	}
+
+	releaseRepository, err := l.repositories.acquire(ctx, a.GL_REPOSITORY)
+	if err != nil {
+		releaseUser()
+		return nil, err
+	}
+
+	return func() {
+		releaseRepository()
+		releaseUser()
+	}, nil
+}
+
+// limitUploadPack acquires slots for git-upload-pack requests. If the
+// request is over the limit it tells the Git client why, and returns nil.
+func (l *CloneLimiter) limitUploadPack(w http.ResponseWriter, r *http.Request, a *api.Response) (release func()) {
+	if getService(r) != "git-upload-pack" {
+		return func() {}
+	}
+
+	release, err := l.acquire(r.Context(), a)
+	if err == nil {
+		return release
+	}
+
+	log.WithContextFields(r.Context(), log.Fields{
+		"gl_id":         a.GL_ID,
+		"gl_repository": a.GL_REPOSITORY,
+	}).WithError(err).Info("git-upload-pack request over the clone limits")
+
+	if r.Method == "POST" {
+		writePostRPCHeader(w, "git-upload-pack")
+	}
+
+	message := "too many concurrent clones and fetches, please try again later"
+	if err == errCloneLimitTimedOut {
+		message = "timed out waiting for a free slot, please try again later"
+	}
+	if err := writeUploadPackError(w, message); err != nil {
+		helper.LogError(r, err)
+	}
+
+	return nil
+}
+
+// keyedLimit is a semaphore with a wait queue for each key
+type keyedLimit struct {
+	name       string
+	limit      uint
+	queueLimit uint
+	timeout    time.Duration
+
+	sync.Mutex
+	slots map[string]*keySlots
+}
+
+type keySlots struct {
+	busy chan struct{}
+	// users counts the requests that hold or wait for a slot
+	users uint
+}
+
+func newKeyedLimit(name string, limit, queueLimit uint, timeout time.Duration) *keyedLimit {
+	return &keyedLimit{
+		name:       name,
+		limit:      limit,
+		queueLimit: queueLimit,
+		timeout:    timeout,
+		slots:      make(map[string]*keySlots),
+	}
+}
+
+func (l *keyedLimit) acquire(ctx context.Context, key string) (release func(), err error) {
+	if l.limit == 0 || key == "" {
+		return func() {}, nil
+	}
+
+	s, ok := l.join(key)
+	if !ok {
+		cloneLimiterRequests.WithLabelValues(l.name, "too_many_requests").Inc()
+		return nil, errCloneLimitQueueFull
+	}
+
+	release = func() {
+		<-s.busy
+		cloneLimiterBusy.WithLabelValues(l.name).Dec()
+		l.leave(key, s)
+	}
+
+	select {
+	case s.busy <- struct{}{}:
+		cloneLimiterBusy.WithLabelValues(l.name).Inc()
+		cloneLimiterRequests.WithLabelValues(l.name, "admitted").Inc()
+		return release, nil
+	default:
+	}
+
+	cloneLimiterWaiting.WithLabelValues(l.name).Inc()
+	defer cloneLimiterWaiting.WithLabelValues(l.name).Dec()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case s.busy <- struct{}{}:
+		cloneLimiterBusy.WithLabelValues(l.name).Inc()
+		cloneLimiterRequests.WithLabelValues(l.name, "queued").Inc()
+		return release, nil
+	case <-timer.C:
+		cloneLimiterRequests.WithLabelValues(l.name, "timed_out").Inc()
+		err = errCloneLimitTimedOut
+	case <-ctx.Done():
+		cloneLimiterRequests.WithLabelValues(l.name, "canceled").Inc()
+		err = ctx.Err()
+	}
+
+	l.leave(key, s)
+	return nil, err
+}
+
+// join registers a request for key, unless there are already limit plus
+// queueLimit of them.
+func (l *keyedLimit) join(key string) (*keySlots, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	s := l.slots[key]
+	if s == nil {
+		s = &keySlots{busy: make(chan struct{}, l.limit)}
+		l.slots[key] = s
+	}
+
+	if s.users >= l.limit+l.queueLimit {
+		return nil, false
+	}
+
+	s.users++
+	return s, true
+}
+
+func (l *keyedLimit) leave(key string, s *keySlots) {
+	l.Lock()
+	defer l.Unlock()
+
+	s.users--
+	if s.users == 0 {
+		delete(l.slots, key)
+	}
+}
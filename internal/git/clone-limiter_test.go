@@ -0,0 +1,137 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestKeyedLimitQueuesAndRejects(t *testing.T) {
+	l := newKeyedLimit("test", 1, 1, time.Minute)
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "user-1")
+	require.NoError(t, err)
+
+	admitted := make(chan error)
+	var releaseQueued func()
+	go func() {
+		var err error
+		releaseQueued, err = l.acquire(ctx, "user-1")
+		admitted <- err
+	}()
+
+	// The second request is queued, so a third one is rejected
+	require.Eventually(t, func() bool { return l.users("user-1") == 2 }, 5*time.Second, time.Millisecond)
+	_, err = l.acquire(ctx, "user-1")
+	require.Equal(t, errCloneLimitQueueFull, err)
+
+	// Other keys have their own slots
+	releaseOther, err := l.acquire(ctx, "user-2")
+	require.NoError(t, err)
+	releaseOther()
+
+	release()
+	select {
+	case err := <-admitted:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued request was not admitted")
+	}
+	releaseQueued()
+
+	require.Empty(t, l.slots, "unused keys are removed")
+}
+
+func TestKeyedLimitTimesOut(t *testing.T) {
+	l := newKeyedLimit("test", 1, 1, 10*time.Millisecond)
+
+	release, err := l.acquire(context.Background(), "user-1")
+	require.NoError(t, err)
+	defer release()
+
+	_, err = l.acquire(context.Background(), "user-1")
+	require.Equal(t, errCloneLimitTimedOut, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.timeout = time.Minute
+	_, err = l.acquire(ctx, "user-1")
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestKeyedLimitWithoutLimitOrKey(t *testing.T) {
+	unlimited := newKeyedLimit("test", 0, 0, time.Minute)
+	limited := newKeyedLimit("test", 1, 0, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		_, err := unlimited.acquire(context.Background(), "user-1")
+		require.NoError(t, err)
+		_, err = limited.acquire(context.Background(), "")
+		require.NoError(t, err)
+	}
+}
+
+func TestCloneLimiterNeedsBothSlots(t *testing.T) {
+	l := NewCloneLimiter(config.CloneLimitsConfig{PerUser: 2, PerRepository: 1})
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, &api.Response{GL_ID: "user-1", GL_REPOSITORY: "project-1"})
+	require.NoError(t, err)
+
+	_, err = l.acquire(ctx, &api.Response{GL_ID: "user-1", GL_REPOSITORY: "project-1"})
+	require.Equal(t, errCloneLimitQueueFull, err)
+	require.Equal(t, uint(1), l.users.users("user-1"), "the user slot is given back")
+
+	releaseOther, err := l.acquire(ctx, &api.Response{GL_ID: "user-1", GL_REPOSITORY: "project-2"})
+	require.NoError(t, err)
+
+	releaseOther()
+	release()
+}
+
+func TestCloneLimiterWritesGitErrors(t *testing.T) {
+	l := NewCloneLimiter(config.CloneLimitsConfig{PerRepository: 1})
+	a := &api.Response{GL_ID: "user-1", GL_REPOSITORY: "project-1"}
+
+	release, err := l.acquire(context.Background(), a)
+	require.NoError(t, err)
+	defer release()
+
+	message := "ERR too many concurrent clones and fetches, please try again later\n"
+	expected := fmt.Sprintf("%04x%s", len(message)+4, message)
+
+	w := httptest.NewRecorder()
+	handleGetInfoRefs(w, httptest.NewRequest("GET", "/foo.git/info/refs?service=git-upload-pack", nil), a, l)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "application/x-git-upload-pack-advertisement", w.Header().Get("Content-Type"))
+	require.Equal(t, expected, w.Body.String())
+
+	w = httptest.NewRecorder()
+	require.Nil(t, l.limitUploadPack(w, httptest.NewRequest("POST", "/foo.git/git-upload-pack", nil), a))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "application/x-git-upload-pack-result", w.Header().Get("Content-Type"))
+	require.Equal(t, expected, w.Body.String())
+
+	// Pushes are not limited
+	releasePush := l.limitUploadPack(httptest.NewRecorder(), httptest.NewRequest("POST", "/foo.git/git-receive-pack", nil), a)
+	require.NotNil(t, releasePush)
+	releasePush()
+}
+
+func (l *keyedLimit) users(key string) uint {
+	l.Lock()
+	defer l.Unlock()
+
+	if s := l.slots[key]; s != nil {
+		return s.users
+	}
+	return 0
+}
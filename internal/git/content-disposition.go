@@ -0,0 +1,16 @@
+package git
+
+import (
+	"net/http"
+	"strings"
+)
+
+// taken from mime/multipart/writer.go
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// setAttachmentFilename makes browsers download the response as filename.
+// We don't use mime.FormatMediaType because it gives up on non-ASCII
+// filenames before Go 1.17.
+func setAttachmentFilename(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Disposition", `attachment; filename="`+quoteEscaper.Replace(filename)+`"`)
+}
@@ -38,11 +38,19 @@ func (d *diff) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 		return
 	}
 
-	if err := diffClient.SendRawDiff(ctx, w, request); err != nil {
+	ew := newEncodingResponseWriter(w, r)
+	if err := diffClient.SendRawDiff(ctx, ew, request); err != nil {
 		helper.LogError(
 			r,
 			&copyError{fmt.Errorf("diff.RawDiff: request=%v, err=%v", request, err)},
 		)
 		return
 	}
+
+	if err := closeResponseEncoding(ew); err != nil {
+		helper.LogError(
+			r,
+			&copyError{fmt.Errorf("diff.RawDiff: request=%v, err=%v", request, err)},
+		)
+	}
 }
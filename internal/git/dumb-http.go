@@ -0,0 +1,358 @@
+/*
+In this file we handle the read-only Git 'dumb' HTTP protocol
+
+Gitaly does not give us the files of the repository, so we serve what they
+would contain. info/refs and HEAD are derived from the ref advertisement of
+git-upload-pack. All objects are in a single pack that git-upload-pack
+generates for the advertised refs, and which we index ourselves. Requests
+for loose objects get a 404, which makes clients look at the packs instead
+of fetching every object with a separate request.
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+var (
+	dumbHTTPPath     = regexp.MustCompile(`\.git/(HEAD|info/refs|objects/.+)\z`)
+	dumbHTTPPackPath = regexp.MustCompile(`\Aobjects/pack/(pack-[0-9a-f]{40})\.(pack|idx)\z`)
+)
+
+// DumbHTTPHandler serves the read-only 'dumb' HTTP protocol if the
+// pre-authorization response enables it. GitLab Rails authorizes these
+// requests like smart HTTP fetches.
+func DumbHTTPHandler(a *api.API, authCache *api.PreAuthorizeCache, cache *FileCache) http.Handler {
+	return repoPreAuthorizeHandler(a, authCache, func(w http.ResponseWriter, r *http.Request, ar *api.Response) {
+		handleDumbHTTP(w, r, ar, cache)
+	})
+}
+
+// NewDumbHTTPCache starts the janitor for the directory that holds the packs
+// we generate for the 'dumb' HTTP protocol. It returns nil if the cache
+// manager is disabled. Clients fetch the pack and its index with separate
+// requests, so we don't serve the 'dumb' HTTP protocol without it.
+func NewDumbHTTPCache(cfg config.FileCacheConfig) (*FileCache, error) {
+	return newFileCache("DumbHTTPCache", cfg, dumbHTTPCacheMetrics)
+}
+
+func handleDumbHTTP(rw http.ResponseWriter, r *http.Request, a *api.Response, cache *FileCache) {
+	w := NewHttpResponseWriter(rw)
+	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
+	defer w.Log(r, 0)
+
+	var file string
+	if m := dumbHTTPPath.FindStringSubmatch(r.URL.Path); m != nil {
+		file = m[1]
+	}
+
+	if !a.DumbHTTP || cache == nil || file == "" || (strings.HasPrefix(file, "objects/") && file != "objects/info/packs" && !dumbHTTPPackPath.MatchString(file)) {
+		http.Error(w, "Not Found", 404)
+		return
+	}
+
+	refs, err := getDumbHTTPRefs(r.Context(), a)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("handleDumbHTTP: %v", err))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	switch file {
+	case "info/refs":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(refs.infoRefs)
+	case "HEAD":
+		if refs.head == "" {
+			http.Error(w, "Not Found", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, refs.head)
+	case "objects/info/packs":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(refs.wants) > 0 {
+			fmt.Fprintf(w, "P %s.pack\n", refs.packName())
+		}
+		io.WriteString(w, "\n")
+	default:
+		m := dumbHTTPPackPath.FindStringSubmatch(file)
+		// The refs have changed if the name doesn't match. The client will
+		// see that when it fetches info/refs again.
+		if len(refs.wants) == 0 || m[1] != refs.packName() {
+			http.Error(w, "Not Found", 404)
+			return
+		}
+
+		packBase, err := getDumbHTTPPack(r.Context(), a, cache, refs)
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("handleDumbHTTP: %v", err))
+			return
+		}
+
+		f, err := os.Open(packBase + "." + m[2])
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("handleDumbHTTP: %v", err))
+			return
+		}
+		defer f.Close()
+
+		if m[2] == "pack" {
+			w.Header().Set("Content-Type", "application/x-git-packed-objects")
+		} else {
+			w.Header().Set("Content-Type", "application/x-git-packed-objects-toc")
+		}
+		http.ServeContent(w, r, "", time.Time{}, f)
+	}
+}
+
+type dumbHTTPRefs struct {
+	// infoRefs is the content of info/refs
+	infoRefs []byte
+	// head is the content of HEAD, or empty if HEAD is not advertised
+	head string
+	// wants are the unique object IDs of the refs
+	wants []string
+}
+
+// packName identifies the pack of all objects reachable from the refs
+func (refs *dumbHTTPRefs) packName() string {
+	sum := sha1.Sum(refs.infoRefs)
+	return "pack-" + hex.EncodeToString(sum[:])
+}
+
+func getDumbHTTPRefs(ctx context.Context, a *api.Response) (*dumbHTTPRefs, error) {
+	ctx, smarthttp, err := gitaly.NewSmartHTTPClient(ctx, a.GitalyServer)
+	if err != nil {
+		return nil, err
+	}
+
+	advertisement, err := smarthttp.InfoRefsResponseReader(ctx, &a.Repository, "git-upload-pack", gitConfigOptions(a), "")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDumbHTTPRefs(advertisement)
+}
+
+// parseDumbHTTPRefs turns the ref advertisement of git-upload-pack into the
+// content of info/refs and HEAD, as 'git update-server-info' would write
+// them.
+func parseDumbHTTPRefs(advertisement io.Reader) (*dumbHTTPRefs, error) {
+	refs := &dumbHTTPRefs{}
+	var infoRefs bytes.Buffer
+	var headOid string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(advertisement)
+	scanner.Buffer(make([]byte, 0, 64*1024), 65520)
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\n")
+		if line == "" || strings.HasPrefix(line, "# service=") {
+			continue
+		}
+
+		line, capabilities := splitCapabilities(line)
+		for _, c := range strings.Fields(capabilities) {
+			if strings.HasPrefix(c, "symref=HEAD:") {
+				refs.head = "ref: " + strings.TrimPrefix(c, "symref=HEAD:") + "\n"
+			}
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("parse ref advertisement: invalid line %q", line)
+		}
+		oid, name := fields[0], fields[1]
+
+		switch {
+		case name == "capabilities^{}":
+			// Empty repository
+		case name == "HEAD":
+			headOid = oid
+		default:
+			fmt.Fprintf(&infoRefs, "%s\t%s\n", oid, name)
+			if !strings.HasSuffix(name, "^{}") && !seen[oid] {
+				seen[oid] = true
+				refs.wants = append(refs.wants, oid)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("parse ref advertisement: %v", err)
+	}
+
+	if refs.head == "" && headOid != "" {
+		// Detached HEAD
+		refs.head = headOid + "\n"
+	}
+	refs.infoRefs = infoRefs.Bytes()
+
+	return refs, nil
+}
+
+func splitCapabilities(line string) (string, string) {
+	if i := strings.IndexByte(line, 0); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
+
+var dumbHTTPPackLocks = struct {
+	sync.Mutex
+	m map[string]*dumbHTTPPackLock
+}{m: make(map[string]*dumbHTTPPackLock)}
+
+type dumbHTTPPackLock struct {
+	sync.Mutex
+	// users is protected by dumbHTTPPackLocks
+	users int
+}
+
+func lockDumbHTTPPack(packBase string) (unlock func()) {
+	dumbHTTPPackLocks.Lock()
+	l, ok := dumbHTTPPackLocks.m[packBase]
+	if !ok {
+		l = &dumbHTTPPackLock{}
+		dumbHTTPPackLocks.m[packBase] = l
+	}
+	l.users++
+	dumbHTTPPackLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		dumbHTTPPackLocks.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(dumbHTTPPackLocks.m, packBase)
+		}
+		dumbHTTPPackLocks.Unlock()
+	}
+}
+
+// getDumbHTTPPack returns the path without extension of the cached pack and
+// index for refs, generating them if needed.
+func getDumbHTTPPack(ctx context.Context, a *api.Response, cache *FileCache, refs *dumbHTTPRefs) (string, error) {
+	repoKey := sha256.Sum256([]byte(a.Repository.StorageName + "\x00" + a.Repository.RelativePath))
+	dir := filepath.Join(cache.dir, hex.EncodeToString(repoKey[:]))
+	packBase := filepath.Join(dir, refs.packName())
+
+	unlock := lockDumbHTTPPack(packBase)
+	defer unlock()
+
+	_, packErr := os.Stat(packBase + ".pack")
+	_, idxErr := os.Stat(packBase + ".idx")
+	if packErr == nil && idxErr == nil {
+		// Clients fetch the index first, the pack must not expire before
+		cache.touch(packBase + ".pack")
+		cache.touch(packBase + ".idx")
+		return packBase, nil
+	}
+
+	if err := generateDumbHTTPPack(ctx, a, dir, packBase, refs); err != nil {
+		return "", fmt.Errorf("generate pack: %v", err)
+	}
+
+	return packBase, nil
+}
+
+func generateDumbHTTPPack(ctx context.Context, a *api.Response, dir string, packBase string, refs *dumbHTTPRefs) error {
+	tempPack, err := prepareArchiveTempfile(dir, "pack-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPack.Name())
+	defer tempPack.Close()
+
+	ctx, smarthttp, err := gitaly.NewSmartHTTPClient(ctx, a.GitalyServer)
+	if err != nil {
+		return err
+	}
+
+	request := &bytes.Buffer{}
+	for i, oid := range refs.wants {
+		line := "want " + oid
+		if i == 0 {
+			line += " ofs-delta"
+		}
+		fmt.Fprintf(request, "%04x%s\n", len(line)+5, line)
+	}
+	io.WriteString(request, "00000009done\n")
+
+	response := &uploadPackPackWriter{w: tempPack}
+	if err := smarthttp.UploadPack(ctx, &a.Repository, request, response, gitConfigOptions(a), ""); err != nil {
+		return fmt.Errorf("smarthttp.UploadPack: %v", err)
+	}
+	if err := tempPack.Close(); err != nil {
+		return err
+	}
+
+	tempIdx := tempPack.Name() + ".idx"
+	defer os.Remove(tempIdx)
+	if err := indexPack(tempPack.Name(), tempIdx); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempIdx, packBase+".idx"); err != nil {
+		return err
+	}
+	return os.Rename(tempPack.Name(), packBase+".pack")
+}
+
+var uploadPackNak = []byte("0008NAK\n")
+
+// uploadPackPackWriter strips the NAK that precedes the pack in the
+// response of git-upload-pack to a request without haves.
+type uploadPackPackWriter struct {
+	w      io.Writer
+	header []byte
+}
+
+func (pw *uploadPackPackWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if missing := len(uploadPackNak) - len(pw.header); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		pw.header = append(pw.header, p[:missing]...)
+		p = p[missing:]
+
+		if !bytes.HasPrefix(uploadPackNak, pw.header) {
+			return 0, errors.New("unexpected git-upload-pack response")
+		}
+	}
+
+	if len(p) > 0 {
+		if _, err := pw.w.Write(p); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+)
+
+func TestDumbHTTPClone(t *testing.T) {
+	repo, cleanUpRepo := createTestRepository(t)
+	defer cleanUpRepo()
+	server, cleanUp := startDumbHTTPServer(t, repo, true)
+	defer cleanUp()
+
+	for _, path := range []string{"/foo.git/info/refs", "/foo.git/HEAD", "/foo.git/objects/info/packs"} {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, 200, resp.StatusCode, path)
+	}
+
+	dir, err := ioutil.TempDir("", "dumb-http-clone")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clone := exec.Command("git", "clone", "-q", server.URL+"/foo.git", filepath.Join(dir, "clone"))
+	clone.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	out, err := clone.CombinedOutput()
+	require.NoError(t, err, "git clone: %s", out)
+
+	require.Equal(t, runGit(t, repo, nil, "rev-parse", "HEAD", "v1.0"), runGit(t, filepath.Join(dir, "clone"), nil, "rev-parse", "HEAD", "v1.0"))
+	runGit(t, filepath.Join(dir, "clone"), nil, "fsck", "--strict")
+}
+
+func TestDumbHTTPLooseObjectsAndStalePacks(t *testing.T) {
+	repo, cleanUpRepo := createTestRepository(t)
+	defer cleanUpRepo()
+	server, cleanUp := startDumbHTTPServer(t, repo, true)
+	defer cleanUp()
+
+	head := strings.TrimSpace(string(runGit(t, repo, nil, "rev-parse", "HEAD")))
+	for _, path := range []string{
+		"/foo.git/objects/" + head[:2] + "/" + head[2:],
+		"/foo.git/objects/pack/pack-" + strings.Repeat("0", 40) + ".idx",
+		"/foo.git/objects/pack/pack-" + strings.Repeat("0", 40) + ".pack",
+	} {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, 404, resp.StatusCode, path)
+	}
+}
+
+func TestDumbHTTPDisabled(t *testing.T) {
+	repo, cleanUpRepo := createTestRepository(t)
+	defer cleanUpRepo()
+	server, cleanUp := startDumbHTTPServer(t, repo, false)
+	defer cleanUp()
+
+	resp, err := http.Get(server.URL + "/foo.git/info/refs")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 404, resp.StatusCode)
+}
+
+func TestDumbHTTPWithoutCache(t *testing.T) {
+	cache, err := NewDumbHTTPCache(config.FileCacheConfig{Enabled: false})
+	require.NoError(t, err)
+	require.Nil(t, cache)
+
+	w := httptest.NewRecorder()
+	a := &api.Response{DumbHTTP: true}
+	handleDumbHTTP(w, httptest.NewRequest("GET", "/foo.git/info/refs", nil), a, cache)
+
+	require.Equal(t, 404, w.Code)
+}
+
+func TestParseDumbHTTPRefs(t *testing.T) {
+	oid1 := strings.Repeat("1", 40)
+	oid2 := strings.Repeat("2", 40)
+	oid3 := strings.Repeat("3", 40)
+
+	testCases := []struct {
+		desc     string
+		lines    []string
+		infoRefs string
+		head     string
+		wants    []string
+	}{
+		{
+			desc: "symbolic HEAD",
+			lines: []string{
+				oid1 + " HEAD\x00multi_ack symref=HEAD:refs/heads/main agent=git/2.28\n",
+				oid1 + " refs/heads/main\n",
+				oid1 + " refs/heads/other\n",
+				oid2 + " refs/tags/v1.0\n",
+				oid3 + " refs/tags/v1.0^{}\n",
+			},
+			infoRefs: oid1 + "\trefs/heads/main\n" + oid1 + "\trefs/heads/other\n" + oid2 + "\trefs/tags/v1.0\n" + oid3 + "\trefs/tags/v1.0^{}\n",
+			head:     "ref: refs/heads/main\n",
+			wants:    []string{oid1, oid2},
+		},
+		{
+			desc: "detached HEAD",
+			lines: []string{
+				oid2 + " HEAD\x00multi_ack agent=git/2.28\n",
+				oid1 + " refs/heads/main\n",
+			},
+			infoRefs: oid1 + "\trefs/heads/main\n",
+			head:     oid2 + "\n",
+			wants:    []string{oid1},
+		},
+		{
+			desc: "empty repository",
+			lines: []string{
+				strings.Repeat("0", 40) + " capabilities^{}\x00multi_ack agent=git/2.28\n",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			advertisement := &bytes.Buffer{}
+			fmt.Fprintf(advertisement, "001e# service=git-upload-pack\n0000")
+			for _, line := range tc.lines {
+				fmt.Fprintf(advertisement, "%04x%s", len(line)+4, line)
+			}
+			advertisement.WriteString("0000")
+
+			refs, err := parseDumbHTTPRefs(advertisement)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.infoRefs, string(refs.infoRefs))
+			require.Equal(t, tc.head, refs.head)
+			require.Equal(t, tc.wants, refs.wants)
+		})
+	}
+}
+
+// dumbHTTPServiceServer answers like Gitaly by running git-upload-pack
+type dumbHTTPServiceServer struct {
+	gitalypb.UnimplementedSmartHTTPServiceServer
+	repo string
+}
+
+func (srv *dumbHTTPServiceServer) InfoRefsUploadPack(req *gitalypb.InfoRefsRequest, stream gitalypb.SmartHTTPService_InfoRefsUploadPackServer) error {
+	out, err := exec.Command("git", "upload-pack", "--stateless-rpc", "--advertise-refs", srv.repo).Output()
+	if err != nil {
+		return err
+	}
+
+	return stream.Send(&gitalypb.InfoRefsResponse{Data: append([]byte("001e# service=git-upload-pack\n0000"), out...)})
+}
+
+func (srv *dumbHTTPServiceServer) PostUploadPack(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+	request := &bytes.Buffer{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		request.Write(req.GetData())
+	}
+
+	cmd := exec.Command("git", "upload-pack", "--stateless-rpc", srv.repo)
+	cmd.Stdin = request
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	return stream.Send(&gitalypb.PostUploadPackResponse{Data: out})
+}
+
+func startDumbHTTPServer(t *testing.T, repo string, enabled bool) (*httptest.Server, func()) {
+	addr, cleanUpGitaly := startSmartHTTPServer(t, &dumbHTTPServiceServer{repo: repo})
+
+	cacheDir, err := ioutil.TempDir("", "dumb-http-cache")
+	require.NoError(t, err)
+
+	cache, err := NewDumbHTTPCache(config.FileCacheConfig{Enabled: true, Dir: cacheDir})
+	require.NoError(t, err)
+
+	a := &api.Response{
+		DumbHTTP:     enabled,
+		GitalyServer: gitaly.Server{Address: addr},
+		Repository:   gitalypb.Repository{StorageName: "default", RelativePath: "foo.git"},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleDumbHTTP(w, r, a, cache)
+	}))
+
+	return server, func() {
+		server.Close()
+		cleanUpGitaly()
+		os.RemoveAll(cacheDir)
+	}
+}
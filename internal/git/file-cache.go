@@ -0,0 +1,236 @@
+/*
+In this file we keep cache directories such as the 'git archive' cache
+within bounds.
+
+Rails tells us where to cache each archive (archiveParams.ArchivePath) or
+bundle (bundleParams.BundlePath) but nothing else ever removes those files.
+The FileCache janitor walks the cache directory and removes files that have
+not been downloaded for a while, and then the least recently used ones until
+the cache fits its size limit. Cache hits bump the modification time of the
+file so that it doubles as its access time; this also works on filesystems
+mounted with noatime.
+*/
+
+package git
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	defaultFileCacheMaxSize = 10 * 1024 * 1024 * 1024 // 10GB
+	defaultFileCacheMaxAge  = 2 * time.Hour
+
+	// Files are written to a tempfile next to their final path. Files
+	// modified this recently may still be in the middle of being written,
+	// and directories this recent may be about to receive one.
+	fileCacheGracePeriod = time.Minute
+)
+
+var fileCacheJanitorInterval = time.Minute
+
+type fileCacheMetrics struct {
+	bytes     prometheus.Gauge
+	files     prometheus.Gauge
+	evictions *prometheus.CounterVec
+}
+
+func newFileCacheMetrics(name, description string) *fileCacheMetrics {
+	return &fileCacheMetrics{
+		bytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "gitlab_workhorse_git_" + name + "_cache_bytes",
+				Help: "Total size of the files in the " + description + " cache directory",
+			},
+		),
+		files: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "gitlab_workhorse_git_" + name + "_cache_files",
+				Help: "Number of files in the " + description + " cache directory",
+			},
+		),
+		evictions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gitlab_workhorse_git_" + name + "_cache_evictions_total",
+				Help: "How many files have been removed from the " + description + " cache, partitioned by reason",
+			},
+			[]string{"reason"},
+		),
+	}
+}
+
+var (
+	archiveCacheMetrics  = newFileCacheMetrics("archive", "'git archive'")
+	bundleCacheMetrics   = newFileCacheMetrics("bundle", "'git bundle'")
+	dumbHTTPCacheMetrics = newFileCacheMetrics("dumb_http", "'dumb' HTTP pack")
+)
+
+func init() {
+	for _, m := range []*fileCacheMetrics{archiveCacheMetrics, bundleCacheMetrics, dumbHTTPCacheMetrics} {
+		prometheus.MustRegister(m.bytes)
+		prometheus.MustRegister(m.files)
+		prometheus.MustRegister(m.evictions)
+	}
+}
+
+// FileCache bounds the size and age of a cache directory.
+type FileCache struct {
+	name    string
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	metrics *fileCacheMetrics
+}
+
+type fileCacheEntry struct {
+	path     string
+	size     int64
+	accessed time.Time
+}
+
+// NewArchiveCache starts the janitor for the archive cache directory. It
+// returns nil if the cache manager is disabled.
+func NewArchiveCache(cfg config.FileCacheConfig) (*FileCache, error) {
+	return newFileCache("ArchiveCache", cfg, archiveCacheMetrics)
+}
+
+// NewBundleCache starts the janitor for the bundle cache directory. It
+// returns nil if the cache manager is disabled.
+func NewBundleCache(cfg config.FileCacheConfig) (*FileCache, error) {
+	return newFileCache("BundleCache", cfg, bundleCacheMetrics)
+}
+
+func newFileCache(name string, cfg config.FileCacheConfig, metrics *fileCacheMetrics) (*FileCache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Dir == "" {
+		return nil, errors.New(name + ": dir must be set")
+	}
+
+	c := &FileCache{
+		name:    name,
+		dir:     filepath.Clean(cfg.Dir),
+		maxSize: cfg.MaxSize,
+		maxAge:  defaultFileCacheMaxAge,
+		metrics: metrics,
+	}
+
+	if c.maxSize <= 0 {
+		c.maxSize = defaultFileCacheMaxSize
+	}
+
+	if cfg.MaxAge != nil && cfg.MaxAge.Duration > 0 {
+		c.maxAge = cfg.MaxAge.Duration
+	}
+
+	go c.janitorLoop()
+
+	return c, nil
+}
+
+// touch marks the cached file at path as recently used.
+func (c *FileCache) touch(path string) {
+	if c == nil {
+		return
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", path).Error(c.name + ": failed to touch file")
+	}
+}
+
+func (c *FileCache) janitorLoop() {
+	for range time.NewTicker(fileCacheJanitorInterval).C {
+		c.clean()
+	}
+}
+
+// clean removes expired files, then the least recently used ones until the
+// cache fits within maxSize, and finally any empty directories.
+func (c *FileCache) clean() {
+	var files []fileCacheEntry
+	var dirs []string
+	var total int64
+
+	now := time.Now()
+	err := filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed concurrently, e.g. by a request that failed
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			if path != c.dir && now.Sub(fi.ModTime()) > fileCacheGracePeriod {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		total += fi.Size()
+		files = append(files, fileCacheEntry{path: path, size: fi.Size(), accessed: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("dir", c.dir).Error(c.name + ": failed to scan cache directory")
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].accessed.Before(files[j].accessed)
+	})
+
+	remaining := len(files)
+	for _, f := range files {
+		idle := now.Sub(f.accessed)
+
+		reason := ""
+		switch {
+		case idle > c.maxAge:
+			reason = "age"
+		case total > c.maxSize && idle > fileCacheGracePeriod:
+			reason = "size"
+		default:
+			continue
+		}
+
+		// Clients that are still downloading the file keep their open file
+		// descriptor.
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", f.path).Error(c.name + ": failed to remove file")
+			continue
+		}
+
+		total -= f.size
+		remaining--
+		c.metrics.evictions.WithLabelValues(reason).Inc()
+	}
+
+	c.metrics.bytes.Set(float64(total))
+	c.metrics.files.Set(float64(remaining))
+
+	// Deepest directories first so that parents become empty in turn.
+	// Removing a directory fails harmlessly if it is not empty.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+}
@@ -0,0 +1,110 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestArchiveCacheRemovesExpiredArchives(t *testing.T) {
+	cache, cleanUp := newTestArchiveCache(t, config.FileCacheConfig{MaxAge: &config.TomlDuration{Duration: time.Hour}})
+	defer cleanUp()
+
+	expired := writeCachedArchive(t, cache.dir, "project-1/abc/expired.tar.gz", 10, 2*time.Hour)
+	fresh := writeCachedArchive(t, cache.dir, "project-1/def/fresh.tar.gz", 10, 10*time.Minute)
+	backdate(t, filepath.Dir(expired), 2*time.Hour)
+
+	cache.clean()
+
+	require.NoFileExists(t, expired)
+	require.NoDirExists(t, filepath.Dir(expired), "empty directories are removed")
+	require.FileExists(t, fresh)
+}
+
+func TestArchiveCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, cleanUp := newTestArchiveCache(t, config.FileCacheConfig{MaxSize: 25})
+	defer cleanUp()
+
+	oldest := writeCachedArchive(t, cache.dir, "project-1/a/archive.zip", 10, 30*time.Minute)
+	older := writeCachedArchive(t, cache.dir, "project-1/b/archive.zip", 10, 20*time.Minute)
+	newer := writeCachedArchive(t, cache.dir, "project-1/c/archive.zip", 10, 10*time.Minute)
+	inProgress := writeCachedArchive(t, cache.dir, "project-1/d/archive.zip123456", 10, 0)
+
+	// A cache hit makes the oldest archive the most recently used one
+	cache.touch(oldest)
+
+	cache.clean()
+
+	require.FileExists(t, oldest)
+	require.NoFileExists(t, older)
+	require.NoFileExists(t, newer)
+	require.FileExists(t, inProgress, "files that may still be written are never evicted")
+}
+
+func TestArchiveCacheKeepsArchivesWithinLimits(t *testing.T) {
+	cache, cleanUp := newTestArchiveCache(t, config.FileCacheConfig{MaxSize: 100})
+	defer cleanUp()
+
+	archive := writeCachedArchive(t, cache.dir, "project-1/a/archive.zip", 10, 30*time.Minute)
+	cache.clean()
+
+	require.FileExists(t, archive)
+}
+
+func TestSendArchiveTouchesCacheHits(t *testing.T) {
+	cache, cleanUp := newTestArchiveCache(t, config.FileCacheConfig{})
+	defer cleanUp()
+	archivePath := writeCachedArchive(t, cache.dir, "project-1/a/archive.zip", 10, time.Hour)
+
+	sendData := archiveSendData(t, archiveParams{ArchivePath: archivePath})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/archive.zip", nil)
+	NewSendArchive(cache, nil).Inject(w, r, sendData)
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 10, w.Body.Len())
+
+	fi, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), fi.ModTime(), time.Minute)
+}
+
+func TestNewArchiveCacheDisabled(t *testing.T) {
+	cache, err := NewArchiveCache(config.FileCacheConfig{Dir: "/tmp"})
+	require.NoError(t, err)
+	require.Nil(t, cache)
+}
+
+func newTestArchiveCache(t *testing.T, cfg config.FileCacheConfig) (*FileCache, func()) {
+	dir, err := ioutil.TempDir("", "archive-cache")
+	require.NoError(t, err)
+
+	cfg.Enabled = true
+	cfg.Dir = dir
+	cache, err := NewArchiveCache(cfg)
+	require.NoError(t, err)
+
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func writeCachedArchive(t *testing.T, dir string, name string, size int, age time.Duration) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, size), 0600))
+	backdate(t, path, age)
+
+	return path
+}
+
+func backdate(t *testing.T, path string, age time.Duration) {
+	when := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, when, when))
+}
@@ -9,9 +9,11 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/bandwidth"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
@@ -21,12 +23,16 @@ const (
 	GitConfigShowAllRefs = "transfer.hideRefs=!refs"
 )
 
-func ReceivePack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleReceivePack", handleReceivePack)
+func ReceivePack(a *api.API, authCache *api.PreAuthorizeCache, inspector *PushInspector) http.Handler {
+	return postRPCHandler(a, authCache, "handleReceivePack", nil, nil, func(w *HttpResponseWriter, r *http.Request, ar *api.Response) error {
+		return handleReceivePack(w, r, ar, inspector)
+	})
 }
 
-func UploadPack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleUploadPack", handleUploadPack)
+func UploadPack(a *api.API, authCache *api.PreAuthorizeCache, cache *PackCache, policy *UploadPackPolicy, limiter *CloneLimiter, shaper *bandwidth.Shaper) http.Handler {
+	return postRPCHandler(a, authCache, "handleUploadPack", limiter, shaper, func(w *HttpResponseWriter, r *http.Request, ar *api.Response) error {
+		return handleUploadPack(w, r, ar, cache, policy)
+	})
 }
 
 func gitConfigOptions(a *api.Response) []string {
@@ -39,16 +45,25 @@ func gitConfigOptions(a *api.Response) []string {
 	return out
 }
 
-func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *http.Request, *api.Response) error) http.Handler {
-	return repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
+func postRPCHandler(a *api.API, authCache *api.PreAuthorizeCache, name string, limiter *CloneLimiter, shaper *bandwidth.Shaper, handler func(*HttpResponseWriter, *http.Request, *api.Response) error) http.Handler {
+	return repoPreAuthorizeHandler(a, authCache, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
 		cr := &countReadCloser{ReadCloser: r.Body}
 		r.Body = cr
 
+		rw, done := shaper.Wrap(rw, r, ar.GL_ID, ar.BandwidthLimit)
+		defer done()
+
 		w := NewHttpResponseWriter(rw)
 		defer func() {
 			w.Log(r, cr.Count())
 		}()
 
+		release := limiter.limitUploadPack(w, r, ar)
+		if release == nil {
+			return
+		}
+		defer release()
+
 		if err := handler(w, r, ar); err != nil {
 			// If the handler already wrote a response this WriteHeader call is a
 			// no-op. It never reaches net/http because GitHttpResponseWriter calls
@@ -59,12 +74,29 @@ func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *
 	})
 }
 
-func repoPreAuthorizeHandler(myAPI *api.API, handleFunc api.HandleFunc) http.Handler {
-	return myAPI.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+func repoPreAuthorizeHandler(myAPI *api.API, authCache *api.PreAuthorizeCache, handleFunc api.HandleFunc) http.Handler {
+	return myAPI.CachedPreAuthorizeHandler(authCache, preAuthorizeCacheScope, func(w http.ResponseWriter, r *http.Request, a *api.Response) {
 		handleFunc(w, r, a)
 	}, "")
 }
 
+// preAuthorizeCacheScope lets all fetch requests of a repository, smart or
+// dumb, share a pre-authorization response, and all push requests share
+// another one.
+func preAuthorizeCacheScope(r *http.Request) string {
+	i := strings.Index(r.URL.Path, ".git/")
+	if i < 0 {
+		return ""
+	}
+
+	action := "fetch"
+	if getService(r) == "git-receive-pack" {
+		action = "push"
+	}
+
+	return action + ":" + r.URL.Path[:i+len(".git")]
+}
+
 func writePostRPCHeader(w http.ResponseWriter, action string) {
 	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", action))
 	w.Header().Set("Cache-Control", "no-cache")
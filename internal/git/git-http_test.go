@@ -0,0 +1,29 @@
+package git
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreAuthorizeCacheScope(t *testing.T) {
+	testCases := []struct {
+		method string
+		path   string
+		scope  string
+	}{
+		{method: "GET", path: "/group/my.github.io.git/info/refs?service=git-upload-pack", scope: "fetch:/group/my.github.io.git"},
+		{method: "POST", path: "/group/project.git/git-upload-pack", scope: "fetch:/group/project.git"},
+		{method: "GET", path: "/group/project.git/objects/info/packs", scope: "fetch:/group/project.git"},
+		{method: "GET", path: "/group/project.git/info/refs?service=git-receive-pack", scope: "push:/group/project.git"},
+		{method: "POST", path: "/group/project.git/git-receive-pack", scope: "push:/group/project.git"},
+		{method: "PUT", path: "/group/project/gitlab-lfs/objects/1234", scope: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			require.Equal(t, tc.scope, preAuthorizeCacheScope(httptest.NewRequest(tc.method, tc.path, nil)))
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package git
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// growingFile tracks a file that is being written by one goroutine while
+// any number of others follow it, similar to 'tail -f'.
+type growingFile struct {
+	mu      sync.Mutex
+	written int64
+	done    bool
+	err     error
+	// changed is closed and replaced whenever written or done change
+	changed chan struct{}
+}
+
+func newGrowingFile() *growingFile {
+	return &growingFile{changed: make(chan struct{})}
+}
+
+func (g *growingFile) isDone() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
+
+func (g *growingFile) getErr() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+func (g *growingFile) state() (written int64, done bool, err error, changed <-chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.written, g.done, g.err, g.changed
+}
+
+func (g *growingFile) notifyLocked() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *growingFile) grow(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.written += int64(n)
+	g.notifyLocked()
+}
+
+func (g *growingFile) finish(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.done = true
+	g.err = err
+	g.notifyLocked()
+}
+
+// waitStarted returns once the first bytes have been written or the writer
+// has finished, whichever comes first.
+func (g *growingFile) waitStarted(ctx context.Context) error {
+	for {
+		written, done, _, changed := g.state()
+		if written > 0 || done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// writeTo copies the contents of f to w, following the file as it grows
+// until the writer has finished.
+func (g *growingFile) writeTo(ctx context.Context, f *os.File, w io.Writer) (int64, error) {
+	var offset int64
+	for {
+		written, done, err, changed := g.state()
+
+		if offset < written {
+			n, err := io.CopyN(w, f, written-offset)
+			offset += n
+			if err != nil {
+				return offset, err
+			}
+			continue
+		}
+
+		if done {
+			return offset, err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return offset, ctx.Err()
+		}
+	}
+}
+
+// growingFileWriter deliberately does not embed *os.File so that io.Copy
+// can't bypass Write through (*os.File).ReadFrom.
+type growingFileWriter struct {
+	file        *os.File
+	growingFile *growingFile
+}
+
+func (w *growingFileWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.growingFile.grow(n)
+	return n, err
+}
@@ -12,22 +12,29 @@ import (
 	"gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/bandwidth"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-func GetInfoRefsHandler(a *api.API) http.Handler {
-	return repoPreAuthorizeHandler(a, handleGetInfoRefs)
+func GetInfoRefsHandler(a *api.API, authCache *api.PreAuthorizeCache, limiter *CloneLimiter, shaper *bandwidth.Shaper) http.Handler {
+	return repoPreAuthorizeHandler(a, authCache, func(w http.ResponseWriter, r *http.Request, ar *api.Response) {
+		w, done := shaper.Wrap(w, r, ar.GL_ID, ar.BandwidthLimit)
+		defer done()
+
+		handleGetInfoRefs(w, r, ar, limiter)
+	})
 }
 
-func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response) {
+func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response, limiter *CloneLimiter) {
 	responseWriter := NewHttpResponseWriter(rw)
 	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
 	defer responseWriter.Log(r, 0)
 
 	rpc := getService(r)
 	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
-		// The 'dumb' Git HTTP protocol is not supported
+		// Requests for the 'dumb' Git HTTP protocol have no service and are
+		// routed to DumbHTTPHandler
 		http.Error(responseWriter, "Not Found", 404)
 		return
 	}
@@ -35,6 +42,12 @@ func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response)
 	responseWriter.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
 	responseWriter.Header().Set("Cache-Control", "no-cache")
 
+	release := limiter.limitUploadPack(responseWriter, r, a)
+	if release == nil {
+		return
+	}
+	defer release()
+
 	gitProtocol := r.Header.Get("Git-Protocol")
 
 	offers := []string{"gzip", "identity"}
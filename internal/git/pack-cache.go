@@ -0,0 +1,386 @@
+/*
+In this file we handle the optional on-disk cache of git-upload-pack responses.
+
+When many clients fetch the same commit at the same time (think CI fleets),
+they all send identical negotiation requests. We answer all of them from a
+single Gitaly PostUploadPack stream that is written to disk, while every
+client tails that file.
+*/
+
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	packCacheSubdir         = "gitlab-workhorse-pack-cache"
+	defaultPackCacheMaxSize = 10 * 1024 * 1024 * 1024 // 10GB
+	defaultPackCacheTTL     = 5 * time.Minute
+)
+
+const (
+	packCacheHit         = "hit"
+	packCacheMiss        = "miss"
+	packCacheCoalesced   = "coalesced"
+	packCacheUncacheable = "uncacheable"
+)
+
+var (
+	packCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_pack_cache_requests_total",
+			Help: "How many git-upload-pack requests went through the pack cache, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+
+	packCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_pack_cache_bytes",
+			Help: "Total size of the git-upload-pack responses currently kept in the pack cache.",
+		},
+	)
+
+	packCacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_pack_cache_evictions_total",
+			Help: "How many git-upload-pack responses have been removed from the pack cache.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(packCacheRequests)
+	prometheus.MustRegister(packCacheBytes)
+	prometheus.MustRegister(packCacheEvictions)
+}
+
+// PackCache stores git-upload-pack responses on local disk so that
+// identical fetches can be served without asking Gitaly again.
+type PackCache struct {
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*packCacheEntry
+	size    int64
+}
+
+type packCacheEntry struct {
+	key     string
+	path    string
+	created time.Time
+	// accessed and size are protected by PackCache.mu; size is only set
+	// once the response is complete and counts against the size limit.
+	accessed time.Time
+	size     int64
+
+	*growingFile
+}
+
+// NewPackCache returns nil when the cache is disabled, which is a valid
+// value that makes handleUploadPack talk to Gitaly directly.
+func NewPackCache(cfg config.PackCacheConfig) (*PackCache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.Dir == "" {
+		return nil, errors.New("PackCache: dir must be set")
+	}
+
+	c := &PackCache{
+		dir:     filepath.Join(cfg.Dir, packCacheSubdir),
+		maxSize: cfg.MaxSize,
+		ttl:     defaultPackCacheTTL,
+		entries: make(map[string]*packCacheEntry),
+	}
+
+	if c.maxSize <= 0 {
+		c.maxSize = defaultPackCacheMaxSize
+	}
+
+	if cfg.TTL != nil && cfg.TTL.Duration > 0 {
+		c.ttl = cfg.TTL.Duration
+	}
+
+	// The index only lives in memory, so whatever a previous process left
+	// behind can never be served again.
+	if err := os.RemoveAll(c.dir); err != nil {
+		return nil, fmt.Errorf("PackCache: %v", err)
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, fmt.Errorf("PackCache: %v", err)
+	}
+
+	go c.expireLoop()
+
+	return c, nil
+}
+
+// serve answers the upload-pack request from the cache. The request body
+// has to be buffered already; ok is false if the request is not eligible
+// for caching, in which case nothing has been written to w.
+func (c *PackCache) serve(ctx context.Context, w io.Writer, a *api.Response, gitProtocol string, body []byte) (ok bool, err error) {
+	key, ok := packCacheKey(a, gitProtocol, body)
+	if !ok {
+		packCacheRequests.WithLabelValues(packCacheUncacheable).Inc()
+		return false, nil
+	}
+
+	entry, reader, writer, err := c.lookupOrCreate(key)
+	if err != nil {
+		// A broken cache should not break clones
+		log.WithContextFields(ctx, log.Fields{"dir": c.dir}).WithError(err).Error("PackCache: bypassing cache")
+		return false, nil
+	}
+	defer reader.Close()
+
+	if writer != nil {
+		packCacheRequests.WithLabelValues(packCacheMiss).Inc()
+		go c.generate(detachedContext(ctx), entry, writer, a, gitProtocol, body)
+	} else if entry.isDone() {
+		packCacheRequests.WithLabelValues(packCacheHit).Inc()
+	} else {
+		packCacheRequests.WithLabelValues(packCacheCoalesced).Inc()
+	}
+
+	if _, err := entry.writeTo(ctx, reader, w); err != nil {
+		return true, fmt.Errorf("PackCache: %v", err)
+	}
+
+	return true, nil
+}
+
+// lookupOrCreate returns the entry for key along with an open reader for
+// it. If the entry had to be created, it also returns the file the caller
+// must write the response to.
+func (c *PackCache) lookupOrCreate(key string) (entry *packCacheEntry, reader *os.File, writer *os.File, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		if !entry.isExpired(c.ttl) && entry.getErr() == nil {
+			// Open the file while holding the lock, so it can't be removed under our feet
+			if reader, err := os.Open(entry.path); err == nil {
+				entry.accessed = time.Now()
+				return entry, reader, nil, nil
+			}
+		}
+
+		c.removeLocked(entry)
+	}
+
+	writer, err = ioutil.TempFile(c.dir, "pack")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("PackCache: %v", err)
+	}
+
+	reader, err = os.Open(writer.Name())
+	if err != nil {
+		writer.Close()
+		os.Remove(writer.Name())
+		return nil, nil, nil, fmt.Errorf("PackCache: %v", err)
+	}
+
+	now := time.Now()
+	entry = &packCacheEntry{
+		key:         key,
+		path:        writer.Name(),
+		created:     now,
+		accessed:    now,
+		growingFile: newGrowingFile(),
+	}
+	c.entries[key] = entry
+
+	return entry, reader, writer, nil
+}
+
+// generate runs a single PostUploadPack for all clients waiting on entry.
+// It must not depend on the request that happened to trigger it, because
+// that client may go away while others are still reading.
+func (c *PackCache) generate(ctx context.Context, entry *packCacheEntry, f *os.File, a *api.Response, gitProtocol string, body []byte) {
+	ctx, cancel := context.WithTimeout(ctx, uploadPackTimeout)
+	defer cancel()
+
+	err := handleUploadPackWithGitaly(ctx, a, bytes.NewReader(body), &growingFileWriter{file: f, growingFile: entry.growingFile}, gitProtocol)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	entry.finish(err)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		log.WithContextFields(ctx, log.Fields{"path": entry.path}).WithError(err).Error("PackCache: failed to generate pack")
+		c.removeLocked(entry)
+		return
+	}
+
+	if c.entries[entry.key] != entry {
+		// Expired while we were still writing it
+		return
+	}
+
+	entry.size = entry.written
+	c.size += entry.size
+	packCacheBytes.Set(float64(c.size))
+	c.evictLocked()
+}
+
+// evictLocked removes the least recently used finished entries until the
+// cache fits into its size limit again.
+func (c *PackCache) evictLocked() {
+	if c.size <= c.maxSize {
+		return
+	}
+
+	var finished []*packCacheEntry
+	for _, entry := range c.entries {
+		if entry.isDone() {
+			finished = append(finished, entry)
+		}
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].accessed.Before(finished[j].accessed)
+	})
+
+	for _, entry := range finished {
+		if c.size <= c.maxSize {
+			return
+		}
+
+		c.removeLocked(entry)
+	}
+}
+
+// removeLocked drops entry from the index and deletes its file. Clients
+// that are still reading the file keep their open file descriptor.
+func (c *PackCache) removeLocked(entry *packCacheEntry) {
+	if c.entries[entry.key] != entry {
+		return
+	}
+
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	packCacheBytes.Set(float64(c.size))
+	packCacheEvictions.Inc()
+
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", entry.path).Error("PackCache: failed to remove pack")
+	}
+}
+
+func (c *PackCache) expireLoop() {
+	for range time.NewTicker(c.ttl).C {
+		c.expire()
+	}
+}
+
+func (c *PackCache) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.isDone() && entry.isExpired(c.ttl) {
+			c.removeLocked(entry)
+		}
+	}
+}
+
+func (e *packCacheEntry) isExpired(ttl time.Duration) bool {
+	return time.Since(e.created) > ttl
+}
+
+// detachedContext keeps the correlation ID of ctx but not its cancellation
+func detachedContext(ctx context.Context) context.Context {
+	return correlation.ContextWithCorrelation(context.Background(), correlation.ExtractFromContext(ctx)) // lint:allow context.Background
+}
+
+// packCacheKey identifies the response to an upload-pack request. Only
+// requests that conclude the negotiation and make Gitaly send a pack are
+// worth caching.
+func packCacheKey(a *api.Response, gitProtocol string, body []byte) (string, bool) {
+	pkts, err := splitPktLines(body)
+	if err != nil || len(pkts) == 0 {
+		return "", false
+	}
+
+	first := string(pkts[0].payload)
+	if !strings.HasPrefix(first, "want ") && first != "command=fetch\n" && first != "command=fetch" {
+		return "", false
+	}
+
+	h := sha256.New()
+
+	repo := &a.Repository
+	fmt.Fprintf(h, "%q %q %q %q %q\n", repo.StorageName, repo.RelativePath, repo.GitObjectDirectory, repo.GitAlternateObjectDirectories, repo.GlRepository)
+	fmt.Fprintf(h, "%q %q\n", gitConfigOptions(a), gitProtocol)
+
+	done := false
+	for i, pkt := range pkts {
+		if pkt.special {
+			h.Write(pkt.raw)
+			continue
+		}
+
+		line := strings.TrimSuffix(string(pkt.payload), "\n")
+		switch {
+		case line == "done":
+			done = true
+		case strings.HasPrefix(line, "agent=") || strings.HasPrefix(line, "session-id="):
+			// Protocol v2 capabilities that say who the client is, not what it wants
+			continue
+		case i == 0 && strings.HasPrefix(line, "want "):
+			line = stripClientCapabilities(line)
+		}
+
+		fmt.Fprintf(h, "%04x%s", len(line)+4, line)
+	}
+
+	if !done {
+		return "", false
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// In protocol v0 and v1 the first want line carries the client capabilities
+func stripClientCapabilities(line string) string {
+	fields := strings.Fields(line)
+	kept := fields[:0]
+	for _, f := range fields {
+		if strings.HasPrefix(f, "agent=") || strings.HasPrefix(f, "session-id=") {
+			continue
+		}
+		kept = append(kept, f)
+	}
+
+	return strings.Join(kept, " ")
+}
@@ -0,0 +1,261 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+)
+
+var (
+	fetchRequest     = pkt("want 1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541 side-band-64k ofs-delta agent=git/2.28.0\n") + "0000" + pkt("done\n")
+	otherAgentFetch  = pkt("want 1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541 side-band-64k ofs-delta agent=git/2.9.0\n") + "0000" + pkt("done\n")
+	otherWantFetch   = pkt("want 2b0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541 side-band-64k ofs-delta agent=git/2.28.0\n") + "0000" + pkt("done\n")
+	negotiateRequest = pkt("want 1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541 side-band-64k ofs-delta agent=git/2.28.0\n") + "0000" + pkt("have 3c0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541\n") + "0000"
+	v2FetchRequest   = pkt("command=fetch\n") + pkt("agent=git/2.28.0\n") + "0001" + pkt("want 1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541\n") + pkt("done\n") + "0000"
+	v2LsRefsRequest  = pkt("command=ls-refs\n") + pkt("agent=git/2.28.0\n") + "0001" + pkt("peel\n") + "0000"
+)
+
+func TestPackCacheKey(t *testing.T) {
+	a := &api.Response{Repository: gitalypb.Repository{StorageName: "default", RelativePath: "foo.git"}}
+
+	key, ok := packCacheKey(a, "", []byte(fetchRequest))
+	require.True(t, ok)
+
+	otherAgentKey, ok := packCacheKey(a, "", []byte(otherAgentFetch))
+	require.True(t, ok)
+	require.Equal(t, key, otherAgentKey, "the client agent should not affect the key")
+
+	otherWantKey, ok := packCacheKey(a, "", []byte(otherWantFetch))
+	require.True(t, ok)
+	require.NotEqual(t, key, otherWantKey)
+
+	showAllRefsKey, ok := packCacheKey(&api.Response{Repository: a.Repository, ShowAllRefs: true}, "", []byte(fetchRequest))
+	require.True(t, ok)
+	require.NotEqual(t, key, showAllRefsKey)
+
+	otherRepoKey, ok := packCacheKey(&api.Response{Repository: gitalypb.Repository{StorageName: "default", RelativePath: "bar.git"}}, "", []byte(fetchRequest))
+	require.True(t, ok)
+	require.NotEqual(t, key, otherRepoKey)
+
+	_, ok = packCacheKey(a, "version=2", []byte(v2FetchRequest))
+	require.True(t, ok)
+
+	for _, body := range []string{negotiateRequest, v2LsRefsRequest, "", "garbage"} {
+		_, ok := packCacheKey(a, "", []byte(body))
+		require.False(t, ok, "expected %q not to be cacheable", body)
+	}
+}
+
+func TestPackCacheCoalescesConcurrentRequests(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			atomic.AddInt32(&calls, 1)
+			drainUploadPackRequest(t, stream)
+
+			require.NoError(t, stream.Send(&gitalypb.PostUploadPackResponse{Data: []byte("first part ")}))
+			<-release
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: []byte("second part")})
+		},
+	})
+	defer cleanUp()
+
+	cache, cleanUpCache := newTestPackCache(t, config.PackCacheConfig{})
+	defer cleanUpCache()
+	a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+	const numClients = 5
+	responses := make([]string, numClients)
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = doCachedUploadPack(t, cache, a, fetchRequest)
+		}(i)
+	}
+
+	// Make sure all clients joined before the stream completes
+	require.Eventually(t, func() bool { return cacheEntryCount(cache) == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for _, response := range responses {
+		require.Equal(t, "first part second part", response)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Later requests are cache hits
+	require.Equal(t, "first part second part", doCachedUploadPack(t, cache, a, otherAgentFetch))
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestPackCacheBypassesUncacheableRequests(t *testing.T) {
+	var calls int32
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			atomic.AddInt32(&calls, 1)
+			request := drainUploadPackRequest(t, stream)
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: []byte("echo " + request)})
+		},
+	})
+	defer cleanUp()
+
+	cache, cleanUpCache := newTestPackCache(t, config.PackCacheConfig{})
+	defer cleanUpCache()
+	a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, "echo "+negotiateRequest, doCachedUploadPack(t, cache, a, negotiateRequest))
+	}
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	require.Equal(t, 0, cacheEntryCount(cache))
+}
+
+func TestPackCacheExpiresEntries(t *testing.T) {
+	var calls int32
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			n := atomic.AddInt32(&calls, 1)
+			drainUploadPackRequest(t, stream)
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: []byte(fmt.Sprintf("pack %d", n))})
+		},
+	})
+	defer cleanUp()
+
+	cache, cleanUpCache := newTestPackCache(t, config.PackCacheConfig{TTL: &config.TomlDuration{Duration: 100 * time.Millisecond}})
+	defer cleanUpCache()
+	a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+	require.Equal(t, "pack 1", doCachedUploadPack(t, cache, a, fetchRequest))
+	require.Equal(t, "pack 1", doCachedUploadPack(t, cache, a, fetchRequest))
+
+	time.Sleep(150 * time.Millisecond)
+
+	require.Equal(t, "pack 2", doCachedUploadPack(t, cache, a, fetchRequest))
+}
+
+func TestPackCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			drainUploadPackRequest(t, stream)
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: bytes.Repeat([]byte("x"), 100)})
+		},
+	})
+	defer cleanUp()
+
+	cache, cleanUpCache := newTestPackCache(t, config.PackCacheConfig{MaxSize: 250})
+	defer cleanUpCache()
+	a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+	doCachedUploadPack(t, cache, a, fetchRequest)
+	doCachedUploadPack(t, cache, a, otherWantFetch)
+	doCachedUploadPack(t, cache, a, fetchRequest) // touch the first entry
+	require.Equal(t, 2, cacheEntryCount(cache))
+
+	doCachedUploadPack(t, cache, a, v2FetchRequest)
+
+	require.Equal(t, 2, cacheEntryCount(cache))
+	key, _ := packCacheKey(a, "", []byte(otherWantFetch))
+	cache.mu.Lock()
+	_, ok := cache.entries[key]
+	size := cache.size
+	cache.mu.Unlock()
+	require.False(t, ok, "expected least recently used entry to be evicted")
+	require.Equal(t, int64(200), size)
+
+	files, err := ioutil.ReadDir(cache.dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+}
+
+func TestPackCacheDoesNotKeepFailedStreams(t *testing.T) {
+	var calls int32
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			atomic.AddInt32(&calls, 1)
+			drainUploadPackRequest(t, stream)
+			return fmt.Errorf("broken")
+		},
+	})
+	defer cleanUp()
+
+	cache, cleanUpCache := newTestPackCache(t, config.PackCacheConfig{})
+	defer cleanUpCache()
+	a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(fetchRequest))
+		require.Error(t, handleUploadPack(NewHttpResponseWriter(w), r, a, cache, nil))
+	}
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	require.Equal(t, 0, cacheEntryCount(cache))
+}
+
+func TestNewPackCacheDisabled(t *testing.T) {
+	cache, err := NewPackCache(config.PackCacheConfig{Dir: "/tmp"})
+	require.NoError(t, err)
+	require.Nil(t, cache)
+}
+
+func newTestPackCache(t *testing.T, cfg config.PackCacheConfig) (*PackCache, func()) {
+	dir, err := ioutil.TempDir("", "pack-cache")
+	require.NoError(t, err)
+
+	cfg.Enabled = true
+	cfg.Dir = dir
+	cache, err := NewPackCache(cfg)
+	require.NoError(t, err)
+
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func doCachedUploadPack(t *testing.T, cache *PackCache, a *api.Response, body string) string {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+
+	require.NoError(t, handleUploadPack(NewHttpResponseWriter(w), r, a, cache, nil))
+
+	return w.Body.String()
+}
+
+func drainUploadPackRequest(t *testing.T, stream gitalypb.SmartHTTPService_PostUploadPackServer) string {
+	var data []byte
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return string(data)
+		}
+		data = append(data, req.GetData()...)
+	}
+}
+
+func pkt(data string) string {
+	return fmt.Sprintf("%04x%s", len(data)+4, data)
+}
+
+func cacheEntryCount(c *PackCache) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
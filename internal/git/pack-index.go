@@ -0,0 +1,478 @@
+/*
+In this file we build the index of a pack file like 'git index-pack' does.
+Gitaly can only give us packs, but clients of the 'dumb' HTTP protocol need
+an index to find objects in them.
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	packObjectCommit   = 1
+	packObjectTree     = 2
+	packObjectBlob     = 3
+	packObjectTag      = 4
+	packObjectOfsDelta = 6
+	packObjectRefDelta = 7
+
+	// Delta bases we keep in memory while resolving deltas
+	maxPackBaseCacheSize = 64 * 1024 * 1024
+)
+
+var packObjectTypeNames = map[int]string{
+	packObjectCommit: "commit",
+	packObjectTree:   "tree",
+	packObjectBlob:   "blob",
+	packObjectTag:    "tag",
+}
+
+type packEntry struct {
+	offset     int64
+	dataOffset int64
+	crc        uint32
+	objectType int
+	baseOffset int64
+	baseOid    [sha1.Size]byte
+	oid        [sha1.Size]byte
+	resolved   bool
+}
+
+type packIndexer struct {
+	pack      io.ReaderAt
+	entries   []*packEntry
+	byOffset  map[int64]*packEntry
+	byOid     map[[sha1.Size]byte]*packEntry
+	bases     map[int64]packObject
+	basesSize int
+}
+
+type packObject struct {
+	objectType int
+	data       []byte
+}
+
+// indexPack writes the version 2 index of the pack file at packPath to
+// idxPath.
+func indexPack(packPath string, idxPath string) error {
+	pack, err := os.Open(packPath)
+	if err != nil {
+		return err
+	}
+	defer pack.Close()
+
+	ix := &packIndexer{
+		pack:     pack,
+		byOffset: make(map[int64]*packEntry),
+		byOid:    make(map[[sha1.Size]byte]*packEntry),
+		bases:    make(map[int64]packObject),
+	}
+
+	checksum, err := ix.scan(pack)
+	if err != nil {
+		return fmt.Errorf("indexPack: %v", err)
+	}
+
+	if err := ix.resolveDeltas(); err != nil {
+		return fmt.Errorf("indexPack: %v", err)
+	}
+
+	idx, err := os.Create(idxPath)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	if err := ix.writeIndex(idx, checksum); err != nil {
+		return fmt.Errorf("indexPack: write index: %v", err)
+	}
+
+	return idx.Close()
+}
+
+// packScanner keeps track of the position, the CRC32 of the current entry
+// and the checksum of the whole pack while we read it sequentially. It is a
+// flate.Reader so that zlib does not read ahead.
+type packScanner struct {
+	r      *bufio.Reader
+	offset int64
+	crc    hash.Hash32
+	sum    hash.Hash
+}
+
+func (s *packScanner) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.offset += int64(n)
+	s.crc.Write(p[:n])
+	s.sum.Write(p[:n])
+	return n, err
+}
+
+func (s *packScanner) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	s.offset++
+	s.crc.Write([]byte{b})
+	s.sum.Write([]byte{b})
+	return b, nil
+}
+
+// scan records every entry of the pack and computes the object IDs of all
+// entries that are not deltas.
+func (ix *packIndexer) scan(pack io.Reader) ([]byte, error) {
+	s := &packScanner{r: bufio.NewReader(pack), crc: crc32.NewIEEE(), sum: sha1.New()}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(s, header); err != nil {
+		return nil, fmt.Errorf("read header: %v", err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) || binary.BigEndian.Uint32(header[4:8]) != 2 {
+		return nil, errors.New("not a version 2 pack")
+	}
+
+	count := binary.BigEndian.Uint32(header[8:])
+	for i := uint32(0); i < count; i++ {
+		s.crc.Reset()
+		entry := &packEntry{offset: s.offset}
+
+		objectType, size, err := readPackEntryHeader(s)
+		if err != nil {
+			return nil, fmt.Errorf("entry at %d: %v", entry.offset, err)
+		}
+		entry.objectType = objectType
+
+		switch objectType {
+		case packObjectOfsDelta:
+			distance, err := readOfsDeltaDistance(s)
+			if err != nil {
+				return nil, fmt.Errorf("entry at %d: %v", entry.offset, err)
+			}
+			entry.baseOffset = entry.offset - distance
+		case packObjectRefDelta:
+			if _, err := io.ReadFull(s, entry.baseOid[:]); err != nil {
+				return nil, fmt.Errorf("entry at %d: %v", entry.offset, err)
+			}
+		}
+
+		entry.dataOffset = s.offset
+		data := ioutil.Discard
+		var h hash.Hash
+		if name, ok := packObjectTypeNames[objectType]; ok {
+			h = objectHash(name, size)
+			data = h
+		}
+
+		if err := inflate(data, s, size); err != nil {
+			return nil, fmt.Errorf("entry at %d: %v", entry.offset, err)
+		}
+
+		if h != nil {
+			copy(entry.oid[:], h.Sum(nil))
+			entry.resolved = true
+			ix.byOid[entry.oid] = entry
+		}
+
+		entry.crc = s.crc.Sum32()
+		ix.entries = append(ix.entries, entry)
+		ix.byOffset[entry.offset] = entry
+	}
+
+	checksum := s.sum.Sum(nil)
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(s.r, trailer); err != nil {
+		return nil, fmt.Errorf("read trailer: %v", err)
+	}
+	if !bytes.Equal(trailer, checksum) {
+		return nil, errors.New("pack checksum mismatch")
+	}
+
+	return checksum, nil
+}
+
+// resolveDeltas computes the object IDs of the delta entries. The base of a
+// ref delta may come after the delta, so we repeat until nothing changes.
+func (ix *packIndexer) resolveDeltas() error {
+	for {
+		pending, progress := 0, false
+
+		for _, entry := range ix.entries {
+			if entry.resolved {
+				continue
+			}
+
+			base := ix.base(entry)
+			if base == nil || !base.resolved {
+				pending++
+				continue
+			}
+
+			objectType, data, err := ix.object(entry)
+			if err != nil {
+				return fmt.Errorf("entry at %d: %v", entry.offset, err)
+			}
+
+			h := objectHash(packObjectTypeNames[objectType], int64(len(data)))
+			h.Write(data)
+			copy(entry.oid[:], h.Sum(nil))
+			entry.resolved = true
+			ix.byOid[entry.oid] = entry
+			progress = true
+		}
+
+		if pending == 0 {
+			return nil
+		}
+		if !progress {
+			return fmt.Errorf("%d deltas without base", pending)
+		}
+	}
+}
+
+func (ix *packIndexer) base(entry *packEntry) *packEntry {
+	switch entry.objectType {
+	case packObjectOfsDelta:
+		return ix.byOffset[entry.baseOffset]
+	case packObjectRefDelta:
+		return ix.byOid[entry.baseOid]
+	}
+	return nil
+}
+
+// object returns the type and the content of the object in entry, applying
+// deltas as needed.
+func (ix *packIndexer) object(entry *packEntry) (int, []byte, error) {
+	buf := &bytes.Buffer{}
+	r := bufio.NewReader(io.NewSectionReader(ix.pack, entry.dataOffset, math.MaxInt64-entry.dataOffset))
+	if err := inflate(buf, r, -1); err != nil {
+		return 0, nil, err
+	}
+
+	base := ix.base(entry)
+	if base == nil {
+		return entry.objectType, buf.Bytes(), nil
+	}
+
+	cached, ok := ix.bases[base.offset]
+	if !ok {
+		objectType, data, err := ix.object(base)
+		if err != nil {
+			return 0, nil, err
+		}
+		cached = packObject{objectType: objectType, data: data}
+		ix.cacheBase(base.offset, cached)
+	}
+
+	data, err := applyDelta(cached.data, buf.Bytes())
+	return cached.objectType, data, err
+}
+
+func (ix *packIndexer) cacheBase(offset int64, object packObject) {
+	if ix.basesSize+len(object.data) > maxPackBaseCacheSize {
+		ix.bases = make(map[int64]packObject)
+		ix.basesSize = 0
+	}
+
+	ix.bases[offset] = object
+	ix.basesSize += len(object.data)
+}
+
+func (ix *packIndexer) writeIndex(w io.Writer, packChecksum []byte) error {
+	entries := append([]*packEntry(nil), ix.entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].oid[:], entries[j].oid[:]) < 0
+	})
+
+	h := sha1.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+
+	bw.Write([]byte{0xff, 't', 'O', 'c'})
+	binary.Write(bw, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.oid[0]]++
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(bw, binary.BigEndian, fanout)
+
+	for _, e := range entries {
+		bw.Write(e.oid[:])
+	}
+	for _, e := range entries {
+		binary.Write(bw, binary.BigEndian, e.crc)
+	}
+
+	var largeOffsets []uint64
+	for _, e := range entries {
+		if e.offset < 1<<31 {
+			binary.Write(bw, binary.BigEndian, uint32(e.offset))
+			continue
+		}
+		binary.Write(bw, binary.BigEndian, uint32(1<<31|len(largeOffsets)))
+		largeOffsets = append(largeOffsets, uint64(e.offset))
+	}
+	binary.Write(bw, binary.BigEndian, largeOffsets)
+
+	bw.Write(packChecksum)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
+
+func readPackEntryHeader(r io.ByteReader) (objectType int, size int64, err error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	objectType = int(c>>4) & 7
+	size = int64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(c&0x7f) << shift
+	}
+
+	return objectType, size, nil
+}
+
+func readOfsDeltaDistance(r io.ByteReader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	distance := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		distance = ((distance + 1) << 7) | int64(c&0x7f)
+	}
+
+	return distance, nil
+}
+
+// inflate decompresses one zlib stream from r. The size check is skipped if
+// size is negative.
+func inflate(w io.Writer, r io.Reader, size int64) error {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	n, err := io.Copy(w, zr)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("expected %d bytes, inflated %d", size, n)
+	}
+
+	return nil
+}
+
+func objectHash(objectType string, size int64) hash.Hash {
+	h := sha1.New()
+	h.Write([]byte(objectType + " " + strconv.FormatInt(size, 10) + "\x00"))
+	return h
+}
+
+// applyDelta reconstructs an object from its delta base as described in
+// Documentation/technical/pack-format.txt of Git.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	errCorrupt := errors.New("corrupt delta")
+
+	readSize := func() (uint64, bool) {
+		var size uint64
+		for shift := uint(0); len(delta) > 0; shift += 7 {
+			c := delta[0]
+			delta = delta[1:]
+			size |= uint64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				return size, true
+			}
+		}
+		return 0, false
+	}
+
+	baseSize, ok := readSize()
+	if !ok || baseSize != uint64(len(base)) {
+		return nil, errCorrupt
+	}
+	resultSize, ok := readSize()
+	if !ok {
+		return nil, errCorrupt
+	}
+
+	result := make([]byte, 0, resultSize)
+	for len(delta) > 0 {
+		cmd := delta[0]
+		delta = delta[1:]
+
+		switch {
+		case cmd&0x80 != 0:
+			var offset, size uint64
+			for i := uint(0); i < 7; i++ {
+				if cmd&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errCorrupt
+				}
+				if i < 4 {
+					offset |= uint64(delta[0]) << (8 * i)
+				} else {
+					size |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, errCorrupt
+			}
+			result = append(result, base[offset:offset+size]...)
+		case cmd != 0:
+			if int(cmd) > len(delta) {
+				return nil, errCorrupt
+			}
+			result = append(result, delta[:cmd]...)
+			delta = delta[cmd:]
+		default:
+			return nil, errCorrupt
+		}
+	}
+
+	if uint64(len(result)) != resultSize {
+		return nil, errCorrupt
+	}
+
+	return result, nil
+}
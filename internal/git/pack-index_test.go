@@ -0,0 +1,121 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexPack(t *testing.T) {
+	repo, cleanUp := createTestRepository(t)
+	defer cleanUp()
+
+	for _, tc := range []struct {
+		desc string
+		args []string
+	}{
+		{desc: "ref deltas", args: []string{"pack-objects", "--revs", "--all", "--stdout"}},
+		{desc: "ofs deltas", args: []string{"pack-objects", "--revs", "--all", "--stdout", "--delta-base-offset"}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pack-index")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			packPath := filepath.Join(dir, "test.pack")
+			pack := runGit(t, repo, strings.NewReader(""), tc.args...)
+			require.NoError(t, ioutil.WriteFile(packPath, pack, 0600))
+
+			runGit(t, repo, nil, "index-pack", "-o", filepath.Join(dir, "expected.idx"), packPath)
+			expected, err := ioutil.ReadFile(filepath.Join(dir, "expected.idx"))
+			require.NoError(t, err)
+
+			require.NoError(t, indexPack(packPath, filepath.Join(dir, "actual.idx")))
+			actual, err := ioutil.ReadFile(filepath.Join(dir, "actual.idx"))
+			require.NoError(t, err)
+
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestIndexPackRejectsCorruptPacks(t *testing.T) {
+	repo, cleanUp := createTestRepository(t)
+	defer cleanUp()
+
+	dir, err := ioutil.TempDir("", "pack-index")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pack := runGit(t, repo, strings.NewReader(""), "pack-objects", "--revs", "--all", "--stdout")
+	pack[len(pack)/2]++
+
+	packPath := filepath.Join(dir, "test.pack")
+	require.NoError(t, ioutil.WriteFile(packPath, pack, 0600))
+
+	require.Error(t, indexPack(packPath, filepath.Join(dir, "test.idx")))
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world")
+	// base size 11, result size 14, copy "hello " from offset 0, insert
+	// "there ", copy "world" from offset 6
+	delta := []byte{11, 17, 0x90, 6, 6, 't', 'h', 'e', 'r', 'e', ' ', 0x91, 6, 5}
+
+	result, err := applyDelta(base, delta)
+	require.NoError(t, err)
+	require.Equal(t, "hello there world", string(result))
+
+	_, err = applyDelta([]byte("short"), delta)
+	require.Error(t, err, "base size mismatch")
+
+	_, err = applyDelta(base, []byte{11, 17, 0x91, 6, 50})
+	require.Error(t, err, "copy beyond the base")
+}
+
+// createTestRepository creates a repository with enough history to
+// contain deltas when packed.
+func createTestRepository(t *testing.T) (string, func()) {
+	repo, err := ioutil.TempDir("", "test-repo")
+	require.NoError(t, err)
+	cleanUp := func() { os.RemoveAll(repo) }
+
+	runGit(t, repo, nil, "init", "-q")
+
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("line %d of a file that changes a little with every commit", i))
+	}
+
+	for i := 0; i < 5; i++ {
+		lines[i*10] = fmt.Sprintf("changed in commit %d", i)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "file.txt"), []byte(strings.Join(lines, "\n")), 0644))
+		runGit(t, repo, nil, "add", "file.txt")
+		runGit(t, repo, nil, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+	}
+	runGit(t, repo, nil, "tag", "-a", "-m", "release", "v1.0")
+
+	return repo, cleanUp
+}
+
+func runGit(t *testing.T, dir string, stdin *strings.Reader, args ...string) []byte {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	out, err := cmd.Output()
+	require.NoError(t, err, "git %v", args)
+	return out
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 )
 
 func scanDeepen(body io.Reader) bool {
@@ -33,6 +34,11 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 		return 4, data[:0], nil
 	}
 
+	if bytes.HasPrefix(data, []byte("0001")) || bytes.HasPrefix(data, []byte("0002")) {
+		// special case: protocol v2 delimiter and response end packets: return empty token
+		return 4, data[:0], nil
+	}
+
 	// We have at least 4 bytes available so we can decode the 4-hex digit
 	// length prefix of the packet line.
 	pktLength64, err := strconv.ParseInt(string(data[:4]), 16, 0)
@@ -43,7 +49,7 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// Cast is safe because we requested an int-size number from strconv.ParseInt
 	pktLength := int(pktLength64)
 
-	if pktLength < 0 {
+	if pktLength < 4 {
 		return 0, nil, fmt.Errorf("pktLineSplitter: invalid length: %d", pktLength)
 	}
 
@@ -57,3 +63,143 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// return "pkt" token without length prefix
 	return pktLength, data[4:pktLength], nil
 }
+
+type pktLine struct {
+	// raw is the complete packet including its length prefix
+	raw []byte
+	// payload is the packet without its length prefix
+	payload []byte
+	// special is true for flush, delimiter and response end packets
+	special bool
+}
+
+// splitPktLines splits a fully buffered pkt-line stream into its packets.
+func splitPktLines(data []byte) ([]pktLine, error) {
+	var pkts []pktLine
+
+	for len(data) > 0 {
+		advance, token, err := pktLineSplitter(data, true)
+		if err != nil {
+			return nil, err
+		}
+
+		pkts = append(pkts, pktLine{
+			raw:     data[:advance],
+			payload: token,
+			special: advance == 4 && len(token) == 0 && !bytes.Equal(data[:4], []byte("0004")),
+		})
+		data = data[advance:]
+	}
+
+	return pkts, nil
+}
+
+// uploadPackRequest summarizes what a git-upload-pack request asks for.
+type uploadPackRequest struct {
+	// command is "fetch" or "ls-refs". Protocol v0 and v1 requests are
+	// always fetches.
+	command  string
+	v2       bool
+	wants    int
+	haves    int
+	shallows int
+	deepen   bool
+	filter   string
+	done     bool
+}
+
+// fullClone tells whether the client asks for the complete history of all
+// the objects it wants.
+func (req *uploadPackRequest) fullClone() bool {
+	return req.command == "fetch" && req.haves == 0 && req.shallows == 0 && !req.deepen && req.filter == ""
+}
+
+// filterType returns the kind of the requested object filter, e.g. "blob"
+// for "blob:none", or "none" when the request is unfiltered. Clients choose
+// the filter, so kinds that Git doesn't know are "other".
+func (req *uploadPackRequest) filterType() string {
+	if req.filter == "" {
+		return "none"
+	}
+
+	kind := req.filter
+	if i := strings.IndexAny(kind, ":+"); i >= 0 {
+		kind = kind[:i]
+	}
+
+	switch kind {
+	case "blob", "tree", "sparse", "object", "combine":
+		return kind
+	default:
+		return "other"
+	}
+}
+
+// parseUploadPackRequest summarizes a protocol v0, v1 or v2 upload-pack
+// request. Parsing stops at the first malformed packet so that a truncated
+// buffer still yields a summary of the packets before it.
+func parseUploadPackRequest(data []byte) *uploadPackRequest {
+	req := &uploadPackRequest{}
+
+	for len(data) > 0 {
+		advance, token, err := pktLineSplitter(data, false)
+		if err != nil || advance == 0 {
+			break
+		}
+		data = data[advance:]
+
+		line := string(bytes.TrimSuffix(token, []byte("\n")))
+		switch {
+		case strings.HasPrefix(line, "command="):
+			req.command = strings.TrimPrefix(line, "command=")
+			req.v2 = true
+		case strings.HasPrefix(line, "want ") || strings.HasPrefix(line, "want-ref "):
+			req.wants++
+		case strings.HasPrefix(line, "have "):
+			req.haves++
+		case strings.HasPrefix(line, "shallow "):
+			req.shallows++
+		case strings.HasPrefix(line, "deepen"):
+			req.deepen = true
+		case strings.HasPrefix(line, "filter "):
+			req.filter = strings.TrimPrefix(line, "filter ")
+		case line == "done":
+			req.done = true
+		}
+	}
+
+	if req.command == "" && req.wants > 0 {
+		req.command = "fetch"
+	}
+
+	return req
+}
+
+// readPktLine reads one packet from a stream without reading ahead, so that
+// the caller can continue with whatever follows the packets, e.g. a pack.
+// The payload of flush packets is nil.
+func readPktLine(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("readPktLine: %v", err)
+	}
+
+	if bytes.Equal(prefix, []byte("0000")) {
+		return nil, nil
+	}
+
+	pktLength, err := strconv.ParseInt(string(prefix), 16, 0)
+	if err != nil {
+		return nil, fmt.Errorf("readPktLine: decode length: %v", err)
+	}
+	if pktLength < 4 {
+		return nil, fmt.Errorf("readPktLine: invalid length: %d", pktLength)
+	}
+
+	payload := make([]byte, pktLength-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("readPktLine: %v", err)
+	}
+
+	return payload, nil
+}
@@ -3,6 +3,8 @@ package git
 import (
 	"bytes"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestSuccessfulScanDeepen(t *testing.T) {
@@ -37,3 +39,105 @@ func TestFailedScanDeepen(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitPktLines(t *testing.T) {
+	pkts, err := splitPktLines([]byte("0012command=fetch\n00010004000ewant 1234\n0000"))
+	require.NoError(t, err)
+
+	require.Len(t, pkts, 5)
+	require.Equal(t, "command=fetch\n", string(pkts[0].payload))
+	require.True(t, pkts[1].special)
+	require.Equal(t, "0001", string(pkts[1].raw))
+	require.False(t, pkts[2].special, "an empty data packet is not a special packet")
+	require.Equal(t, "want 1234\n", string(pkts[3].payload))
+	require.True(t, pkts[4].special)
+	require.Equal(t, "0000", string(pkts[4].raw))
+}
+
+func TestSplitPktLinesInvalid(t *testing.T) {
+	for _, example := range []string{"0003", "00ffshort", "zzzz"} {
+		_, err := splitPktLines([]byte(example))
+		require.Error(t, err, "example %q", example)
+	}
+}
+
+func TestParseUploadPackRequest(t *testing.T) {
+	want := pkt("want 1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541\n")
+
+	testCases := []struct {
+		desc      string
+		body      string
+		expected  uploadPackRequest
+		fullClone bool
+	}{
+		{
+			desc:      "v0 clone",
+			body:      fetchRequest,
+			expected:  uploadPackRequest{command: "fetch", wants: 1, done: true},
+			fullClone: true,
+		},
+		{
+			desc:     "v0 negotiation",
+			body:     negotiateRequest,
+			expected: uploadPackRequest{command: "fetch", wants: 1, haves: 1},
+		},
+		{
+			desc:      "v2 clone",
+			body:      v2FetchRequest,
+			expected:  uploadPackRequest{command: "fetch", v2: true, wants: 1, done: true},
+			fullClone: true,
+		},
+		{
+			desc:     "v2 ls-refs",
+			body:     v2LsRefsRequest,
+			expected: uploadPackRequest{command: "ls-refs", v2: true},
+		},
+		{
+			desc:     "v2 partial clone",
+			body:     pkt("command=fetch\n") + "0001" + want + want + pkt("filter blob:none\n") + pkt("done\n") + "0000",
+			expected: uploadPackRequest{command: "fetch", v2: true, wants: 2, filter: "blob:none", done: true},
+		},
+		{
+			desc:     "v2 shallow fetch",
+			body:     pkt("command=fetch\n") + "0001" + want + pkt("shallow 3c0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541\n") + pkt("deepen 1\n") + pkt("done\n") + "0000",
+			expected: uploadPackRequest{command: "fetch", v2: true, wants: 1, shallows: 1, deepen: true, done: true},
+		},
+		{
+			desc:      "truncated",
+			body:      fetchRequest[:len(fetchRequest)-3],
+			expected:  uploadPackRequest{command: "fetch", wants: 1},
+			fullClone: true,
+		},
+		{
+			desc:     "garbage",
+			body:     "zzzz",
+			expected: uploadPackRequest{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := parseUploadPackRequest([]byte(tc.body))
+			require.Equal(t, tc.expected, *req)
+			require.Equal(t, tc.fullClone, req.fullClone())
+		})
+	}
+}
+
+func TestUploadPackRequestFilterType(t *testing.T) {
+	for filter, expected := range map[string]string{
+		"":                         "none",
+		"blob:none":                "blob",
+		"blob:limit=1m":            "blob",
+		"tree:0":                   "tree",
+		"combine:blob:none+tree:0": "combine",
+		"sparse:oid=1234":          "sparse",
+		"object:type=blob":         "object",
+		"foo1":                     "other",
+		"foo2:bar":                 "other",
+		"+blob:none":               "other",
+	} {
+		req := &uploadPackRequest{filter: filter}
+		require.Equal(t, expected, req.filterType(), "filter %q", filter)
+	}
+}
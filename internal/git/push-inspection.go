@@ -0,0 +1,770 @@
+/*
+In this file we inspect the objects of 'git push' requests before Gitaly
+accepts them
+
+The request streams to Gitaly while we parse it, except for its last 20
+bytes. Those are the checksum of the pack, without which git-receive-pack
+cannot accept the pack, so we only let them through once the inspection
+has passed. If we find something to reject we cancel the Gitaly call
+instead and tell the client why we rejected the push. If we can't parse the
+request we let it through, and leave it to Gitaly to check it.
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	pushInspectionAccepted     = "accepted"
+	pushInspectionBlobTooLarge = "blob_too_large"
+	pushInspectionSecret       = "secret"
+	pushInspectionFailed       = "failed"
+
+	// We hold back the checksum at the end of the pack until the inspection
+	// is complete
+	pushInspectionHoldback = sha1.Size
+
+	// Like Git, we consider blobs with a NUL byte in their first 8000 bytes
+	// binary. We don't look for secrets in binary blobs.
+	binaryBlobCheckSize = 8000
+	// We look for secrets in longer lines piece by piece
+	maxSecretScanLine = 64 * 1024
+
+	zeroOid = "0000000000000000000000000000000000000000"
+)
+
+var (
+	pushInspections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_receive_pack_inspections_total",
+			Help: "How many git-receive-pack requests have been inspected, by result",
+		},
+		[]string{"result"},
+	)
+
+	receivePackCommandPattern = regexp.MustCompile(`\A[0-9a-f]{40} ([0-9a-f]{40}) (\S+)\z`)
+)
+
+func init() {
+	prometheus.MustRegister(pushInspections)
+}
+
+// PushInspector looks at the blobs in git-receive-pack requests, and
+// rejects pushes of blobs that are larger than the MaxPushBlobSize of the
+// pre-authorization response or that match a secret pattern. Unlike server
+// hooks it stops the push before Gitaly accepts any of the objects.
+type PushInspector struct {
+	secretPatterns []pushSecretPattern
+}
+
+type pushSecretPattern struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// NewPushInspector compiles the secret patterns, which LoadConfig has
+// already validated.
+func NewPushInspector(cfg []config.PushSecretPattern) *PushInspector {
+	inspector := &PushInspector{}
+
+	for _, c := range cfg {
+		inspector.secretPatterns = append(inspector.secretPatterns, pushSecretPattern{
+			name:    c.Name,
+			pattern: regexp.MustCompile(c.Pattern),
+		})
+	}
+
+	return inspector
+}
+
+// pushRejection tells the user why we rejected a push
+type pushRejection struct {
+	result  string
+	message string
+	// cause is the error that made the inspection fail, if any
+	cause error
+}
+
+func (r *pushRejection) Error() string {
+	return r.message
+}
+
+type receivePackCommand struct {
+	newOid string
+	ref    string
+}
+
+// pushInspection inspects the body of one git-receive-pack request while
+// Gitaly reads it.
+type pushInspection struct {
+	body    io.Reader
+	pipe    *io.PipeWriter
+	cancel  func()
+	buf     []byte
+	forward []byte
+	eof     bool
+
+	maxBlobSize    int64
+	secretPatterns []pushSecretPattern
+
+	// inspect sets these before it closes done
+	done         chan struct{}
+	commands     []receivePackCommand
+	capabilities []string
+	err          error
+
+	// passthrough is set once the inspection has failed without finding
+	// anything to reject
+	passthrough bool
+
+	mu       sync.Mutex
+	rejected *pushRejection
+	failed   error
+}
+
+// start returns nil if there is nothing to look for in this push. cancel
+// must abort the Gitaly call.
+func (inspector *PushInspector) start(a *api.Response, body io.Reader, cancel func()) *pushInspection {
+	var secretPatterns []pushSecretPattern
+	if inspector != nil {
+		secretPatterns = inspector.secretPatterns
+	}
+
+	if len(secretPatterns) == 0 && a.MaxPushBlobSize <= 0 {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	pi := &pushInspection{
+		body:           body,
+		pipe:           pw,
+		cancel:         cancel,
+		buf:            make([]byte, 32*1024),
+		maxBlobSize:    a.MaxPushBlobSize,
+		secretPatterns: secretPatterns,
+		done:           make(chan struct{}),
+	}
+	go pi.run(pr)
+
+	return pi
+}
+
+func (pi *pushInspection) run(pr *io.PipeReader) {
+	err := pi.inspect(bufio.NewReader(pr))
+	if err == nil {
+		// Nothing follows the pack, but we must not block the request body
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+
+	result := pushInspectionAccepted
+	var rejection *pushRejection
+	if errors.As(err, &rejection) {
+		result = rejection.result
+	} else if err != nil {
+		result = pushInspectionFailed
+	}
+	pushInspections.WithLabelValues(result).Inc()
+
+	pi.err = err
+	close(pi.done)
+
+	if err != nil {
+		pr.CloseWithError(err)
+	}
+}
+
+// Read passes the request body on to Gitaly once we have inspected it.
+func (pi *pushInspection) Read(p []byte) (int, error) {
+	for {
+		if pi.passthrough {
+			return pi.readPassthrough(p)
+		}
+
+		select {
+		case <-pi.done:
+			if pi.err != nil {
+				if err := pi.finish(); err != nil {
+					return 0, err
+				}
+				continue
+			}
+		default:
+		}
+
+		if pi.eof {
+			<-pi.done
+			if pi.err != nil {
+				if err := pi.finish(); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			if len(pi.forward) == 0 {
+				return 0, io.EOF
+			}
+			n := copy(p, pi.forward)
+			pi.forward = pi.forward[n:]
+			return n, nil
+		}
+
+		if len(pi.forward) > pushInspectionHoldback {
+			n := copy(p, pi.forward[:len(pi.forward)-pushInspectionHoldback])
+			pi.forward = pi.forward[n:]
+			return n, nil
+		}
+
+		n, err := pi.body.Read(pi.buf)
+		if n > 0 {
+			pi.forward = append(pi.forward, pi.buf[:n]...)
+			if _, err := pi.pipe.Write(pi.buf[:n]); err != nil {
+				// The inspection has failed and closed the pipe
+				<-pi.done
+				if err := pi.finish(); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		if err == io.EOF {
+			pi.pipe.Close()
+			pi.eof = true
+		} else if err != nil {
+			pi.pipe.CloseWithError(err)
+			return 0, err
+		}
+	}
+}
+
+// readPassthrough passes the rest of the request body on to Gitaly as is.
+func (pi *pushInspection) readPassthrough(p []byte) (int, error) {
+	if len(pi.forward) > 0 {
+		n := copy(p, pi.forward)
+		pi.forward = pi.forward[n:]
+		return n, nil
+	}
+
+	if pi.eof {
+		return 0, io.EOF
+	}
+
+	return pi.body.Read(p)
+}
+
+// finish acts on the failed inspection. We only reject pushes for what we
+// found in them. Pushes we can't parse are Gitaly's to accept or reject, so
+// that a bug in our parser doesn't stop anybody from pushing.
+func (pi *pushInspection) finish() error {
+	var rejection *pushRejection
+	if !errors.As(pi.err, &rejection) {
+		pi.passthrough = true
+
+		pi.mu.Lock()
+		pi.failed = pi.err
+		pi.mu.Unlock()
+
+		return nil
+	}
+
+	pi.mu.Lock()
+	pi.rejected = rejection
+	pi.mu.Unlock()
+
+	pi.cancel()
+	return rejection
+}
+
+// rejection returns why we rejected the push, or nil
+func (pi *pushInspection) rejection() *pushRejection {
+	if pi == nil {
+		return nil
+	}
+
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	return pi.rejected
+}
+
+// failure returns why we could not inspect the push, or nil
+func (pi *pushInspection) failure() error {
+	if pi == nil {
+		return nil
+	}
+
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	return pi.failed
+}
+
+// close stops the inspection if Gitaly did not read the whole request
+func (pi *pushInspection) close() {
+	if pi != nil {
+		pi.pipe.CloseWithError(errors.New("push inspection aborted"))
+	}
+}
+
+// responseWriter drops what Gitaly writes after we rejected the push, so
+// that it doesn't get mixed up with our rejection.
+func (pi *pushInspection) responseWriter(w io.Writer) io.Writer {
+	if pi == nil {
+		return w
+	}
+	return &pushInspectionResponseWriter{pi: pi, w: w}
+}
+
+type pushInspectionResponseWriter struct {
+	pi *pushInspection
+	w  io.Writer
+}
+
+func (w *pushInspectionResponseWriter) Write(p []byte) (int, error) {
+	w.pi.mu.Lock()
+	defer w.pi.mu.Unlock()
+
+	if w.pi.rejected != nil {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+// inspect parses the ref update commands and the pack that follows them.
+func (pi *pushInspection) inspect(r *bufio.Reader) error {
+	expectPack := false
+
+	// Signed pushes send the commands inside a push certificate, followed by
+	// its signature. Neither of them contains lines that look like
+	// commands, so we don't need to parse the certificate.
+	for {
+		payload, err := readPktLine(r)
+		if err != nil {
+			return fmt.Errorf("read commands: %v", err)
+		}
+		if payload == nil {
+			break
+		}
+
+		line, capabilities := splitCapabilities(strings.TrimSuffix(string(payload), "\n"))
+		if pi.capabilities == nil && capabilities != "" {
+			pi.capabilities = strings.Fields(capabilities)
+		}
+
+		if m := receivePackCommandPattern.FindStringSubmatch(line); m != nil {
+			pi.commands = append(pi.commands, receivePackCommand{newOid: m[1], ref: m[2]})
+			expectPack = expectPack || m[1] != zeroOid
+		}
+	}
+
+	if hasCapability(pi.capabilities, "push-options") {
+		for {
+			payload, err := readPktLine(r)
+			if err != nil {
+				return fmt.Errorf("read push options: %v", err)
+			}
+			if payload == nil {
+				break
+			}
+		}
+	}
+
+	// Pushes that only delete refs have no pack
+	if !expectPack {
+		return nil
+	}
+
+	return pi.inspectPack(r)
+}
+
+// inspectPack looks at every blob in the pack as it streams by. We know
+// the type of the result of a delta only if its base is in the pack. Pushes
+// are thin packs though, so deltas against objects in the repository have
+// an unknown type. We treat them like blobs.
+func (pi *pushInspection) inspectPack(r *bufio.Reader) error {
+	s := &packScanner{r: r, crc: crc32.NewIEEE(), sum: sha1.New()}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(s, header); err != nil {
+		return fmt.Errorf("read pack header: %v", err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) || binary.BigEndian.Uint32(header[4:8]) != 2 {
+		return errors.New("not a version 2 pack")
+	}
+
+	// Object types by offset and by object ID, 0 if unknown
+	typeByOffset := make(map[int64]int)
+	typeByOid := make(map[[sha1.Size]byte]int)
+
+	count := binary.BigEndian.Uint32(header[8:])
+	for i := uint32(0); i < count; i++ {
+		offset := s.offset
+
+		objectType, size, err := readPackEntryHeader(s)
+		if err != nil {
+			return fmt.Errorf("entry at %d: %v", offset, err)
+		}
+
+		resultType := objectType
+		switch objectType {
+		case packObjectOfsDelta:
+			distance, err := readOfsDeltaDistance(s)
+			if err != nil {
+				return fmt.Errorf("entry at %d: %v", offset, err)
+			}
+			baseType, ok := typeByOffset[offset-distance]
+			if !ok {
+				return fmt.Errorf("entry at %d: no delta base at %d", offset, offset-distance)
+			}
+			resultType = baseType
+		case packObjectRefDelta:
+			var baseOid [sha1.Size]byte
+			if _, err := io.ReadFull(s, baseOid[:]); err != nil {
+				return fmt.Errorf("entry at %d: %v", offset, err)
+			}
+			resultType = typeByOid[baseOid]
+		}
+		typeByOffset[offset] = resultType
+
+		var h hash.Hash
+		var secrets *secretScanner
+		data := ioutil.Discard
+
+		if name, ok := packObjectTypeNames[objectType]; ok {
+			h = objectHash(name, size)
+			data = h
+
+			if objectType == packObjectBlob {
+				if err := pi.checkBlobSize(size); err != nil {
+					return err
+				}
+				if secrets = pi.newSecretScanner(); secrets != nil {
+					data = io.MultiWriter(h, secrets)
+				}
+			}
+		} else if resultType == packObjectBlob || resultType == 0 {
+			secrets = pi.newSecretScanner()
+			data = &deltaInspector{checkSize: pi.checkBlobSize, inserts: secrets}
+		}
+
+		if err := inflate(data, s, size); err != nil {
+			var rejection *pushRejection
+			if errors.As(err, &rejection) {
+				return err
+			}
+			return fmt.Errorf("entry at %d: %v", offset, err)
+		}
+
+		if secrets != nil {
+			if err := secrets.finish(); err != nil {
+				return err
+			}
+		}
+
+		if h != nil {
+			var oid [sha1.Size]byte
+			copy(oid[:], h.Sum(nil))
+			typeByOid[oid] = objectType
+		}
+	}
+
+	checksum := s.sum.Sum(nil)
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(s.r, trailer); err != nil {
+		return fmt.Errorf("read pack trailer: %v", err)
+	}
+	if !bytes.Equal(trailer, checksum) {
+		return errors.New("pack checksum mismatch")
+	}
+
+	return nil
+}
+
+func (pi *pushInspection) checkBlobSize(size int64) error {
+	if pi.maxBlobSize <= 0 || size <= pi.maxBlobSize {
+		return nil
+	}
+
+	return &pushRejection{
+		result:  pushInspectionBlobTooLarge,
+		message: fmt.Sprintf("push contains a blob of %d bytes, the limit is %d bytes", size, pi.maxBlobSize),
+	}
+}
+
+func (pi *pushInspection) newSecretScanner() *secretScanner {
+	if len(pi.secretPatterns) == 0 {
+		return nil
+	}
+	return &secretScanner{patterns: pi.secretPatterns}
+}
+
+// deltaInspector parses a delta as it is inflated. It checks the size of
+// the result, and passes the data that the delta inserts to the secret
+// scanner. What a delta copies from its base was in the repository or in
+// the pack already.
+type deltaInspector struct {
+	checkSize func(int64) error
+	inserts   *secretScanner
+
+	headers  int
+	size     int64
+	shift    uint
+	copyArgs int
+	insert   int
+}
+
+func (d *deltaInspector) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		switch {
+		case d.headers < 2:
+			// The sizes of the base and of the result
+			c := p[0]
+			p = p[1:]
+			if d.shift > 56 {
+				return 0, errors.New("corrupt delta")
+			}
+			d.size |= int64(c&0x7f) << d.shift
+			d.shift += 7
+			if c&0x80 != 0 {
+				continue
+			}
+
+			d.headers++
+			if d.headers == 2 {
+				if err := d.checkSize(d.size); err != nil {
+					return 0, err
+				}
+			}
+			d.size, d.shift = 0, 0
+		case d.insert > 0:
+			k := d.insert
+			if k > len(p) {
+				k = len(p)
+			}
+			if d.inserts != nil {
+				if _, err := d.inserts.Write(p[:k]); err != nil {
+					return 0, err
+				}
+			}
+			d.insert -= k
+			p = p[k:]
+		case d.copyArgs > 0:
+			d.copyArgs--
+			p = p[1:]
+		default:
+			cmd := p[0]
+			p = p[1:]
+			if cmd&0x80 == 0 {
+				d.insert = int(cmd)
+				continue
+			}
+
+			d.copyArgs = bits.OnesCount8(cmd & 0x7f)
+			// Don't join the inserts before and after the copy into one line
+			if d.inserts != nil {
+				if _, err := d.inserts.Write([]byte{'\n'}); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// secretScanner matches the secret patterns against every line of a blob.
+type secretScanner struct {
+	patterns []pushSecretPattern
+	head     []byte
+	decided  bool
+	binary   bool
+	line     []byte
+}
+
+func (s *secretScanner) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if !s.decided {
+		s.head = append(s.head, p...)
+		if len(s.head) < binaryBlobCheckSize {
+			return n, nil
+		}
+
+		p = s.head
+		s.head = nil
+		s.decided = true
+		s.binary = bytes.IndexByte(p[:binaryBlobCheckSize], 0) >= 0
+	}
+
+	if s.binary {
+		return n, nil
+	}
+
+	return n, s.scan(p)
+}
+
+// finish looks for secrets in the last line of the blob
+func (s *secretScanner) finish() error {
+	if !s.decided {
+		s.decided = true
+		s.binary = bytes.IndexByte(s.head, 0) >= 0
+		if !s.binary {
+			if err := s.scan(s.head); err != nil {
+				return err
+			}
+		}
+		s.head = nil
+	}
+
+	if s.binary {
+		return nil
+	}
+
+	return s.matchLine()
+}
+
+func (s *secretScanner) scan(p []byte) error {
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		newline := end >= 0
+		if !newline {
+			end = len(p)
+		}
+		if room := maxSecretScanLine - len(s.line); end > room {
+			end, newline = room, false
+		}
+
+		s.line = append(s.line, p[:end]...)
+		p = p[end:]
+		if newline {
+			p = p[1:]
+		}
+
+		if newline || len(s.line) == maxSecretScanLine {
+			if err := s.matchLine(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *secretScanner) matchLine() error {
+	line := s.line
+	s.line = s.line[:0]
+
+	for _, p := range s.patterns {
+		if p.pattern.Match(line) {
+			return &pushRejection{
+				result:  pushInspectionSecret,
+				message: fmt.Sprintf("push contains a blob that matches the secret pattern %q", p.name),
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasCapability(capabilities []string, name string) bool {
+	for _, c := range capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func logPushRejection(r *http.Request, rejection *pushRejection) {
+	fields := log.Fields{
+		"push_inspection_result": rejection.result,
+	}
+	if rejection.cause != nil {
+		fields["push_inspection_error"] = rejection.cause.Error()
+	}
+
+	log.WithContextFields(r.Context(), fields).Info("rejected git-receive-pack request: " + rejection.message)
+}
+
+func logPushInspectionFailure(r *http.Request, err error) {
+	log.WithContextFields(r.Context(), log.Fields{
+		"push_inspection_result": pushInspectionFailed,
+	}).WithError(err).Warn("unable to inspect git-receive-pack request, passing it on to Gitaly")
+}
+
+// writeReceivePackRejection reports all ref updates as failed, which Git
+// clients show as "[remote rejected] (<message>)". Clients without
+// report-status only see the message if they use a sideband.
+func writeReceivePackRejection(w io.Writer, commands []receivePackCommand, capabilities []string, message string) error {
+	maxPacket := 0
+	switch {
+	case hasCapability(capabilities, "side-band-64k"):
+		maxPacket = 65520
+	case hasCapability(capabilities, "side-band"):
+		maxPacket = 1000
+	}
+
+	reportStatus := hasCapability(capabilities, "report-status") || hasCapability(capabilities, "report-status-v2")
+
+	if maxPacket == 0 {
+		if !reportStatus {
+			return nil
+		}
+		_, err := w.Write(receivePackReport(commands, message))
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	if reportStatus {
+		for report := receivePackReport(commands, message); len(report) > 0; {
+			n := len(report)
+			if n > maxPacket-5 {
+				n = maxPacket - 5
+			}
+			fmt.Fprintf(out, "%04x\x01%s", n+5, report[:n])
+			report = report[n:]
+		}
+	} else {
+		line := message + "\n"
+		fmt.Fprintf(out, "%04x\x03%s", len(line)+5, line)
+	}
+	out.WriteString("0000")
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func receivePackReport(commands []receivePackCommand, message string) []byte {
+	report := &bytes.Buffer{}
+
+	line := "unpack " + message + "\n"
+	fmt.Fprintf(report, "%04x%s", len(line)+4, line)
+	for _, cmd := range commands {
+		line := "ng " + cmd.ref + " " + message + "\n"
+		fmt.Fprintf(report, "%04x%s", len(line)+4, line)
+	}
+	report.WriteString("0000")
+
+	return report.Bytes()
+}
@@ -1,7 +1,10 @@
 package git
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
@@ -11,21 +14,47 @@ import (
 
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleReceivePack(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+func handleReceivePack(w *HttpResponseWriter, r *http.Request, a *api.Response, inspector *PushInspector) error {
 	action := getService(r)
 	writePostRPCHeader(w, action)
 
-	cr, cw := helper.NewWriteAfterReader(r.Body, w)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var body io.Reader = r.Body
+	inspection := inspector.start(a, r.Body, cancel)
+	if inspection != nil {
+		defer inspection.close()
+		body = inspection
+	}
+
+	cr, cw := helper.NewWriteAfterReader(body, inspection.responseWriter(w))
 	defer cw.Flush()
 
 	gitProtocol := r.Header.Get("Git-Protocol")
 
-	ctx, smarthttp, err := gitaly.NewSmartHTTPClient(r.Context(), a.GitalyServer)
+	ctx, smarthttp, err := gitaly.NewSmartHTTPClient(ctx, a.GitalyServer)
 	if err != nil {
 		return fmt.Errorf("smarthttp.ReceivePack: %v", err)
 	}
 
-	if err := smarthttp.ReceivePack(ctx, &a.Repository, a.GL_ID, a.GL_USERNAME, a.GL_REPOSITORY, a.GitConfigOptions, cr, cw, gitProtocol); err != nil {
+	err = smarthttp.ReceivePack(ctx, &a.Repository, a.GL_ID, a.GL_USERNAME, a.GL_REPOSITORY, a.GitConfigOptions, cr, cw, gitProtocol)
+
+	if rejection := inspection.rejection(); rejection != nil {
+		logPushRejection(r, rejection)
+
+		// Git clients only read the response once they have sent the whole
+		// request.
+		io.Copy(ioutil.Discard, r.Body)
+
+		return writeReceivePackRejection(w, inspection.commands, inspection.capabilities, rejection.message)
+	}
+
+	if failure := inspection.failure(); failure != nil {
+		logPushInspectionFailure(r, failure)
+	}
+
+	if err != nil {
 		return fmt.Errorf("smarthttp.ReceivePack: %v", err)
 	}
 
@@ -0,0 +1,82 @@
+package git
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/andybalholm/brotli"
+	"github.com/golang/gddo/httputil"
+)
+
+var responseEncoders = map[string]func(io.Writer) io.WriteCloser{
+	"br": func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriter(w)
+	},
+	"gzip": func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+}
+
+// encodingResponseWriter compresses the response body on the fly with the
+// Content-Encoding the client prefers. The Content-Encoding header is only
+// set once the body gets written, so that failures before that still
+// produce a plain response.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	encoding  string
+	newWriter func(io.Writer) io.WriteCloser
+	writer    io.WriteCloser
+}
+
+// newEncodingResponseWriter returns w itself if the client does not accept
+// any encoding we support. Otherwise the caller must Close the returned
+// writer after writing the complete body, but not after a failure:
+// closing writes the end of the compressed stream, which would make a
+// truncated body look complete.
+func newEncodingResponseWriter(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := httputil.NegotiateContentEncoding(r, []string{"br", "gzip", "identity"})
+	newWriter, ok := responseEncoders[encoding]
+	if !ok {
+		return w
+	}
+
+	return &encodingResponseWriter{ResponseWriter: w, encoding: encoding, newWriter: newWriter}
+}
+
+func (w *encodingResponseWriter) start() {
+	if w.writer != nil {
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.writer = w.newWriter(w.ResponseWriter)
+}
+
+func (w *encodingResponseWriter) WriteHeader(status int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *encodingResponseWriter) Write(data []byte) (int, error) {
+	w.start()
+	return w.writer.Write(data)
+}
+
+func (w *encodingResponseWriter) Close() error {
+	if w.writer == nil {
+		return nil
+	}
+	return w.writer.Close()
+}
+
+// closeResponseEncoding finishes the compressed body, if any.
+func closeResponseEncoding(w http.ResponseWriter) error {
+	if ew, ok := w.(*encodingResponseWriter); ok {
+		return ew.Close()
+	}
+	return nil
+}
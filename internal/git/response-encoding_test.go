@@ -0,0 +1,70 @@
+package git
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodingResponseWriter(t *testing.T) {
+	body := strings.Repeat("diff --git a/README.md b/README.md\n", 1000)
+
+	testCases := []struct {
+		acceptEncoding string
+		encoding       string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{acceptEncoding: "", encoding: ""},
+		{acceptEncoding: "deflate", encoding: ""},
+		{acceptEncoding: "gzip", encoding: "gzip", decode: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{acceptEncoding: "gzip, deflate, br", encoding: "br", decode: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+		{acceptEncoding: "br;q=0.5, gzip", encoding: "gzip", decode: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/diff", nil)
+			if tc.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+
+			ew := newEncodingResponseWriter(w, r)
+			_, err := io.WriteString(ew, body)
+			require.NoError(t, err)
+			require.NoError(t, closeResponseEncoding(ew))
+
+			require.Equal(t, tc.encoding, w.Header().Get("Content-Encoding"))
+			require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+			var decoded io.Reader = w.Body
+			if tc.decode != nil {
+				require.Less(t, w.Body.Len(), len(body))
+				decoded, err = tc.decode(w.Body)
+				require.NoError(t, err)
+			}
+
+			data, err := ioutil.ReadAll(decoded)
+			require.NoError(t, err)
+			require.Equal(t, body, string(data))
+		})
+	}
+}
+
+func TestEncodingResponseWriterWithoutBody(t *testing.T) {
+	r := httptest.NewRequest("GET", "/diff", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	ew := newEncodingResponseWriter(w, r)
+	require.NoError(t, closeResponseEncoding(ew))
+
+	require.Empty(t, w.Header().Get("Content-Encoding"), "failures before the body keep a plain response")
+	require.Equal(t, 0, w.Body.Len())
+}
@@ -7,6 +7,7 @@ import (
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/bandwidth"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
@@ -14,17 +15,27 @@ import (
 
 type snapshot struct {
 	senddata.Prefix
+	shaper *bandwidth.Shaper
 }
 
 type snapshotParams struct {
 	GitalyServer       gitaly.Server
 	GetSnapshotRequest string
+	// BandwidthLimit overrides the per-identity bandwidth limit in bytes
+	// per second if positive
+	BandwidthLimit int64
 }
 
 var (
-	SendSnapshot = &snapshot{"git-snapshot:"}
+	SendSnapshot = &snapshot{Prefix: "git-snapshot:"}
 )
 
+// NewSendSnapshot returns the snapshot injecter that sends snapshots at
+// the pace of shaper.
+func NewSendSnapshot(shaper *bandwidth.Shaper) senddata.Injecter {
+	return &snapshot{Prefix: SendSnapshot.Prefix, shaper: shaper}
+}
+
 func (s *snapshot) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 	var params snapshotParams
 
@@ -33,6 +44,9 @@ func (s *snapshot) Inject(w http.ResponseWriter, r *http.Request, sendData strin
 		return
 	}
 
+	w, done := s.shaper.Wrap(w, r, "", params.BandwidthLimit)
+	defer done()
+
 	request := &gitalypb.GetSnapshotRequest{}
 	if err := gitaly.UnmarshalJSON(params.GetSnapshotRequest, request); err != nil {
 		helper.Fail500(w, r, fmt.Errorf("SendSnapshot: unmarshal GetSnapshotRequest: %v", err))
@@ -52,7 +66,7 @@ func (s *snapshot) Inject(w http.ResponseWriter, r *http.Request, sendData strin
 	}
 
 	w.Header().Del("Content-Length")
-	w.Header().Set("Content-Disposition", `attachment; filename="snapshot.tar"`)
+	setAttachmentFilename(w, "snapshot.tar")
 	w.Header().Set("Content-Type", "application/x-tar")
 	w.Header().Set("Content-Transfer-Encoding", "binary")
 	w.Header().Set("Cache-Control", "private")
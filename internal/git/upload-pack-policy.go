@@ -0,0 +1,200 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+)
+
+const (
+	uploadPackActionReject = "reject"
+	uploadPackActionQueue  = "queue"
+	uploadPackActionAllow  = "allow"
+
+	defaultUploadPackRejectMessage = "this request is not allowed by the server"
+)
+
+var (
+	uploadPackRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_requests_total",
+			Help: "How many git-upload-pack requests have been processed, by protocol command and requested features",
+		},
+		[]string{"command", "protocol", "filter", "deepen", "full_clone", "action"},
+	)
+
+	uploadPackWants = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_upload_pack_wants",
+			Help:    "How many objects or refs git-upload-pack fetch requests want",
+			Buckets: []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadPackRequests)
+	prometheus.MustRegister(uploadPackWants)
+}
+
+// UploadPackPolicy decides whether git-upload-pack requests may proceed
+// based on what they ask for, e.g. to reject or throttle unfiltered full
+// clones of huge repositories.
+type UploadPackPolicy struct {
+	rules []*uploadPackRule
+}
+
+type uploadPackRule struct {
+	config.UploadPackRule
+	queue *queueing.Queue
+}
+
+// NewUploadPackPolicy sets up the validated rules. Rules are evaluated in
+// order and the first matching rule applies.
+func NewUploadPackPolicy(cfg []config.UploadPackRule) *UploadPackPolicy {
+	p := &UploadPackPolicy{}
+
+	for _, c := range cfg {
+		rule := &uploadPackRule{UploadPackRule: c}
+
+		if c.Action == uploadPackActionQueue {
+			timeout := queueing.DefaultTimeout
+			if c.QueueTimeout != nil {
+				timeout = c.QueueTimeout.Duration
+			}
+			rule.queue = queueing.NewQueue("git_upload_pack_"+c.Name, c.Limit, c.QueueLimit, timeout)
+		}
+
+		p.rules = append(p.rules, rule)
+	}
+
+	return p
+}
+
+func (rule *uploadPackRule) matches(a *api.Response, req *uploadPackRequest) bool {
+	if rule.Command != "" && rule.Command != req.command {
+		return false
+	}
+	if rule.FullClone && !req.fullClone() {
+		return false
+	}
+	if rule.Unfiltered && req.filter != "" {
+		return false
+	}
+	if len(rule.Repositories) == 0 {
+		return true
+	}
+
+	for _, pattern := range rule.Repositories {
+		for _, name := range []string{a.GL_REPOSITORY, a.Repository.RelativePath} {
+			if ok, _ := path.Match(pattern, name); ok && name != "" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (rule *uploadPackRule) message() string {
+	if rule.Message != "" {
+		return rule.Message
+	}
+	return defaultUploadPackRejectMessage
+}
+
+// empty reports whether no rule would ever apply, so that requests don't
+// need to be inspected before they are sent to Gitaly.
+func (p *UploadPackPolicy) empty() bool {
+	return p == nil || len(p.rules) == 0
+}
+
+// admit applies the first matching rule to the request. If the request may
+// proceed the returned release function must be called once it is done.
+// Otherwise rejectMessage explains to the Git client why it was turned down.
+func (p *UploadPackPolicy) admit(a *api.Response, req *uploadPackRequest) (action string, release func(), rejectMessage string) {
+	noop := func() {}
+	if p == nil {
+		return uploadPackActionAllow, noop, ""
+	}
+
+	for _, rule := range p.rules {
+		if !rule.matches(a, req) {
+			continue
+		}
+
+		if rule.queue == nil {
+			return uploadPackActionReject, nil, rule.message()
+		}
+
+		switch err := rule.queue.Acquire(); err {
+		case nil:
+			return uploadPackActionQueue, rule.queue.Release, ""
+		case queueing.ErrTooManyRequests:
+			return uploadPackActionReject, nil, "too many requests for this repository, please try again later"
+		default:
+			return uploadPackActionReject, nil, "timed out waiting for a free slot, please try again later"
+		}
+	}
+
+	return uploadPackActionAllow, noop, ""
+}
+
+func logUploadPackRequest(r *http.Request, req *uploadPackRequest, action string) {
+	protocol := "v0"
+	if req.v2 {
+		protocol = "v2"
+	}
+
+	// Clients choose the command name so we must not use it verbatim as a
+	// metric label.
+	commandLabel := "other"
+	switch req.command {
+	case "fetch", "ls-refs":
+		commandLabel = req.command
+	case "":
+		commandLabel = "unknown"
+	}
+
+	uploadPackRequests.WithLabelValues(
+		commandLabel,
+		protocol,
+		req.filterType(),
+		strconv.FormatBool(req.deepen),
+		strconv.FormatBool(req.fullClone()),
+		action,
+	).Inc()
+
+	if req.command == "fetch" {
+		uploadPackWants.Observe(float64(req.wants))
+	}
+
+	log.WithContextFields(r.Context(), log.Fields{
+		"upload_pack_command":    req.command,
+		"upload_pack_protocol":   protocol,
+		"upload_pack_wants":      req.wants,
+		"upload_pack_haves":      req.haves,
+		"upload_pack_shallows":   req.shallows,
+		"upload_pack_deepen":     req.deepen,
+		"upload_pack_filter":     req.filter,
+		"upload_pack_full_clone": req.fullClone(),
+		"upload_pack_action":     action,
+	}).Info("git-upload-pack request")
+}
+
+// writeUploadPackError sends an ERR packet, which Git clients show to the
+// user as "remote error: <message>".
+func writeUploadPackError(w http.ResponseWriter, message string) error {
+	line := "ERR " + message + "\n"
+	_, err := fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+	return err
+}
@@ -0,0 +1,152 @@
+package git
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+)
+
+func TestUploadPackPolicyRejectsMatchingRequests(t *testing.T) {
+	var calls int32
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			atomic.AddInt32(&calls, 1)
+			drainUploadPackRequest(t, stream)
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: []byte("pack")})
+		},
+	})
+	defer cleanUp()
+
+	policy := NewUploadPackPolicy([]config.UploadPackRule{
+		{
+			Repositories: []string{"project-4*"},
+			FullClone:    true,
+			Unfiltered:   true,
+			Action:       "reject",
+			Message:      "please use a partial clone",
+		},
+	})
+
+	partialClone := pkt("command=fetch\n") + "0001" + pkt("want 1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541\n") + pkt("filter blob:none\n") + pkt("done\n") + "0000"
+
+	testCases := []struct {
+		desc         string
+		glRepository string
+		body         string
+		rejected     bool
+	}{
+		{desc: "v0 full clone", glRepository: "project-42", body: fetchRequest, rejected: true},
+		{desc: "v2 full clone", glRepository: "project-42", body: v2FetchRequest, rejected: true},
+		{desc: "other repository", glRepository: "project-1", body: v2FetchRequest},
+		{desc: "partial clone", glRepository: "project-42", body: partialClone},
+		{desc: "incremental fetch", glRepository: "project-42", body: negotiateRequest},
+		{desc: "ls-refs", glRepository: "project-42", body: v2LsRefsRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			before := atomic.LoadInt32(&calls)
+			a := &api.Response{GL_REPOSITORY: tc.glRepository, GitalyServer: gitaly.Server{Address: addr}}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(tc.body))
+			require.NoError(t, handleUploadPack(NewHttpResponseWriter(w), r, a, nil, policy))
+
+			if tc.rejected {
+				require.Equal(t, pkt("ERR please use a partial clone\n"), w.Body.String())
+				require.Equal(t, before, atomic.LoadInt32(&calls))
+			} else {
+				require.Equal(t, "pack", w.Body.String())
+				require.Equal(t, before+1, atomic.LoadInt32(&calls))
+			}
+		})
+	}
+}
+
+func TestUploadPackPolicyQueuesMatchingRequests(t *testing.T) {
+	policy := NewUploadPackPolicy([]config.UploadPackRule{
+		{
+			Name:         "test_full_clones",
+			Command:      "fetch",
+			FullClone:    true,
+			Action:       "queue",
+			Limit:        1,
+			QueueLimit:   1,
+			QueueTimeout: &config.TomlDuration{Duration: 10 * time.Millisecond},
+		},
+	})
+	a := &api.Response{}
+	fullClone := parseUploadPackRequest([]byte(v2FetchRequest))
+
+	action, release, _ := policy.admit(a, fullClone)
+	require.Equal(t, "queue", action)
+	require.NotNil(t, release)
+
+	action, otherRelease, message := policy.admit(a, fullClone)
+	require.Equal(t, "reject", action)
+	require.Nil(t, otherRelease)
+	require.Contains(t, message, "timed out")
+
+	action, otherRelease, _ = policy.admit(a, parseUploadPackRequest([]byte(negotiateRequest)))
+	require.Equal(t, "allow", action, "only full clones are queued")
+	otherRelease()
+
+	release()
+
+	action, release, _ = policy.admit(a, fullClone)
+	require.Equal(t, "queue", action)
+	release()
+}
+
+func TestUploadPackPolicyMatchesRelativePath(t *testing.T) {
+	policy := NewUploadPackPolicy([]config.UploadPackRule{
+		{Repositories: []string{"huge/*.git"}, Action: "reject"},
+	})
+
+	req := parseUploadPackRequest([]byte(fetchRequest))
+
+	a := &api.Response{Repository: gitalypb.Repository{RelativePath: "huge/linux.git"}}
+	action, _, message := policy.admit(a, req)
+	require.Equal(t, "reject", action)
+	require.Equal(t, defaultUploadPackRejectMessage, message)
+
+	a = &api.Response{Repository: gitalypb.Repository{RelativePath: "small/linux.git"}}
+	action, _, _ = policy.admit(a, req)
+	require.Equal(t, "allow", action)
+}
+
+func TestUploadPackRequestsWithUnknownFilters(t *testing.T) {
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			drainUploadPackRequest(t, stream)
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: []byte("pack")})
+		},
+	})
+	defer cleanUp()
+
+	other := uploadPackRequests.WithLabelValues("fetch", "v2", "other", "false", "false", "allow")
+	before := testutil.ToFloat64(other)
+
+	for _, filter := range []string{"foo1", "foo2"} {
+		body := pkt("command=fetch\n") + "0001" + pkt("want 1a0dd3d2b8e8a05d1e1a1bcd1bc1dc4d9db6b541\n") + pkt("filter "+filter+"\n") + pkt("done\n") + "0000"
+		a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/git-upload-pack", strings.NewReader(body))
+		require.NoError(t, handleUploadPack(NewHttpResponseWriter(w), r, a, nil, nil))
+		require.Equal(t, "pack", w.Body.String())
+	}
+
+	require.Equal(t, before+2, testutil.ToFloat64(other), "unknown filters share one label value")
+}
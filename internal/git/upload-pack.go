@@ -1,10 +1,13 @@
 package git
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
@@ -16,9 +19,13 @@ var (
 	uploadPackTimeout = 10 * time.Minute
 )
 
+// Requests with huge numbers of haves are neither worth caching nor
+// inspecting any further, so we only buffer this much of a request body.
+const maxUploadPackRequestBuffer = 1024 * 1024
+
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response, cache *PackCache, policy *UploadPackPolicy) error {
 	ctx := r.Context()
 
 	// Prevent the client from holding the connection open indefinitely. A
@@ -31,15 +38,48 @@ func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) e
 	readerCtx, cancel := context.WithTimeout(ctx, uploadPackTimeout)
 	defer cancel()
 
-	limited := helper.NewContextReader(readerCtx, r.Body)
-	cr, cw := helper.NewWriteAfterReader(limited, w)
-	defer cw.Flush()
+	var body io.Reader = helper.NewContextReader(readerCtx, r.Body)
 
 	action := getService(r)
 	writePostRPCHeader(w, action)
 
 	gitProtocol := r.Header.Get("Git-Protocol")
 
+	if cache == nil && policy.empty() {
+		// Nobody needs to see the request before Gitaly does, so we stream
+		// it and only keep its beginning around for logging.
+		prefix := &prefixBuffer{limit: maxUploadPackRequestBuffer}
+		cr, cw := helper.NewWriteAfterReader(io.TeeReader(body, prefix), w)
+		defer cw.Flush()
+
+		err := handleUploadPackWithGitaly(ctx, a, cr, cw, gitProtocol)
+		logUploadPackRequest(r, parseUploadPackRequest(prefix.Bytes()), uploadPackActionAllow)
+		return err
+	}
+
+	buffered, err := ioutil.ReadAll(io.LimitReader(body, maxUploadPackRequestBuffer+1))
+	if err != nil {
+		return fmt.Errorf("read request body: %v", err)
+	}
+	body = io.MultiReader(bytes.NewReader(buffered), body)
+
+	req := parseUploadPackRequest(buffered)
+	action, release, rejectMessage := policy.admit(a, req)
+	logUploadPackRequest(r, req, action)
+	if release == nil {
+		return writeUploadPackError(w, rejectMessage)
+	}
+	defer release()
+
+	if cache != nil && len(buffered) <= maxUploadPackRequestBuffer {
+		if ok, err := cache.serve(ctx, w, a, gitProtocol, buffered); ok || err != nil {
+			return err
+		}
+	}
+
+	cr, cw := helper.NewWriteAfterReader(body, w)
+	defer cw.Flush()
+
 	return handleUploadPackWithGitaly(ctx, a, cr, cw, gitProtocol)
 }
 
@@ -55,3 +95,33 @@ func handleUploadPackWithGitaly(ctx context.Context, a *api.Response, clientRequ
 
 	return nil
 }
+
+// prefixBuffer keeps the first limit bytes written to it and discards the
+// rest. Gitaly may still be reading the request when the RPC fails, so
+// writes and reads are synchronized.
+type prefixBuffer struct {
+	limit int
+	buf   []byte
+	m     sync.Mutex
+}
+
+func (p *prefixBuffer) Write(data []byte) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if n := p.limit - len(p.buf); n > 0 {
+		if n > len(data) {
+			n = len(data)
+		}
+		p.buf = append(p.buf, data[:n]...)
+	}
+
+	return len(data), nil
+}
+
+func (p *prefixBuffer) Bytes() []byte {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return append([]byte(nil), p.buf...)
+}
@@ -1,6 +1,7 @@
 package git
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -14,6 +15,7 @@ import (
 	"google.golang.org/grpc"
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+	"gitlab.com/gitlab-org/gitaly/streamio"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
@@ -34,13 +36,18 @@ func (f *fakeReader) Read(b []byte) (int, error) {
 
 type smartHTTPServiceServer struct {
 	gitalypb.UnimplementedSmartHTTPServiceServer
-	PostUploadPackFunc func(gitalypb.SmartHTTPService_PostUploadPackServer) error
+	PostUploadPackFunc  func(gitalypb.SmartHTTPService_PostUploadPackServer) error
+	PostReceivePackFunc func(gitalypb.SmartHTTPService_PostReceivePackServer) error
 }
 
 func (srv *smartHTTPServiceServer) PostUploadPack(s gitalypb.SmartHTTPService_PostUploadPackServer) error {
 	return srv.PostUploadPackFunc(s)
 }
 
+func (srv *smartHTTPServiceServer) PostReceivePack(s gitalypb.SmartHTTPService_PostReceivePackServer) error {
+	return srv.PostReceivePackFunc(s)
+}
+
 func TestUploadPackTimesOut(t *testing.T) {
 	uploadPackTimeout = time.Millisecond
 	defer func() { uploadPackTimeout = originalUploadPackTimeout }()
@@ -60,10 +67,41 @@ func TestUploadPackTimesOut(t *testing.T) {
 	r := httptest.NewRequest("GET", "/", body)
 	a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
 
-	err := handleUploadPack(NewHttpResponseWriter(w), r, a)
+	err := handleUploadPack(NewHttpResponseWriter(w), r, a, nil, nil)
 	require.EqualError(t, err, "smarthttp.UploadPack: busyReader: context deadline exceeded")
 }
 
+func TestUploadPackStreamsRequestWithoutCacheOrPolicy(t *testing.T) {
+	// Larger than what we would buffer for the pack cache or a policy
+	request := bytes.Repeat([]byte("0032have 0123456789012345678901234567890123456789\n"), 30000)
+
+	received := make(chan []byte, 1)
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			_, err := stream.Recv()
+			require.NoError(t, err)
+
+			data, err := ioutil.ReadAll(streamio.NewReader(func() ([]byte, error) {
+				req, err := stream.Recv()
+				return req.GetData(), err
+			}))
+			require.NoError(t, err)
+			received <- data
+
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: []byte("0008NAK\n")})
+		},
+	})
+	defer cleanUp()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/git-upload-pack", bytes.NewReader(request))
+	a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+	require.NoError(t, handleUploadPack(NewHttpResponseWriter(w), r, a, nil, nil))
+	require.Equal(t, request, <-received)
+	require.Equal(t, "0008NAK\n", w.Body.String())
+}
+
 func startSmartHTTPServer(t testing.TB, s gitalypb.SmartHTTPServiceServer) (string, func()) {
 	tmp, err := ioutil.TempDir("", "")
 	require.NoError(t, err)
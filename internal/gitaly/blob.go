@@ -1,11 +1,10 @@
 package gitaly
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"net/http"
-	"strconv"
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 	"gitlab.com/gitlab-org/gitaly/streamio"
@@ -15,27 +14,33 @@ type BlobClient struct {
 	gitalypb.BlobServiceClient
 }
 
-func (client *BlobClient) SendBlob(ctx context.Context, w http.ResponseWriter, request *gitalypb.GetBlobRequest) error {
+// BlobReader returns the size of the whole blob and a reader for its
+// content, which is truncated to request.Limit bytes unless that is -1.
+func (client *BlobClient) BlobReader(ctx context.Context, request *gitalypb.GetBlobRequest) (int64, io.Reader, error) {
 	c, err := client.GetBlob(ctx, request)
 	if err != nil {
-		return fmt.Errorf("rpc failed: %v", err)
+		return 0, nil, fmt.Errorf("rpc failed: %v", err)
 	}
 
-	firstResponseReceived := false
-	rr := streamio.NewReader(func() ([]byte, error) {
-		resp, err := c.Recv()
+	// Only the first response carries the size of the blob
+	first, err := c.Recv()
+	if err == io.EOF {
+		return 0, bytes.NewReader(nil), nil
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("rpc failed: %v", err)
+	}
 
-		if !firstResponseReceived && err == nil {
-			firstResponseReceived = true
-			w.Header().Set("Content-Length", strconv.FormatInt(resp.GetSize(), 10))
+	firstConsumed := false
+	rr := streamio.NewReader(func() ([]byte, error) {
+		if !firstConsumed {
+			firstConsumed = true
+			return first.GetData(), nil
 		}
 
+		resp, err := c.Recv()
 		return resp.GetData(), err
 	})
 
-	if _, err := io.Copy(w, rr); err != nil {
-		return fmt.Errorf("copy rpc data: %v", err)
-	}
-
-	return nil
+	return first.GetSize(), rr, nil
 }
@@ -0,0 +1,389 @@
+package gitaly
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto" //lint:ignore SA1019 https://gitlab.com/gitlab-org/gitlab-workhorse/-/issues/274
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// These RPCs don't change the repository, so any replica in
+// Server.Addresses can serve them.
+var readOnlyMethods = map[string]bool{
+	"/gitaly.SmartHTTPService/InfoRefsUploadPack": true,
+	"/gitaly.SmartHTTPService/PostUploadPack":     true,
+	"/gitaly.BlobService/GetBlob":                 true,
+	"/gitaly.RepositoryService/GetArchive":        true,
+	"/gitaly.RepositoryService/GetSnapshot":       true,
+	"/gitaly.RepositoryService/CreateBundle":      true,
+	"/gitaly.DiffService/RawDiff":                 true,
+	"/gitaly.DiffService/RawPatch":                true,
+}
+
+// Slow calls of these RPCs are hedged to the next replica
+var hedgedMethods = map[string]bool{
+	"/gitaly.BlobService/GetBlob":          true,
+	"/gitaly.RepositoryService/GetArchive": true,
+}
+
+// We can only fail over while we can replay the request to the next
+// replica, so we give up on failover after this many request bytes.
+const maxReplayBytes = 1024 * 1024
+
+var (
+	replicaAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_replica_attempts_total",
+			Help: "Number of attempts of read-only Gitaly RPCs on replicas, by address and result",
+		},
+		[]string{"address", "result"},
+	)
+
+	hedgedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_hedged_requests_total",
+			Help: "Number of slow read-only Gitaly RPCs that were hedged, by the address of the hedge",
+		},
+		[]string{"address"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(replicaAttempts)
+	prometheus.MustRegister(hedgedRequests)
+}
+
+type replicasKey struct{}
+type attemptKey struct{}
+
+func withReplicas(ctx context.Context, server Server) context.Context {
+	if len(server.Addresses) == 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, replicasKey{}, server)
+}
+
+func failoverStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	server, ok := ctx.Value(replicasKey{}).(Server)
+	if !ok || !readOnlyMethods[method] || ctx.Value(attemptKey{}) != nil {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+
+	s := &failoverStream{ctx: ctx, desc: desc, method: method, opts: opts, server: server, replayable: true}
+	a, err := s.openNext()
+	if err != nil {
+		return nil, err
+	}
+	s.current = a
+
+	return s, nil
+}
+
+// failoverStream tries the replicas of a Server in order until one of them
+// is available. Once a replica has responded we stick with it, because the
+// response may already be on its way to the client.
+type failoverStream struct {
+	ctx    context.Context
+	desc   *grpc.StreamDesc
+	method string
+	opts   []grpc.CallOption
+	server Server
+
+	sync.Mutex
+	current *attempt
+	// next is the index of the next replica in server.Addresses
+	next int
+	// sent holds the messages to replay on the next replica
+	sent       []proto.Message
+	sentBytes  int
+	replayable bool
+	closed     bool
+	committed  bool
+}
+
+type attempt struct {
+	grpc.ClientStream
+	address string
+	cancel  context.CancelFunc
+}
+
+// openNext opens the stream on the next replica that is available, and
+// replays what we sent so far. It must be called with s locked.
+func (s *failoverStream) openNext() (*attempt, error) {
+	err := status.Error(codes.Unavailable, "no Gitaly replica left to try")
+
+	for s.next < len(s.server.Addresses) {
+		address := s.server.Addresses[s.next]
+		s.next++
+
+		var a *attempt
+		a, err = s.open(address)
+		if err == nil {
+			return a, nil
+		}
+
+		if status.Code(err) != codes.Unavailable {
+			replicaAttempts.WithLabelValues(address, "error").Inc()
+			return nil, err
+		}
+		replicaAttempts.WithLabelValues(address, "unavailable").Inc()
+	}
+
+	return nil, err
+}
+
+func (s *failoverStream) open(address string) (*attempt, error) {
+	conn, err := getOrCreateConnection(Server{Address: address, Token: s.server.Token})
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "connect to %s: %v", address, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(s.ctx, attemptKey{}, true))
+	stream, err := conn.NewStream(ctx, s.desc, s.method, s.opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	for _, m := range s.sent {
+		if err := stream.SendMsg(m); err != nil {
+			// RecvMsg will tell us what went wrong
+			break
+		}
+	}
+	if s.closed {
+		stream.CloseSend()
+	}
+
+	return &attempt{ClientStream: stream, address: address, cancel: cancel}, nil
+}
+
+func (s *failoverStream) attempt() *attempt {
+	s.Lock()
+	defer s.Unlock()
+	return s.current
+}
+
+func (s *failoverStream) Header() (metadata.MD, error) { return s.attempt().Header() }
+func (s *failoverStream) Trailer() metadata.MD         { return s.attempt().Trailer() }
+func (s *failoverStream) Context() context.Context     { return s.attempt().Context() }
+
+func (s *failoverStream) CloseSend() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	return s.current.CloseSend()
+}
+
+func (s *failoverStream) SendMsg(m interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.committed && s.replayable {
+		s.record(m)
+	}
+
+	err := s.current.SendMsg(m)
+	if err == io.EOF && !s.committed && s.replayable {
+		// The replica went away. RecvMsg finds out why, and fails over if it
+		// can.
+		return nil
+	}
+
+	return err
+}
+
+func (s *failoverStream) record(m interface{}) {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		s.replayable = false
+		s.sent = nil
+		return
+	}
+
+	msg = proto.Clone(msg)
+	s.sentBytes += proto.Size(msg)
+	if s.sentBytes > maxReplayBytes {
+		s.replayable = false
+		s.sent = nil
+		return
+	}
+
+	s.sent = append(s.sent, msg)
+}
+
+func (s *failoverStream) RecvMsg(m interface{}) error {
+	s.Lock()
+	current, committed := s.current, s.committed
+	s.Unlock()
+
+	if !committed {
+		return s.recvFirst(m)
+	}
+
+	err := current.RecvMsg(m)
+	if err != nil {
+		current.cancel()
+	}
+	return err
+}
+
+// recvFirst waits for the first response, and fails over to the next
+// replica for as long as the current one is unavailable.
+func (s *failoverStream) recvFirst(m interface{}) error {
+	var a *attempt
+	var err error
+	if s.hedged() {
+		a, err = s.recvHedged(m)
+	} else {
+		a = s.attempt()
+		err = a.RecvMsg(m)
+	}
+
+	for status.Code(err) == codes.Unavailable {
+		next := s.failover(a)
+		if next == nil {
+			break
+		}
+
+		a = next
+		err = a.RecvMsg(m)
+	}
+
+	s.commit(a, err)
+	return err
+}
+
+// failover replaces the unavailable attempt a with one on the next
+// replica. It returns nil if there is none.
+func (s *failoverStream) failover(a *attempt) *attempt {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.replayable || s.next >= len(s.server.Addresses) {
+		return nil
+	}
+
+	next, err := s.openNext()
+	if err != nil {
+		return nil
+	}
+
+	replicaAttempts.WithLabelValues(a.address, "unavailable").Inc()
+	a.cancel()
+	s.current = next
+	return next
+}
+
+func (s *failoverStream) commit(a *attempt, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.current = a
+	s.committed = true
+	s.sent = nil
+
+	result := "ok"
+	if err != nil && err != io.EOF {
+		result = "error"
+		if status.Code(err) == codes.Unavailable {
+			result = "unavailable"
+		}
+	}
+	replicaAttempts.WithLabelValues(a.address, result).Inc()
+
+	if err != nil {
+		a.cancel()
+	}
+}
+
+func (s *failoverStream) hedged() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return hedgeDelay > 0 && hedgedMethods[s.method] && !s.desc.ClientStreams && s.next < len(s.server.Addresses)
+}
+
+type hedgeResult struct {
+	attempt *attempt
+	msg     proto.Message
+	err     error
+}
+
+// recvHedged waits for the first response of the current attempt, and
+// makes the same call on the next replica if that takes longer than the
+// hedge delay. The first replica to respond wins, and the other call is
+// canceled.
+func (s *failoverStream) recvHedged(m interface{}) (*attempt, error) {
+	results := make(chan hedgeResult, 2)
+	recv := func(a *attempt) {
+		// Both calls receive into their own message, and we copy the winner
+		msg := proto.Clone(m.(proto.Message))
+		msg.Reset()
+		go func() {
+			err := a.RecvMsg(msg)
+			results <- hedgeResult{attempt: a, msg: msg, err: err}
+		}()
+	}
+
+	first := s.attempt()
+	recv(first)
+
+	timer := time.NewTimer(hedgeDelay)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		return res.attempt, res.copyTo(m)
+	case <-timer.C:
+	}
+
+	s.Lock()
+	hedge, err := s.openNext()
+	s.Unlock()
+	if err != nil {
+		res := <-results
+		return res.attempt, res.copyTo(m)
+	}
+
+	hedgedRequests.WithLabelValues(hedge.address).Inc()
+	recv(hedge)
+
+	res := <-results
+	if status.Code(res.err) == codes.Unavailable {
+		replicaAttempts.WithLabelValues(res.attempt.address, "unavailable").Inc()
+		res.attempt.cancel()
+		res = <-results
+	} else {
+		loser := first
+		if res.attempt == first {
+			loser = hedge
+		}
+		replicaAttempts.WithLabelValues(loser.address, "canceled").Inc()
+		loser.cancel()
+	}
+
+	s.Lock()
+	s.current = res.attempt
+	s.Unlock()
+
+	return res.attempt, res.copyTo(m)
+}
+
+func (res hedgeResult) copyTo(m interface{}) error {
+	if res.err == nil {
+		m.(proto.Message).Reset()
+		proto.Merge(m.(proto.Message), res.msg)
+	}
+
+	return res.err
+}
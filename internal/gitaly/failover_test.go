@@ -0,0 +1,208 @@
+package gitaly
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBlobReaderFailsOverToAvailableReplica(t *testing.T) {
+	defer CloseConnections()
+
+	down := unavailableAddress(t)
+	up, cleanUp := startBlobServer(t, func(req *gitalypb.GetBlobRequest, stream gitalypb.BlobService_GetBlobServer) error {
+		return stream.Send(&gitalypb.GetBlobResponse{Size: 5, Data: []byte("hello")})
+	})
+	defer cleanUp()
+
+	unavailable := testutil.ToFloat64(replicaAttempts.WithLabelValues(down, "unavailable"))
+	ok := testutil.ToFloat64(replicaAttempts.WithLabelValues(up, "ok"))
+
+	size, data := readBlob(t, Server{Address: down, Addresses: []string{down, up}})
+	require.Equal(t, int64(5), size)
+	require.Equal(t, "hello", data)
+
+	require.Equal(t, unavailable+1, testutil.ToFloat64(replicaAttempts.WithLabelValues(down, "unavailable")))
+	require.Equal(t, ok+1, testutil.ToFloat64(replicaAttempts.WithLabelValues(up, "ok")))
+}
+
+func TestBlobReaderOnlyFailsOverWhenUnavailable(t *testing.T) {
+	defer CloseConnections()
+
+	notFound, cleanUpNotFound := startBlobServer(t, func(req *gitalypb.GetBlobRequest, stream gitalypb.BlobService_GetBlobServer) error {
+		return status.Error(codes.NotFound, "no such blob")
+	})
+	defer cleanUpNotFound()
+
+	called := false
+	up, cleanUp := startBlobServer(t, func(req *gitalypb.GetBlobRequest, stream gitalypb.BlobService_GetBlobServer) error {
+		called = true
+		return stream.Send(&gitalypb.GetBlobResponse{Size: 5, Data: []byte("hello")})
+	})
+	defer cleanUp()
+
+	ctx, c, err := NewBlobClient(context.Background(), Server{Address: notFound, Addresses: []string{notFound, up}})
+	require.NoError(t, err)
+
+	_, _, err = c.BlobReader(ctx, &gitalypb.GetBlobRequest{Limit: -1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no such blob")
+	require.False(t, called, "the next replica is not asked")
+}
+
+func TestBlobReaderHedgesSlowReplica(t *testing.T) {
+	defer CloseConnections()
+
+	hedgeDelay = 10 * time.Millisecond
+	defer func() { hedgeDelay = 0 }()
+
+	canceled := make(chan struct{})
+	slow, cleanUpSlow := startBlobServer(t, func(req *gitalypb.GetBlobRequest, stream gitalypb.BlobService_GetBlobServer) error {
+		<-stream.Context().Done()
+		close(canceled)
+		return stream.Context().Err()
+	})
+	defer cleanUpSlow()
+
+	fast, cleanUpFast := startBlobServer(t, func(req *gitalypb.GetBlobRequest, stream gitalypb.BlobService_GetBlobServer) error {
+		return stream.Send(&gitalypb.GetBlobResponse{Size: 4, Data: []byte("fast")})
+	})
+	defer cleanUpFast()
+
+	hedged := testutil.ToFloat64(hedgedRequests.WithLabelValues(fast))
+
+	size, data := readBlob(t, Server{Address: slow, Addresses: []string{slow, fast}})
+	require.Equal(t, int64(4), size)
+	require.Equal(t, "fast", data)
+	require.Equal(t, hedged+1, testutil.ToFloat64(hedgedRequests.WithLabelValues(fast)))
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow call was not canceled")
+	}
+}
+
+func TestUploadPackFailsOverToAvailableReplica(t *testing.T) {
+	defer CloseConnections()
+
+	down := unavailableAddress(t)
+	// This one fails after it has read the request, so we have to replay it
+	failing, cleanUpFailing := startEchoUploadPackServer(t, true)
+	defer cleanUpFailing()
+	up, cleanUp := startEchoUploadPackServer(t, false)
+	defer cleanUp()
+
+	ctx, c, err := NewSmartHTTPClient(context.Background(), Server{Address: down, Addresses: []string{down, failing, up}})
+	require.NoError(t, err)
+
+	request := bytes.Repeat([]byte("0032want 0123456789012345678901234567890123456789\n"), 1000)
+	response := &bytes.Buffer{}
+	require.NoError(t, c.UploadPack(ctx, &gitalypb.Repository{}, bytes.NewReader(request), response, nil, ""))
+	require.Equal(t, request, response.Bytes())
+}
+
+func TestUploadPackDoesNotFailOverLargeRequests(t *testing.T) {
+	defer CloseConnections()
+
+	failing, cleanUpFailing := startEchoUploadPackServer(t, true)
+	defer cleanUpFailing()
+	up, cleanUp := startEchoUploadPackServer(t, false)
+	defer cleanUp()
+
+	ctx, c, err := NewSmartHTTPClient(context.Background(), Server{Address: failing, Addresses: []string{failing, up}})
+	require.NoError(t, err)
+
+	request := bytes.Repeat([]byte("x"), 2*maxReplayBytes)
+	err = c.UploadPack(ctx, &gitalypb.Repository{}, bytes.NewReader(request), ioutil.Discard, nil, "")
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func readBlob(t *testing.T, server Server) (int64, string) {
+	ctx, c, err := NewBlobClient(context.Background(), server)
+	require.NoError(t, err)
+
+	size, reader, err := c.BlobReader(ctx, &gitalypb.GetBlobRequest{Limit: -1})
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+
+	return size, string(data)
+}
+
+// unavailableAddress returns an address that refuses connections
+func unavailableAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	return "tcp://" + listener.Addr().String()
+}
+
+type blobServer struct {
+	gitalypb.UnimplementedBlobServiceServer
+	getBlob func(*gitalypb.GetBlobRequest, gitalypb.BlobService_GetBlobServer) error
+}
+
+func (s *blobServer) GetBlob(req *gitalypb.GetBlobRequest, stream gitalypb.BlobService_GetBlobServer) error {
+	return s.getBlob(req, stream)
+}
+
+func startBlobServer(t *testing.T, getBlob func(*gitalypb.GetBlobRequest, gitalypb.BlobService_GetBlobServer) error) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	gitalypb.RegisterBlobServiceServer(grpcServer, &blobServer{getBlob: getBlob})
+	go grpcServer.Serve(listener)
+
+	return "tcp://" + listener.Addr().String(), grpcServer.Stop
+}
+
+type echoUploadPackServer struct {
+	gitalypb.UnimplementedSmartHTTPServiceServer
+	unavailable bool
+}
+
+func (s *echoUploadPackServer) PostUploadPack(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+	request := &bytes.Buffer{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		request.Write(req.GetData())
+	}
+
+	if s.unavailable {
+		return status.Error(codes.Unavailable, "shutting down")
+	}
+
+	return stream.Send(&gitalypb.PostUploadPackResponse{Data: request.Bytes()})
+}
+
+func startEchoUploadPackServer(t *testing.T, unavailable bool) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	gitalypb.RegisterSmartHTTPServiceServer(grpcServer, &echoUploadPackServer{unavailable: unavailable})
+	go grpcServer.Serve(listener)
+
+	return "tcp://" + listener.Addr().String(), grpcServer.Stop
+}
@@ -2,8 +2,11 @@ package gitaly
 
 import (
 	"context"
+	"fmt"
+	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/jsonpb" //lint:ignore SA1019 https://gitlab.com/gitlab-org/gitlab-workhorse/-/issues/274
 	"github.com/golang/protobuf/proto"  //lint:ignore SA1019 https://gitlab.com/gitlab-org/gitlab-workhorse/-/issues/274
@@ -14,6 +17,8 @@ import (
 	gitalyclient "gitlab.com/gitlab-org/gitaly/client"
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 
 	grpccorrelation "gitlab.com/gitlab-org/labkit/correlation/grpc"
@@ -21,9 +26,12 @@ import (
 )
 
 type Server struct {
-	Address  string            `json:"address"`
-	Token    string            `json:"token"`
-	Features map[string]string `json:"features"`
+	Address string `json:"address"`
+	// Addresses are the replicas that serve read-only RPCs, in order of
+	// preference. We fail over to the next one if a replica is unavailable.
+	Addresses []string          `json:"addresses"`
+	Token     string            `json:"token"`
+	Features  map[string]string `json:"features"`
 }
 
 type cacheKey struct{ address, token string }
@@ -34,13 +42,15 @@ func (server Server) cacheKey() cacheKey {
 
 type connectionsCache struct {
 	sync.RWMutex
-	connections map[cacheKey]*grpc.ClientConn
+	connections map[cacheKey]*connection
+	// draining holds evicted connections until their RPCs are done
+	draining []*connection
 }
 
 var (
 	jsonUnMarshaler = jsonpb.Unmarshaler{AllowUnknownFields: true}
 	cache           = connectionsCache{
-		connections: make(map[cacheKey]*grpc.ClientConn),
+		connections: make(map[cacheKey]*connection),
 	}
 
 	connectionsTotal = prometheus.NewCounterVec(
@@ -74,7 +84,7 @@ func NewSmartHTTPClient(ctx context.Context, server Server) (context.Context, *S
 		return nil, nil, err
 	}
 	grpcClient := gitalypb.NewSmartHTTPServiceClient(conn)
-	return withOutgoingMetadata(ctx, server.Features), &SmartHTTPClient{grpcClient}, nil
+	return withOutgoingMetadata(withReplicas(ctx, server), server.Features), &SmartHTTPClient{grpcClient}, nil
 }
 
 func NewBlobClient(ctx context.Context, server Server) (context.Context, *BlobClient, error) {
@@ -83,7 +93,7 @@ func NewBlobClient(ctx context.Context, server Server) (context.Context, *BlobCl
 		return nil, nil, err
 	}
 	grpcClient := gitalypb.NewBlobServiceClient(conn)
-	return withOutgoingMetadata(ctx, server.Features), &BlobClient{grpcClient}, nil
+	return withOutgoingMetadata(withReplicas(ctx, server), server.Features), &BlobClient{grpcClient}, nil
 }
 
 func NewRepositoryClient(ctx context.Context, server Server) (context.Context, *RepositoryClient, error) {
@@ -92,7 +102,7 @@ func NewRepositoryClient(ctx context.Context, server Server) (context.Context, *
 		return nil, nil, err
 	}
 	grpcClient := gitalypb.NewRepositoryServiceClient(conn)
-	return withOutgoingMetadata(ctx, server.Features), &RepositoryClient{grpcClient}, nil
+	return withOutgoingMetadata(withReplicas(ctx, server), server.Features), &RepositoryClient{grpcClient}, nil
 }
 
 // NewNamespaceClient is only used by the Gitaly integration tests at present
@@ -102,7 +112,7 @@ func NewNamespaceClient(ctx context.Context, server Server) (context.Context, *N
 		return nil, nil, err
 	}
 	grpcClient := gitalypb.NewNamespaceServiceClient(conn)
-	return withOutgoingMetadata(ctx, server.Features), &NamespaceClient{grpcClient}, nil
+	return withOutgoingMetadata(withReplicas(ctx, server), server.Features), &NamespaceClient{grpcClient}, nil
 }
 
 func NewDiffClient(ctx context.Context, server Server) (context.Context, *DiffClient, error) {
@@ -111,7 +121,7 @@ func NewDiffClient(ctx context.Context, server Server) (context.Context, *DiffCl
 		return nil, nil, err
 	}
 	grpcClient := gitalypb.NewDiffServiceClient(conn)
-	return withOutgoingMetadata(ctx, server.Features), &DiffClient{grpcClient}, nil
+	return withOutgoingMetadata(withReplicas(ctx, server), server.Features), &DiffClient{grpcClient}, nil
 }
 
 func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
@@ -122,14 +132,16 @@ func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
 	cache.RUnlock()
 
 	if conn != nil {
-		return conn, nil
+		conn.touch()
+		return conn.ClientConn, nil
 	}
 
 	cache.Lock()
 	defer cache.Unlock()
 
 	if conn := cache.connections[key]; conn != nil {
-		return conn, nil
+		conn.touch()
+		return conn.ClientConn, nil
 	}
 
 	conn, err := newConnection(server)
@@ -137,25 +149,36 @@ func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
 		return nil, err
 	}
 
+	conn.touch()
 	cache.connections[key] = conn
 
-	return conn, nil
+	return conn.ClientConn, nil
 }
 
 func CloseConnections() {
 	cache.Lock()
 	defer cache.Unlock()
 
-	for _, conn := range cache.connections {
+	for key, conn := range cache.connections {
 		conn.Close()
+		delete(cache.connections, key)
 	}
+
+	for _, conn := range cache.draining {
+		conn.Close()
+	}
+	cache.draining = nil
 }
 
-func newConnection(server Server) (*grpc.ClientConn, error) {
+func newConnection(server Server) (*connection, error) {
+	conn := &connection{address: server.Address}
+
 	connOpts := append(gitalyclient.DefaultDialOpts,
 		grpc.WithPerRPCCredentials(gitalyauth.RPCCredentialsV2(server.Token)),
 		grpc.WithStreamInterceptor(
 			grpc_middleware.ChainStreamClient(
+				failoverStreamInterceptor,
+				conn.streamInterceptor,
 				grpctracing.StreamClientTracingInterceptor(),
 				grpc_prometheus.StreamClientInterceptor,
 				grpccorrelation.StreamClientCorrelationInterceptor(
@@ -166,6 +189,7 @@ func newConnection(server Server) (*grpc.ClientConn, error) {
 
 		grpc.WithUnaryInterceptor(
 			grpc_middleware.ChainUnaryClient(
+				conn.unaryInterceptor,
 				grpctracing.UnaryClientTracingInterceptor(),
 				grpc_prometheus.UnaryClientInterceptor,
 				grpccorrelation.UnaryClientCorrelationInterceptor(
@@ -175,7 +199,7 @@ func newConnection(server Server) (*grpc.ClientConn, error) {
 		),
 	)
 
-	conn, connErr := gitalyclient.Dial(server.Address, connOpts)
+	clientConn, connErr := dial(server.Address, connOpts)
 
 	label := "ok"
 	if connErr != nil {
@@ -183,7 +207,39 @@ func newConnection(server Server) (*grpc.ClientConn, error) {
 	}
 	connectionsTotal.WithLabelValues(label).Inc()
 
-	return conn, connErr
+	if connErr != nil {
+		return nil, connErr
+	}
+
+	conn.ClientConn = clientConn
+	return conn, nil
+}
+
+// dial uses our own TLS configuration for tls:// addresses if there is
+// one. gitalyclient.Dial only trusts the system certificates.
+func dial(address string, connOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	if tlsConfig == nil || !strings.HasPrefix(address, "tls://") {
+		return gitalyclient.Dial(address, connOpts)
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", address, err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("no port in %q", address)
+	}
+
+	connOpts = append(connOpts,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		// Like gitalyclient.Dial
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                20 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+
+	return grpc.Dial(u.Host, connOpts...)
 }
 
 func UnmarshalJSON(s string, msg proto.Message) error {
@@ -0,0 +1,319 @@
+package gitaly
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultConnectionTTL       = 10 * time.Minute
+	maxHealthCheckTimeout      = 5 * time.Second
+
+	// A request may have got an evicted connection from the cache just
+	// before we evicted it, so we wait a little before we close it.
+	evictionGracePeriod = 10 * time.Second
+)
+
+var (
+	// idleCheckInterval is how often we look for idle connections and
+	// close evicted ones, independently of the health checks
+	idleCheckInterval = 10 * time.Second
+)
+
+var (
+	// Set by Configure
+	tlsConfig           *tls.Config
+	healthCheckInterval = defaultHealthCheckInterval
+	connectionTTL       = defaultConnectionTTL
+	hedgeDelay          time.Duration
+
+	connectionEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_connection_evictions_total",
+			Help: "Number of Gitaly connections that have been evicted from the connection cache, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	connectionStates = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_gitaly_connections",
+			Help: "Number of cached Gitaly connections by address and connectivity state",
+		},
+		[]string{"address", "state"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(connectionEvictions)
+	prometheus.MustRegister(connectionStates)
+}
+
+// Configure sets up TLS, the connection monitoring and hedging. It must be called
+// before the first connection is made.
+func Configure(cfg config.GitalyConfig) error {
+	tlsConfig = nil
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return fmt.Errorf("load system certificates: %v", err)
+		}
+
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %q", cfg.CAFile)
+		}
+
+		tlsConfig = &tls.Config{RootCAs: pool}
+	}
+
+	healthCheckInterval = defaultHealthCheckInterval
+	if cfg.HealthCheckInterval != nil {
+		healthCheckInterval = cfg.HealthCheckInterval.Duration
+	}
+
+	connectionTTL = defaultConnectionTTL
+	if cfg.ConnectionTTL != nil {
+		connectionTTL = cfg.ConnectionTTL.Duration
+	}
+
+	hedgeDelay = 0
+	if cfg.HedgeDelay != nil {
+		hedgeDelay = cfg.HedgeDelay.Duration
+	}
+
+	return nil
+}
+
+// connection is a cached Gitaly connection. It knows when it was last used
+// and how many RPCs are in flight, so that we never close a connection
+// that is still in use.
+type connection struct {
+	*grpc.ClientConn
+	address string
+
+	// lastUsed is a UnixNano timestamp. Both fields are accessed atomically.
+	lastUsed int64
+	active   int64
+}
+
+func (conn *connection) touch() {
+	atomic.StoreInt64(&conn.lastUsed, time.Now().UnixNano())
+}
+
+func (conn *connection) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&conn.lastUsed)))
+}
+
+func (conn *connection) activeRPCs() int64 {
+	return atomic.LoadInt64(&conn.active)
+}
+
+func (conn *connection) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	atomic.AddInt64(&conn.active, 1)
+	defer atomic.AddInt64(&conn.active, -1)
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (conn *connection) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	atomic.AddInt64(&conn.active, 1)
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		atomic.AddInt64(&conn.active, -1)
+		return nil, err
+	}
+
+	s := &trackedClientStream{ClientStream: stream, finished: make(chan struct{})}
+	go func() {
+		// Streams end when the client has received everything, or when
+		// the context is done
+		select {
+		case <-s.finished:
+		case <-ctx.Done():
+		}
+		atomic.AddInt64(&conn.active, -1)
+	}()
+
+	return s, nil
+}
+
+type trackedClientStream struct {
+	grpc.ClientStream
+	finished chan struct{}
+	once     sync.Once
+}
+
+func (s *trackedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() { close(s.finished) })
+	}
+	return err
+}
+
+func (conn *connection) checkHealth() error {
+	timeout := healthCheckInterval
+	if timeout > maxHealthCheckTimeout {
+		timeout = maxHealthCheckTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout) // lint:allow context.Background
+	defer cancel()
+
+	response, err := grpc_health_v1.NewHealthClient(conn.ClientConn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		// The server is there, it just can't tell us more
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if response.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return errors.New(response.Status.String())
+	}
+
+	return nil
+}
+
+// MonitorConnections evicts cached connections that fail a health check,
+// or that no request has used for the connection TTL, until the returned
+// function is called. A zero health check interval disables the health
+// checks but not the eviction of idle connections.
+func MonitorConnections() (stop func()) {
+	done := make(chan struct{})
+	go monitorConnections(done)
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func monitorConnections(done <-chan struct{}) {
+	idleTicker := time.NewTicker(idleCheckInterval)
+	defer idleTicker.Stop()
+
+	// A nil channel never fires
+	var healthChecks <-chan time.Time
+	if healthCheckInterval > 0 {
+		healthTicker := time.NewTicker(healthCheckInterval)
+		defer healthTicker.Stop()
+		healthChecks = healthTicker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-idleTicker.C:
+			evictIdleConnections()
+		case <-healthChecks:
+			checkConnections()
+		}
+	}
+}
+
+// checkConnections evicts idle connections and connections that fail a
+// health check
+func checkConnections() {
+	for key, conn := range cachedConnections() {
+		if evictIfIdle(key, conn) {
+			continue
+		}
+
+		if err := conn.checkHealth(); err != nil {
+			log.WithError(err).WithField("gitaly_address", conn.address).Error("gitaly health check failed")
+			evictConnection(key, conn, "unhealthy")
+		}
+	}
+
+	closeDrainedConnections()
+	updateConnectionStates()
+}
+
+func evictIdleConnections() {
+	for key, conn := range cachedConnections() {
+		evictIfIdle(key, conn)
+	}
+
+	closeDrainedConnections()
+	updateConnectionStates()
+}
+
+func cachedConnections() map[cacheKey]*connection {
+	cache.RLock()
+	defer cache.RUnlock()
+
+	connections := make(map[cacheKey]*connection, len(cache.connections))
+	for key, conn := range cache.connections {
+		connections[key] = conn
+	}
+	return connections
+}
+
+func evictIfIdle(key cacheKey, conn *connection) bool {
+	if conn.idle() > connectionTTL && conn.activeRPCs() == 0 {
+		evictConnection(key, conn, "idle")
+		return true
+	}
+	return false
+}
+
+func evictConnection(key cacheKey, conn *connection, reason string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.connections[key] != conn {
+		return
+	}
+
+	delete(cache.connections, key)
+	cache.draining = append(cache.draining, conn)
+	connectionEvictions.WithLabelValues(reason).Inc()
+}
+
+func closeDrainedConnections() {
+	cache.Lock()
+	defer cache.Unlock()
+
+	var draining []*connection
+	for _, conn := range cache.draining {
+		if conn.activeRPCs() > 0 || conn.idle() < evictionGracePeriod {
+			draining = append(draining, conn)
+			continue
+		}
+		conn.Close()
+	}
+	cache.draining = draining
+}
+
+func updateConnectionStates() {
+	cache.RLock()
+	defer cache.RUnlock()
+
+	connectionStates.Reset()
+	for _, conn := range cache.connections {
+		connectionStates.WithLabelValues(conn.address, conn.GetState().String()).Inc()
+	}
+}
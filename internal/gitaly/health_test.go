@@ -0,0 +1,227 @@
+package gitaly
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestCheckConnectionsKeepsHealthyConnections(t *testing.T) {
+	defer CloseConnections()
+
+	addr, _, cleanUp := startHealthServer(t)
+	defer cleanUp()
+
+	conn := getTestConnection(t, Server{Address: addr})
+	checkConnections()
+
+	require.Equal(t, conn, getTestConnection(t, Server{Address: addr}))
+	require.Equal(t, float64(1), testutil.ToFloat64(connectionStates.WithLabelValues(addr, connectivity.Ready.String())))
+}
+
+func TestCheckConnectionsWithoutHealthService(t *testing.T) {
+	defer CloseConnections()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	addr := "tcp://" + listener.Addr().String()
+	conn := getTestConnection(t, Server{Address: addr})
+	checkConnections()
+
+	require.Equal(t, conn, getTestConnection(t, Server{Address: addr}))
+}
+
+func TestCheckConnectionsEvictsUnhealthyConnections(t *testing.T) {
+	defer CloseConnections()
+
+	addr, healthServer, cleanUp := startHealthServer(t)
+	defer cleanUp()
+
+	conn := getTestConnection(t, Server{Address: addr})
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	evictions := testutil.ToFloat64(connectionEvictions.WithLabelValues("unhealthy"))
+	checkConnections()
+	require.Equal(t, evictions+1, testutil.ToFloat64(connectionEvictions.WithLabelValues("unhealthy")))
+
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	require.NotEqual(t, conn, getTestConnection(t, Server{Address: addr}))
+
+	// The evicted connection was used recently, so it is not closed yet
+	require.NotEqual(t, connectivity.Shutdown, conn.GetState())
+	atomic.StoreInt64(&conn.lastUsed, time.Now().Add(-time.Hour).UnixNano())
+	checkConnections()
+	require.Equal(t, connectivity.Shutdown, conn.GetState())
+}
+
+func TestCheckConnectionsEvictsIdleConnections(t *testing.T) {
+	defer CloseConnections()
+
+	addr, _, cleanUp := startHealthServer(t)
+	defer cleanUp()
+
+	conn := getTestConnection(t, Server{Address: addr})
+	atomic.StoreInt64(&conn.lastUsed, time.Now().Add(-2*connectionTTL).UnixNano())
+	checkConnections()
+
+	require.Equal(t, connectivity.Shutdown, conn.GetState())
+	require.NotEqual(t, conn, getTestConnection(t, Server{Address: addr}))
+}
+
+func TestMonitorConnectionsEvictsIdleConnectionsWithoutHealthChecks(t *testing.T) {
+	defer CloseConnections()
+
+	defer func(interval time.Duration) { healthCheckInterval = interval }(healthCheckInterval)
+	defer func(interval time.Duration) { idleCheckInterval = interval }(idleCheckInterval)
+	healthCheckInterval = 0
+	idleCheckInterval = 10 * time.Millisecond
+
+	addr, _, cleanUp := startHealthServer(t)
+	defer cleanUp()
+
+	conn := getTestConnection(t, Server{Address: addr})
+	atomic.StoreInt64(&conn.lastUsed, time.Now().Add(-2*connectionTTL).UnixNano())
+
+	stop := MonitorConnections()
+	defer stop()
+
+	require.Eventually(t, func() bool { return conn.GetState() == connectivity.Shutdown }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCheckConnectionsWaitsForActiveStreams(t *testing.T) {
+	defer CloseConnections()
+
+	addr, healthServer, cleanUp := startHealthServer(t)
+	defer cleanUp()
+
+	conn := getTestConnection(t, Server{Address: addr})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := grpc_health_v1.NewHealthClient(conn.ClientConn).Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), conn.activeRPCs())
+
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	atomic.StoreInt64(&conn.lastUsed, time.Now().Add(-time.Hour).UnixNano())
+	checkConnections()
+	require.NotEqual(t, connectivity.Shutdown, conn.GetState(), "the stream keeps the connection open")
+
+	cancel()
+	require.Eventually(t, func() bool { return conn.activeRPCs() == 0 }, 5*time.Second, 10*time.Millisecond)
+	checkConnections()
+	require.Equal(t, connectivity.Shutdown, conn.GetState())
+}
+
+func TestTLSConnection(t *testing.T) {
+	defer CloseConnections()
+
+	certificate, caFile, cleanUpCert := createTestCertificate(t)
+	defer cleanUpCert()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&certificate)))
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	require.NoError(t, Configure(config.GitalyConfig{CAFile: caFile}))
+	defer Configure(config.GitalyConfig{})
+
+	conn := getTestConnection(t, Server{Address: "tls://" + listener.Addr().String()})
+	require.NoError(t, conn.checkHealth())
+}
+
+func TestConfigureWithInvalidCAFile(t *testing.T) {
+	defer Configure(config.GitalyConfig{})
+
+	require.Error(t, Configure(config.GitalyConfig{CAFile: "/path/to/nowhere"}))
+
+	tmpFile, err := ioutil.TempFile("", "gitaly-ca")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.WriteString("not a certificate")
+	require.NoError(t, err)
+	require.NoError(t, tmpFile.Close())
+
+	require.Error(t, Configure(config.GitalyConfig{CAFile: tmpFile.Name()}))
+}
+
+func startHealthServer(t *testing.T) (string, *health.Server, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	go grpcServer.Serve(listener)
+
+	return "tcp://" + listener.Addr().String(), healthServer, grpcServer.Stop
+}
+
+func getTestConnection(t *testing.T, server Server) *connection {
+	_, err := getOrCreateConnection(server)
+	require.NoError(t, err)
+
+	cache.RLock()
+	defer cache.RUnlock()
+	return cache.connections[server.cacheKey()]
+}
+
+// createTestCertificate returns a self-signed certificate for 127.0.0.1,
+// and a file that contains it in PEM format.
+func createTestCertificate(t *testing.T) (tls.Certificate, string, func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gitaly"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	caFile, err := ioutil.TempFile("", "gitaly-ca")
+	require.NoError(t, err)
+	require.NoError(t, pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	require.NoError(t, caFile.Close())
+
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return certificate, caFile.Name(), func() { os.Remove(caFile.Name()) }
+}
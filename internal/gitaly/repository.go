@@ -43,3 +43,18 @@ func (client *RepositoryClient) SnapshotReader(ctx context.Context, request *git
 		return resp.GetData(), err
 	}), nil
 }
+
+// BundleReader performs a CreateBundle Gitaly request and returns an io.Reader
+// for the response
+func (client *RepositoryClient) BundleReader(ctx context.Context, request *gitalypb.CreateBundleRequest) (io.Reader, error) {
+	c, err := client.CreateBundle(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("RepositoryService::CreateBundle: %v", err)
+	}
+
+	return streamio.NewReader(func() ([]byte, error) {
+		resp, err := c.Recv()
+
+		return resp.GetData(), err
+	}), nil
+}
@@ -63,6 +63,29 @@ func SetNoCacheHeaders(header http.Header) {
 	header.Set("Expires", "Fri, 01 Jan 1990 00:00:00 GMT")
 }
 
+// IsNotModified tells whether the If-None-Match header of the request
+// matches the ETag of the response.
+func IsNotModified(r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func WriteNotModified(w http.ResponseWriter, etag string) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
+
 func OpenFile(path string) (file *os.File, fi os.FileInfo, err error) {
 	file, err = os.Open(path)
 	if err != nil {
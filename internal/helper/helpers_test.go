@@ -42,6 +42,29 @@ func TestFixRemoteAddr(t *testing.T) {
 	}
 }
 
+func TestIsNotModified(t *testing.T) {
+	testCases := []struct {
+		ifNoneMatch string
+		etag        string
+		expected    bool
+	}{
+		{ifNoneMatch: "", etag: `"abc"`, expected: false},
+		{ifNoneMatch: `"abc"`, etag: `"abc"`, expected: true},
+		{ifNoneMatch: `W/"abc"`, etag: `"abc"`, expected: true},
+		{ifNoneMatch: `"def", "abc"`, etag: `"abc"`, expected: true},
+		{ifNoneMatch: `*`, etag: `"abc"`, expected: true},
+		{ifNoneMatch: `"def"`, etag: `"abc"`, expected: false},
+		{ifNoneMatch: `*`, etag: "", expected: false},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("If-None-Match", tc.ifNoneMatch)
+
+		require.Equal(t, tc.expected, IsNotModified(req, tc.etag), "If-None-Match: %s, ETag: %s", tc.ifNoneMatch, tc.etag)
+	}
+}
+
 func TestSetForwardedForGeneratesHeader(t *testing.T) {
 	testCases := []struct {
 		remoteAddr           string
@@ -2,6 +2,8 @@ package imageresizer
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -14,7 +16,10 @@ import (
 	"syscall"
 	"time"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -37,6 +42,15 @@ type resizeParams struct {
 	Location    string
 	ContentType string
 	Width       uint
+	// ObjectStorage is set instead of Location when the image should be read from object
+	// storage with Workhorse's own credentials rather than through a presigned URL
+	ObjectStorage *objectStorageParams
+}
+
+type objectStorageParams struct {
+	api.ObjectStorageParams
+	// Key is the name of the object within the bucket
+	Key string
 }
 
 type processCounter struct {
@@ -47,11 +61,16 @@ type resizeStatus = string
 
 const (
 	statusSuccess        = "success"        // a rescaled image was served
+	statusNotModified    = "not-modified"   // the client's cached copy is still valid
 	statusScalingFailure = "scaling-failed" // scaling failed but the original image was served
 	statusRequestFailure = "request-failed" // no image was served
 	statusUnknown        = "unknown"        // indicates an unhandled status case
 )
 
+// Bump this whenever gitlab-resize-image starts producing different output for the same
+// input, so clients do not keep using images rendered by an older scaler.
+const etagVersion = "1"
+
 var envInjector = tracing.NewEnvInjector()
 
 // Images might be located remotely in object storage, in which case we need to stream
@@ -164,7 +183,20 @@ func (r *Resizer) Inject(w http.ResponseWriter, req *http.Request, paramsData st
 		return
 	}
 
-	sourceImageReader, fileSize, err := openSourceImage(params.Location)
+	// Answer conditional requests from the source image metadata so a cached copy
+	// does not cost us a download of the original. Should that lookup fail, e.g.
+	// because a presigned URL only permits GET, we check again after opening it.
+	if req.Header.Get("If-None-Match") != "" {
+		if sourceIdentity, err := r.statSourceImage(req.Context(), params); err == nil && sourceIdentity != "" {
+			if etag := scaledImageETag(sourceIdentity, params); helper.IsNotModified(req, etag) {
+				status = statusNotModified
+				helper.WriteNotModified(w, etag)
+				return
+			}
+		}
+	}
+
+	sourceImageReader, fileSize, sourceIdentity, err := r.openSourceImage(req.Context(), params)
 	if err != nil {
 		// This means we cannot even read the input image; fail fast.
 		status = statusRequestFailure
@@ -173,6 +205,17 @@ func (r *Resizer) Inject(w http.ResponseWriter, req *http.Request, paramsData st
 	}
 	defer sourceImageReader.Close()
 
+	var etag string
+	if sourceIdentity != "" {
+		etag = scaledImageETag(sourceIdentity, params)
+	}
+
+	if helper.IsNotModified(req, etag) {
+		status = statusNotModified
+		helper.WriteNotModified(w, etag)
+		return
+	}
+
 	logFields := func(bytesWritten int64) *log.Fields {
 		return &log.Fields{
 			"bytes_written":     bytesWritten,
@@ -193,6 +236,10 @@ func (r *Resizer) Inject(w http.ResponseWriter, req *http.Request, paramsData st
 	defer helper.CleanUpProcessGroup(resizeCmd)
 
 	w.Header().Del("Content-Length")
+	// The ETag describes the scaled image; don't hand it out along with the original
+	if resizeCmd != nil && etag != "" {
+		w.Header().Set("ETag", etag)
+	}
 	bytesWritten, err := serveImage(imageReader, w, resizeCmd)
 
 	// We failed serving image data; this is a hard failure.
@@ -243,7 +290,11 @@ func (r *Resizer) unpackParameters(paramsData string) (*resizeParams, error) {
 		return nil, err
 	}
 
-	if params.Location == "" {
+	if params.ObjectStorage != nil {
+		if params.ObjectStorage.Key == "" {
+			return nil, fmt.Errorf("ImageResizer: ObjectStorage.Key is empty")
+		}
+	} else if params.Location == "" {
 		return nil, fmt.Errorf("ImageResizer: Location is empty")
 	}
 
@@ -304,43 +355,156 @@ func isURL(location string) bool {
 	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
 }
 
-func openSourceImage(location string) (io.ReadCloser, int64, error) {
-	if isURL(location) {
-		return openFromURL(location)
+// Returns the string identifying the current version of the source image, as
+// openSourceImage would, but without reading any image data.
+func (r *Resizer) statSourceImage(ctx context.Context, params *resizeParams) (string, error) {
+	if params.ObjectStorage != nil {
+		return r.statFromObjectStorage(ctx, params.ObjectStorage)
+	}
+
+	if isURL(params.Location) {
+		return statFromURL(params.Location)
+	}
+
+	fi, err := os.Stat(params.Location)
+	if err != nil {
+		return "", err
+	}
+
+	return fileIdentity(fi), nil
+}
+
+// Opens the source image and returns a reader for it along with its size and a string
+// identifying this particular version of the image, which is empty if unknown.
+func (r *Resizer) openSourceImage(ctx context.Context, params *resizeParams) (io.ReadCloser, int64, string, error) {
+	if params.ObjectStorage != nil {
+		return r.openFromObjectStorage(ctx, params.ObjectStorage)
+	}
+
+	if isURL(params.Location) {
+		return openFromURL(params.Location)
+	}
+
+	return openFromFile(params.Location)
+}
+
+// We access object storage through the same clients we use for direct uploads,
+// which saves Rails from presigning a URL for every image.
+func (r *Resizer) objectStorageConfig(params *objectStorageParams) (*filestore.ObjectStorageConfig, error) {
+	cfg := &filestore.ObjectStorageConfig{
+		Provider:      params.Provider,
+		S3Credentials: r.ObjectStorageCredentials.S3Credentials,
+		S3Config:      params.S3Config,
+		URLMux:        r.ObjectStorageConfig.URLMux,
+		GoCloudConfig: params.GoCloudConfig,
 	}
 
-	return openFromFile(location)
+	switch {
+	case !cfg.IsValid():
+		return nil, fmt.Errorf("ImageResizer: object storage provider %q is not configured", params.Provider)
+	case !cfg.IsAWS() && cfg.URLMux == nil:
+		return nil, fmt.Errorf("ImageResizer: no GoCloud URL openers registered")
+	}
+
+	return cfg, nil
 }
 
-func openFromURL(location string) (io.ReadCloser, int64, error) {
+func (r *Resizer) statFromObjectStorage(ctx context.Context, params *objectStorageParams) (string, error) {
+	cfg, err := r.objectStorageConfig(params)
+	if err != nil {
+		return "", err
+	}
+
+	var attrs *objectstore.ObjectAttributes
+	if cfg.IsAWS() {
+		attrs, err = objectstore.StatS3Object(ctx, params.Key, cfg.S3Credentials, cfg.S3Config)
+	} else {
+		attrs, err = objectstore.StatGoCloudObject(ctx, cfg.URLMux, cfg.GoCloudConfig.URL, params.Key)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("ImageResizer: cannot stat object %q: %v", params.Key, err)
+	}
+
+	return attrs.Version, nil
+}
+
+func (r *Resizer) openFromObjectStorage(ctx context.Context, params *objectStorageParams) (io.ReadCloser, int64, string, error) {
+	cfg, err := r.objectStorageConfig(params)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var object *objectstore.ObjectReader
+	if cfg.IsAWS() {
+		object, err = objectstore.OpenS3Object(ctx, params.Key, cfg.S3Credentials, cfg.S3Config)
+	} else {
+		object, err = objectstore.OpenGoCloudObject(ctx, cfg.URLMux, cfg.GoCloudConfig.URL, params.Key)
+	}
+
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("ImageResizer: cannot read object %q: %v", params.Key, err)
+	}
+
+	return object, object.Size, object.Version, nil
+}
+
+func statFromURL(location string) (string, error) {
+	res, err := httpClient.Head(location)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ImageResizer: cannot stat %q: %d %s", location, res.StatusCode, res.Status)
+	}
+
+	return res.Header.Get("ETag"), nil
+}
+
+func openFromURL(location string) (io.ReadCloser, int64, string, error) {
 	res, err := httpClient.Get(location)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, "", err
 	}
 
 	if res.StatusCode != http.StatusOK {
 		res.Body.Close()
 
-		return nil, 0, fmt.Errorf("ImageResizer: cannot read data from %q: %d %s",
+		return nil, 0, "", fmt.Errorf("ImageResizer: cannot read data from %q: %d %s",
 			location, res.StatusCode, res.Status)
 	}
 
-	return res.Body, res.ContentLength, nil
+	return res.Body, res.ContentLength, res.Header.Get("ETag"), nil
 }
 
-func openFromFile(location string) (io.ReadCloser, int64, error) {
+func openFromFile(location string) (io.ReadCloser, int64, string, error) {
 	file, err := os.Open(location)
 
 	if err != nil {
-		return file, 0, err
+		return file, 0, "", err
 	}
 
 	fi, err := file.Stat()
 	if err != nil {
-		return file, 0, err
+		return file, 0, "", err
 	}
 
-	return file, fi.Size(), nil
+	return file, fi.Size(), fileIdentity(fi), nil
+}
+
+func fileIdentity(fi os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// The ETag of a scaled image depends on the source image as well as everything that
+// affects how it is rendered.
+func scaledImageETag(sourceIdentity string, params *resizeParams) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n%s", etagVersion, sourceIdentity, params.Width, params.ContentType)
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:20]) + `"`
 }
 
 // Only allow more scaling requests if we haven't yet reached the maximum
@@ -4,11 +4,21 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
 
 	"gitlab.com/gitlab-org/labkit/log"
 
@@ -53,6 +63,27 @@ func TestUnpackParametersReturnsErrorWhenContentTypeBlank(t *testing.T) {
 	require.Error(t, err, "expected error when ContentType is blank")
 }
 
+func TestUnpackParametersAcceptsObjectStorageWithoutLocation(t *testing.T) {
+	r := Resizer{}
+	inParams := resizeParams{Width: 64, ContentType: "image/png", ObjectStorage: &objectStorageParams{Key: "path/to/img"}}
+	inParams.ObjectStorage.Provider = "AWS"
+	inParams.ObjectStorage.S3Config = config.S3Config{Bucket: "uploads", Region: "eu-central-1"}
+
+	outParams, err := r.unpackParameters(encodeParams(t, &inParams))
+
+	require.NoError(t, err)
+	require.Equal(t, inParams, *outParams)
+}
+
+func TestUnpackParametersReturnsErrorWhenObjectKeyBlank(t *testing.T) {
+	r := Resizer{}
+	inParams := resizeParams{Width: 64, ContentType: "image/png", ObjectStorage: &objectStorageParams{}}
+
+	_, err := r.unpackParameters(encodeParams(t, &inParams))
+
+	require.Error(t, err, "expected error when ObjectStorage.Key is blank")
+}
+
 func TestTryResizeImageSuccess(t *testing.T) {
 	r := Resizer{}
 	inParams := resizeParams{Location: "/path/to/img", Width: 64, ContentType: "image/png"}
@@ -116,6 +147,38 @@ func TestTryResizeImageFailsWhenContentTypeNotMatchingFileContents(t *testing.T)
 	require.Error(t, cmd.Wait(), "Expected to fail due to content-type mismatch")
 }
 
+func TestTryResizeImageAppliesExifOrientation(t *testing.T) {
+	r := Resizer{}
+	inParams := resizeParams{Location: "/path/to/img", Width: 10, ContentType: "image/jpeg"}
+	inFile, err := os.Open("../../testdata/image-exif-orientation-6.jpg")
+	require.NoError(t, err)
+	defer inFile.Close()
+	req, err := http.NewRequest("GET", "/foo", nil)
+	require.NoError(t, err)
+
+	reader, cmd, err := r.tryResizeImage(
+		req,
+		inFile,
+		os.Stderr,
+		&inParams,
+		int64(config.DefaultImageResizerConfig.MaxFilesize),
+		config.DefaultImageResizerConfig,
+	)
+	require.NoError(t, err)
+
+	out, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, cmd.Wait())
+
+	// The fixture is stored as 40x20 but tagged to be displayed rotated by 90 degrees
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+	require.NoError(t, err)
+	require.Equal(t, "jpeg", format)
+	require.Equal(t, 10, cfg.Width)
+	require.Equal(t, 20, cfg.Height)
+	require.NotContains(t, string(out), "Exif", "Expected metadata to be stripped")
+}
+
 func TestServeImage(t *testing.T) {
 	inFile := testImage(t)
 	var writer bytes.Buffer
@@ -127,6 +190,226 @@ func TestServeImage(t *testing.T) {
 	require.Equal(t, int64(len(writer.Bytes())), bytesWritten)
 }
 
+func TestInjectSetsETagOnScaledImage(t *testing.T) {
+	r := NewResizer(config.Config{ImageResizerConfig: config.DefaultImageResizerConfig})
+	params := resizeParams{Location: "../../testdata/image.png", Width: 64, ContentType: "image/png"}
+
+	w := httptest.NewRecorder()
+	r.Inject(w, httptest.NewRequest("GET", "/image", nil), encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEmpty(t, w.Header().Get("ETag"))
+	require.NotZero(t, w.Body.Len())
+
+	params.Width = 32
+	w2 := httptest.NewRecorder()
+	r.Inject(w2, httptest.NewRequest("GET", "/image", nil), encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusOK, w2.Code)
+	require.NotEqual(t, w.Header().Get("ETag"), w2.Header().Get("ETag"), "Expected ETag to depend on the width")
+}
+
+func TestInjectOmitsETagWhenServingOriginal(t *testing.T) {
+	cfg := config.DefaultImageResizerConfig
+	cfg.MaxFilesize = 1
+	r := NewResizer(config.Config{ImageResizerConfig: cfg})
+	params := resizeParams{Location: "../../testdata/image.png", Width: 64, ContentType: "image/png"}
+
+	w := httptest.NewRecorder()
+	r.Inject(w, httptest.NewRequest("GET", "/image", nil), encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestInjectNotModifiedForFile(t *testing.T) {
+	// No scaler process may run, so a 200 would mean we served the original
+	cfg := config.DefaultImageResizerConfig
+	cfg.MaxScalerProcs = 0
+	r := NewResizer(config.Config{ImageResizerConfig: cfg})
+	params := resizeParams{Location: "../../testdata/image.png", Width: 64, ContentType: "image/png"}
+
+	fi, err := os.Stat(params.Location)
+	require.NoError(t, err)
+	etag := scaledImageETag(fileIdentity(fi), &params)
+
+	for _, ifNoneMatch := range []string{etag, `"foo", W/` + etag, "*"} {
+		req := httptest.NewRequest("GET", "/image", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+
+		r.Inject(w, req, encodeSendData(t, r, &params))
+
+		require.Equal(t, http.StatusNotModified, w.Code, "If-None-Match: %s", ifNoneMatch)
+		require.Equal(t, etag, w.Header().Get("ETag"))
+		require.Zero(t, w.Body.Len())
+	}
+}
+
+func TestInjectNotModifiedForURL(t *testing.T) {
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests[req.Method]++
+		w.Header().Set("ETag", `"remote-etag"`)
+		http.ServeFile(w, req, "../../testdata/image.png")
+	}))
+	defer ts.Close()
+
+	cfg := config.DefaultImageResizerConfig
+	cfg.MaxScalerProcs = 0
+	r := NewResizer(config.Config{ImageResizerConfig: cfg})
+	params := resizeParams{Location: ts.URL + "/image.png", Width: 64, ContentType: "image/png"}
+	etag := scaledImageETag(`"remote-etag"`, &params)
+
+	req := httptest.NewRequest("GET", "/image", nil)
+	req.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+
+	r.Inject(w, req, encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, etag, w.Header().Get("ETag"))
+	require.Equal(t, 1, requests["HEAD"])
+	require.Equal(t, 0, requests["GET"], "Expected the source image not to be downloaded")
+}
+
+func TestInjectNotModifiedForURLWithoutHEAD(t *testing.T) {
+	// Presigned URLs are only valid for the method they were signed for
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", `"remote-etag"`)
+		http.ServeFile(w, req, "../../testdata/image.png")
+	}))
+	defer ts.Close()
+
+	cfg := config.DefaultImageResizerConfig
+	cfg.MaxScalerProcs = 0
+	r := NewResizer(config.Config{ImageResizerConfig: cfg})
+	params := resizeParams{Location: ts.URL + "/image.png", Width: 64, ContentType: "image/png"}
+	etag := scaledImageETag(`"remote-etag"`, &params)
+
+	req := httptest.NewRequest("GET", "/image", nil)
+	req.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+
+	r.Inject(w, req, encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, etag, w.Header().Get("ETag"))
+}
+
+func TestInjectServesImageWhenETagDoesNotMatch(t *testing.T) {
+	r := NewResizer(config.Config{ImageResizerConfig: config.DefaultImageResizerConfig})
+	params := resizeParams{Location: "../../testdata/image.png", Width: 64, ContentType: "image/png"}
+
+	req := httptest.NewRequest("GET", "/image", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	w := httptest.NewRecorder()
+
+	r.Inject(w, req, encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEqual(t, `"stale"`, w.Header().Get("ETag"))
+	require.NotZero(t, w.Body.Len())
+}
+
+func TestInjectFromS3(t *testing.T) {
+	creds, s3Config, sess, ts := test.SetupS3(t, "")
+	defer ts.Close()
+
+	_, err := s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s3Config.Bucket),
+		Key:    aws.String("avatars/image.png"),
+		Body:   testImage(t),
+	})
+	require.NoError(t, err)
+
+	cfg := config.Config{ImageResizerConfig: config.DefaultImageResizerConfig}
+	cfg.ObjectStorageCredentials.S3Credentials = creds
+	r := NewResizer(cfg)
+
+	params := resizeParams{Width: 64, ContentType: "image/png", ObjectStorage: &objectStorageParams{Key: "avatars/image.png"}}
+	params.ObjectStorage.Provider = "AWS"
+	params.ObjectStorage.S3Config = s3Config
+
+	w := httptest.NewRecorder()
+	r.Inject(w, httptest.NewRequest("GET", "/image", nil), encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	requireScaledPNG(t, w.Body.Bytes(), 64)
+	require.NotEmpty(t, w.Header().Get("ETag"))
+}
+
+func TestInjectFromGoCloud(t *testing.T) {
+	mux, bucketDir, cleanup := test.SetupGoCloudFileBucket(t, "azblob")
+	defer cleanup()
+
+	image, err := ioutil.ReadFile("../../testdata/image.png")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(bucketDir, "avatars"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bucketDir, "avatars", "image.png"), image, 0644))
+
+	cfg := config.Config{ImageResizerConfig: config.DefaultImageResizerConfig}
+	cfg.ObjectStorageConfig.URLMux = mux
+	r := NewResizer(cfg)
+
+	params := resizeParams{Width: 64, ContentType: "image/png", ObjectStorage: &objectStorageParams{Key: "avatars/image.png"}}
+	params.ObjectStorage.Provider = "AzureRM"
+	params.ObjectStorage.GoCloudConfig = config.GoCloudConfig{URL: "azblob://uploads"}
+
+	w := httptest.NewRecorder()
+	r.Inject(w, httptest.NewRequest("GET", "/image", nil), encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	requireScaledPNG(t, w.Body.Bytes(), 64)
+}
+
+func TestInjectFromObjectStorageFailsForMissingObject(t *testing.T) {
+	mux, _, cleanup := test.SetupGoCloudFileBucket(t, "azblob")
+	defer cleanup()
+
+	cfg := config.Config{ImageResizerConfig: config.DefaultImageResizerConfig}
+	cfg.ObjectStorageConfig.URLMux = mux
+	r := NewResizer(cfg)
+
+	params := resizeParams{Width: 64, ContentType: "image/png", ObjectStorage: &objectStorageParams{Key: "missing.png"}}
+	params.ObjectStorage.GoCloudConfig = config.GoCloudConfig{URL: "azblob://uploads"}
+
+	w := httptest.NewRecorder()
+	r.Inject(w, httptest.NewRequest("GET", "/image", nil), encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestInjectFromObjectStorageFailsWhenNotConfigured(t *testing.T) {
+	r := NewResizer(config.Config{ImageResizerConfig: config.DefaultImageResizerConfig})
+
+	params := resizeParams{Width: 64, ContentType: "image/png", ObjectStorage: &objectStorageParams{Key: "avatars/image.png"}}
+	params.ObjectStorage.Provider = "AWS"
+	params.ObjectStorage.S3Config = config.S3Config{Bucket: "uploads", Region: "eu-central-1"}
+
+	w := httptest.NewRecorder()
+	r.Inject(w, httptest.NewRequest("GET", "/image", nil), encodeSendData(t, r, &params))
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func requireScaledPNG(t *testing.T, data []byte, width int) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, "png", format)
+	require.Equal(t, width, cfg.Width)
+}
+
+func encodeSendData(t *testing.T, r *Resizer, p *resizeParams) string {
+	json, err := json.Marshal(*p)
+	require.NoError(t, err)
+	return string(r.Prefix) + base64.URLEncoding.EncodeToString(json)
+}
+
 // The Rails applications sends a Base64 encoded JSON string carrying
 // these parameters in an HTTP response header
 func encodeParams(t *testing.T, p *resizeParams) string {
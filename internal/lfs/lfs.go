@@ -46,6 +46,8 @@ func (l *uploadPreparer) Prepare(a *api.Response) (*filestore.SaveFileOpts, uplo
 	}
 
 	opts.TempFilePrefix = a.LfsOid
+	// We verify the object ID
+	opts.AddHashes("sha256")
 
 	return opts, &object{oid: a.LfsOid, size: a.LfsSize}, nil
 }
@@ -59,3 +59,14 @@ func TestLfsUploadPreparerWithNoConfig(t *testing.T) {
 	require.False(t, opts.UseWorkhorseClient)
 	require.NotNil(t, verifier)
 }
+
+func TestLfsUploadPreparerComputesSHA256(t *testing.T) {
+	c := config.Config{}
+	r := &api.Response{RemoteObject: api.RemoteObject{ID: "the upload ID"}, UploadHashes: []string{"md5"}}
+	uploadPreparer := upload.NewObjectStoragePreparer(c)
+	lfsPreparer := lfs.NewLfsUploadPreparer(c, uploadPreparer)
+	opts, _, err := lfsPreparer.Prepare(r)
+
+	require.NoError(t, err)
+	require.Equal(t, []string{"md5", "sha256"}, opts.Hashes)
+}
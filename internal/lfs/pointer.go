@@ -0,0 +1,140 @@
+/*
+In this file we recognize git lfs pointer files and open the objects they
+point to, so that they can be served in place of the pointer.
+*/
+
+package lfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/mask"
+	"gitlab.com/gitlab-org/labkit/tracing"
+)
+
+// MaxPointerSize is the size limit for pointer files imposed by git-lfs
+const MaxPointerSize = 1024
+
+var (
+	pointerVersion = []byte("version https://git-lfs.github.com/spec/v1\n")
+	pointerOid     = regexp.MustCompile(`\Aoid sha256:([0-9a-f]{64})\z`)
+	pointerSize    = regexp.MustCompile(`\Asize ([0-9]+)\z`)
+)
+
+var httpClient = &http.Client{
+	Transport: tracing.NewRoundTripper(correlation.NewInstrumentedRoundTripper(&http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).DialContext,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		DisableCompression:    true,
+	})),
+}
+
+// Pointer is the parsed content of a git lfs pointer file
+type Pointer struct {
+	Oid  string
+	Size int64
+}
+
+// ParsePointer recognizes git lfs pointer files as described in
+// https://github.com/git-lfs/git-lfs/blob/master/docs/spec.md
+func ParsePointer(data []byte) (*Pointer, bool) {
+	if len(data) > MaxPointerSize || !bytes.HasPrefix(data, pointerVersion) || !bytes.HasSuffix(data, []byte("\n")) {
+		return nil, false
+	}
+
+	p := &Pointer{Size: -1}
+	for _, line := range bytes.Split(bytes.TrimSuffix(data[len(pointerVersion):], []byte("\n")), []byte("\n")) {
+		if m := pointerOid.FindSubmatch(line); m != nil {
+			p.Oid = string(m[1])
+		} else if m := pointerSize.FindSubmatch(line); m != nil {
+			size, err := strconv.ParseInt(string(m[1]), 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			p.Size = size
+		}
+		// Other keys are extensions which don't change where the object is
+	}
+
+	if p.Oid == "" || p.Size < 0 {
+		return nil, false
+	}
+
+	return p, true
+}
+
+// Object tells where GitLab Rails stores the content of an lfs object
+type Object struct {
+	Oid  string
+	Size int64
+	// Path is set for objects in local storage
+	Path string
+	// URL is set for objects in object storage. It is usually presigned.
+	URL string
+}
+
+// Open returns the content of the object. It fails if the stored object
+// does not have the expected size.
+func (o *Object) Open(ctx context.Context) (io.ReadCloser, error) {
+	switch {
+	case o.Path != "":
+		f, err := os.Open(o.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if fi.Size() != o.Size {
+			f.Close()
+			return nil, fmt.Errorf("LFSObject: expected size %d, found %d", o.Size, fi.Size())
+		}
+
+		return f, nil
+	case o.URL != "":
+		req, err := http.NewRequestWithContext(ctx, "GET", o.URL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("LFSObject: GET %q: %v", mask.URL(o.URL), err)
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("LFSObject: GET %q: %v", mask.URL(o.URL), err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("LFSObject: GET %q: %s", mask.URL(o.URL), resp.Status)
+		}
+
+		if resp.ContentLength != o.Size {
+			resp.Body.Close()
+			return nil, fmt.Errorf("LFSObject: expected size %d, found %d", o.Size, resp.ContentLength)
+		}
+
+		return resp.Body, nil
+	}
+
+	return nil, fmt.Errorf("LFSObject: no location for %s", o.Oid)
+}
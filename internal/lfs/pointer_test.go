@@ -0,0 +1,90 @@
+package lfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+)
+
+const testOid = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+func TestParsePointer(t *testing.T) {
+	pointer, ok := lfs.ParsePointer([]byte("version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\nsize 12345\n"))
+	require.True(t, ok)
+	require.Equal(t, &lfs.Pointer{Oid: testOid, Size: 12345}, pointer)
+
+	pointer, ok = lfs.ParsePointer([]byte("version https://git-lfs.github.com/spec/v1\next-0-foo sha256:" + testOid + "\noid sha256:" + testOid + "\nsize 0\n"))
+	require.True(t, ok, "extensions are allowed")
+	require.Equal(t, &lfs.Pointer{Oid: testOid, Size: 0}, pointer)
+
+	for _, data := range []string{
+		"",
+		"hello world\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\n",
+		"version https://git-lfs.github.com/spec/v1\nsize 12345\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:abc\nsize 12345\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\nsize 12345",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + testOid + "\nsize -1\n",
+	} {
+		_, ok := lfs.ParsePointer([]byte(data))
+		require.False(t, ok, "not a pointer: %q", data)
+	}
+}
+
+func TestOpenLocalObject(t *testing.T) {
+	f, err := ioutil.TempFile("", "lfs-object")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("content")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	object := &lfs.Object{Oid: testOid, Size: 7, Path: f.Name()}
+	requireObjectContent(t, object, "content")
+
+	object.Size = 8
+	_, err = object.Open(context.Background())
+	require.Error(t, err, "size mismatch")
+}
+
+func TestOpenRemoteObject(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/object" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer ts.Close()
+
+	object := &lfs.Object{Oid: testOid, Size: 7, URL: ts.URL + "/object"}
+	requireObjectContent(t, object, "content")
+
+	object.Size = 8
+	_, err := object.Open(context.Background())
+	require.Error(t, err, "size mismatch")
+
+	object = &lfs.Object{Oid: testOid, Size: 7, URL: ts.URL + "/missing"}
+	_, err = object.Open(context.Background())
+	require.Error(t, err)
+
+	_, err = (&lfs.Object{Oid: testOid}).Open(context.Background())
+	require.Error(t, err, "no location")
+}
+
+func requireObjectContent(t *testing.T, object *lfs.Object, expected string) {
+	content, err := object.Open(context.Background())
+	require.NoError(t, err)
+	defer content.Close()
+
+	data, err := ioutil.ReadAll(content)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(data))
+}
@@ -0,0 +1,63 @@
+package objectstore
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+type gcsClientKey struct {
+	credentials config.GoogleCredentials
+	endpoint    string
+}
+
+type gcsClientCache struct {
+	// Like S3 sessions, GCS clients don't depend on the bucket. Their
+	// token sources refresh access tokens as needed, so unlike S3
+	// sessions they don't expire. Reusing them saves an OAuth token
+	// request per upload.
+	clients map[gcsClientKey]*storage.Client
+	sync.Mutex
+}
+
+var gcsClients = &gcsClientCache{clients: make(map[gcsClientKey]*storage.Client)}
+
+// setupGCSClient returns a cached GCS client for googleCredentials and the
+// endpoint of googleConfig, and creates one if necessary
+func setupGCSClient(googleCredentials config.GoogleCredentials, googleConfig config.GoogleConfig) (*storage.Client, error) {
+	gcsClients.Lock()
+	defer gcsClients.Unlock()
+
+	key := gcsClientKey{credentials: googleCredentials, endpoint: googleConfig.Endpoint}
+	if client, ok := gcsClients.clients[key]; ok {
+		return client, nil
+	}
+
+	var opts []option.ClientOption
+	if googleConfig.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(googleConfig.Endpoint))
+	}
+
+	// Without a key, the client finds Application Default Credentials,
+	// e.g. those of GKE Workload Identity
+	if googleCredentials.JSONKeyString != "" {
+		opts = append(opts, option.WithCredentialsJSON([]byte(googleCredentials.JSONKeyString)))
+	} else if googleCredentials.JSONKeyLocation != "" {
+		opts = append(opts, option.WithCredentialsFile(googleCredentials.JSONKeyLocation))
+	}
+
+	// The client uses this context to refresh access tokens for as long as
+	// it is cached, so it can't be the context of a request.
+	client, err := storage.NewClient(context.Background(), opts...) // lint:allow context.Background
+	if err != nil {
+		return nil, err
+	}
+
+	gcsClients.clients[key] = client
+
+	return client, nil
+}
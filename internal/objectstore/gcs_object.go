@@ -0,0 +1,103 @@
+package objectstore
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// DefaultGCSChunkSize is the default size of the chunks of resumable GCS
+// uploads. We buffer one chunk in memory per upload.
+const DefaultGCSChunkSize = 8 * 1024 * 1024
+
+type GCSObject struct {
+	credentials config.GoogleCredentials
+	config      config.GoogleConfig
+	objectName  string
+	uploaded    bool
+	md5         []byte
+
+	// ChunkSize is the size of the chunks of the resumable upload. GCS
+	// rounds it up to a multiple of 256KiB. Uploads that fit in one chunk
+	// are sent in a single request.
+	ChunkSize int
+
+	*uploader
+}
+
+func NewGCSObject(objectName string, googleCredentials config.GoogleCredentials, googleConfig config.GoogleConfig) (*GCSObject, error) {
+	o := &GCSObject{
+		credentials: googleCredentials,
+		config:      googleConfig,
+		objectName:  objectName,
+		ChunkSize:   DefaultGCSChunkSize,
+	}
+
+	// GCS returns the MD5 of the object, so we can compare it like an S3 ETag
+	o.uploader = newETagCheckUploader(o, true)
+	return o, nil
+}
+
+func (o *GCSObject) Upload(ctx context.Context, r io.Reader) error {
+	client, err := setupGCSClient(o.credentials, o.config)
+	if err != nil {
+		log.WithError(err).Error("error creating GCS client")
+		return err
+	}
+
+	// The writer aborts the upload if ctx is done before Close. It retries
+	// chunks that fail with transient errors.
+	w := client.Bucket(o.config.Bucket).Object(o.objectName).NewWriter(ctx)
+	w.ChunkSize = o.ChunkSize
+	w.ContentType = "application/octet-stream"
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.CloseWithError(err)
+		log.WithError(err).Error("error uploading GCS object")
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		log.WithError(err).Error("error uploading GCS object")
+		return err
+	}
+
+	o.md5 = w.Attrs().MD5
+	o.uploaded = true
+
+	return nil
+}
+
+func (o *GCSObject) ETag() string {
+	return hex.EncodeToString(o.md5)
+}
+
+func (o *GCSObject) Abort() {
+	o.Delete()
+}
+
+func (o *GCSObject) Delete() {
+	if !o.uploaded {
+		return
+	}
+
+	client, err := setupGCSClient(o.credentials, o.config)
+	if err != nil {
+		log.WithError(err).Error("error creating GCS client in delete")
+		return
+	}
+
+	// Note we can't use the request context because in a successful
+	// case, the original request has already completed.
+	deleteCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second) // lint:allow context.Background
+	defer cancel()
+
+	if err := client.Bucket(o.config.Bucket).Object(o.objectName).Delete(deleteCtx); err != nil {
+		log.WithError(err).Error("error deleting GCS object")
+	}
+}
@@ -0,0 +1,109 @@
+package objectstore_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+// The smallest chunk size of resumable GCS uploads
+const gcsChunkSize = 256 * 1024
+
+func TestGCSObjectUpload(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		content   string
+		resumable bool
+	}{
+		{desc: "single chunk", content: test.ObjectContent},
+		{desc: "several chunks", content: strings.Repeat("0123456789", gcsChunkSize/4), resumable: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			creds, config, stub, ts := test.SetupGCS(t, "uploads")
+			defer ts.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			objectName := "tmp/uploads/gcs-test-data"
+			object, err := objectstore.NewGCSObject(objectName, creds, config)
+			require.NoError(t, err)
+			object.ChunkSize = gcsChunkSize
+
+			n, err := object.Consume(ctx, strings.NewReader(tc.content), time.Now().Add(testTimeout))
+			require.NoError(t, err)
+			require.Equal(t, int64(len(tc.content)), n)
+
+			data, ok := stub.GetObject(objectName)
+			require.True(t, ok, "the object is uploaded")
+			require.Equal(t, tc.content, string(data))
+
+			if tc.resumable {
+				require.Equal(t, 1, stub.ResumableUploadsCnt())
+				require.Equal(t, 3, stub.ChunksCnt())
+			} else {
+				require.Equal(t, 1, stub.MultipartUploadsCnt())
+			}
+
+			cancel()
+
+			testhelper.Retry(t, 5*time.Second, func() error {
+				if _, ok := stub.GetObject(objectName); ok {
+					return fmt.Errorf("file is still present")
+				}
+
+				return nil
+			})
+		})
+	}
+}
+
+func TestGCSObjectUploadRetriesChunks(t *testing.T) {
+	creds, config, stub, ts := test.SetupGCS(t, "uploads")
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := strings.Repeat("0123456789", gcsChunkSize/4)
+	stub.FailChunks(1)
+
+	object, err := objectstore.NewGCSObject("gcs-test-data", creds, config)
+	require.NoError(t, err)
+	object.ChunkSize = gcsChunkSize
+
+	_, err = object.Consume(ctx, strings.NewReader(content), time.Now().Add(testTimeout))
+	require.NoError(t, err)
+	require.Equal(t, 4, stub.ChunksCnt(), "the failed chunk is uploaded again")
+
+	data, ok := stub.GetObject("gcs-test-data")
+	require.True(t, ok)
+	require.Equal(t, content, string(data))
+}
+
+func TestGCSObjectUploadFailure(t *testing.T) {
+	creds, config, stub, ts := test.SetupGCS(t, "uploads")
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config.Bucket = "missing-bucket"
+
+	object, err := objectstore.NewGCSObject("gcs-test-data", creds, config)
+	require.NoError(t, err)
+
+	_, err = object.Consume(ctx, strings.NewReader(test.ObjectContent), time.Now().Add(testTimeout))
+	require.Error(t, err)
+	require.Equal(t, 0, stub.MultipartUploadsCnt())
+}
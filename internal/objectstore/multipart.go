@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
 
 	"gitlab.com/gitlab-org/labkit/log"
 	"gitlab.com/gitlab-org/labkit/mask"
@@ -29,8 +30,13 @@ type Multipart struct {
 	// DeleteURL is a presigned URL for RemoveObject
 	DeleteURL  string
 	PutHeaders map[string]string
-	partSize   int64
-	etag       string
+	// Concurrency is how many parts we upload at the same time. We
+	// buffer up to this many parts.
+	Concurrency int
+	// MemoryBuffer buffers parts in memory instead of temporary files
+	MemoryBuffer bool
+	partSize     int64
+	etag         string
 
 	*uploader
 }
@@ -53,18 +59,74 @@ func NewMultipart(partURLs []string, completeURL, abortURL, deleteURL string, pu
 }
 
 func (m *Multipart) Upload(ctx context.Context, r io.Reader) error {
-	cmu := &CompleteMultipartUpload{}
+	concurrency := m.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		uploadErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			uploadErr = err
+			cancel()
+		})
+	}
+
+	// We read the parts one after the other, and upload up to concurrency
+	// of them at the same time. A part only takes a slot, and a buffer,
+	// once we start reading it.
+	slots := make(chan struct{}, concurrency)
+	parts := make([]*completeMultipartUploadPart, 0, len(m.PartURLs))
+
+readParts:
 	for i, partURL := range m.PartURLs {
-		src := io.LimitReader(r, m.partSize)
-		part, err := m.readAndUploadOnePart(ctx, partURL, m.PutHeaders, src, i+1)
-		if err != nil {
-			return err
+		select {
+		case slots <- struct{}{}:
+		case <-uploadCtx.Done():
+			break readParts
 		}
-		if part == nil {
+
+		buf, n, err := m.readPart(io.LimitReader(r, m.partSize))
+		if err != nil || n == 0 {
+			<-slots
+			if err != nil {
+				fail(err)
+			}
 			break
-		} else {
-			cmu.Part = append(cmu.Part, part)
 		}
+
+		part := &completeMultipartUploadPart{PartNumber: i + 1}
+		parts = append(parts, part)
+
+		wg.Add(1)
+		go func(partURL string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer buf.Close()
+
+			etag, err := m.uploadPartWithRetries(uploadCtx, partURL, buf, n, part.PartNumber)
+			if err != nil {
+				fail(fmt.Errorf("upload part %d: %v", part.PartNumber, err))
+				return
+			}
+
+			part.ETag = etag
+		}(partURL)
+	}
+
+	wg.Wait()
+	if uploadErr != nil {
+		return uploadErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	n, err := io.Copy(ioutil.Discard, r)
@@ -75,7 +137,7 @@ func (m *Multipart) Upload(ctx context.Context, r io.Reader) error {
 		return ErrNotEnoughParts
 	}
 
-	if err := m.complete(ctx, cmu); err != nil {
+	if err := m.complete(ctx, &CompleteMultipartUpload{Part: parts}); err != nil {
 		return err
 	}
 
@@ -93,34 +155,44 @@ func (m *Multipart) Delete() {
 	deleteURL(m.DeleteURL)
 }
 
-func (m *Multipart) readAndUploadOnePart(ctx context.Context, partURL string, putHeaders map[string]string, src io.Reader, partNumber int) (*completeMultipartUploadPart, error) {
-	file, err := ioutil.TempFile("", "part-buffer")
-	if err != nil {
-		return nil, fmt.Errorf("create temporary buffer file: %v", err)
-	}
-	defer func(path string) {
-		if err := os.Remove(path); err != nil {
-			log.WithError(err).WithField("file", path).Warning("Unable to delete temporary file")
+// readPart buffers src, on disk or in memory
+func (m *Multipart) readPart(src io.Reader) (partBuffer, int64, error) {
+	var buf partBuffer
+	if m.MemoryBuffer {
+		buf = &memoryPartBuffer{}
+	} else {
+		file, err := ioutil.TempFile("", "part-buffer")
+		if err != nil {
+			return nil, 0, fmt.Errorf("create temporary buffer file: %v", err)
 		}
-	}(file.Name())
-
-	n, err := io.Copy(file, src)
-	if err != nil {
-		return nil, err
-	}
-	if n == 0 {
-		return nil, nil
+		buf = &diskPartBuffer{file: file}
 	}
 
-	if _, err = file.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("rewind part %d temporary dump : %v", partNumber, err)
+	n, err := io.Copy(buf, src)
+	if err != nil || n == 0 {
+		buf.Close()
+		return nil, 0, err
 	}
 
-	etag, err := m.uploadPart(ctx, partURL, putHeaders, file, n)
-	if err != nil {
-		return nil, fmt.Errorf("upload part %d: %v", partNumber, err)
-	}
-	return &completeMultipartUploadPart{PartNumber: partNumber, ETag: etag}, nil
+	return buf, n, nil
+}
+
+// uploadPartWithRetries uploads a part again if it fails with a transient
+// error. Each attempt reads the part from its own reader, because the HTTP
+// client may still read the body of a failed request.
+func (m *Multipart) uploadPartWithRetries(ctx context.Context, partURL string, buf partBuffer, size int64, partNumber int) (etag string, err error) {
+	err = retry(ctx, "upload_part", isTransientError, func() error {
+		body, err := buf.Reader()
+		if err != nil {
+			return fmt.Errorf("reopen part %d temporary dump: %v", partNumber, err)
+		}
+		defer body.Close()
+
+		etag, err = m.uploadPart(ctx, partURL, m.PutHeaders, body, size)
+		return err
+	})
+
+	return etag, err
 }
 
 func (m *Multipart) uploadPart(ctx context.Context, url string, headers map[string]string, body io.Reader, size int64) (string, error) {
@@ -150,6 +222,12 @@ func (m *Multipart) complete(ctx context.Context, cmu *CompleteMultipartUpload)
 		return fmt.Errorf("marshal CompleteMultipartUpload request: %v", err)
 	}
 
+	return retry(ctx, "complete_multipart", isTransientError, func() error {
+		return m.completeOnce(ctx, body)
+	})
+}
+
+func (m *Multipart) completeOnce(ctx context.Context, body []byte) error {
 	req, err := http.NewRequest("POST", m.CompleteURL, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("create CompleteMultipartUpload request: %v", err)
@@ -160,12 +238,16 @@ func (m *Multipart) complete(ctx context.Context, cmu *CompleteMultipartUpload)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("CompleteMultipartUpload request %q: %v", mask.URL(m.CompleteURL), err)
+		return &transientError{fmt.Errorf("CompleteMultipartUpload request %q: %w", mask.URL(m.CompleteURL), err)}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("CompleteMultipartUpload request %v returned: %s", mask.URL(m.CompleteURL), resp.Status)
+		err := fmt.Errorf("CompleteMultipartUpload request %v returned: %s", mask.URL(m.CompleteURL), resp.Status)
+		if isTransientStatus(resp.StatusCode) {
+			return &transientError{err}
+		}
+		return err
 	}
 
 	result := &compoundCompleteMultipartUploadResult{}
@@ -175,6 +257,11 @@ func (m *Multipart) complete(ctx context.Context, cmu *CompleteMultipartUpload)
 	}
 
 	if result.isError() {
+		// S3 can fail after it answered 200 OK. We should retry these.
+		switch result.Code {
+		case "InternalError", "SlowDown":
+			return &transientError{result}
+		}
 		return result
 	}
 
@@ -186,3 +273,41 @@ func (m *Multipart) complete(ctx context.Context, cmu *CompleteMultipartUpload)
 
 	return nil
 }
+
+// partBuffer holds a part while we upload it
+type partBuffer interface {
+	io.Writer
+	// Reader returns a new reader of the whole part
+	Reader() (io.ReadCloser, error)
+	Close()
+}
+
+type diskPartBuffer struct {
+	file *os.File
+}
+
+func (b *diskPartBuffer) Write(p []byte) (int, error) {
+	return b.file.Write(p)
+}
+
+func (b *diskPartBuffer) Reader() (io.ReadCloser, error) {
+	return os.Open(b.file.Name())
+}
+
+func (b *diskPartBuffer) Close() {
+	b.file.Close()
+
+	if err := os.Remove(b.file.Name()); err != nil {
+		log.WithError(err).WithField("file", b.file.Name()).Warning("Unable to delete temporary file")
+	}
+}
+
+type memoryPartBuffer struct {
+	bytes.Buffer
+}
+
+func (b *memoryPartBuffer) Reader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b.Bytes())), nil
+}
+
+func (b *memoryPartBuffer) Close() {}
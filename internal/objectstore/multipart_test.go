@@ -1,11 +1,15 @@
 package objectstore_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/xml"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -62,3 +66,211 @@ func TestMultipartUploadWithUpcaseETags(t *testing.T) {
 	require.Equal(t, 1, putCnt, "1 part expected")
 	require.Equal(t, 1, postCnt, "1 complete multipart upload expected")
 }
+
+// multipartStub wraps an ObjectstoreStub to slow down part uploads, to fail
+// some of them and to record the completion request
+type multipartStub struct {
+	*test.ObjectstoreStub
+	failures map[string]int
+
+	sync.Mutex
+	inFlight, maxInFlight int
+	completeParts         []int
+}
+
+func (s *multipartStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT":
+		partNumber := r.URL.Query().Get("partNumber")
+
+		s.Lock()
+		s.inFlight++
+		if s.inFlight > s.maxInFlight {
+			s.maxInFlight = s.inFlight
+		}
+		fail := s.failures[partNumber] > 0
+		if fail {
+			s.failures[partNumber]--
+		}
+		s.Unlock()
+
+		defer func() {
+			s.Lock()
+			s.inFlight--
+			s.Unlock()
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		if fail {
+			ioutil.ReadAll(r.Body)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.Lock()
+		fail := s.failures["complete"] > 0
+		if fail {
+			s.failures["complete"]--
+		}
+		s.Unlock()
+
+		if fail {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		var cmu objectstore.CompleteMultipartUpload
+		if err := xml.Unmarshal(body, &cmu); err == nil {
+			s.Lock()
+			for _, part := range cmu.Part {
+				s.completeParts = append(s.completeParts, part.PartNumber)
+			}
+			s.Unlock()
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	s.ObjectstoreStub.ServeHTTP(w, r)
+}
+
+func newMultipartStub(t *testing.T, failures map[string]int) (*multipartStub, *httptest.Server) {
+	osStub, osServer := test.StartObjectStore()
+	osServer.Close()
+
+	stub := &multipartStub{ObjectstoreStub: osStub, failures: failures}
+	ts := httptest.NewServer(stub)
+
+	require.NoError(t, osStub.InitiateMultipartUpload(test.ObjectPath))
+
+	return stub, ts
+}
+
+func newTestMultipart(t *testing.T, ts *httptest.Server, parts int, partSize int64) *objectstore.Multipart {
+	objectURL := ts.URL + test.ObjectPath
+
+	var partURLs []string
+	for i := 1; i <= parts; i++ {
+		partURLs = append(partURLs, fmt.Sprintf("%s?partNumber=%d", objectURL, i))
+	}
+
+	m, err := objectstore.NewMultipart(partURLs, objectURL, objectURL, objectURL, map[string]string{}, partSize)
+	require.NoError(t, err)
+
+	return m
+}
+
+func TestMultipartUploadConcurrently(t *testing.T) {
+	for _, memoryBuffer := range []bool{false, true} {
+		t.Run(fmt.Sprintf("memory buffer: %v", memoryBuffer), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			stub, ts := newMultipartStub(t, nil)
+			defer ts.Close()
+
+			// 19 bytes in 5 parts of 4 bytes
+			m := newTestMultipart(t, ts, 6, 4)
+			m.Concurrency = 3
+			m.MemoryBuffer = memoryBuffer
+
+			n, err := m.Consume(ctx, strings.NewReader(test.ObjectContent), time.Now().Add(testTimeout))
+			require.NoError(t, err)
+			require.Equal(t, test.ObjectSize, n)
+
+			require.Equal(t, 5, stub.PutsCnt())
+			require.Equal(t, 3, stub.maxInFlight, "parts are uploaded concurrently")
+			require.Equal(t, []int{1, 2, 3, 4, 5}, stub.completeParts, "parts are completed in order")
+			require.False(t, stub.IsMultipartUpload(test.ObjectPath), "MultipartUpload is still in progress")
+		})
+	}
+}
+
+func TestMultipartUploadSequentially(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stub, ts := newMultipartStub(t, nil)
+	defer ts.Close()
+
+	m := newTestMultipart(t, ts, 5, 4)
+
+	_, err := m.Consume(ctx, strings.NewReader(test.ObjectContent), time.Now().Add(testTimeout))
+	require.NoError(t, err)
+	require.Equal(t, 1, stub.maxInFlight)
+	require.Equal(t, []int{1, 2, 3, 4, 5}, stub.completeParts)
+}
+
+func TestMultipartUploadRetriesFailedParts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stub, ts := newMultipartStub(t, map[string]int{"2": 2})
+	defer ts.Close()
+
+	m := newTestMultipart(t, ts, 5, 4)
+	m.Concurrency = 2
+
+	_, err := m.Consume(ctx, strings.NewReader(test.ObjectContent), time.Now().Add(testTimeout))
+	require.NoError(t, err)
+	require.Equal(t, 5, stub.PutsCnt(), "failed part uploads don't reach the stub")
+	require.Equal(t, []int{1, 2, 3, 4, 5}, stub.completeParts)
+}
+
+func TestMultipartUploadFailsAfterRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// We try 4 times
+	stub, ts := newMultipartStub(t, map[string]int{"3": 4})
+	defer ts.Close()
+
+	m := newTestMultipart(t, ts, 5, 4)
+	m.Concurrency = 2
+
+	_, err := m.Consume(ctx, strings.NewReader(test.ObjectContent), time.Now().Add(testTimeout))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "upload part 3")
+	require.Empty(t, stub.completeParts, "the upload is not completed")
+	require.Equal(t, 1, stub.DeletesCnt(), "the upload is aborted")
+}
+
+func TestMultipartUploadRetriesCompletion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stub, ts := newMultipartStub(t, map[string]int{"complete": 2})
+	defer ts.Close()
+
+	m := newTestMultipart(t, ts, 5, 4)
+
+	_, err := m.Consume(ctx, strings.NewReader(test.ObjectContent), time.Now().Add(testTimeout))
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5}, stub.completeParts)
+	require.False(t, stub.IsMultipartUpload(test.ObjectPath), "MultipartUpload is still in progress")
+}
+
+func TestMultipartUploadDoesNotRetryPermanentErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	m := newTestMultipart(t, ts, 5, 4)
+
+	_, err := m.Consume(ctx, strings.NewReader(test.ObjectContent), time.Now().Add(testTimeout))
+	require.Error(t, err)
+	require.Equal(t, 2, requests, "1 part upload and the abort")
+}
@@ -46,6 +46,9 @@ type Object struct {
 	size       int64
 	etag       string
 	metrics    bool
+	// retryConnect retries the PUT request if we could not connect. We
+	// can't replay the body, so that is the only error we retry.
+	retryConnect bool
 
 	*uploader
 }
@@ -54,7 +57,13 @@ type StatusCodeError error
 
 // NewObject opens an HTTP connection to Object Store and returns an Object pointer that can be used for uploading.
 func NewObject(putURL, deleteURL string, putHeaders map[string]string, size int64) (*Object, error) {
-	return newObject(putURL, deleteURL, putHeaders, size, true)
+	o, err := newObject(putURL, deleteURL, putHeaders, size, true)
+	if err != nil {
+		return nil, err
+	}
+
+	o.retryConnect = true
+	return o, nil
 }
 
 func newObject(putURL, deleteURL string, putHeaders map[string]string, size int64, metrics bool) (*Object, error) {
@@ -71,6 +80,16 @@ func newObject(putURL, deleteURL string, putHeaders map[string]string, size int6
 }
 
 func (o *Object) Upload(ctx context.Context, r io.Reader) error {
+	if !o.retryConnect {
+		return o.put(ctx, r)
+	}
+
+	return retry(ctx, "put", isConnectError, func() error {
+		return o.put(ctx, r)
+	})
+}
+
+func (o *Object) put(ctx context.Context, r io.Reader) error {
 	// we should prevent pr.Close() otherwise it may shadow error set with pr.CloseWithError(err)
 	req, err := http.NewRequest(http.MethodPut, o.putURL, ioutil.NopCloser(r))
 
@@ -78,6 +97,7 @@ func (o *Object) Upload(ctx context.Context, r io.Reader) error {
 		return fmt.Errorf("PUT %q: %v", mask.URL(o.putURL), err)
 	}
 	req.ContentLength = o.size
+	req = req.WithContext(ctx)
 
 	for k, v := range o.putHeaders {
 		req.Header.Set(k, v)
@@ -85,7 +105,7 @@ func (o *Object) Upload(ctx context.Context, r io.Reader) error {
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("PUT request %q: %v", mask.URL(o.putURL), err)
+		return &transientError{fmt.Errorf("PUT request %q: %w", mask.URL(o.putURL), err)}
 	}
 	defer resp.Body.Close()
 
@@ -93,7 +113,12 @@ func (o *Object) Upload(ctx context.Context, r io.Reader) error {
 		if o.metrics {
 			objectStorageUploadRequestsInvalidStatus.Inc()
 		}
-		return StatusCodeError(fmt.Errorf("PUT request %v returned: %s", mask.URL(o.putURL), resp.Status))
+
+		err := StatusCodeError(fmt.Errorf("PUT request %v returned: %s", mask.URL(o.putURL), resp.Status))
+		if isTransientStatus(resp.StatusCode) {
+			return &transientError{err}
+		}
+		return err
 	}
 
 	o.etag = extractETag(resp.Header.Get("ETag"))
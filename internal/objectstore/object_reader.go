@@ -0,0 +1,134 @@
+package objectstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gocloud.dev/blob"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// ObjectReader streams an object that was opened with Workhorse's own
+// object storage credentials, as opposed to a presigned URL.
+type ObjectReader struct {
+	io.ReadCloser
+	ObjectAttributes
+}
+
+// ObjectAttributes describes an object without reading its contents.
+type ObjectAttributes struct {
+	// Size is the size of the object in bytes
+	Size int64
+	// Version identifies this particular revision of the object, e.g. the S3 ETag
+	Version string
+}
+
+// OpenS3Object opens objectName in the bucket given by s3Config for reading.
+func OpenS3Object(ctx context.Context, objectName string, s3Credentials config.S3Credentials, s3Config config.S3Config) (*ObjectReader, error) {
+	sess, err := setupS3Session(s3Credentials, s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("create S3 session: %v", err)
+	}
+
+	svc := s3.New(sess)
+	output, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3Config.Bucket),
+		Key:    aws.String(objectName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectReader{
+		ReadCloser: output.Body,
+		ObjectAttributes: ObjectAttributes{
+			Size:    aws.Int64Value(output.ContentLength),
+			Version: aws.StringValue(output.ETag),
+		},
+	}, nil
+}
+
+// StatS3Object returns the attributes of objectName without downloading it.
+func StatS3Object(ctx context.Context, objectName string, s3Credentials config.S3Credentials, s3Config config.S3Config) (*ObjectAttributes, error) {
+	sess, err := setupS3Session(s3Credentials, s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("create S3 session: %v", err)
+	}
+
+	svc := s3.New(sess)
+	output, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Config.Bucket),
+		Key:    aws.String(objectName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectAttributes{
+		Size:    aws.Int64Value(output.ContentLength),
+		Version: aws.StringValue(output.ETag),
+	}, nil
+}
+
+// OpenGoCloudObject opens objectName in the bucket identified by bucketURL
+// using the providers registered in mux.
+func OpenGoCloudObject(ctx context.Context, mux *blob.URLMux, bucketURL string, objectName string) (*ObjectReader, error) {
+	bucket, err := mux.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := bucket.NewReader(ctx, objectName, nil)
+	if err != nil {
+		bucket.Close()
+		return nil, err
+	}
+
+	return &ObjectReader{
+		ReadCloser:       &goCloudReader{Reader: reader, bucket: bucket},
+		ObjectAttributes: goCloudAttributes(reader.ModTime(), reader.Size()),
+	}, nil
+}
+
+// StatGoCloudObject returns the attributes of objectName without opening it
+// for reading.
+func StatGoCloudObject(ctx context.Context, mux *blob.URLMux, bucketURL string, objectName string) (*ObjectAttributes, error) {
+	bucket, err := mux.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+
+	attrs, err := bucket.Attributes(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := goCloudAttributes(attrs.ModTime, attrs.Size)
+	return &result, nil
+}
+
+// Not every GoCloud provider exposes an ETag, so we derive the version from
+// the modification time and size.
+func goCloudAttributes(modTime time.Time, size int64) ObjectAttributes {
+	return ObjectAttributes{
+		Size:    size,
+		Version: fmt.Sprintf("%d-%d", modTime.UnixNano(), size),
+	}
+}
+
+type goCloudReader struct {
+	*blob.Reader
+	bucket *blob.Bucket
+}
+
+func (r *goCloudReader) Close() error {
+	defer r.bucket.Close()
+
+	return r.Reader.Close()
+}
@@ -0,0 +1,75 @@
+package objectstore_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
+)
+
+func TestOpenS3Object(t *testing.T) {
+	creds, config, sess, ts := test.SetupS3(t, "")
+	defer ts.Close()
+
+	_, err := s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String("s3-test-data"),
+		Body:   strings.NewReader(test.ObjectContent),
+	})
+	require.NoError(t, err)
+
+	object, err := objectstore.OpenS3Object(context.Background(), "s3-test-data", creds, config)
+	require.NoError(t, err)
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+	require.NoError(t, err)
+	require.Equal(t, test.ObjectContent, string(data))
+	require.Equal(t, test.ObjectSize, object.Size)
+	require.NotEmpty(t, object.Version)
+
+	attrs, err := objectstore.StatS3Object(context.Background(), "s3-test-data", creds, config)
+	require.NoError(t, err)
+	require.Equal(t, object.ObjectAttributes, *attrs)
+
+	_, err = objectstore.OpenS3Object(context.Background(), "missing", creds, config)
+	require.Error(t, err)
+
+	_, err = objectstore.StatS3Object(context.Background(), "missing", creds, config)
+	require.Error(t, err)
+}
+
+func TestOpenGoCloudObject(t *testing.T) {
+	mux, bucketDir, cleanup := test.SetupGoCloudFileBucket(t, "azblob")
+	defer cleanup()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bucketDir, "test-data"), []byte(test.ObjectContent), 0644))
+
+	object, err := objectstore.OpenGoCloudObject(context.Background(), mux, "azblob://test-container", "test-data")
+	require.NoError(t, err)
+	defer object.Close()
+
+	data, err := ioutil.ReadAll(object)
+	require.NoError(t, err)
+	require.Equal(t, test.ObjectContent, string(data))
+	require.Equal(t, test.ObjectSize, object.Size)
+	require.NotEmpty(t, object.Version)
+
+	attrs, err := objectstore.StatGoCloudObject(context.Background(), mux, "azblob://test-container", "test-data")
+	require.NoError(t, err)
+	require.Equal(t, object.ObjectAttributes, *attrs)
+
+	_, err = objectstore.OpenGoCloudObject(context.Background(), mux, "azblob://test-container", "missing")
+	require.Error(t, err)
+
+	_, err = objectstore.StatGoCloudObject(context.Background(), mux, "azblob://test-container", "missing")
+	require.Error(t, err)
+}
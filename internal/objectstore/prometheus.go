@@ -29,6 +29,14 @@ var (
 			Buckets: objectStorageUploadTimeBuckets,
 		})
 
+	objectStorageUploadRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_object_storage_upload_retries_total",
+			Help: "How many object storage upload requests we retried, by operation",
+		},
+		[]string{"operation"},
+	)
+
 	objectStorageUploadRequestsRequestFailed = objectStorageUploadRequests.WithLabelValues("request-failed")
 	objectStorageUploadRequestsInvalidStatus = objectStorageUploadRequests.WithLabelValues("invalid-status")
 
@@ -39,5 +47,6 @@ func init() {
 	prometheus.MustRegister(
 		objectStorageUploadRequests,
 		objectStorageUploadsOpen,
-		objectStorageUploadBytes)
+		objectStorageUploadBytes,
+		objectStorageUploadRetries)
 }
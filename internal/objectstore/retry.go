@@ -0,0 +1,88 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+const (
+	// retryAttempts is how many times we try an object storage request
+	retryAttempts = 4
+)
+
+var (
+	retryInitialBackoff = 100 * time.Millisecond
+	retryMaxBackoff     = 3 * time.Second
+)
+
+// transientError is an error that another attempt of the same request may
+// not have
+type transientError struct {
+	error
+}
+
+func (e *transientError) Unwrap() error {
+	return e.error
+}
+
+func isTransientError(err error) bool {
+	var transient *transientError
+	return errors.As(err, &transient)
+}
+
+// isConnectError matches errors of requests that never reached object
+// storage, so they didn't read their body
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isTransientStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// retry calls f until it returns nil or an error that retryable doesn't
+// match, for up to retryAttempts attempts. It waits with exponential
+// backoff and jitter between attempts, and it gives up early if the next
+// attempt would start after the deadline of ctx.
+func retry(ctx context.Context, operation string, retryable func(error) bool, f func() error) error {
+	backoff := retryInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt == retryAttempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		objectStorageUploadRetries.WithLabelValues(operation).Inc()
+		log.WithContextFields(ctx, log.Fields{
+			"operation": operation,
+			"attempt":   attempt,
+			"wait_ms":   wait.Milliseconds(),
+		}).WithError(err).Warning("retrying object storage request")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
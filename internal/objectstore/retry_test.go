@@ -0,0 +1,92 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	errTransient := &transientError{errors.New("transient")}
+	errPermanent := errors.New("permanent")
+
+	testCases := []struct {
+		desc     string
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{desc: "success", errs: []error{nil}, attempts: 1},
+		{desc: "success after transient errors", errs: []error{errTransient, errTransient, nil}, attempts: 3},
+		{desc: "permanent error", errs: []error{errTransient, errPermanent, nil}, attempts: 2, err: errPermanent},
+		{desc: "too many transient errors", errs: []error{errTransient, errTransient, errTransient, errTransient, nil}, attempts: retryAttempts, err: errTransient},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			operation := "test_" + strings.ReplaceAll(tc.desc, " ", "_")
+			retries := objectStorageUploadRetries.WithLabelValues(operation)
+			before := testutil.ToFloat64(retries)
+
+			attempts := 0
+			err := retry(context.Background(), operation, isTransientError, func() error {
+				attempts++
+				return tc.errs[attempts-1]
+			})
+
+			require.Equal(t, tc.err, err)
+			require.Equal(t, tc.attempts, attempts)
+			require.Equal(t, float64(tc.attempts-1), testutil.ToFloat64(retries)-before)
+		})
+	}
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	started := time.Now()
+	err := retry(ctx, "test_deadline", isTransientError, func() error {
+		attempts++
+		return &transientError{errors.New("transient")}
+	})
+
+	require.Error(t, err)
+	require.Less(t, attempts, retryAttempts, "we don't wait for attempts that would start after the deadline")
+	require.WithinDuration(t, started, time.Now(), 150*time.Millisecond)
+}
+
+func TestObjectPutRetries(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	o, err := NewObject(ts.URL, "", nil, 4)
+	require.NoError(t, err)
+	err = o.Upload(context.Background(), strings.NewReader("test"))
+	require.True(t, isTransientError(err))
+	require.Equal(t, 1, requests, "we can't replay the body of single PUT requests")
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	o, err = NewObject(closed.URL, "", nil, 4)
+	require.NoError(t, err)
+
+	retries := objectStorageUploadRetries.WithLabelValues("put")
+	before := testutil.ToFloat64(retries)
+	err = o.Upload(context.Background(), strings.NewReader("test"))
+	require.True(t, isConnectError(err))
+	require.Equal(t, float64(retryAttempts-1), testutil.ToFloat64(retries)-before, "we retry when we could not connect")
+}
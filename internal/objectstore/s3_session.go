@@ -7,6 +7,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 )
@@ -86,6 +87,16 @@ func setupS3Session(s3Credentials config.S3Credentials, s3Config config.S3Config
 	return sess, nil
 }
 
+// NewS3Client returns an S3 client that uses the cached session of s3Config
+func NewS3Client(s3Credentials config.S3Credentials, s3Config config.S3Config) (*s3.S3, error) {
+	sess, err := setupS3Session(s3Credentials, s3Config)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.New(sess), nil
+}
+
 func ResetS3Session(s3Config config.S3Config) {
 	sessionCache.Lock()
 	defer sessionCache.Unlock()
@@ -0,0 +1,314 @@
+package test
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const gcsAccessToken = "gcs-test-token"
+
+// GCSStub is a fake Google Cloud Storage server. It implements the JSON API
+// requests that Workhorse makes to upload and delete objects, and the OAuth
+// token endpoint of the service account of SetupGCS.
+type GCSStub struct {
+	bucket string
+
+	// objects contains uploaded objects by name
+	objects map[string][]byte
+	// sessions contains the data of resumable uploads in progress by upload ID
+	sessions map[string]*gcsSession
+
+	multipartUploads int
+	resumableUploads int
+	chunks           int
+	failChunks       int
+
+	m sync.Mutex
+}
+
+type gcsSession struct {
+	name string
+	data []byte
+}
+
+// SetupGCS starts a GCSStub with a bucket and returns service account
+// credentials and a config to use it
+func SetupGCS(t *testing.T, bucket string) (config.GoogleCredentials, config.GoogleConfig, *GCSStub, *httptest.Server) {
+	stub := &GCSStub{
+		bucket:   bucket,
+		objects:  make(map[string][]byte),
+		sessions: make(map[string]*gcsSession),
+	}
+	ts := httptest.NewServer(stub)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	keyJSON, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "workhorse-test",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"client_email":   "workhorse@workhorse-test.iam.gserviceaccount.com",
+		"client_id":      "1",
+		"token_uri":      ts.URL + "/token",
+	})
+	require.NoError(t, err)
+
+	creds := config.GoogleCredentials{JSONKeyString: string(keyJSON)}
+	cfg := config.GoogleConfig{Bucket: bucket, Endpoint: ts.URL + "/storage/v1/"}
+
+	return creds, cfg, stub, ts
+}
+
+// GetObject returns the content of an uploaded object, and whether it exists
+func (s *GCSStub) GetObject(name string) ([]byte, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	data, ok := s.objects[name]
+	return data, ok
+}
+
+// MultipartUploadsCnt counts uploads in a single request
+func (s *GCSStub) MultipartUploadsCnt() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.multipartUploads
+}
+
+// ResumableUploadsCnt counts started resumable uploads
+func (s *GCSStub) ResumableUploadsCnt() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.resumableUploads
+}
+
+// ChunksCnt counts chunks of resumable uploads, including failed ones
+func (s *GCSStub) ChunksCnt() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.chunks
+}
+
+// FailChunks makes the next n chunks of resumable uploads fail with 503
+func (s *GCSStub) FailChunks(n int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.failChunks = n
+}
+
+func (s *GCSStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method == "POST" && r.URL.Path == "/token" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": 3600}`, gcsAccessToken)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+gcsAccessToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	uploadPath := "/upload/storage/v1/b/" + s.bucket + "/o"
+	objectPrefix := "/storage/v1/b/" + s.bucket + "/o/"
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == uploadPath && r.URL.Query().Get("upload_id") != "":
+		s.uploadChunk(w, r)
+	case r.Method == "POST" && r.URL.Path == uploadPath && r.URL.Query().Get("uploadType") == "resumable":
+		s.startResumableUpload(w, r)
+	case r.Method == "POST" && r.URL.Path == uploadPath && r.URL.Query().Get("uploadType") == "multipart":
+		s.multipartUpload(w, r)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, objectPrefix):
+		s.deleteObject(w, strings.TrimPrefix(r.URL.Path, objectPrefix))
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
+
+// multipartUpload handles a multipart/related request with the metadata and
+// the content of an object
+func (s *GCSStub) multipartUpload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	part, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, err := decodeGCSMetadata(part)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.m.Lock()
+	s.multipartUploads++
+	s.objects[name] = data
+	s.m.Unlock()
+
+	s.writeObject(w, name, data)
+}
+
+func decodeGCSMetadata(r io.Reader) (string, error) {
+	var metadata struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
+		return "", err
+	}
+
+	if metadata.Name == "" {
+		return "", fmt.Errorf("missing object name")
+	}
+
+	return metadata.Name, nil
+}
+
+func (s *GCSStub) startResumableUpload(w http.ResponseWriter, r *http.Request) {
+	name, err := decodeGCSMetadata(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.m.Lock()
+	s.resumableUploads++
+	uploadID := strconv.Itoa(s.resumableUploads)
+	s.sessions[uploadID] = &gcsSession{name: name}
+	s.m.Unlock()
+
+	w.Header().Set("Location", fmt.Sprintf("http://%s%s?uploadType=resumable&upload_id=%s", r.Host, r.URL.Path, uploadID))
+}
+
+// uploadChunk appends a chunk to a resumable upload. Chunks have a
+// Content-Range like "bytes 0-99/*", or "bytes 100-149/150" and "bytes */150"
+// for the last one.
+func (s *GCSStub) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.chunks++
+	if s.failChunks > 0 {
+		s.failChunks--
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	session := s.sessions[r.URL.Query().Get("upload_id")]
+	if session == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	var first, last int
+	var total string
+	contentRange := r.Header.Get("Content-Range")
+	if strings.HasPrefix(contentRange, "bytes */") {
+		first = len(session.data)
+		total = strings.TrimPrefix(contentRange, "bytes */")
+	} else if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &first, &last, &total); err != nil || last-first+1 != len(data) {
+		http.Error(w, "invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+
+	if first != len(session.data) {
+		http.Error(w, "chunk out of order", http.StatusBadRequest)
+		return
+	}
+	session.data = append(session.data, data...)
+
+	if total == "*" {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		return
+	}
+
+	if size, err := strconv.Atoi(total); err != nil || size != len(session.data) {
+		http.Error(w, "incomplete upload", http.StatusBadRequest)
+		return
+	}
+
+	delete(s.sessions, r.URL.Query().Get("upload_id"))
+	s.objects[session.name] = session.data
+
+	s.writeObject(w, session.name, session.data)
+}
+
+func (s *GCSStub) deleteObject(w http.ResponseWriter, name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.objects[name]; !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	delete(s.objects, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *GCSStub) writeObject(w http.ResponseWriter, name string, data []byte) {
+	sum := md5.Sum(data)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"kind":    "storage#object",
+		"bucket":  s.bucket,
+		"name":    name,
+		"size":    strconv.Itoa(len(data)),
+		"md5Hash": base64.StdEncoding.EncodeToString(sum[:]),
+	})
+}
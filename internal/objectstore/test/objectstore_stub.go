@@ -218,6 +218,12 @@ func (o *ObjectstoreStub) completeMultipartUpload(w http.ResponseWriter, r *http
 		}
 	}
 
+	split := strings.SplitN(objectPath[1:], "/", 2)
+	if len(split) < 2 {
+		encodeXMLAnswer(w, MultipartUploadInternalError())
+		return
+	}
+
 	etag, overwritten := o.overwriteMD5[objectPath]
 	if !overwritten {
 		etag = "CompleteMultipartUploadETag"
@@ -227,11 +233,6 @@ func (o *ObjectstoreStub) completeMultipartUpload(w http.ResponseWriter, r *http
 	delete(o.multipart, objectPath)
 
 	w.Header().Set("ETag", etag)
-	split := strings.SplitN(objectPath[1:], "/", 2)
-	if len(split) < 2 {
-		encodeXMLAnswer(w, MultipartUploadInternalError())
-		return
-	}
 
 	bucket := split[0]
 	key := split[1]
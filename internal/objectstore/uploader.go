@@ -93,9 +93,19 @@ func (u *uploader) Consume(outerCtx context.Context, reader io.Reader, deadline
 	return cr.n, nil
 }
 
+// eTagMismatchError means that object storage returned an ETag that is not
+// the MD5 of what we sent
+type eTagMismatchError struct {
+	local, remote string
+}
+
+func (e *eTagMismatchError) Error() string {
+	return fmt.Sprintf("ETag mismatch. expected %q got %q", e.local, e.remote)
+}
+
 func compareMD5(local, remote string) error {
 	if !strings.EqualFold(local, remote) {
-		return fmt.Errorf("ETag mismatch. expected %q got %q", local, remote)
+		return &eTagMismatchError{local: local, remote: remote}
 	}
 
 	return nil
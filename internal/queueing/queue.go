@@ -125,14 +125,14 @@ type Queue struct {
 	timeout   time.Duration
 }
 
-// newQueue creates a new queue
+// NewQueue creates a new queue
 // name specifies name used to label queue metrics.
-//      Don't call newQueue twice with the same name argument!
+//      Don't call NewQueue twice with the same name argument!
 // limit specifies number of requests run concurrently
 // queueLimit specifies maximum number of requests that can be queued
 // timeout specifies the time limit of storing the request in the queue
 // if the number of requests is above the limit
-func newQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue {
+func NewQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue {
 	queue := &Queue{
 		name:      name,
 		busyCh:    make(chan struct{}, limit),
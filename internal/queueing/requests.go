@@ -27,7 +27,7 @@ func QueueRequests(name string, h http.Handler, limit, queueLimit uint, queueTim
 		queueTimeout = DefaultTimeout
 	}
 
-	queue := newQueue(name, limit, queueLimit, queueTimeout)
+	queue := NewQueue(name, limit, queueLimit, queueTimeout)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := queue.Acquire()
@@ -18,6 +18,7 @@ import (
 	"gitlab.com/gitlab-org/labkit/log"
 	"gitlab.com/gitlab-org/labkit/mask"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/bandwidth"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/headers"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
@@ -47,6 +48,7 @@ type sendFileResponseWriter struct {
 	status   int
 	hijacked bool
 	req      *http.Request
+	shaper   *bandwidth.Shaper
 }
 
 func init() {
@@ -54,11 +56,14 @@ func init() {
 	prometheus.MustRegister(sendFileBytes)
 }
 
-func SendFile(h http.Handler) http.Handler {
+// SendFile serves the files that upstream responses point to, at the pace
+// of shaper.
+func SendFile(h http.Handler, shaper *bandwidth.Shaper) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		s := &sendFileResponseWriter{
-			rw:  rw,
-			req: req,
+			rw:     rw,
+			req:    req,
+			shaper: shaper,
 		}
 		// Advertise to upstream (Rails) that we support X-Sendfile
 		req.Header.Set(headers.XSendFileTypeHeader, headers.XSendFileHeader)
@@ -99,7 +104,9 @@ func (s *sendFileResponseWriter) WriteHeader(status int) {
 
 		// Serve the file
 		helper.DisableResponseBuffering(s.rw)
-		sendFileFromDisk(s.rw, s.req, file)
+		w, done := s.shaper.Wrap(s.rw, s.req, "", 0)
+		defer done()
+		sendFileFromDisk(w, s.req, file)
 		return
 	}
 
@@ -0,0 +1,479 @@
+package tus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+)
+
+const (
+	defaultS3PartSize = 10 * 1024 * 1024
+	s3ObjectPrefix    = "tus/"
+	// s3SaveTimeout bounds how long we try to save the tail of a write
+	// after the client went away
+	s3SaveTimeout = time.Minute
+	// Every node sweeps the bucket for expired uploads, so we do it less
+	// often than the local store
+	s3StoreJanitorInterval = time.Hour
+)
+
+// s3Store keeps the data of each upload in an S3 multipart upload. Clients
+// send data in chunks of any size, so we keep what doesn't fill a part
+// yet in a tail object. The tail object is named after the part it
+// precedes, so that a tail that we failed to remove after uploading the
+// part is ignored.
+type s3Store struct {
+	credentials config.S3Credentials
+	config      config.S3Config
+	partSize    int64
+}
+
+func newS3Store(credentials config.S3Credentials, cfg config.TusS3Config) *s3Store {
+	s := &s3Store{
+		credentials: credentials,
+		config: config.S3Config{
+			Bucket:    cfg.Bucket,
+			Region:    cfg.Region,
+			Endpoint:  cfg.Endpoint,
+			PathStyle: cfg.PathStyle,
+		},
+		partSize: cfg.PartSize,
+	}
+
+	if s.partSize <= 0 {
+		s.partSize = defaultS3PartSize
+	}
+
+	go s.janitorLoop()
+
+	return s
+}
+
+func (s *s3Store) client() (*s3.S3, error) {
+	return objectstore.NewS3Client(s.credentials, s.config)
+}
+
+func (s *s3Store) dataKey(id string) string {
+	return s3ObjectPrefix + id
+}
+
+func (s *s3Store) infoKey(id string) string {
+	return s3ObjectPrefix + id + ".info"
+}
+
+func (s *s3Store) tailPrefix(id string) string {
+	return s3ObjectPrefix + id + ".tail."
+}
+
+func (s *s3Store) tailKey(id string, partNumber int64) string {
+	return s.tailPrefix(id) + strconv.FormatInt(partNumber, 10)
+}
+
+func (s *s3Store) create(ctx context.Context, info *uploadInfo) error {
+	svc, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	output, err := svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.dataKey(info.ID)),
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %v", err)
+	}
+
+	info.MultipartUploadID = aws.StringValue(output.UploadId)
+	return s.putInfo(ctx, svc, info)
+}
+
+func (s *s3Store) putInfo(ctx context.Context, svc *s3.S3, info *uploadInfo) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(ctx, svc, s.infoKey(info.ID), encoded)
+}
+
+func (s *s3Store) putObject(ctx context.Context, svc *s3.S3, key string, data []byte) error {
+	_, err := svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *s3Store) getObject(ctx context.Context, svc *s3.S3, key string) ([]byte, error) {
+	output, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	return ioutil.ReadAll(output.Body)
+}
+
+func (s *s3Store) get(ctx context.Context, id string) (*uploadInfo, int64, error) {
+	svc, err := s.client()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := s.readInfo(ctx, svc, id)
+	if isS3NotFound(err) {
+		return nil, 0, errUploadNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if info.expired(time.Now()) {
+		uploadsCounter.WithLabelValues("expired").Inc()
+		if err := s.remove(ctx, info); err != nil {
+			log.WithContextFields(ctx, log.Fields{"upload_id": id}).WithError(err).Error("tus: failed to remove expired upload")
+		}
+		return nil, 0, errUploadNotFound
+	}
+
+	if info.Completed {
+		return info, info.Length, nil
+	}
+
+	parts, err := s.listParts(ctx, svc, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offset := int64(0)
+	for _, part := range parts {
+		offset += aws.Int64Value(part.Size)
+	}
+
+	tail, err := s.getTail(ctx, svc, info, int64(len(parts)+1))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return info, offset + int64(len(tail)), nil
+}
+
+func (s *s3Store) readInfo(ctx context.Context, svc *s3.S3, id string) (*uploadInfo, error) {
+	encoded, err := s.getObject(ctx, svc, s.infoKey(id))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &uploadInfo{}
+	if err := json.Unmarshal(encoded, info); err != nil {
+		return nil, fmt.Errorf("decode upload info: %v", err)
+	}
+
+	return info, nil
+}
+
+func (s *s3Store) listParts(ctx context.Context, svc *s3.S3, info *uploadInfo) ([]*s3.Part, error) {
+	var parts []*s3.Part
+
+	err := svc.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(s.config.Bucket),
+		Key:      aws.String(s.dataKey(info.ID)),
+		UploadId: aws.String(info.MultipartUploadID),
+	}, func(output *s3.ListPartsOutput, _ bool) bool {
+		parts = append(parts, output.Parts...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list parts: %v", err)
+	}
+
+	return parts, nil
+}
+
+func (s *s3Store) getTail(ctx context.Context, svc *s3.S3, info *uploadInfo, partNumber int64) ([]byte, error) {
+	tail, err := s.getObject(ctx, svc, s.tailKey(info.ID, partNumber))
+	if isS3NotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get tail: %v", err)
+	}
+
+	return tail, nil
+}
+
+func (s *s3Store) write(ctx context.Context, info *uploadInfo, r io.Reader) error {
+	svc, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	parts, err := s.listParts(ctx, svc, info)
+	if err != nil {
+		return err
+	}
+
+	partNumber := int64(len(parts) + 1)
+	tail, err := s.getTail(ctx, svc, info, partNumber)
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, s.partSize)
+	n := copy(buffer, tail)
+	firstPartNumber := partNumber
+
+	var readErr error
+	for readErr == nil {
+		var m int
+		m, readErr = io.ReadFull(r, buffer[n:])
+		n += m
+
+		if n < len(buffer) {
+			break
+		}
+
+		if err := s.uploadPart(ctx, svc, info, partNumber, buffer); err != nil {
+			readErr = err
+			break
+		}
+
+		partNumber++
+		n = 0
+	}
+
+	if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+		readErr = nil
+	}
+
+	// The client may have gone away, but we still want to keep what it sent
+	saveCtx, cancel := context.WithTimeout(context.Background(), s3SaveTimeout) // lint:allow context.Background
+	defer cancel()
+
+	if n > 0 && (partNumber != firstPartNumber || n > len(tail)) {
+		if err := s.putObject(saveCtx, svc, s.tailKey(info.ID, partNumber), buffer[:n]); err != nil {
+			return fmt.Errorf("put tail: %v", err)
+		}
+	}
+
+	if partNumber != firstPartNumber && len(tail) > 0 {
+		s.deleteObject(saveCtx, svc, s.tailKey(info.ID, firstPartNumber))
+	}
+
+	return readErr
+}
+
+func (s *s3Store) uploadPart(ctx context.Context, svc *s3.S3, info *uploadInfo, partNumber int64, data []byte) error {
+	_, err := svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(s.config.Bucket),
+		Key:        aws.String(s.dataKey(info.ID)),
+		UploadId:   aws.String(info.MultipartUploadID),
+		PartNumber: aws.Int64(partNumber),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("upload part %d: %v", partNumber, err)
+	}
+
+	return nil
+}
+
+func (s *s3Store) deleteObject(ctx context.Context, svc *s3.S3, key string) {
+	_, err := svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil && !isS3NotFound(err) {
+		log.WithContextFields(ctx, log.Fields{"key": key}).WithError(err).Error("tus: failed to delete S3 object")
+	}
+}
+
+// open uploads the tail as the last part and completes the multipart upload
+func (s *s3Store) open(ctx context.Context, info *uploadInfo) (io.ReadCloser, error) {
+	svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Completed {
+		if err := s.complete(ctx, svc, info); err != nil {
+			return nil, err
+		}
+	}
+
+	output, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.dataKey(info.ID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output.Body, nil
+}
+
+func (s *s3Store) complete(ctx context.Context, svc *s3.S3, info *uploadInfo) error {
+	parts, err := s.listParts(ctx, svc, info)
+	if err != nil {
+		return err
+	}
+
+	lastPartNumber := int64(len(parts) + 1)
+	tail, err := s.getTail(ctx, svc, info, lastPartNumber)
+	if err != nil {
+		return err
+	}
+
+	// S3 needs at least one part, so empty uploads get an empty one
+	if len(tail) > 0 || len(parts) == 0 {
+		if err := s.uploadPart(ctx, svc, info, lastPartNumber, tail); err != nil {
+			return err
+		}
+
+		if parts, err = s.listParts(ctx, svc, info); err != nil {
+			return err
+		}
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, &s3.CompletedPart{ETag: part.ETag, PartNumber: part.PartNumber})
+	}
+
+	_, err = svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.config.Bucket),
+		Key:             aws.String(s.dataKey(info.ID)),
+		UploadId:        aws.String(info.MultipartUploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %v", err)
+	}
+
+	s.deleteObject(ctx, svc, s.tailKey(info.ID, lastPartNumber))
+
+	info.Completed = true
+	return s.putInfo(ctx, svc, info)
+}
+
+func (s *s3Store) remove(ctx context.Context, info *uploadInfo) error {
+	svc, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	// Remove the info object first so that the upload is gone at once
+	_, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.infoKey(info.ID)),
+	})
+	if err != nil {
+		return err
+	}
+
+	if info.Completed {
+		s.deleteObject(ctx, svc, s.dataKey(info.ID))
+	} else {
+		_, err := svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.config.Bucket),
+			Key:      aws.String(s.dataKey(info.ID)),
+			UploadId: aws.String(info.MultipartUploadID),
+		})
+		if err != nil && !isS3NotFound(err) {
+			log.WithContextFields(ctx, log.Fields{"upload_id": info.ID}).WithError(err).Error("tus: failed to abort multipart upload")
+		}
+	}
+
+	return svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s.tailPrefix(info.ID)),
+	}, func(output *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range output.Contents {
+			s.deleteObject(ctx, svc, aws.StringValue(object.Key))
+		}
+		return true
+	})
+}
+
+func (s *s3Store) janitorLoop() {
+	for range time.NewTicker(s3StoreJanitorInterval).C {
+		ctx, cancel := context.WithTimeout(context.Background(), s3StoreJanitorInterval) // lint:allow context.Background
+		s.clean(ctx)
+		cancel()
+	}
+}
+
+// clean removes expired uploads, including those that no client asks for
+// anymore
+func (s *s3Store) clean(ctx context.Context) {
+	svc, err := s.client()
+	if err != nil {
+		log.WithError(err).Error("tus: failed to create S3 client")
+		return
+	}
+
+	var ids []string
+	err = svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s3ObjectPrefix),
+	}, func(output *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range output.Contents {
+			if key := aws.StringValue(object.Key); strings.HasSuffix(key, ".info") {
+				ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(key, s3ObjectPrefix), ".info"))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.WithError(err).WithField("bucket", s.config.Bucket).Error("tus: failed to list uploads")
+		return
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		info, err := s.readInfo(ctx, svc, id)
+		if err != nil {
+			// Another node may have removed it
+			if !isS3NotFound(err) {
+				log.WithError(err).WithField("upload_id", id).Error("tus: failed to read upload info")
+			}
+			continue
+		}
+
+		if info.expired(now) {
+			uploadsCounter.WithLabelValues("expired").Inc()
+			if err := s.remove(ctx, info); err != nil {
+				log.WithError(err).WithField("upload_id", info.ID).Error("tus: failed to remove expired upload")
+			}
+		}
+	}
+}
+
+func isS3NotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchUpload, "NotFound":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package tus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+const localStoreJanitorInterval = 10 * time.Minute
+
+// errUploadNotFound means that the upload doesn't exist or has expired
+var errUploadNotFound = errors.New("upload not found")
+
+type uploadInfo struct {
+	ID     string
+	Length int64
+	// URI is the request URI of the package upload that we replay once we
+	// have all of the data
+	URI     string
+	Expires time.Time
+	// MultipartUploadID is the S3 multipart upload that holds the data of
+	// the s3 store
+	MultipartUploadID string `json:",omitempty"`
+	// Completed is set once the s3 store completed the multipart upload
+	Completed bool `json:",omitempty"`
+}
+
+func (info *uploadInfo) expired(now time.Time) bool {
+	return now.After(info.Expires)
+}
+
+// store keeps the data of uploads until they are complete. Callers make
+// sure that only one request at a time writes to an upload.
+type store interface {
+	create(ctx context.Context, info *uploadInfo) error
+	// get returns errUploadNotFound for unknown and expired uploads
+	get(ctx context.Context, id string) (info *uploadInfo, offset int64, err error)
+	// write appends r to the upload. It keeps the data it read even if r
+	// fails, so that the client can resume from there.
+	write(ctx context.Context, info *uploadInfo, r io.Reader) error
+	// open returns the data of a complete upload
+	open(ctx context.Context, info *uploadInfo) (io.ReadCloser, error)
+	remove(ctx context.Context, info *uploadInfo) error
+}
+
+// localStore keeps each upload as a data file and a JSON info file
+type localStore struct {
+	dir string
+}
+
+func newLocalStore(dir string) (*localStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &localStore{dir: dir}
+	go s.janitorLoop()
+
+	return s, nil
+}
+
+func (s *localStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *localStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".info")
+}
+
+func (s *localStore) create(_ context.Context, info *uploadInfo) error {
+	data, err := os.OpenFile(s.dataPath(info.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	// Write the info file last: uploads without one don't exist
+	tmp, err := ioutil.TempFile(s.dir, info.ID+".info.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.infoPath(info.ID))
+}
+
+func (s *localStore) get(_ context.Context, id string) (*uploadInfo, int64, error) {
+	info, err := s.readInfo(id)
+	if os.IsNotExist(err) {
+		return nil, 0, errUploadNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if info.expired(time.Now()) {
+		uploadsCounter.WithLabelValues("expired").Inc()
+		s.removeFiles(id)
+		return nil, 0, errUploadNotFound
+	}
+
+	fi, err := os.Stat(s.dataPath(id))
+	if os.IsNotExist(err) {
+		return nil, 0, errUploadNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return info, fi.Size(), nil
+}
+
+func (s *localStore) readInfo(id string) (*uploadInfo, error) {
+	encoded, err := ioutil.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &uploadInfo{}
+	if err := json.Unmarshal(encoded, info); err != nil {
+		return nil, fmt.Errorf("decode upload info: %v", err)
+	}
+
+	return info, nil
+}
+
+func (s *localStore) write(_ context.Context, info *uploadInfo, r io.Reader) error {
+	data, err := os.OpenFile(s.dataPath(info.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(data, r)
+	if errClose := data.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+func (s *localStore) open(_ context.Context, info *uploadInfo) (io.ReadCloser, error) {
+	return os.Open(s.dataPath(info.ID))
+}
+
+func (s *localStore) remove(_ context.Context, info *uploadInfo) error {
+	return s.removeFiles(info.ID)
+}
+
+func (s *localStore) removeFiles(id string) error {
+	// Remove the info file first so that the upload is gone at once
+	err := os.Remove(s.infoPath(id))
+	if errData := os.Remove(s.dataPath(id)); err == nil {
+		err = errData
+	}
+
+	return err
+}
+
+func (s *localStore) janitorLoop() {
+	for range time.NewTicker(localStoreJanitorInterval).C {
+		s.clean()
+	}
+}
+
+// clean removes expired uploads
+func (s *localStore) clean() {
+	infos, err := filepath.Glob(filepath.Join(s.dir, "*.info"))
+	if err != nil {
+		log.WithError(err).WithField("dir", s.dir).Error("tus: failed to scan upload directory")
+		return
+	}
+
+	now := time.Now()
+	for _, path := range infos {
+		info, err := s.readInfo(strings.TrimSuffix(filepath.Base(path), ".info"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.WithError(err).WithField("path", path).Error("tus: failed to read upload info")
+			}
+			continue
+		}
+
+		if info.expired(now) {
+			uploadsCounter.WithLabelValues("expired").Inc()
+			if err := s.removeFiles(info.ID); err != nil && !os.IsNotExist(err) {
+				log.WithError(err).WithField("upload_id", info.ID).Error("tus: failed to remove expired upload")
+			}
+		}
+	}
+}
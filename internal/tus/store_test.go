@@ -0,0 +1,208 @@
+package tus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
+)
+
+// failingReader returns its data, then fails like a dropped connection
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, errors.New("connection reset")
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func newTestLocalStore(t *testing.T) (*localStore, func()) {
+	dir, err := ioutil.TempDir("", "tus-store")
+	require.NoError(t, err)
+
+	s, err := newLocalStore(dir)
+	require.NoError(t, err)
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func newTestS3Store(t *testing.T, partSize int64) (*s3Store, func()) {
+	creds, cfg, _, ts := test.SetupS3(t, "")
+
+	s := newS3Store(creds, config.TusS3Config{
+		Bucket:    cfg.Bucket,
+		Region:    cfg.Region,
+		Endpoint:  cfg.Endpoint,
+		PathStyle: cfg.PathStyle,
+		PartSize:  partSize,
+	})
+
+	return s, ts.Close
+}
+
+func TestStores(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		newStore func(t *testing.T) (store, func())
+	}{
+		{
+			desc: "local",
+			newStore: func(t *testing.T) (store, func()) {
+				return newTestLocalStore(t)
+			},
+		},
+		{
+			desc: "s3",
+			newStore: func(t *testing.T) (store, func()) {
+				return newTestS3Store(t, 4)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			s, cleanUp := tc.newStore(t)
+			defer cleanUp()
+
+			testStore(t, s)
+		})
+	}
+}
+
+func testStore(t *testing.T, s store) {
+	ctx := context.Background()
+	content := "0123456789abcdefghij"
+
+	info := &uploadInfo{ID: "0123456789abcdef0123456789abcdef", Length: int64(len(content)), Expires: time.Now().Add(time.Hour)}
+	require.NoError(t, s.create(ctx, info))
+
+	requireOffset := func(expected int64) {
+		t.Helper()
+
+		_, offset, err := s.get(ctx, info.ID)
+		require.NoError(t, err)
+		require.Equal(t, expected, offset)
+	}
+	requireOffset(0)
+
+	// Writes that don't fill a part, that fill several and that fail
+	require.NoError(t, s.write(ctx, info, strings.NewReader(content[:2])))
+	requireOffset(2)
+	require.NoError(t, s.write(ctx, info, strings.NewReader(content[2:11])))
+	requireOffset(11)
+	// We keep the data that came before the failure
+	require.Error(t, s.write(ctx, info, &failingReader{data: content[11:14]}))
+	requireOffset(14)
+	require.NoError(t, s.write(ctx, info, strings.NewReader(content[14:])))
+	requireOffset(20)
+
+	for i := 0; i < 2; i++ {
+		body, err := s.open(ctx, info)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		require.NoError(t, body.Close())
+		require.Equal(t, content, string(data), "the upload can be opened again")
+	}
+
+	require.NoError(t, s.remove(ctx, info))
+	_, _, err := s.get(ctx, info.ID)
+	require.Equal(t, errUploadNotFound, err)
+
+	expired := &uploadInfo{ID: "fedcba9876543210fedcba9876543210", Length: 10, Expires: time.Now().Add(-time.Second)}
+	require.NoError(t, s.create(ctx, expired))
+	_, _, err = s.get(ctx, expired.ID)
+	require.Equal(t, errUploadNotFound, err)
+}
+
+func TestLocalStoreRemovesExpiredUploads(t *testing.T) {
+	s, cleanUp := newTestLocalStore(t)
+	defer cleanUp()
+
+	live := &uploadInfo{ID: "0123456789abcdef0123456789abcdef", Length: 10, Expires: time.Now().Add(time.Hour)}
+	expired := &uploadInfo{ID: "fedcba9876543210fedcba9876543210", Length: 10, Expires: time.Now().Add(-time.Second)}
+	require.NoError(t, s.create(context.Background(), live))
+	require.NoError(t, s.create(context.Background(), expired))
+
+	s.clean()
+
+	files, err := ioutil.ReadDir(s.dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	require.ElementsMatch(t, []string{live.ID + ".bin", live.ID + ".info"}, names)
+}
+
+func TestS3StoreRemovesExpiredUploads(t *testing.T) {
+	s, cleanUp := newTestS3Store(t, 4)
+	defer cleanUp()
+
+	ctx := context.Background()
+	live := &uploadInfo{ID: "0123456789abcdef0123456789abcdef", Length: 10, Expires: time.Now().Add(time.Hour)}
+	expired := &uploadInfo{ID: "fedcba9876543210fedcba9876543210", Length: 10, Expires: time.Now().Add(time.Hour)}
+	require.NoError(t, s.create(ctx, live))
+	require.NoError(t, s.create(ctx, expired))
+	require.NoError(t, s.write(ctx, expired, strings.NewReader("abcdef")))
+
+	// Let the upload expire without asking for it
+	svc, err := s.client()
+	require.NoError(t, err)
+	expired.Expires = time.Now().Add(-time.Second)
+	require.NoError(t, s.putInfo(ctx, svc, expired))
+
+	s.clean(ctx)
+
+	_, _, err = s.get(ctx, live.ID)
+	require.NoError(t, err)
+
+	_, err = s.readInfo(ctx, svc, expired.ID)
+	require.True(t, isS3NotFound(err), "info of the expired upload is removed")
+	_, err = s.getObject(ctx, svc, s.tailKey(expired.ID, 2))
+	require.True(t, isS3NotFound(err), "tail of the expired upload is removed")
+}
+
+func TestS3StoreDropsStaleTails(t *testing.T) {
+	s, cleanUp := newTestS3Store(t, 4)
+	defer cleanUp()
+
+	ctx := context.Background()
+	info := &uploadInfo{ID: "0123456789abcdef0123456789abcdef", Length: 6, Expires: time.Now().Add(time.Hour)}
+	require.NoError(t, s.create(ctx, info))
+	require.NoError(t, s.write(ctx, info, strings.NewReader("ab")))
+
+	svc, err := s.client()
+	require.NoError(t, err)
+
+	// A tail that is older than the last part doesn't count
+	require.NoError(t, s.uploadPart(ctx, svc, info, 1, []byte("abcd")))
+	_, offset, err := s.get(ctx, info.ID)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), offset)
+
+	require.NoError(t, s.write(ctx, info, io.LimitReader(strings.NewReader("efgh"), 2)))
+	body, err := s.open(ctx, info)
+	require.NoError(t, err)
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	require.Equal(t, "abcdef", string(data))
+}
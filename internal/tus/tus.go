@@ -0,0 +1,407 @@
+/*
+Package tus implements version 1.0.0 of the tus resumable upload protocol,
+with the creation and expiration extensions, for package uploads. See
+https://tus.io/protocols/resumable-upload.html.
+
+Clients create an upload with a POST to the URL of the package upload,
+and send the data with PATCH requests to the upload URL that we return.
+Once we have all of the data we replay the package upload through
+upload.BodyUploader, so that GitLab Rails sees a regular package upload.
+*/
+package tus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
+)
+
+const (
+	tusVersion        = "1.0.0"
+	tusExtensions     = "creation,expiration"
+	offsetContentType = "application/offset+octet-stream"
+	defaultExpiration = 24 * time.Hour
+)
+
+var (
+	uploadIDPattern = regexp.MustCompile(`\A[0-9a-f]{32}\z`)
+
+	uploadsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_tus_uploads_total",
+			Help: "How many tus uploads were created, completed, failed to complete or expired",
+		},
+		[]string{"event"},
+	)
+
+	receivedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_tus_received_bytes_total",
+			Help: "How many bytes of tus uploads we stored",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadsCounter)
+	prometheus.MustRegister(receivedBytes)
+}
+
+// Handler serves the creation of uploads and the upload URLs
+type Handler struct {
+	store      store
+	maxSize    int64
+	expiration time.Duration
+	// uploadPath is the path of the upload URLs, without the ID
+	uploadPath string
+	rails      upload.PreAuthorizer
+	uploader   http.Handler
+
+	sync.Mutex
+	busy map[string]bool
+}
+
+// NewHandler returns nil if tus uploads are disabled. Complete uploads go
+// through upload.BodyUploader with rails, h and p.
+func NewHandler(cfg config.TusConfig, credentials config.ObjectStorageCredentials, uploadPath string, rails upload.PreAuthorizer, h http.Handler, p upload.Preparer) (*Handler, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	handler := &Handler{
+		maxSize:    cfg.MaxSize,
+		expiration: defaultExpiration,
+		uploadPath: uploadPath,
+		rails:      rails,
+		uploader:   upload.BodyUploader(rails, h, p),
+		busy:       make(map[string]bool),
+	}
+
+	if cfg.Expiration != nil && cfg.Expiration.Duration > 0 {
+		handler.expiration = cfg.Expiration.Duration
+	}
+
+	switch cfg.Store {
+	case "s3":
+		handler.store = newS3Store(credentials.S3Credentials, cfg.S3)
+	default:
+		s, err := newLocalStore(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		handler.store = s
+	}
+
+	return handler, nil
+}
+
+// IsCreation matches the requests that Create handles
+func IsCreation(r *http.Request) bool {
+	return r.Method == "OPTIONS" || (r.Method == "POST" && r.Header.Get("Tus-Resumable") != "")
+}
+
+// Create creates an upload for the package upload at the request URL. The
+// client must be allowed to upload the package.
+func (h *Handler) Create() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method == "OPTIONS" {
+			h.options(w)
+			return
+		}
+
+		if !checkVersion(w, r) {
+			return
+		}
+
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			// This includes Upload-Defer-Length, which we don't support
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+
+		if h.maxSize > 0 && length > h.maxSize {
+			http.Error(w, "Upload-Length exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// GitLab Rails authorizes package uploads as PUT requests
+		authReq := r.Clone(r.Context())
+		authReq.Method = "PUT"
+
+		h.rails.PreAuthorizeHandler(func(w http.ResponseWriter, _ *http.Request, a *api.Response) {
+			if a.MaximumSize > 0 && length > a.MaximumSize {
+				http.Error(w, "Upload-Length exceeds the maximum size", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			h.create(w, r, length)
+		}, "/authorize").ServeHTTP(w, authReq)
+	})
+}
+
+func (h *Handler) create(w http.ResponseWriter, r *http.Request, length int64) {
+	id, err := newUploadID()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: create upload ID: %v", err))
+		return
+	}
+
+	info := &uploadInfo{
+		ID:      id,
+		Length:  length,
+		URI:     r.URL.RequestURI(),
+		Expires: time.Now().Add(h.expiration),
+	}
+
+	if err := h.store.create(r.Context(), info); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: create upload: %v", err))
+		return
+	}
+
+	uploadsCounter.WithLabelValues("created").Inc()
+	log.WithContextFields(r.Context(), log.Fields{
+		"upload_id":     id,
+		"upload_length": length,
+	}).Info("tus: created upload")
+
+	w.Header().Set("Location", h.uploadPath+id)
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+
+	if length == 0 {
+		h.complete(w, r, info)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Upload serves HEAD and PATCH requests to upload URLs
+func (h *Handler) Upload() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		switch r.Method {
+		case "OPTIONS":
+			h.options(w)
+			return
+		case "HEAD", "PATCH":
+		default:
+			w.Header().Set("Allow", "OPTIONS, HEAD, PATCH")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !checkVersion(w, r) {
+			return
+		}
+
+		id := path.Base(r.URL.Path)
+		if !uploadIDPattern.MatchString(id) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		if r.Method == "PATCH" {
+			if !h.lock(id) {
+				http.Error(w, "Another request is writing to this upload", http.StatusLocked)
+				return
+			}
+			defer h.unlock(id)
+		}
+
+		info, offset, err := h.store.get(r.Context(), id)
+		if err == errUploadNotFound {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("tus: get upload: %v", err))
+			return
+		}
+
+		w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+
+		if r.Method == "HEAD" {
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		h.patch(w, r, info, offset)
+	})
+}
+
+func (h *Handler) patch(w http.ResponseWriter, r *http.Request, info *uploadInfo, offset int64) {
+	if !helper.IsContentType(offsetContentType, r.Header.Get("Content-Type")) {
+		http.Error(w, "Content-Type must be "+offsetContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	if clientOffset != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	remaining := info.Length - offset
+	if r.ContentLength > remaining {
+		http.Error(w, "The request exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if remaining > 0 {
+		writeErr := h.store.write(r.Context(), info, io.LimitReader(r.Body, remaining))
+
+		_, newOffset, err := h.store.get(r.Context(), info.ID)
+		if err == nil {
+			receivedBytes.Add(float64(newOffset - offset))
+			offset = newOffset
+		} else if writeErr == nil {
+			writeErr = err
+		}
+
+		if writeErr != nil {
+			helper.Fail500(w, r, fmt.Errorf("tus: write upload: %v", writeErr))
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	if offset < info.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.complete(w, r, info)
+}
+
+// complete replays the package upload with the data of the upload and the
+// headers of r. The client gets the response of GitLab Rails. If the
+// upload fails the data is kept, so that the client can try again with an
+// empty PATCH request.
+func (h *Handler) complete(w http.ResponseWriter, r *http.Request, info *uploadInfo) {
+	uploadURL, err := url.Parse(info.URI)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: parse upload URI: %v", err))
+		return
+	}
+
+	body, err := h.store.open(r.Context(), info)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("tus: open upload: %v", err))
+		return
+	}
+	defer body.Close()
+
+	req := r.Clone(r.Context())
+	req.Method = "PUT"
+	req.URL = uploadURL
+	req.RequestURI = info.URI
+	req.Body = body
+	req.ContentLength = info.Length
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for _, header := range []string{"Content-Length", "Tus-Resumable", "Upload-Length", "Upload-Offset"} {
+		req.Header.Del(header)
+	}
+	// Checksums of the last PATCH request are not checksums of the upload
+	for _, header := range []string{"Content-MD5", "Digest", "Repr-Digest", "X-Checksum-Md5", "X-Checksum-Sha1", "X-Checksum-Sha256", "X-Checksum-Sha512"} {
+		req.Header.Del(header)
+	}
+
+	cw := helper.NewCountingResponseWriter(w)
+	h.uploader.ServeHTTP(cw, req)
+
+	logger := log.WithContextFields(r.Context(), log.Fields{
+		"upload_id": info.ID,
+		"status":    cw.Status(),
+	})
+
+	if cw.Status() < 200 || cw.Status() >= 300 {
+		uploadsCounter.WithLabelValues("failed").Inc()
+		logger.Info("tus: failed to complete upload")
+		return
+	}
+
+	uploadsCounter.WithLabelValues("completed").Inc()
+	logger.Info("tus: completed upload")
+
+	if err := h.store.remove(r.Context(), info); err != nil {
+		helper.LogError(r, fmt.Errorf("tus: remove upload: %v", err))
+	}
+}
+
+func (h *Handler) options(w http.ResponseWriter) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if h.maxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func checkVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+
+	w.Header().Set("Tus-Version", tusVersion)
+	http.Error(w, "Unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+	return false
+}
+
+func (h *Handler) lock(id string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.busy[id] {
+		return false
+	}
+
+	h.busy[id] = true
+	return true
+}
+
+func (h *Handler) unlock(id string) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.busy, id)
+}
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,262 @@
+package tus
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
+)
+
+const (
+	packagePath = "/api/v4/projects/1/packages/generic/foo/1.0/foo.bin?status=hidden"
+	uploadPath  = "/api/v4/tus/uploads/"
+)
+
+type rails struct {
+	unauthorized bool
+	maximumSize  int64
+	authorized   []string
+}
+
+func (r *rails) PreAuthorizeHandler(next api.HandleFunc, suffix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.authorized = append(r.authorized, req.Method+" "+req.URL.Path+suffix)
+
+		if r.unauthorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next(w, req, &api.Response{TempPath: os.TempDir(), MaximumSize: r.maximumSize})
+	})
+}
+
+// packageUpload stands in for GitLab Rails finalizing the package upload
+type packageUpload struct {
+	t        *testing.T
+	status   int
+	requests []*http.Request
+	content  string
+}
+
+func (p *packageUpload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	require.NoError(p.t, r.ParseForm())
+	p.requests = append(p.requests, r)
+
+	data, err := ioutil.ReadFile(r.PostFormValue("file.path"))
+	require.NoError(p.t, err)
+	p.content = string(data)
+
+	w.WriteHeader(p.status)
+}
+
+func newTestHandler(t *testing.T, r *rails, p *packageUpload, maxSize int64) (*Handler, func()) {
+	testhelper.ConfigureSecret()
+
+	dir, err := ioutil.TempDir("", "tus")
+	require.NoError(t, err)
+
+	h, err := NewHandler(config.TusConfig{Enabled: true, Dir: dir, MaxSize: maxSize}, config.ObjectStorageCredentials{}, uploadPath, r, p, &upload.DefaultPreparer{})
+	require.NoError(t, err)
+
+	return h, func() { os.RemoveAll(dir) }
+}
+
+func doRequest(h http.Handler, method, path string, headers map[string]string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func doPatch(h *Handler, location string, offset int, data string) *httptest.ResponseRecorder {
+	return doRequest(h.Upload(), "PATCH", location, map[string]string{
+		"Authorization": "Bearer token",
+		"Content-Type":  offsetContentType,
+		"Upload-Offset": strconv.Itoa(offset),
+	}, strings.NewReader(data))
+}
+
+func TestResumableUpload(t *testing.T) {
+	r := &rails{}
+	p := &packageUpload{t: t, status: http.StatusCreated}
+	h, cleanUp := newTestHandler(t, r, p, 1000)
+	defer cleanUp()
+
+	content := "0123456789"
+
+	w := doRequest(h.Create(), "OPTIONS", packagePath, nil, nil)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, tusExtensions, w.Header().Get("Tus-Extension"))
+	require.Equal(t, "1000", w.Header().Get("Tus-Max-Size"))
+
+	w = doRequest(h.Create(), "POST", packagePath, map[string]string{"Upload-Length": strconv.Itoa(len(content))}, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Equal(t, tusVersion, w.Header().Get("Tus-Resumable"))
+	require.NotEmpty(t, w.Header().Get("Upload-Expires"))
+	require.Equal(t, []string{"PUT /api/v4/projects/1/packages/generic/foo/1.0/foo.bin/authorize"}, r.authorized)
+
+	location := w.Header().Get("Location")
+	require.Regexp(t, `\A/api/v4/tus/uploads/[0-9a-f]{32}\z`, location)
+
+	w = doPatch(h, location, 0, content[:4])
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, "4", w.Header().Get("Upload-Offset"))
+
+	w = doPatch(h, location, 2, content[2:])
+	require.Equal(t, http.StatusConflict, w.Code, "the offset must match")
+
+	w = doRequest(h.Upload(), "HEAD", location, nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "4", w.Header().Get("Upload-Offset"))
+	require.Equal(t, "10", w.Header().Get("Upload-Length"))
+	require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	require.Empty(t, p.requests, "GitLab Rails only sees the complete upload")
+
+	w = doPatch(h, location, 4, content[4:])
+	require.Equal(t, http.StatusCreated, w.Code, "the last PATCH gets the response of GitLab Rails")
+	require.Equal(t, "10", w.Header().Get("Upload-Offset"))
+
+	require.Len(t, p.requests, 1)
+	require.Equal(t, "PUT", p.requests[0].Method)
+	require.Equal(t, packagePath, p.requests[0].URL.RequestURI())
+	require.Equal(t, "Bearer token", p.requests[0].Header.Get("Authorization"))
+	require.Equal(t, content, p.content)
+
+	w = doRequest(h.Upload(), "HEAD", location, nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code, "complete uploads are removed")
+}
+
+func TestFailedCompletionCanBeRetried(t *testing.T) {
+	p := &packageUpload{t: t, status: http.StatusServiceUnavailable}
+	h, cleanUp := newTestHandler(t, &rails{}, p, 0)
+	defer cleanUp()
+
+	w := doRequest(h.Create(), "POST", packagePath, map[string]string{"Upload-Length": "3"}, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	w = doPatch(h, location, 0, "abc")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	p.status = http.StatusOK
+	w = doPatch(h, location, 3, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, p.requests, 2)
+	require.Equal(t, "abc", p.content)
+}
+
+func TestChecksumsOfTheLastPatchAreNotReplayed(t *testing.T) {
+	p := &packageUpload{t: t, status: http.StatusCreated}
+	h, cleanUp := newTestHandler(t, &rails{}, p, 0)
+	defer cleanUp()
+
+	w := doRequest(h.Create(), "POST", packagePath, map[string]string{"Upload-Length": "6"}, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	w = doPatch(h, location, 0, "abc")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	// The checksum of "def"
+	w = doRequest(h.Upload(), "PATCH", location, map[string]string{
+		"Content-Type":    offsetContentType,
+		"Upload-Offset":   "3",
+		"X-Checksum-Sha1": "589c22335a381f122d129225f5c0ba3056ed5811",
+	}, strings.NewReader("def"))
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Empty(t, p.requests[0].Header.Get("X-Checksum-Sha1"))
+	require.Equal(t, "abcdef", p.content)
+}
+
+func TestEmptyUploadCompletesOnCreation(t *testing.T) {
+	p := &packageUpload{t: t, status: http.StatusCreated}
+	h, cleanUp := newTestHandler(t, &rails{}, p, 0)
+	defer cleanUp()
+
+	w := doRequest(h.Create(), "POST", packagePath, map[string]string{"Upload-Length": "0"}, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Len(t, p.requests, 1)
+	require.Equal(t, "", p.content)
+}
+
+func TestCreateErrors(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		rails   *rails
+		headers map[string]string
+		status  int
+	}{
+		{desc: "unsupported version", rails: &rails{}, headers: map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "10"}, status: http.StatusPreconditionFailed},
+		{desc: "deferred length", rails: &rails{}, headers: map[string]string{"Upload-Defer-Length": "1"}, status: http.StatusBadRequest},
+		{desc: "over Tus-Max-Size", rails: &rails{}, headers: map[string]string{"Upload-Length": "101"}, status: http.StatusRequestEntityTooLarge},
+		{desc: "over the maximum size of GitLab", rails: &rails{maximumSize: 10}, headers: map[string]string{"Upload-Length": "11"}, status: http.StatusRequestEntityTooLarge},
+		{desc: "unauthorized", rails: &rails{unauthorized: true}, headers: map[string]string{"Upload-Length": "10"}, status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h, cleanUp := newTestHandler(t, tc.rails, &packageUpload{t: t}, 100)
+			defer cleanUp()
+
+			w := doRequest(h.Create(), "POST", packagePath, tc.headers, nil)
+			require.Equal(t, tc.status, w.Code)
+			require.Empty(t, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	h, cleanUp := newTestHandler(t, &rails{}, &packageUpload{t: t}, 0)
+	defer cleanUp()
+
+	w := doRequest(h.Create(), "POST", packagePath, map[string]string{"Upload-Length": "3"}, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	w = doRequest(h.Upload(), "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader("abc"))
+	require.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w = doPatch(h, location, 0, "abcd")
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = doPatch(h, uploadPath+"0123456789abcdef0123456789abcdef", 0, "abc")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doPatch(h, uploadPath+"..", 0, "abc")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doRequest(h.Upload(), "DELETE", location, nil, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	require.True(t, h.lock(location[len(uploadPath):]))
+	w = doPatch(h, location, 0, "abc")
+	require.Equal(t, http.StatusLocked, w.Code)
+}
+
+func TestIsCreation(t *testing.T) {
+	post := httptest.NewRequest("POST", packagePath, nil)
+	require.False(t, IsCreation(post))
+
+	post.Header.Set("Tus-Resumable", tusVersion)
+	require.True(t, IsCreation(post))
+
+	require.True(t, IsCreation(httptest.NewRequest("OPTIONS", packagePath, nil)))
+	require.False(t, IsCreation(httptest.NewRequest("PUT", packagePath, nil)))
+}
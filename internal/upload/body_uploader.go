@@ -41,18 +41,34 @@ func (s *DefaultPreparer) Prepare(a *api.Response) (*filestore.SaveFileOpts, Ver
 // Providing an Preparer allows to customize the upload process
 func BodyUploader(rails PreAuthorizer, h http.Handler, p Preparer) http.Handler {
 	return rails.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		checksums, err := filestore.ChecksumsFromHeader(r.Header)
+		if err != nil {
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		opts, verifier, err := p.Prepare(a)
 		if err != nil {
 			helper.Fail500(w, r, fmt.Errorf("BodyUploader: preparation failed: %v", err))
 			return
 		}
 
+		for hashName := range checksums {
+			opts.AddHashes(hashName)
+		}
+
 		fh, err := filestore.SaveFileFromReader(r.Context(), r.Body, r.ContentLength, opts)
 		if err != nil {
 			helper.Fail500(w, r, fmt.Errorf("BodyUploader: upload failed: %v", err))
 			return
 		}
 
+		// We don't finalize the upload, so it is deleted with the request
+		if err := fh.VerifyChecksums(checksums); err != nil {
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		if verifier != nil {
 			if err := verifier.Verify(fh); err != nil {
 				helper.Fail500(w, r, fmt.Errorf("BodyUploader: verification failed: %v", err))
@@ -1,6 +1,11 @@
 package upload
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,12 +15,14 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 )
 
@@ -82,6 +89,74 @@ func TestBodyUploaderErrors(t *testing.T) {
 	}
 }
 
+func TestBodyUploaderChecksums(t *testing.T) {
+	md5sum := md5.Sum([]byte(fileContent))
+	sha256sum := sha256.Sum256([]byte(fileContent))
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{name: "matching Content-MD5", headers: map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md5sum[:])}, status: http.StatusOK},
+		{name: "matching X-Checksum-Sha256", headers: map[string]string{"X-Checksum-Sha256": hex.EncodeToString(sha256sum[:])}, status: http.StatusOK},
+		{name: "mismatching Digest", headers: map[string]string{"Digest": "SHA-256=n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="}, status: http.StatusBadRequest},
+		{name: "malformed Content-MD5", headers: map[string]string{"Content-MD5": "not base64"}, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://example.com/upload", strings.NewReader(fileContent))
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+
+			proxied := false
+			proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxied = true
+			})
+
+			BodyUploader(&rails{}, proxy, &alwaysLocalPreparer{}).ServeHTTP(w, req)
+
+			require.Equal(t, test.status, w.Code)
+			require.Equal(t, test.status == http.StatusOK, proxied)
+		})
+	}
+}
+
+func TestBodyUploaderDeletesMismatchingObject(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	objectURL := ts.URL + test.ObjectPath
+	preparer := &remotePreparer{response: &api.Response{
+		RemoteObject: api.RemoteObject{
+			StoreURL:  objectURL,
+			DeleteURL: objectURL,
+			ID:        "test-file",
+			Timeout:   60,
+		},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req := httptest.NewRequest("POST", "http://example.com/upload", strings.NewReader(fileContent)).WithContext(ctx)
+	req.Header.Set("X-Checksum-Md5", strings.Repeat("0", 32))
+	w := httptest.NewRecorder()
+
+	BodyUploader(&rails{}, nilHandler, preparer).ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, 1, osStub.PutsCnt())
+
+	cancel()
+	for i := 0; i < 100 && osStub.DeletesCnt() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 1, osStub.DeletesCnt(), "Object not deleted")
+}
+
 func testNoProxyInvocation(t *testing.T, expectedStatus int, auth PreAuthorizer, preparer Preparer) {
 	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		require.Fail(t, "request proxied upstream")
@@ -178,6 +253,15 @@ func (a *alwaysLocalPreparer) Prepare(_ *api.Response) (*filestore.SaveFileOpts,
 	return opts, a.verifier, a.prepareError
 }
 
+type remotePreparer struct {
+	response *api.Response
+}
+
+func (p *remotePreparer) Prepare(_ *api.Response) (*filestore.SaveFileOpts, Verifier, error) {
+	opts, err := filestore.GetOpts(p.response)
+	return opts, nil, err
+}
+
 type alwaysFailsVerifier struct{}
 
 func (alwaysFailsVerifier) Verify(handler *filestore.FileHandler) error {
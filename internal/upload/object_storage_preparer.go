@@ -9,10 +9,11 @@ import (
 type ObjectStoragePreparer struct {
 	config      config.ObjectStorageConfig
 	credentials config.ObjectStorageCredentials
+	multipart   config.MultipartUploadConfig
 }
 
 func NewObjectStoragePreparer(c config.Config) Preparer {
-	return &ObjectStoragePreparer{credentials: c.ObjectStorageCredentials, config: c.ObjectStorageConfig}
+	return &ObjectStoragePreparer{credentials: c.ObjectStorageCredentials, config: c.ObjectStorageConfig, multipart: c.MultipartUploadConfig}
 }
 
 func (p *ObjectStoragePreparer) Prepare(a *api.Response) (*filestore.SaveFileOpts, Verifier, error) {
@@ -23,6 +24,9 @@ func (p *ObjectStoragePreparer) Prepare(a *api.Response) (*filestore.SaveFileOpt
 
 	opts.ObjectStorageConfig.URLMux = p.config.URLMux
 	opts.ObjectStorageConfig.S3Credentials = p.credentials.S3Credentials
+	opts.ObjectStorageConfig.GoogleCredentials = p.credentials.GoogleCredentials
+	opts.PartConcurrency = p.multipart.Concurrency
+	opts.PartMemoryBuffer = p.multipart.Buffer == "memory"
 
 	return opts, nil, nil
 }
@@ -49,6 +49,37 @@ func TestPrepareWithS3Config(t *testing.T) {
 	require.Equal(t, nil, v)
 }
 
+func TestPrepareWithGoogleConfig(t *testing.T) {
+	creds := config.GoogleCredentials{JSONKeyLocation: "/etc/gitlab/gcs.json"}
+
+	c := config.Config{
+		ObjectStorageCredentials: config.ObjectStorageCredentials{
+			Provider:          "Google",
+			GoogleCredentials: creds,
+		},
+	}
+
+	r := &api.Response{
+		RemoteObject: api.RemoteObject{
+			ID:                 "the ID",
+			UseWorkhorseClient: true,
+			ObjectStorage: &api.ObjectStorageParams{
+				Provider:     "Google",
+				GoogleConfig: config.GoogleConfig{Bucket: "uploads"},
+			},
+		},
+	}
+
+	p := upload.NewObjectStoragePreparer(c)
+	opts, _, err := p.Prepare(r)
+
+	require.NoError(t, err)
+	require.True(t, opts.ObjectStorageConfig.IsGoogle())
+	require.True(t, opts.ObjectStorageConfig.IsValid())
+	require.Equal(t, creds, opts.ObjectStorageConfig.GoogleCredentials)
+	require.Equal(t, "uploads", opts.ObjectStorageConfig.GoogleConfig.Bucket)
+}
+
 func TestPrepareWithNoConfig(t *testing.T) {
 	c := config.Config{}
 	r := &api.Response{RemoteObject: api.RemoteObject{ID: "id"}}
@@ -60,3 +91,14 @@ func TestPrepareWithNoConfig(t *testing.T) {
 	require.Nil(t, v)
 	require.Nil(t, opts.ObjectStorageConfig.URLMux)
 }
+
+func TestPrepareWithMultipartUploadConfig(t *testing.T) {
+	c := config.Config{MultipartUploadConfig: config.MultipartUploadConfig{Concurrency: 4, Buffer: "memory"}}
+	r := &api.Response{RemoteObject: api.RemoteObject{ID: "id"}}
+	p := upload.NewObjectStoragePreparer(c)
+	opts, _, err := p.Prepare(r)
+
+	require.NoError(t, err)
+	require.Equal(t, 4, opts.PartConcurrency)
+	require.True(t, opts.PartMemoryBuffer)
+}
@@ -125,25 +125,36 @@ func (rew *rewriter) handleFilePart(ctx context.Context, name string, p *multipa
 
 	opts.TempFilePrefix = filename
 
+	checksums, err := filestore.ChecksumsFromHeader(http.Header(p.Header))
+	if err != nil {
+		return err
+	}
+
 	var inputReader io.ReadCloser
-	var err error
 	switch {
 	case exif.IsExifFile(filename):
 		inputReader, err = handleExifUpload(ctx, p, filename)
 		if err != nil {
 			return err
 		}
+		// The client checksums are of the part, not of what we store
+		checksums = nil
 	case rew.preauth.ProcessLsif:
 		inputReader, err = handleLsifUpload(ctx, p, opts.LocalTempPath, filename, rew.preauth)
 		if err != nil {
 			return err
 		}
+		checksums = nil
 	default:
 		inputReader = ioutil.NopCloser(p)
 	}
 
 	defer inputReader.Close()
 
+	for hashName := range checksums {
+		opts.AddHashes(hashName)
+	}
+
 	fh, err := filestore.SaveFileFromReader(ctx, inputReader, -1, opts)
 	if err != nil {
 		switch err {
@@ -154,6 +165,10 @@ func (rew *rewriter) handleFilePart(ctx context.Context, name string, p *multipa
 		}
 	}
 
+	if err := fh.VerifyChecksums(checksums); err != nil {
+		return err
+	}
+
 	fields, err := fh.GitLabFinalizeFields(name)
 	if err != nil {
 		return fmt.Errorf("failed to finalize fields: %v", err)
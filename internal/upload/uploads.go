@@ -3,6 +3,7 @@ package upload
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
@@ -31,6 +32,12 @@ func HandleFileUploads(w http.ResponseWriter, r *http.Request, h http.Handler, p
 	// Rewrite multipart form data
 	err := rewriteFormFilesFromMultipart(r, writer, preauth, filter, opts)
 	if err != nil {
+		var checksumErr *filestore.ChecksumError
+		if errors.As(err, &checksumErr) {
+			helper.CaptureAndFail(w, r, err, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		switch err {
 		case ErrInjectedClientParam:
 			helper.CaptureAndFail(w, r, err, "Bad Request", http.StatusBadRequest)
@@ -8,6 +8,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
 	"regexp"
 	"strconv"
@@ -317,6 +318,51 @@ func TestUploadProcessingFile(t *testing.T) {
 
 }
 
+func TestUploadProcessingFileChecksums(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	tests := []struct {
+		name     string
+		checksum string
+		code     int
+	}{
+		{name: "matching checksum", checksum: "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", code: 200},
+		{name: "mismatching checksum", checksum: strings.Repeat("0", 40), code: 400},
+		{name: "malformed checksum", checksum: "test", code: 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			writer := multipart.NewWriter(&buffer)
+			file, err := writer.CreatePart(textproto.MIMEHeader{
+				"Content-Disposition": {`form-data; name="file"; filename="my.file"`},
+				"Content-Type":        {"application/octet-stream"},
+				"X-Checksum-Sha1":     {test.checksum},
+			})
+			require.NoError(t, err)
+			fmt.Fprint(file, "test")
+			writer.Close()
+
+			httpRequest, err := http.NewRequest("PUT", "/url/path", &buffer)
+			require.NoError(t, err)
+			httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+			response := httptest.NewRecorder()
+			apiResponse := &api.Response{TempPath: tempPath}
+			preparer := &DefaultPreparer{}
+			opts, _, err := preparer.Prepare(apiResponse)
+			require.NoError(t, err)
+
+			HandleFileUploads(response, httpRequest, nilHandler, apiResponse, &testFormProcessor{}, opts)
+
+			require.Equal(t, test.code, response.Code)
+		})
+	}
+}
+
 func TestInvalidFileNames(t *testing.T) {
 	testhelper.ConfigureSecret()
 
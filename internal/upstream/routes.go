@@ -13,6 +13,7 @@ import (
 
 	apipkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/artifacts"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/bandwidth"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/builds"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/channel"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
@@ -28,6 +29,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendurl"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/staticpages"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/tus"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
 )
 
@@ -141,6 +143,11 @@ func isContentType(contentType string) func(*http.Request) bool {
 	}
 }
 
+// Requests for info/refs without a service use the 'dumb' HTTP protocol.
+func isDumbHTTPInfoRefs(r *http.Request) bool {
+	return r.URL.Query().Get("service") == ""
+}
+
 func (ro *routeEntry) isMatch(cleanedPath string, req *http.Request) bool {
 	if ro.method != "" && req.Method != ro.method {
 		return false
@@ -161,16 +168,17 @@ func (ro *routeEntry) isMatch(cleanedPath string, req *http.Request) bool {
 	return ok
 }
 
-func buildProxy(backend *url.URL, version string, rt http.RoundTripper, cfg config.Config) http.Handler {
+func buildProxy(backend *url.URL, version string, rt http.RoundTripper, cfg config.Config, archiveCache, bundleCache *git.FileCache, shaper *bandwidth.Shaper) http.Handler {
 	proxier := proxypkg.NewProxy(backend, version, rt)
 
 	return senddata.SendData(
-		sendfile.SendFile(apipkg.Block(proxier)),
-		git.SendArchive,
+		sendfile.SendFile(apipkg.Block(proxier), shaper),
+		git.NewSendArchive(archiveCache, shaper),
 		git.SendBlob,
 		git.SendDiff,
 		git.SendPatch,
-		git.SendSnapshot,
+		git.NewSendSnapshot(shaper),
+		git.NewSendBundle(bundleCache),
 		artifacts.SendEntry,
 		sendurl.SendURL,
 		imageresizer.NewResizer(cfg),
@@ -188,14 +196,42 @@ func (u *upstream) configureRoutes() {
 		u.RoundTripper,
 	)
 
+	archiveCache, err := git.NewArchiveCache(u.Config.ArchiveCacheConfig)
+	if err != nil {
+		log.WithError(err).Error("archive cache manager disabled")
+	}
+	bundleCache, err := git.NewBundleCache(u.Config.BundleCacheConfig)
+	if err != nil {
+		log.WithError(err).Error("bundle cache manager disabled")
+	}
+	dumbHTTPCache, err := git.NewDumbHTTPCache(u.Config.DumbHTTPCacheConfig)
+	if err != nil {
+		log.WithError(err).Error("dumb HTTP cache manager disabled")
+	}
+
+	shaper := bandwidth.NewShaper(u.Config.BandwidthConfig)
+
 	static := &staticpages.Static{DocumentRoot: u.DocumentRoot}
-	proxy := buildProxy(u.Backend, u.Version, u.RoundTripper, u.Config)
+	proxy := buildProxy(u.Backend, u.Version, u.RoundTripper, u.Config, archiveCache, bundleCache, shaper)
 	cableProxy := proxypkg.NewProxy(u.CableBackend, u.Version, u.CableRoundTripper)
 
 	signingTripper := secret.NewRoundTripper(u.RoundTripper, u.Version)
-	signingProxy := buildProxy(u.Backend, u.Version, signingTripper, u.Config)
+	signingProxy := buildProxy(u.Backend, u.Version, signingTripper, u.Config, archiveCache, bundleCache, shaper)
 
 	preparers := createUploadPreparers(u.Config)
+
+	packCache, err := git.NewPackCache(u.Config.PackCacheConfig)
+	if err != nil {
+		log.WithError(err).Error("pack cache disabled")
+	}
+	uploadPackPolicy := git.NewUploadPackPolicy(u.Config.UploadPackRules)
+	pushInspector := git.NewPushInspector(u.Config.PushSecretPatterns)
+	cloneLimiter := git.NewCloneLimiter(u.Config.CloneLimitsConfig)
+	preAuthorizeCache := apipkg.NewPreAuthorizeCache(u.Config.PreAuthorizeCacheConfig)
+	tusHandler, err := tus.NewHandler(u.Config.TusConfig, u.Config.ObjectStorageCredentials, string(u.URLPrefix)+"api/v4/tus/uploads/", api, signingProxy, preparers.packages)
+	if err != nil {
+		log.WithError(err).Error("tus uploads disabled")
+	}
 	uploadPath := path.Join(u.DocumentRoot, "uploads/tmp")
 	uploadAccelerateProxy := upload.Accelerate(&upload.SkipRailsAuthorizer{TempPath: uploadPath}, proxy, preparers.uploads)
 	ciAPIProxyQueue := queueing.QueueRequests("ci_api_job_requests", uploadAccelerateProxy, u.APILimit, u.APIQueueLimit, u.APIQueueTimeout)
@@ -212,9 +248,11 @@ func (u *upstream) configureRoutes() {
 
 	u.Routes = []routeEntry{
 		// Git Clone
-		u.route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api)),
-		u.route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api)), withMatcher(isContentType("application/x-git-upload-pack-request"))),
-		u.route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api)), withMatcher(isContentType("application/x-git-receive-pack-request"))),
+		u.route("GET", gitProjectPattern+`info/refs\z`, git.DumbHTTPHandler(api, preAuthorizeCache, dumbHTTPCache), withMatcher(isDumbHTTPInfoRefs)),
+		u.route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api, preAuthorizeCache, cloneLimiter, shaper)),
+		u.route("GET", gitProjectPattern+`(HEAD|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(pack|idx))\z`, git.DumbHTTPHandler(api, preAuthorizeCache, dumbHTTPCache)),
+		u.route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api, preAuthorizeCache, packCache, uploadPackPolicy, cloneLimiter, shaper)), withMatcher(isContentType("application/x-git-upload-pack-request"))),
+		u.route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api, preAuthorizeCache, pushInspector)), withMatcher(isContentType("application/x-git-receive-pack-request"))),
 		u.route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, lfs.PutStore(api, signingProxy, preparers.lfs), withMatcher(isContentType("application/octet-stream"))),
 
 		// CI Artifacts
@@ -304,6 +342,25 @@ func (u *upstream) configureRoutes() {
 
 		u.route("", "", defaultUpstream),
 	}
+
+	if tusHandler != nil {
+		u.Routes = append(u.tusRoutes(tusHandler), u.Routes...)
+	}
+}
+
+// tusRoutes serve tus resumable uploads of the package files that we
+// otherwise upload with upload.BodyUploader
+func (u *upstream) tusRoutes(h *tus.Handler) []routeEntry {
+	create := withMatcher(tus.IsCreation)
+
+	return []routeEntry{
+		u.route("", apiPattern+`v4/tus/uploads/[0-9a-f]{32}\z`, h.Upload()),
+		u.route("", apiPattern+`v4/projects/[0-9]+/packages/maven/`, h.Create(), create),
+		u.route("", apiPattern+`v4/packages/conan/`, h.Create(), create),
+		u.route("", apiPattern+`v4/projects/[0-9]+/packages/conan/`, h.Create(), create),
+		u.route("", apiPattern+`v4/projects/[0-9]+/packages/generic/`, h.Create(), create),
+		u.route("", apiPattern+`v4/projects/[0-9]+/-/packages/debian/incoming/`, h.Create(), create),
+	}
 }
 
 func createUploadPreparers(cfg config.Config) uploadPreparers {
@@ -16,6 +16,7 @@ import (
 	"gitlab.com/gitlab-org/labkit/tracing"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
@@ -143,6 +144,18 @@ func buildConfig(arg0 string, args []string) (*bootConfig, *config.Config, error
 	cfg.Redis = cfgFromFile.Redis
 	cfg.ObjectStorageCredentials = cfgFromFile.ObjectStorageCredentials
 	cfg.ImageResizerConfig = cfgFromFile.ImageResizerConfig
+	cfg.PackCacheConfig = cfgFromFile.PackCacheConfig
+	cfg.UploadPackRules = cfgFromFile.UploadPackRules
+	cfg.ArchiveCacheConfig = cfgFromFile.ArchiveCacheConfig
+	cfg.BundleCacheConfig = cfgFromFile.BundleCacheConfig
+	cfg.DumbHTTPCacheConfig = cfgFromFile.DumbHTTPCacheConfig
+	cfg.PushSecretPatterns = cfgFromFile.PushSecretPatterns
+	cfg.GitalyConfig = cfgFromFile.GitalyConfig
+	cfg.CloneLimitsConfig = cfgFromFile.CloneLimitsConfig
+	cfg.BandwidthConfig = cfgFromFile.BandwidthConfig
+	cfg.PreAuthorizeCacheConfig = cfgFromFile.PreAuthorizeCacheConfig
+	cfg.TusConfig = cfgFromFile.TusConfig
+	cfg.MultipartUploadConfig = cfgFromFile.MultipartUploadConfig
 
 	return boot, cfg, nil
 }
@@ -212,6 +225,12 @@ func run(boot bootConfig, cfg config.Config) error {
 		go redis.Process()
 	}
 
+	if err := gitaly.Configure(cfg.GitalyConfig); err != nil {
+		return fmt.Errorf("configure gitaly: %v", err)
+	}
+	stopMonitoring := gitaly.MonitorConnections()
+	defer stopMonitoring()
+
 	if err := cfg.RegisterGoCloudURLOpeners(); err != nil {
 		return fmt.Errorf("register cloud credentials: %v", err)
 	}